@@ -4,9 +4,11 @@ import "test"
 import "fmt"
 import "os"
 import "os/exec"
+import "path/filepath"
 import "strings"
 //import "strconv"
 import "paxos"
+import "rsm"
 import "shardmaster"
 import "shardkv"
 import "flag"
@@ -19,9 +21,34 @@ func main() {
 	var nmasters = flag.Int("nmasters", 3, "number of shardmasters per shard group")
 	var nreplicas = flag.Int("nreplicas", 3, "number of kvshard replicas per group")
 	var clean =  flag.Bool("clean", false, "clean the db")
+	var datadir = flag.String("datadir", rsm.DefaultOptions().DataDir, "directory for the databases of this node")
+	var batchsize = flag.Int("batchsize", rsm.DefaultOptions().BatchSize, "most client ops a shardkv group agrees on in one instance")
+	var batchdelay = flag.Duration("batchdelay", rsm.DefaultOptions().BatchDelay, "how long shardkv waits for more client ops before proposing a batch")
+	var pipeline = flag.Int("pipeline", rsm.DefaultOptions().Pipeline, "most client ops a server agrees on at once")
+	var durability = flag.String("durability", rsm.DefaultOptions().Durability.String(), "how far writes get before replies: none, buffered or fsync")
+	var q1 = flag.Int("q1", 0, "peers a paxos prepare or leader election needs (0 = majority, or whatever meets every q2)")
+	var q2 = flag.Int("q2", 0, "peers a paxos accept or lease renewal needs (0 = majority, or whatever meets every q1)")
+	var excludeafter = flag.Duration("excludeafter", 0, "how long a silent peer may keep paxos from forgetting old instances (0 = forever)")
 	
 	flag.Parse()
 	args := flag.Args()
+	opts := rsm.DefaultOptions()
+	opts.BatchSize = *batchsize
+	opts.BatchDelay = *batchdelay
+	opts.Pipeline = *pipeline
+	opts.Q1 = *q1
+	opts.Q2 = *q2
+	opts.ExcludeAfter = *excludeafter
+	var err error
+	// Resolved now, so a relative -datadir stays where the node started
+	if opts.DataDir, err = filepath.Abs(*datadir); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
+	if opts.Durability, err = paxos.ParseDurability(*durability); err != nil {
+		fmt.Println(err)
+		os.Exit(1)
+	}
 	if len(args) < 1 {
 		fmt.Printf("Not enough arguments, must specify program type:\n"+
  			"   paxos|shardmaster|shardkv\n")
@@ -32,7 +59,7 @@ func main() {
 	case "paxos":
 		fmt.Println("Attempting to start paxos server...")
 		if *clean {
-			cleanDB("paxos")
+			cleanDB("paxos", opts.Options)
 		}
 		peers := test.GetPaxos(*npaxos) 
 		me := whoami(peers)
@@ -40,7 +67,7 @@ func main() {
 			fmt.Println("Host didn't find own IP in peer list! Exiting!")
 			os.Exit(1)
 		}
-		paxos.Make(peers, me, nil, network, "somedbtag") 
+		paxos.Make(peers, me, nil, network, "somedbtag", opts.Options) 
 		fmt.Println("peers: ",peers)
 		fmt.Println("me: ", me)
 		fmt.Printf("Started paxos server.\n")
@@ -48,7 +75,7 @@ func main() {
 	case "shardmaster":
 		fmt.Println("Attempting to start shardmaster server...")
 		if *clean {
-			cleanDB("shardmaster")
+			cleanDB("shardmaster", opts.Options)
 		}
 		peers, _ := test.GetShardmasters(*nmasters, *ngroups)
 		me := whoami(peers)
@@ -56,7 +83,7 @@ func main() {
 			fmt.Println("Host didn't find own IP in peer list! Exiting!")
 			os.Exit(1)
 		}
-		shardmaster.StartServer(peers, me, network)
+		shardmaster.StartServer(peers, me, network, opts)
 		fmt.Println("peers: ",peers)
 		fmt.Println("me: ", me)
 		fmt.Printf("Started shardmaster.\n")
@@ -80,9 +107,9 @@ func main() {
 		if me != -1 {
 			fmt.Println("Starting shardmaster instead.")
 			if *clean {
-				cleanDB("shardmaster")
+				cleanDB("shardmaster", opts.Options)
 			}
-			shardmaster.StartServer(masters, me, network)
+			shardmaster.StartServer(masters, me, network, opts)
 			fmt.Printf("peers: %v\n", masters)
 			fmt.Printf("me: %d\n", me)
 			fmt.Println("Success!")
@@ -105,12 +132,12 @@ func main() {
 			os.Exit(1)
 		}
 		if *clean {
-			cleanDB("shardkv")
+			cleanDB("shardkv", opts.Options)
 		}
 		fmt.Println("masters:",masters)
 		fmt.Printf("peers: %v\n", peers)
 		fmt.Printf("me: %d, gid :%d\n", me, gid)
-		shardkv.StartServer(gid, masters, peers, me, network)
+		shardkv.StartServer(gid, masters, peers, me, network, opts)
 		
 	default: 
 		fmt.Printf("Invalid program type, choose one:" +
@@ -148,20 +175,21 @@ func getIP() string {
 }
 
 
-func cleanDB(server string)  {
-	//ifconfig eth0 | grep 'inet addr:' | cut -d: -f2 | awk '{ print $1}'
-	fmt.Printf("cleaning db....\n")
-	cmd := ""
+func cleanDB(server string, opts paxos.Options)  {
+	fmt.Printf("cleaning db in %s....\n", opts.DataDir)
+	var err error
 	switch server {
-	case "paxos": cmd = "/home/ubuntu/mexos/src/paxos/cleanPersist"
-	case "shardmaster": cmd = "/home/ubuntu/mexos/src/shardmaster/cleanPersist"
-	case "shardkv": cmd = "/home/ubuntu/mexos/src/shardkv/cleanPersist"
+	case "paxos": err = paxos.Destroy(opts)
+	case "shardmaster": err = shardmaster.Destroy(opts)
+	case "shardkv": err = shardkv.Destroy(opts)
 	default:
 		fmt.Println("invalid switch in cleanDB()")
 		os.Exit(1)
 	}
-	_, err := exec.Command(cmd).Output()
-	//out, err := exec.Command("./getip").Output()
+	// Servers run a Paxos peer underneath, so clear its log as well
+	if err == nil && server != "paxos" {
+		err = paxos.Destroy(opts)
+	}
 	if err != nil {
 		fmt.Printf("Could not clean db: %s\n", err)
 		os.Exit(1)
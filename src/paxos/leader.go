@@ -0,0 +1,455 @@
+package paxos
+
+//
+// Multi-Paxos mode (Options.EnableLeader = MultiPaxos).
+//
+// A peer becomes leader by running phase 1 once for every instance
+// from its Min() on (PrepareLeader); after that it runs only phase 2
+// for the instances it proposes, with one value per instance. It keeps
+// a lease by sending heartbeats: a peer that answers an election or a
+// heartbeat won't help another peer become leader, or prepare for one,
+// until the lease it granted runs out, and a peer restarted from disk
+// helps nobody for a lease. So while IsLeader() is true no
+// other peer can get a value chosen. Other peers forward proposals to
+// the leader, and campaign once they stop hearing from it.
+//
+// px.IsLeader() bool -- this peer is leader and its lease hasn't run out
+// px.Leader() string -- address of the leader as far as this peer knows, or ""
+// px.ReadIndex() (int, bool) -- while leader, the highest instance that may be chosen
+//
+
+import "math/rand"
+import "time"
+
+// Value of Options.EnableLeader for Multi-Paxos
+const MultiPaxos = 3
+
+type LeaderArgs struct {
+	Server int // Index of the candidate in the peers of Config
+	Addr   string
+	PID    Ballot
+	From   int // First instance the candidate will lead
+	Config int
+	Done   map[string]int
+}
+
+type LeaderReply struct {
+	Err      bool
+	Promised Ballot           // Ballot promised instead, when refusing
+	Accepted map[int]Proposal // Instances >= From accepted here
+	Done     map[string]int
+}
+
+type HeartbeatArgs struct {
+	Addr string
+	PID  Ballot
+	Done map[string]int
+}
+
+type HeartbeatReply struct {
+	Err      bool
+	Promised Ballot
+	Done     map[string]int
+}
+
+// Reply from one peer to an election or a heartbeat (nil if it didn't answer)
+type leaderResult struct {
+	peer  string
+	reply *LeaderReply
+}
+
+type heartbeatResult struct {
+	peer  string
+	reply *HeartbeatReply
+}
+
+func (px *Paxos) multi() bool {
+	return px.enableLeader == MultiPaxos
+}
+
+// Whether the leader is tracked per instance, as in modes 1 and 2
+func (px *Paxos) stickyLeader() bool {
+	return px.enableLeader == 1 || px.enableLeader == 2
+}
+
+// Holder of a lease granted before a restart, whose real holder we forgot
+const unknownHolder = "?"
+
+// Whether a lease we granted to a peer other than addr is still running; px.mu must be held
+func (px *Paxos) leasedToOther(addr string) bool {
+	return px.leaseHolder != "" && px.leaseHolder != addr && time.Now().Before(px.followUntil)
+}
+
+// Promise pid for every instance, and help nobody but addr lead for a lease; px.mu must be held
+func (px *Paxos) grantLease(addr string, pid Ballot) {
+	if px.promised.Less(pid) {
+		px.promised = pid
+		px.dbWritePromised()
+	}
+	px.leaseHolder = addr
+	px.followUntil = time.Now().Add(px.leaseDuration)
+}
+
+// Address of peer server in the peers running seq, or ""; px.mu must be held
+func (px *Paxos) peerAddr(seq int, server int) string {
+	_, peers := px.configAt(seq)
+	if server < 0 || server >= len(peers) {
+		return ""
+	}
+	return peers[server]
+}
+
+//
+// whether this peer is the Multi-Paxos leader and holds a lease.
+// while it does, no other peer can get a value chosen.
+//
+func (px *Paxos) IsLeader() bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return px.multi() && px.leading && time.Now().Before(px.leaseUntil)
+}
+
+//
+// the address of the Multi-Paxos leader as far as this peer knows,
+// or "" if it hasn't heard from one within a lease.
+//
+func (px *Paxos) Leader() string {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	now := time.Now()
+	if px.leading && now.Before(px.leaseUntil) {
+		return px.addr
+	}
+	if now.Before(px.followUntil) && px.leaseHolder != unknownHolder {
+		return px.leaseHolder
+	}
+	return ""
+}
+
+//
+// while this peer holds the leader lease, no instance past the one
+// returned can be chosen without this peer proposing it, so an
+// application that has applied every instance up to it can answer
+// reads from its own state. returns false without a lease.
+//
+func (px *Paxos) ReadIndex() (int, bool) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if !px.multi() || !px.leading || !time.Now().Before(px.leaseUntil) {
+		return -1, false
+	}
+	// Instances of a newer config are run with both phases, so they aren't tracked here
+	if from, _ := px.configAt(px.maxInstance + 1); from != px.leaderConfig {
+		return -1, false
+	}
+	if px.maxAssigned > px.maxInstance {
+		return px.maxAssigned, true
+	}
+	return px.maxInstance, true
+}
+
+// Respond to a candidate's request to lead every instance from args.From on
+func (px *Paxos) PrepareLeader(args *LeaderArgs, reply *LeaderReply) error {
+	px.recordDones(args.Done)
+	px.mu.Lock()
+	reply.Err = true
+	if px.voteless || px.damagedFrom(args.From) {
+		// The accepted values we would report may be missing some
+		DPrintf("\n%v: Refusing to elect %v with damaged records", px.me, args.Server)
+	} else if px.learnsOnly(args.From) {
+		DPrintf("\n%v: Learner refusing to elect %v", px.me, args.Server)
+	} else if args.PID.Less(px.promised) || px.leasedToOther(args.Addr) {
+		reply.Promised = px.promised
+	} else {
+		px.grantLease(args.Addr, args.PID)
+		reply.Err = false
+		reply.Accepted = make(map[int]Proposal)
+		for seq := args.From; seq <= px.maxInstance; seq++ {
+			if prop := px.getInstance(seq); prop.Accepted {
+				reply.Accepted[seq] = prop
+			}
+		}
+	}
+	px.mu.Unlock()
+
+	reply.Done = px.copyDone()
+	return px.ack("PrepareLeader")
+}
+
+// Respond to a leader renewing its lease
+func (px *Paxos) Heartbeat(args *HeartbeatArgs, reply *HeartbeatReply) error {
+	px.recordDones(args.Done)
+	px.mu.Lock()
+	reply.Err = true
+	if px.voteless {
+		DPrintf("\n%v: Refusing to renew a lease with a damaged promise", px.me)
+	} else if px.learnsOnly(px.maxInstance + 1) {
+		DPrintf("\n%v: Learner refusing to renew a lease", px.me)
+	} else if args.PID.Less(px.promised) || px.leasedToOther(args.Addr) {
+		reply.Promised = px.promised
+	} else {
+		px.grantLease(args.Addr, args.PID)
+		reply.Err = false
+	}
+	px.mu.Unlock()
+
+	reply.Done = px.copyDone()
+	return px.ack("Heartbeat")
+}
+
+// Try to become leader of the current peers, for every instance from Min() on
+// Returns whether this peer won
+func (px *Paxos) campaign() bool {
+	first := px.Min()
+	px.mu.Lock()
+	from, peers := px.configAt(px.maxInstance + 1)
+	me := indexOf(peers, px.addr)
+	round := px.promised.Round
+	if px.seenRound > round {
+		round = px.seenRound
+	}
+	pid := Ballot{round + 1, me}
+	px.mu.Unlock()
+	if me < 0 {
+		return false
+	}
+
+	start := time.Now()
+	done := px.copyDone()
+	args := &LeaderArgs{me, px.addr, pid, first, from, done}
+	replies := make(chan leaderResult, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			var reply LeaderReply
+			if px.callAcceptor(peer, "Paxos.PrepareLeader", args, &reply) {
+				px.recordDones(reply.Done)
+				replies <- leaderResult{peer, &reply}
+			} else {
+				replies <- leaderResult{peer, nil}
+			}
+		}(peer)
+	}
+
+	// Keep the value accepted with the highest ballot for each instance, and any decided one
+	best := make(map[int]Proposal)
+	granted := make(map[string]bool)
+	refused := make(map[string]bool)
+	for !px.quorums.has(phase1, peers, granted) && px.quorums.possible(phase1, peers, refused) {
+		result := <-replies
+		reply := result.reply
+		if reply == nil || reply.Err {
+			refused[result.peer] = true
+			if reply != nil {
+				px.mu.Lock()
+				if reply.Promised.Round > px.seenRound {
+					px.seenRound = reply.Promised.Round
+				}
+				px.mu.Unlock()
+			}
+			continue
+		}
+		granted[result.peer] = true
+		for seq, prop := range reply.Accepted {
+			if old, ok := best[seq]; !ok || (!old.Decided && (prop.Decided || old.Accept.Less(prop.Accept))) {
+				best[seq] = prop
+			}
+		}
+	}
+	if !px.quorums.has(phase1, peers, granted) {
+		DPrintf("\n%v: Lost election at %v", px.me, pid)
+		return false
+	}
+
+	px.mu.Lock()
+	if pid.Less(px.promised) {
+		// Our own acceptor has moved on to another candidate
+		px.mu.Unlock()
+		return false
+	}
+	px.leading = true
+	px.leaderPID = pid
+	px.leaderConfig = from
+	px.leaderFrom = first
+	// Only peers that meet every phase 1 quorum can hold off other candidates
+	px.leaseUntil = time.Time{}
+	if px.quorums.has(phase2, peers, granted) {
+		px.leaseUntil = start.Add(px.leaseDuration - px.leaseDuration/10)
+	}
+	px.assigned = make(map[int]interface{})
+	px.maxAssigned = -1
+	var unfinished []int
+	for seq, prop := range best {
+		if prop.Decided {
+			px.putInstance(seq, Proposal{prop.Prepare, prop.Accept, prop.Value, true, true})
+		} else {
+			// This value may have been chosen, so it is the only one we may propose here
+			px.assign(seq, prop.Value)
+			unfinished = append(unfinished, seq)
+		}
+	}
+	px.mu.Unlock()
+	DPrintf("\n%v: Won election at %v", px.me, pid)
+
+	for _, seq := range unfinished {
+		go px.propose(seq, nil, done)
+	}
+	return true
+}
+
+// Record the value we propose for seq as leader; px.mu must be held
+func (px *Paxos) assign(seq int, v interface{}) {
+	px.assigned[seq] = v
+	if seq > px.maxAssigned {
+		px.maxAssigned = seq
+	}
+}
+
+// Stop leading, if we still lead at pid
+func (px *Paxos) stepDown(pid Ballot) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.leading && px.leaderPID == pid {
+		DPrintf("\n%v: Stepping down from %v", px.me, pid)
+		px.leading = false
+	}
+}
+
+// Run phase 2 for seq as leader
+// Returns whether seq got decided, and false for handled if we lead but not for seq,
+// in which case the caller runs both phases itself
+func (px *Paxos) proposeMulti(seq int, v interface{}, newDone map[string]int) (decided bool, handled bool) {
+	px.mu.Lock()
+	if !px.leading {
+		px.mu.Unlock()
+		return false, true
+	}
+	from, peers := px.configAt(seq)
+	if from != px.leaderConfig || seq < px.leaderFrom {
+		px.mu.Unlock()
+		return false, false
+	}
+	if prop := px.getInstance(seq); prop.Decided {
+		px.mu.Unlock()
+		return true, true
+	}
+	// Never two values for one instance at one ballot
+	if assigned, ok := px.assigned[seq]; ok {
+		v = assigned
+	} else {
+		px.assign(seq, v)
+	}
+	pid := px.leaderPID
+	me := indexOf(peers, px.addr)
+	px.mu.Unlock()
+
+	args := &AcceptArgs{me, seq, pid, v, false, newDone, me, from}
+	out := px.broadcastAccept(args, peers)
+	if out.accepted {
+		px.broadcastDecide(&DecideArgs{me, seq, pid, v, newDone, me}, peers)
+		return true, true
+	}
+	if pid.Less(out.promised) {
+		px.stepDown(pid)
+	}
+	return false, true
+}
+
+// Get seq decided through the leader, campaigning while there is none
+func (px *Paxos) forward(seq int, args *ProposeArgs) {
+	for !px.isdead() {
+		if decided, _ := px.Status(seq); decided {
+			return
+		}
+		var reply ProposeReply
+		leader := px.Leader()
+		if leader == px.addr {
+			px.Propose(args, &reply)
+		} else if leader != "" {
+			if !px.callWrap(leader, "Paxos.Propose", args, &reply) {
+				reply.Err = true
+			}
+		} else if !px.campaign() {
+			reply.Err = true
+		} else {
+			continue
+		}
+		if !reply.Err {
+			if reply.Forgotten && leader != px.addr {
+				px.giveUp(seq)
+			}
+			return
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(px.leaseDuration/4) + 1)))
+	}
+}
+
+// Renew the lease while leading, and campaign when nobody has led for a lease
+func (px *Paxos) leaderLoop() {
+	for !px.isdead() {
+		time.Sleep(px.leaseDuration / 4)
+		if px.isrecovering() {
+			continue
+		}
+		px.mu.Lock()
+		leading := px.leading
+		pid := px.leaderPID
+		idle := time.Now().After(px.followUntil)
+		px.mu.Unlock()
+		if leading {
+			px.sendHeartbeats(pid)
+		} else if idle {
+			// Stagger candidates, so one usually wins before the others try
+			time.Sleep(time.Duration(rand.Int63n(int64(px.leaseDuration/2) + 1)))
+			px.mu.Lock()
+			idle = time.Now().After(px.followUntil)
+			px.mu.Unlock()
+			if idle {
+				px.campaign()
+			}
+		}
+	}
+}
+
+// Ask the peers to renew our lease, extending it if a phase 2 quorum does
+func (px *Paxos) sendHeartbeats(pid Ballot) {
+	px.mu.Lock()
+	_, peers := px.configAt(px.maxInstance + 1)
+	px.mu.Unlock()
+	start := time.Now()
+	done := px.copyDone()
+	args := &HeartbeatArgs{px.addr, pid, done}
+	replies := make(chan heartbeatResult, len(peers))
+	for _, peer := range peers {
+		go func(peer string) {
+			var reply HeartbeatReply
+			if px.callAcceptor(peer, "Paxos.Heartbeat", args, &reply) {
+				px.recordDones(reply.Done)
+				replies <- heartbeatResult{peer, &reply}
+			} else {
+				replies <- heartbeatResult{peer, nil}
+			}
+		}(peer)
+	}
+	granted := make(map[string]bool)
+	refused := make(map[string]bool)
+	for !px.quorums.has(phase2, peers, granted) && px.quorums.possible(phase2, peers, refused) {
+		result := <-replies
+		reply := result.reply
+		if reply != nil && !reply.Err {
+			granted[result.peer] = true
+			continue
+		}
+		refused[result.peer] = true
+		if reply != nil && pid.Less(reply.Promised) {
+			px.stepDown(pid)
+			return
+		}
+	}
+	if px.quorums.has(phase2, peers, granted) {
+		px.mu.Lock()
+		if px.leading && px.leaderPID == pid {
+			px.leaseUntil = start.Add(px.leaseDuration - px.leaseDuration/10)
+		}
+		px.mu.Unlock()
+	}
+}
@@ -7,14 +7,16 @@ import "strconv"
 //import "os"
 import "time"
 import "math/rand"
+import "sync/atomic"
 
 func netport(i int) string {
 	s := "127.0.0.1:"
-	s += strconv.Itoa(startport+i)
+	s += strconv.Itoa(DefaultOptions().StartPort+i)
 	return s
 }
 
 func TestNetworkBasic(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   const npaxos = 3
@@ -26,7 +28,7 @@ func TestNetworkBasic(t *testing.T) {
     pxh[i] = netport(i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil, true, "networkBasic" + string(i))
+    pxa[i] = Make(pxh, i, nil, true, "networkBasic" + string(i), opts)
   }
 
   fmt.Printf("Test: Single proposer ...\n")
@@ -75,6 +77,7 @@ func TestNetworkBasic(t *testing.T) {
 }
 
 func TestNetworkDeaf(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   const npaxos = 5
@@ -86,7 +89,7 @@ func TestNetworkDeaf(t *testing.T) {
     pxh[i] = netport(i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil, true, "networkDeaf" + string(i))
+    pxa[i] = Make(pxh, i, nil, true, "networkDeaf" + string(i), opts)
   }
 
   fmt.Printf("Test: Deaf proposer ...\n")
@@ -97,8 +100,8 @@ func TestNetworkDeaf(t *testing.T) {
 
   //os.Remove(pxh[0])
   //os.Remove(pxh[
-	pxa[0].deaf = true
-	pxa[npaxos-1].deaf = true
+	pxa[0].setdeaf(true)
+	pxa[npaxos-1].setdeaf(true)
 
   pxa[1].Start(1, "goodbye")
   waitForDecisionMajority(t, pxa, 1)
@@ -121,6 +124,7 @@ func TestNetworkDeaf(t *testing.T) {
 }
 
 func TestNetworkForget(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   const npaxos = 6
@@ -132,7 +136,7 @@ func TestNetworkForget(t *testing.T) {
     pxh[i] = netport(i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil, true, "networkForget" + string(i))
+    pxa[i] = Make(pxh, i, nil, true, "networkForget" + string(i), opts)
   }
 
   fmt.Printf("Test: Forgetting ...\n")
@@ -203,6 +207,7 @@ func TestNetworkForget(t *testing.T) {
 }
 
 func TestNetworkManyForget(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   const npaxos = 3
@@ -214,14 +219,14 @@ func TestNetworkManyForget(t *testing.T) {
     pxh[i] = netport(i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil, true, "networkManyForget" + string(i))
-    pxa[i].unreliable = true
+    pxa[i] = Make(pxh, i, nil, true, "networkManyForget" + string(i), opts)
+    pxa[i].setunreliable(true)
   }
 
   fmt.Printf("Test: Lots of forgetting ...\n")
 
   const maxseq = 20
-  done := false
+  var done int32
 
   go func() {
     na := rand.Perm(maxseq)
@@ -235,7 +240,7 @@ func TestNetworkManyForget(t *testing.T) {
   }()
 
   go func() {
-    for done == false {
+    for atomic.LoadInt32(&done) == 0 {
       seq := (rand.Int() % maxseq)
       i := (rand.Int() % npaxos)
       if seq >= pxa[i].Min() {
@@ -249,9 +254,9 @@ func TestNetworkManyForget(t *testing.T) {
   }()
 
   time.Sleep(5 * time.Second)
-  done = true
+  atomic.StoreInt32(&done, 1)
   for i := 0; i < npaxos; i++ {
-    pxa[i].unreliable = false
+    pxa[i].setunreliable(false)
   }
   time.Sleep(2 * time.Second)
 
@@ -270,6 +275,7 @@ func TestNetworkManyForget(t *testing.T) {
 // does paxos forgetting actually free the memory?
 //
 func TestNetworkForgetMem(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   fmt.Printf("Test: Paxos frees forgotten instance memory ...\n")
@@ -283,7 +289,7 @@ func TestNetworkForgetMem(t *testing.T) {
     pxh[i] = netport(i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil, true, "networkNetworkForgetMem" + string(i))
+    pxa[i] = Make(pxh, i, nil, true, "networkNetworkForgetMem" + string(i), opts)
   }
 
   pxa[0].Start(0, "x")
@@ -334,6 +340,7 @@ func TestNetworkForgetMem(t *testing.T) {
 }
 
 func TestNetworkRPCCount(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   fmt.Printf("Test: RPC counts aren't too high ...\n")
@@ -347,7 +354,7 @@ func TestNetworkRPCCount(t *testing.T) {
     pxh[i] = netport(i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil, true, "networkRPCCount" + string(i))
+    pxa[i] = Make(pxh, i, nil, true, "networkRPCCount" + string(i), opts)
   }
 
   ninst1 := 5
@@ -362,7 +369,7 @@ func TestNetworkRPCCount(t *testing.T) {
 
   total1 := 0
   for j := 0; j < npaxos; j++ {
-    total1 += pxa[j].rpcCount
+    total1 += pxa[j].getRPCCount()
   }
 
   // per agreement:
@@ -388,7 +395,7 @@ func TestNetworkRPCCount(t *testing.T) {
 
   total2 := 0
   for j := 0; j < npaxos; j++ {
-    total2 += pxa[j].rpcCount
+    total2 += pxa[j].getRPCCount()
   }
   total2 -= total1
 
@@ -409,6 +416,7 @@ func TestNetworkRPCCount(t *testing.T) {
 // many agreements (without failures)
 //
 func TestNetworkMany(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   fmt.Printf("Test: Many instances ...\n")
@@ -422,7 +430,7 @@ func TestNetworkMany(t *testing.T) {
     pxh[i] = netport(i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil, true, "networkMany" + string(i))
+    pxa[i] = Make(pxh, i, nil, true, "networkMany" + string(i), opts)
     pxa[i].Start(0, 0)
   }
 
@@ -459,6 +467,7 @@ func TestNetworkMany(t *testing.T) {
 // then another peer starts, without a proposal.
 // 
 func TestNetworkOld(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   fmt.Printf("Test: Minority proposal ignored ...\n")
@@ -472,20 +481,20 @@ func TestNetworkOld(t *testing.T) {
     pxh[i] = netport(i)
   }
 
-  pxa[1] = Make(pxh, 1, nil, true, "networkOld1")
-  pxa[2] = Make(pxh, 2, nil, true, "networkOld2")
-  pxa[3] = Make(pxh, 3, nil, true, "networkOld3")
+  pxa[1] = Make(pxh, 1, nil, true, "networkOld1", opts)
+  pxa[2] = Make(pxh, 2, nil, true, "networkOld2", opts)
+  pxa[3] = Make(pxh, 3, nil, true, "networkOld3", opts)
   pxa[1].Start(1, 111)
 
   waitForDecisionMajority(t, pxa, 1)
 
-  pxa[0] = Make(pxh, 0, nil, true, "networkOld0")
+  pxa[0] = Make(pxh, 0, nil, true, "networkOld0", opts)
   pxa[0].Start(1, 222)
 
   waitForDecision(t, pxa, 1, 4)
 
   if false {
-    pxa[4] = Make(pxh, 4, nil, true, "networkOld4")
+    pxa[4] = Make(pxh, 4, nil, true, "networkOld4", opts)
     waitForDecision(t, pxa, 1, npaxos)
   }
 
@@ -496,6 +505,7 @@ func TestNetworkOld(t *testing.T) {
 // many agreements, with unreliable RPC
 //
 func TestNetworkManyUnreliable(t *testing.T) {
+  opts := testOptions(t)
   runtime.GOMAXPROCS(4)
 
   fmt.Printf("Test: Many instances, unreliable RPC ...\n")
@@ -509,8 +519,8 @@ func TestNetworkManyUnreliable(t *testing.T) {
     pxh[i] = netport(i)
   }
   for i := 0; i < npaxos; i++ {
-    pxa[i] = Make(pxh, i, nil, true, "networkManyUnreliable" + string(i))
-    pxa[i].unreliable = true
+    pxa[i] = Make(pxh, i, nil, true, "networkManyUnreliable" + string(i), opts)
+    pxa[i].setunreliable(true)
     pxa[i].Start(0, 0)
   }
 
@@ -542,53 +552,34 @@ func TestNetworkManyUnreliable(t *testing.T) {
   fmt.Printf("  ... Passed\n")
 }
 
-/*
-func pp(tag string, src int, dst int) string {
-  s := "/var/tmp/824-"
-  s += strconv.Itoa(os.Getuid()) + "/"
-  s += "px-" + tag + "-"
-  s += strconv.Itoa(os.Getpid()) + "-"
-  s += strconv.Itoa(src) + "-"
-  s += strconv.Itoa(dst)
-  return s
-}
-
-func cleanpp(tag string, n int) {
-  for i := 0; i < n; i++ {
-    for j := 0; j < n; j++ {
-      ij := pp(tag, i, j)
-      os.Remove(ij)
-    }
-  }
-}*/
-
 func part(t *testing.T, pxa []*Paxos , p1 []int, p2 []int, p3 []int) {
 	//set all inititally unreachable
 	for _,p := range pxa {
-		for i,_ := range p.reachable {
-			p.reachable[i] = false
+		for i, _ := range p.peers {
+			p.setReachable(i, false)
 		}
 	}
 
 	//then create connections
 	for _, h := range p1 {
 		for _, r := range p1 {
-			pxa[h].reachable[r] = true
+			pxa[h].setReachable(r, true)
 		}
 	}
 	for _, h := range p2 {
 		for _, r := range p2 {
-			pxa[h].reachable[r] = true
+			pxa[h].setReachable(r, true)
 		}
 	}
 	for _, h := range p3 {
 		for _, r := range p3 {
-			pxa[h].reachable[r] = true
+			pxa[h].setReachable(r, true)
 		}
 	}
 }
 
 func TestNetworkPartition(t *testing.T) {
+  opts := testOptions(t)
 	runtime.GOMAXPROCS(4)
 
 	//tag := "partition"
@@ -602,7 +593,7 @@ func TestNetworkPartition(t *testing.T) {
 		pxh[i] = netport(i) //TODO: fixme
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = Make(pxh, i, nil, true, "networkPartition" + string(i))
+		pxa[i] = Make(pxh, i, nil, true, "networkPartition" + string(i), opts)
 	}
 	
 	//defer part(t, tag, npaxos, []int{}, []int{}, []int{})
@@ -653,7 +644,7 @@ func TestNetworkPartition(t *testing.T) {
 		seq++
 		
 		for i := 0; i < npaxos; i++ {
-			pxa[i].unreliable = true
+			pxa[i].setunreliable(true)
 		}
 		
 		part(t, pxa, []int{0,1,2}, []int{3,4}, []int{})
@@ -668,7 +659,7 @@ func TestNetworkPartition(t *testing.T) {
 		part(t, pxa, []int{0,1}, []int{2,3,4}, []int{})
 		
 		for i := 0; i < npaxos; i++ {
-			pxa[i].unreliable = false
+			pxa[i].setunreliable(false)
 		}
 		
 		waitForDecision(t, pxa, seq, 5)
@@ -677,6 +668,7 @@ func TestNetworkPartition(t *testing.T) {
 }
 
 func TestNetworkLots(t *testing.T) {
+  opts := testOptions(t)
 	runtime.GOMAXPROCS(4)
 	
 	fmt.Printf("Test: Many requests, changing partitions ...\n")
@@ -692,18 +684,18 @@ func TestNetworkLots(t *testing.T) {
 		pxh[i] = netport(i) 
 	}
 	for i := 0; i < npaxos; i++ {
-		pxa[i] = Make(pxh, i, nil, true, "networkLots" + string(i))
-		pxa[i].unreliable = true
+		pxa[i] = Make(pxh, i, nil, true, "networkLots" + string(i), opts)
+		pxa[i].setunreliable(true)
 	}
 	//defer part(t, tag, npaxos, []int{}, []int{}, []int{})
 	
-	done := false
+	var done int32
 	
 	// re-partition periodically
 	ch1 := make(chan bool)
 	go func() {
 		defer func(){ ch1 <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			var a [npaxos]int
 			for i := 0; i < npaxos; i++ {
 				a[i] = (rand.Int() % 3)
@@ -727,7 +719,7 @@ func TestNetworkLots(t *testing.T) {
 	ch2 := make(chan bool)
 	go func () {
 		defer func() { ch2 <- true } ()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			// how many instances are in progress?
 			nd := 0
 			for i := 0; i < seq; i++ {
@@ -749,7 +741,7 @@ func TestNetworkLots(t *testing.T) {
 	ch3 := make(chan bool)
 	go func() {
 		defer func() { ch3 <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			for i := 0; i < seq; i++ {
 				numDecided(t, pxa, i)
 			}
@@ -758,14 +750,14 @@ func TestNetworkLots(t *testing.T) {
 	}()
 
 	time.Sleep(20 * time.Second)
-	done = true
+	atomic.StoreInt32(&done, 1)
 	<- ch1
 	<- ch2
 	<- ch3
 	
 	// repair, then check that all instances decided.
 	for i := 0; i < npaxos; i++ {
-		pxa[i].unreliable = false
+		pxa[i].setunreliable(false)
 	}
 	part(t, pxa, []int{0,1,2,3,4}, []int{}, []int{})
 	time.Sleep(5 * time.Second)
@@ -6,7 +6,7 @@ package paxos
 // a Paxos peer.
 //
 // Manages a sequence of agreed-on values.
-// The set of peers is fixed.
+// The set of peers can be changed through the log with ChangePeers.
 // Copes with network failures (partition, msg loss, &c).
 // Does not store anything persistently, so cannot handle crash+restart.
 //
@@ -15,46 +15,47 @@ package paxos
 // px = paxos.Make(peers []string, me string)
 // px.Start(seq int, v interface{}) -- start agreement on new instance
 // px.Status(seq int) (decided bool, v interface{}) -- get info about an instance
+// px.Wait(seq int, timeout time.Duration) (decided bool, v interface{}) -- wait for an instance to be decided
 // px.Done(seq int) -- ok to forget all instances <= seq
 // px.Max() int -- highest instance seq known, or -1
 // px.Min() int -- instances before this seq have been forgotten
+// px.ChangePeers(peers []string) int -- agree on a new set of peers, returns the first instance they run
+// px.Promote(learner string) int -- make a learner one of the peers, returns the first instance it votes in
+// px.Exclude(peer string) -- let Min() move past a peer that stopped calling Done()
+// px.SetSnapshotter(s Snapshotter) -- let peers that fall behind Min() fetch application snapshots, in chunks
+// px.FetchedSnapshot() (seq int, data []byte) -- snapshot fetched for instances the peers forgot, to install before replaying
+// px.RequestSnapshot(seq int) (seq int, data []byte) -- a peer's snapshot reflecting at least seq, to replace damaged application state
+//
+// Peers named in Options.Learners only learn: they get every Decide and
+// recover like the others, but never vote, so they don't count toward
+// quorums or hold back Min(). Start() on a learner asks a voter to propose.
 //
 
-import "net"
+import "errors"
+import "io"
 import "net/rpc"
 import "log"
 import "os"
-import "syscall"
 import "sync"
+import "sync/atomic"
 import "fmt"
 import "math/rand"
 import "time"
 import "strconv"
+import "strings"
+import "path/filepath"
 
-import "github.com/jmhodges/levigo"
+import "storage"
+import "transport"
 import "encoding/gob"
 import "bytes"
+import "reflect"
 
-const startport = 2100
 const printRPCerrors = false
 
 const Debug = 0
 const DebugPersist = 0
 
-const enableLeader = 1
-
-const persistent = true
-const recovery = true
-const writeToMemory = false   // Whether responses/store should be written to memory (as well as disk / disk cache)
-const dbUseCompression = true // Whether database should compress entries
-const dbUseCache = true       // Whether database should use a built-in cache
-const dbCacheSize = 100       // Size of database cache in MB (ignored if dbUseCache is false)
-
-// Will use these to check that dbCacheSize doesn't overflow an int
-// (int size is either 32 or 64 bits depending on implementation)
-const MaxUint = ^uint(0)
-const MaxInt = int(^uint(0) >> 1)
-
 func DPrintf(format string, a ...interface{}) (n int, err error) {
 	if Debug > 0 {
 		fmt.Printf(format, a...)
@@ -69,12 +70,183 @@ func DPrintfPersist(format string, a ...interface{}) (n int, err error) {
 	return
 }
 
+// How far a peer's writes get before it answers a request that made them
+type Durability int
+
+const (
+	DurabilityBuffered Durability = iota // Handed to the OS first, so they survive the process crashing
+	DurabilitySync                       // Synced to disk first, so they survive the machine losing power
+	DurabilityNone                       // Written in the background, so a crash can roll back promises
+)
+
+var durabilityNames = []string{"buffered", "fsync", "none"}
+
+func (d Durability) String() string {
+	if d < 0 || int(d) >= len(durabilityNames) {
+		return fmt.Sprintf("Durability(%d)", int(d))
+	}
+	return durabilityNames[d]
+}
+
+// Durability named by "none", "buffered" or "fsync"
+func ParseDurability(name string) (Durability, error) {
+	for d, durabilityName := range durabilityNames {
+		if name == durabilityName {
+			return Durability(d), nil
+		}
+	}
+	return DurabilityBuffered, fmt.Errorf("paxos: unknown durability %q", name)
+}
+
+// Behavioral options for a Paxos peer
+// Shardmaster and shardkv take them inside rsm.Options and pass them through to their Paxos peers
+// (and use the database settings for their own persistence as well)
+type Options struct {
+	Persistent       bool                // Whether state should be written to disk
+	Recovery         bool                // Whether a restarted peer should ask other peers for missed state
+	WriteToMemory    bool                // Whether responses/store should be written to memory (as well as disk / disk cache)
+	DBUseCompression bool                // Whether database should compress entries
+	DBUseCache       bool                // Whether database should use a built-in cache
+	DBCacheSize      int                 // Size of database cache in MB (ignored if DBUseCache is false)
+	DBEngine         string              // Storage engine to persist with ("" = storage.DefaultEngine)
+	DataDir          string              // Directory holding the databases (each package uses its own subdirectory)
+	EnableLeader     int                 // 0 = no leader, 1 = sticky leader per instance, 2 = leader reset every round, 3 = MultiPaxos
+	StartPort        int                 // Port to listen on when using the network
+	RPCTimeout       time.Duration       // Deadline for each RPC to another peer
+	Transport        transport.Transport // Network to use (nil = TCP or unix sockets, by the network flag)
+	Relay            bool                // Whether to send Prepare/Accept/Decide through another peer when a direct link is down
+	LeaseDuration    time.Duration       // How long a Multi-Paxos leader's lease lasts without heartbeats
+	Durability       Durability          // How far writes get before replies are sent (storage syncs every write at DurabilitySync)
+	Q1               int                 // Weight a Prepare or leader election needs (0 = the least that meets every phase 2 quorum, or a majority)
+	Q2               int                 // Weight an Accept or lease renewal needs (0 = the least that meets every phase 1 quorum, or a majority)
+	Weights          map[string]int      // Weight of each peer's vote by address (missing = 1)
+	Q1Sets           [][]string          // Explicit phase 1 quorums, instead of Q1
+	Q2Sets           [][]string          // Explicit phase 2 quorums, instead of Q2
+	Learners         []string            // Peers given to Make that learn decided values without voting
+	ExcludeAfter     time.Duration       // Let Min() pass peers silent this long, while a Snapshotter is set (0 = never)
+}
+
+// Default directory for the databases
+// Promises must outlive a reboot, so not under the temporary directory, and the
+// path is resolved once, at startup, so a later change of working directory doesn't move it
+var defaultDataDir = func() string {
+	dir, err := filepath.Abs("persist")
+	if err != nil {
+		return "persist"
+	}
+	return dir
+}()
+
+// Returns the options that used to be compiled in
+func DefaultOptions() Options {
+	opts := Options{}
+	opts.Persistent = true
+	opts.Recovery = true
+	opts.WriteToMemory = false
+	opts.DBUseCompression = true
+	opts.DBUseCache = true
+	opts.DBCacheSize = 100
+	opts.DataDir = defaultDataDir
+	opts.EnableLeader = 1
+	opts.StartPort = 2100
+	opts.RPCTimeout = transport.DefaultTimeout
+	opts.LeaseDuration = time.Second
+	return opts
+}
+
+// Storage options for databases opened with these options
+func (opts Options) StorageOptions() storage.Options {
+	dbOpts := storage.Options{}
+	dbOpts.Engine = opts.DBEngine
+	dbOpts.Compression = opts.DBUseCompression
+	dbOpts.Cache = opts.DBUseCache
+	dbOpts.CacheSize = opts.DBCacheSize
+	dbOpts.Sync = opts.Durability == DurabilitySync
+	return dbOpts
+}
+
+// Directory where the given package keeps its databases
+func (opts Options) DBDir(pkg string) string {
+	return filepath.Join(opts.DataDir, pkg)
+}
+
+// Deletes every Paxos database stored under opts.DataDir
+// Peers using them should be killed first
+func Destroy(opts Options) error {
+	return storage.Destroy(opts.DBDir("paxos"), opts.StorageOptions())
+}
+
+// Proposal number, unique across servers
+// Ordered by round, with ties broken by the index of the proposing server
+type Ballot struct {
+	Round  int
+	Server int
+}
+
+// Lower than any ballot a server will propose
+var noBallot = Ballot{-1, -1}
+
+func (b Ballot) Less(other Ballot) bool {
+	if b.Round != other.Round {
+		return b.Round < other.Round
+	}
+	return b.Server < other.Server
+}
+
+// How often peers exchange reachability rows when relaying
+const gossipInterval = 100 * time.Millisecond
+
+// Longest wait between retries of a Decide to an unreachable peer
+const decideRetryMax = 5 * time.Second
+
+// Instances per piece of the log handed to one peer when recovering
+const recoveryChunk = 500
+
+// Most bytes of instances a peer puts in one recovery reply
+const recoveryBatchBytes = 1 << 20
+
+// Wait before a chunk a peer failed to send is tried again
+const recoveryRetryDelay = 100 * time.Millisecond
+
+// Most bytes of a snapshot a peer puts in one FetchSnapshot reply
+const snapshotChunk = 1 << 20
+
+// Instances between deciding a PeerChange and the new peers taking over
+// A proposer must hear of a change before it runs an instance this far past it
+const changeDelay = 10
+
+// Value that replaces the set of peers, agreed on like any other value
+// If it is decided at instance seq, Peers run every instance from seq+changeDelay on
+// (until the next change), and applications should treat it as a no-op
+type PeerChange struct {
+	Peers []string
+}
+
+// A PeerChange this peer has accepted, and whether it is known to be decided
+type ChangeState struct {
+	Peers   []string
+	Decided bool
+}
+
+// Source of application snapshots, for peers that fall behind Min()
+type Snapshotter interface {
+	// Encoded application state, and the instance it reflects (every instance <= it applied)
+	Snapshot() (int, []byte)
+}
+
+// The peers one peer can reach directly, as of Version (its clock when it last changed)
+// Peers gossip these rows, keeping the newest row from each peer
+type ReachRow struct {
+	Links   map[string]bool
+	Version int64
+}
+
 // Structure for a proposal status
 // Will be written to disk for each sequence
 // (note Paxos persistence requires writing Np, Na, and Va so using Proposal just has an extra bool)
 type Proposal struct {
-	Prepare  int
-	Accept   int
+	Prepare  Ballot
+	Accept   Ballot
 	Value    interface{}
 	Decided  bool
 	Accepted bool
@@ -82,47 +254,104 @@ type Proposal struct {
 
 type Paxos struct {
 	mu        sync.Mutex
-	l         net.Listener
-	dead      bool
+	listener  io.Closer // Guarded by mu
+	dead      int32     // Set once killed, read with isdead()
 	dbDeleted bool
 	dbClosed  bool
 
-	// Paxos state
-	instances    map[int]Proposal
-	maxInstance  int
-	done         map[int]int
-	doneChannels map[int]chan bool
-	leader       map[int]int
-	proposed     map[int]bool
+	// Paxos state; forget drops what is kept per instance once it is below Min()
+	instances   map[int]Proposal
+	maxInstance int
+	done        map[string]int    // Highest Done() argument by peer address
+	waiters     map[int]chan bool // Closed when the instance is decided, guarded by waitMu
+	waitMu      sync.Mutex
+	leader      map[int]int // Guarded by leaderMu
+	leaderMu    sync.Mutex
+	proposed    map[int]bool // Guarded by mu
 
 	// Networking stuff
-	unreliable bool
+	unreliable int32                    // For testing, set with setunreliable()
+	crashAfter func(method string) bool // For testing: whether to crash once a request's writes are made, before replying, guarded by crashMu
+	crashMu    sync.Mutex
 	network    bool
-	deaf       bool
-	rpcCount   int
-	reachable  []bool
-	peers      []string
-	me         int // index into peers[]
+	deaf       int32 // For testing, set with setdeaf()
+	rpcCount   int32
+	reachable  []bool // For partition tests, guarded by reachMu
+	reachMu    sync.Mutex
+	transport  transport.Transport
+	peers      []string // peers given to Make
+	me         int      // index into peers[]
+	addr       string   // peers[me]
+
+	// Peer sets, guarded by mu
+	initial []string            // peers before the first PeerChange
+	changes map[int]ChangeState // PeerChanges accepted here, by instance
+
+	// Relaying, guarded by routeMu
+	relay   bool
+	routes  map[string]ReachRow // Reachability rows by peer address, including our own
+	routeMu sync.Mutex
+
+	// Multi-Paxos, guarded by mu
+	promised      Ballot              // No lower ballot is prepared or accepted, for any instance
+	leaseHolder   string              // Peer we last granted a lease
+	followUntil   time.Time           // When the lease we granted runs out
+	seenRound     int                 // Highest round another candidate was promised
+	leading       bool                // Whether we won an election at leaderPID
+	leaderPID     Ballot              // Ballot we lead with
+	leaderConfig  int                 // PeerChange instance of the peers that elected us
+	leaderFrom    int                 // First instance we lead
+	leaseUntil    time.Time           // When our lease runs out
+	assigned      map[int]interface{} // The one value we may propose at leaderPID, by instance
+	maxAssigned   int                 // Highest instance in assigned
+	leaseDuration time.Duration
+
+	// Snapshots, guarded by mu
+	snapshotter Snapshotter // Serves FetchSnapshot (nil = none)
+	snapSeq     int         // Instance of the last snapshot fetched from a peer
+	snapData    []byte      // Snapshot fetched from a peer, until the application takes it
+
+	// Snapshot being sent to peers in chunks, until its last one is, guarded by sendMu
+	sentID   int64 // Random, since two snapshots of one instance may encode differently
+	sentSeq  int
+	sentData []byte
+	sendMu   sync.Mutex
 
 	// Persistence stuff
-	dbReadOptions  *levigo.ReadOptions
-	dbWriteOptions *levigo.WriteOptions
-	dbOpts         *levigo.Options
-	dbName         string
-	db             *levigo.DB
-	dbLock         sync.Mutex
-	dbMaxInstance  int
-	recovering     bool
+	dbOpts        storage.Options
+	dbDir         string
+	dbName        string
+	db            storage.Engine
+	dbLock        sync.Mutex
+	dbMaxInstance int
+	recovering    int32        // Set until startup recovery finishes, read with isrecovering()
+	damaged       map[int]bool // Instances whose records failed their checksum, guarded by mu; not voted on until learned decided
+	voteless      bool         // Whether the promise or the peer sets were damaged, so this peer must not vote again
+
+	// Group commit: writes are staged, then written in batches before replies go out
+	dbPending    map[string][]byte // Writes not handed to the database yet; nil deletes the key
+	dbCommitting map[string][]byte // Writes in the batch being written, or nil
+	dbBatch      int               // Number of the batch pending writes will go in
+	dbWritten    int               // Number of batches written
+	dbCommitted  *sync.Cond        // On dbLock, signalled when a batch is written
+	durability   Durability
 
 	// Behavioral Options
-	// NOTE: If shardkv/shardmaster is set to send settings to paxos, the below
-	// options will be overwritten
-	persistent       bool
-	recovery         bool
-	dbUseCompression bool
-	dbUseCache       bool
-	dbCacheSize      int
-	writeToMemory    bool
+	persistent    bool
+	recovery      bool
+	writeToMemory bool
+	enableLeader  int
+	startport     int
+	quorums       *quorums // Phase 1 and phase 2 quorums
+	learners      []string // Peers that only learn, unless a PeerChange made them voters
+
+	// Stragglers
+	excluded     map[string]bool      // Peers Min() passes until they catch up, guarded by mu
+	collected    int                  // Instances below this were forgotten here, guarded by mu
+	excludeAfter time.Duration        // How long a peer may be silent before it is excluded (0 = forever)
+	heard        map[string]time.Time // When each peer last answered a call, guarded by heardMu
+	pinging      map[string]bool      // Peers with a ping outstanding, guarded by heardMu
+	heardMu      sync.Mutex
 }
 
 type RecoverArgs struct {
@@ -130,72 +359,143 @@ type RecoverArgs struct {
 }
 
 type RecoverReply struct {
-	Done        map[int]int
+	Done        map[string]int
 	MaxInstance int
+	Min         int
 	Instance    Proposal
+	Initial     []string
+	Changes     map[int]ChangeState
 	Err         bool
 }
 
+type RecoverRangeArgs struct {
+	From     int
+	To       int // Exclusive
+	MaxBytes int
+}
+
+type RecoverRangeReply struct {
+	Instances map[int]Proposal // Decided instances only
+	Next      int
+	Err       bool
+}
+
+type GossipArgs struct {
+	Routes map[string]ReachRow
+}
+
+type GossipReply struct {
+	Routes map[string]ReachRow
+}
+
+// A message for To that the sender couldn't deliver directly
+type RelayArgs struct {
+	To   string
+	Name string
+	Args interface{}
+}
+
+// Err means the relaying peer couldn't reach To either
+type RelayReply struct {
+	Reply interface{}
+	Err   bool
+}
+
+type SnapshotArgs struct {
+	AtLeast int   // Lowest instance the snapshot may reflect
+	ID      int64 // Snapshot being fetched, once Offset > 0
+	Offset  int   // Bytes of it the caller already has
+}
+
+// Missing means the peer has no Snapshotter
+// Data is the snapshot from args.Offset on, up to snapshotChunk bytes; Complete means it ends there
+type SnapshotReply struct {
+	Seq      int
+	ID       int64
+	Data     []byte
+	Complete bool
+	Missing  bool
+	Err      bool
+}
+
+// Server and Leader are indexes into the peers running the instance
+// Config is the instance of the PeerChange those peers come from (-1 for the initial peers)
 type PrepareArgs struct {
 	Server   int
 	Instance int
-	PID      int
+	PID      Ballot
 	Decided  bool
-	Done     map[int]int
+	Done     map[string]int
 	Leader   int
+	Config   int
 }
 
+// Stale means the proposer missed the PeerChange at instance Change
+// Forgotten means the acceptor already forgot the instance, which was decided long ago
 type PrepareReply struct {
-	Err     bool
-	PID     int
-	Decided bool
-	Value   interface{}
-	Done    map[int]int
-	Leader  int
+	Err       bool
+	PID       Ballot
+	Decided   bool
+	Accepted  bool
+	Value     interface{}
+	Done      map[string]int
+	Leader    int
+	Stale     bool
+	Change    int
+	Forgotten bool
 }
 
 type AcceptArgs struct {
 	Server   int
 	Instance int
-	PID      int
+	PID      Ballot
 	Value    interface{}
 	Decided  bool
-	Done     map[int]int
+	Done     map[string]int
 	Leader   int
+	Config   int
 }
 
+// TooLate means the value is a PeerChange that this acceptor can no longer accept
 type AcceptReply struct {
-	Err    bool
-	PID    int
-	Done   map[int]int
-	Leader int
+	Err       bool
+	PID       Ballot
+	Done      map[string]int
+	Leader    int
+	Stale     bool
+	Change    int
+	TooLate   bool
+	Promised  Ballot // Ballot promised to a Multi-Paxos leader, when refusing
+	Forgotten bool
 }
 
 type DecideArgs struct {
 	Server   int
 	Instance int
-	PID      int
+	PID      Ballot
 	Value    interface{}
-	Done     map[int]int
+	Done     map[string]int
 	Leader   int
 }
 
 type DecideReply struct {
 	Err    bool
-	Done   map[int]int
+	Done   map[string]int
 	Leader int
 }
 
 type ProposeArgs struct {
 	Sequence int
 	Value    interface{}
-	Done     map[int]int
+	Done     map[string]int
 }
 
+// Forgotten means the peer already forgot the instance, which was decided long ago
 type ProposeReply struct {
-	Err    bool
-	Done   map[int]int
-	Leader int
+	Err       bool
+	Done      map[string]int
+	Leader    int
+	Forgotten bool
 }
 
 //
@@ -212,109 +512,330 @@ type ProposeReply struct {
 // error after a while if it does not get a reply from the server.
 //
 // please use call() to send all RPCs, in client.go and server.go.
-// please do not change this function.
+// connections to peers are kept open and reused between calls.
 //
 func (px *Paxos) callWrap(srv string, name string, args interface{},
+	reply interface{}) bool {
+	if px.callDirect(srv, name, args, reply) {
+		return true
+	}
+	if px.relay && (name == "Paxos.Prepare" || name == "Paxos.Accept" || name == "Paxos.Decide") {
+		return px.callRelayed(srv, name, args, reply)
+	}
+	return false
+}
+
+// Call srv over the direct link only, and note whether the link works
+func (px *Paxos) callDirect(srv string, name string, args interface{},
+	reply interface{}) bool {
+	ok := px.callLink(srv, name, args, reply)
+	if px.relay {
+		px.setLink(srv, ok)
+	}
+	return ok
+}
+
+func (px *Paxos) callLink(srv string, name string, args interface{},
 	reply interface{}) bool {
 	//check if unreachable, for partition tests
-	for i, p := range px.peers {
-		if p == srv && !px.reachable[i] {
-			return false
-		}
+	if !px.canReach(srv) {
+		return false
+	}
+	err := px.transport.Call(srv, name, args, reply)
+	if err == nil {
+		px.heardFrom(srv)
+		return true
 	}
-	return call(srv, name, args, reply, px.network)
+	if printRPCerrors {
+		fmt.Println(err)
+	}
+	return false
 }
 
-func call(srv string, name string, args interface{}, reply interface{},
-	network bool) bool {
-	if network {
-		c, err := rpc.Dial("tcp", srv)
-		if err != nil {
-			err1 := err.(*net.OpError)
-			if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-				fmt.Printf("paxos Dial() failed: %v\n", err1)
-			}
-			return false
+// Send a message for srv through a peer that says it can reach srv
+func (px *Paxos) callRelayed(srv string, name string, args interface{}, reply interface{}) bool {
+	relayArgs := &RelayArgs{srv, name, reflect.Indirect(reflect.ValueOf(args)).Interface()}
+	for _, via := range px.relaysTo(srv) {
+		var relayReply RelayReply
+		if px.callDirect(via, "Paxos.Relay", relayArgs, &relayReply) && !relayReply.Err {
+			reflect.ValueOf(reply).Elem().Set(reflect.ValueOf(relayReply.Reply))
+			return true
 		}
-		defer c.Close()
+	}
+	return false
+}
 
-		err = c.Call(name, args, reply)
-		if err == nil {
-			return true
+// Peers we reach directly that reach srv directly, as far as we know
+func (px *Paxos) relaysTo(srv string) []string {
+	px.routeMu.Lock()
+	defer px.routeMu.Unlock()
+	var vias []string
+	for via, ok := range px.routes[px.addr].Links {
+		if ok && via != srv && px.routes[via].Links[srv] {
+			vias = append(vias, via)
 		}
+	}
+	return vias
+}
+
+// Record whether our link to srv works, in our own reachability row
+func (px *Paxos) setLink(srv string, ok bool) {
+	px.routeMu.Lock()
+	defer px.routeMu.Unlock()
+	own := px.routes[px.addr]
+	if old, known := own.Links[srv]; known && old == ok {
+		return
+	}
+	links := make(map[string]bool)
+	for peer, linked := range own.Links {
+		links[peer] = linked
+	}
+	links[srv] = ok
+	px.routes[px.addr] = ReachRow{links, time.Now().UnixNano()}
+}
 
-		if printRPCerrors {
-			fmt.Println(err)
+// Keep the newer of our row and the given row for each peer
+func (px *Paxos) mergeRoutes(routes map[string]ReachRow) {
+	px.routeMu.Lock()
+	defer px.routeMu.Unlock()
+	for peer, row := range routes {
+		if peer != px.addr && row.Version > px.routes[peer].Version {
+			px.routes[peer] = row
 		}
-		return false
-	} else {
-		c, err := rpc.Dial("unix", srv)
-		if err != nil {
-			err1 := err.(*net.OpError)
-			if err1.Err != syscall.ENOENT && err1.Err != syscall.ECONNREFUSED {
-				fmt.Printf("paxos Dial() failed: %v\n", err1)
+	}
+}
+
+func (px *Paxos) copyRoutes() map[string]ReachRow {
+	px.routeMu.Lock()
+	defer px.routeMu.Unlock()
+	routes := make(map[string]ReachRow)
+	for peer, row := range px.routes {
+		routes[peer] = row
+	}
+	return routes
+}
+
+// Exchange reachability rows with every peer, which also tests our links to them
+func (px *Paxos) gossip() {
+	for !px.isdead() {
+		px.mu.Lock()
+		peers := append([]string{}, px.latestPeers()...)
+		px.mu.Unlock()
+		for _, peer := range peers {
+			if peer == px.addr {
+				continue
 			}
-			return false
+			go func(peer string) {
+				args := &GossipArgs{px.copyRoutes()}
+				var reply GossipReply
+				if px.callDirect(peer, "Paxos.Gossip", args, &reply) {
+					px.mergeRoutes(reply.Routes)
+				}
+			}(peer)
 		}
-		defer c.Close()
+		time.Sleep(gossipInterval)
+	}
+}
 
-		err = c.Call(name, args, reply)
-		if err == nil {
-			return true
-		}
+// Respond to a Gossip request with our reachability rows
+func (px *Paxos) Gossip(args *GossipArgs, reply *GossipReply) error {
+	px.mergeRoutes(args.Routes)
+	reply.Routes = px.copyRoutes()
+	return nil
+}
 
-		if printRPCerrors {
-			fmt.Println(err)
-		}
-		return false
+// Pass a message on to a peer the sender can't reach, and its reply back
+func (px *Paxos) Relay(args *RelayArgs, reply *RelayReply) error {
+	var out interface{}
+	switch args.Name {
+	case "Paxos.Prepare":
+		out = &PrepareReply{}
+	case "Paxos.Accept":
+		out = &AcceptReply{}
+	case "Paxos.Decide":
+		out = &DecideReply{}
+	default:
+		reply.Err = true
+		return nil
+	}
+	// Only one hop, so messages can't loop
+	if args.To == px.addr || !px.callDirect(args.To, args.Name, args.Args, out) {
+		reply.Err = true
+		return nil
 	}
+	reply.Reply = reflect.ValueOf(out).Elem().Interface()
+	return nil
 }
 
-// Wrapper for calling prepare, accept, or decide
+// Wrapper for calling prepare, accept, or decide on the peer at the given address
 // Uses local function if calling myself, otherwise uses RPC
-func (px *Paxos) callAcceptor(index int, name string, args interface{}, reply interface{}) bool {
-	if index == px.me {
+func (px *Paxos) callAcceptor(peer string, name string, args interface{}, reply interface{}) bool {
+	if peer == px.addr {
 		if name == "Paxos.Prepare" {
 			return px.Prepare(args.(*PrepareArgs), reply.(*PrepareReply)) == nil
 		} else if name == "Paxos.Accept" {
 			return px.Accept(args.(*AcceptArgs), reply.(*AcceptReply)) == nil
 		} else if name == "Paxos.Decide" {
 			return px.Decide(args.(*DecideArgs), reply.(*DecideReply)) == nil
+		} else if name == "Paxos.PrepareLeader" {
+			return px.PrepareLeader(args.(*LeaderArgs), reply.(*LeaderReply)) == nil
+		} else if name == "Paxos.Heartbeat" {
+			return px.Heartbeat(args.(*HeartbeatArgs), reply.(*HeartbeatReply)) == nil
 		}
 	}
 	if name == "Paxos.Decide" {
-		// Retry call until it succeeds
-		for !px.dead {
-			if px.callWrap(px.peers[index], name, args, reply) {
+		// Retry call until it succeeds, backing off so dead peers cost little
+		delay := 50 * time.Millisecond
+		for !px.isdead() {
+			if px.callWrap(peer, name, args, reply) {
 				return true
 			}
-			time.Sleep(50 * time.Millisecond)
+			time.Sleep(delay)
+			if delay < decideRetryMax {
+				delay *= 2
+			}
 		}
 		return false
 	} else {
-		return px.callWrap(px.peers[index], name, args, reply)
+		return px.callWrap(peer, name, args, reply)
 	}
 }
 
 // Writes the given proposal to memory and/or disk
+// px.mu must be held
 func (px *Paxos) putInstance(seq int, proposal Proposal) {
+	if seq < px.collected {
+		// Forgotten already, so don't keep it again
+		return
+	}
 	if px.writeToMemory {
 		px.instances[seq] = proposal
 	}
+	if seq > px.maxInstance {
+		px.maxInstance = seq
+	}
 	px.dbWriteInstance(seq, proposal)
+	px.trackChange(seq, proposal)
+	if proposal.Decided {
+		// A decided value replaces a damaged record safely
+		delete(px.damaged, seq)
+		px.notifyDecided(seq)
+	}
+}
+
+// Whether this peer must not promise or accept anything for seq,
+// because records of what it already did were damaged; px.mu must be held
+func (px *Paxos) cantVote(seq int) bool {
+	return px.voteless || px.damaged[seq]
+}
+
+// Whether this peer is a learner that doesn't vote in seq; px.mu must be held
+func (px *Paxos) learnsOnly(seq int) bool {
+	_, peers := px.configAt(seq)
+	return indexOf(px.learners, px.addr) >= 0 && indexOf(peers, px.addr) < 0
+}
+
+// Whether any instance from seq on is damaged; px.mu must be held
+func (px *Paxos) damagedFrom(seq int) bool {
+	for damaged := range px.damaged {
+		if damaged >= seq {
+			return true
+		}
+	}
+	return false
+}
+
+// Keep px.changes in step with the value accepted or decided at seq; px.mu must be held
+func (px *Paxos) trackChange(seq int, proposal Proposal) {
+	old, had := px.changes[seq]
+	if change, ok := proposal.Value.(PeerChange); ok && proposal.Accepted {
+		if had && old.Decided == proposal.Decided && reflect.DeepEqual(old.Peers, change.Peers) {
+			return
+		}
+		px.changes[seq] = ChangeState{change.Peers, proposal.Decided}
+	} else if had && (proposal.Accepted || proposal.Decided) {
+		// Another value replaced the change
+		delete(px.changes, seq)
+	} else {
+		return
+	}
+	px.dbWritePeers()
+}
+
+// Peers running the given instance, and the instance of the PeerChange
+// that chose them (-1 for the initial peers); px.mu must be held
+func (px *Paxos) configAt(seq int) (int, []string) {
+	from := -1
+	peers := px.initial
+	for d, change := range px.changes {
+		if change.Decided && d+changeDelay <= seq && d > from {
+			from = d
+			peers = change.Peers
+		}
+	}
+	return from, peers
+}
+
+// Peers of the newest decided PeerChange, even if it hasn't taken effect yet; px.mu must be held
+func (px *Paxos) latestPeers() []string {
+	from := -1
+	peers := px.initial
+	for d, change := range px.changes {
+		if change.Decided && d > from {
+			from = d
+			peers = change.Peers
+		}
+	}
+	return peers
+}
+
+// Newest PeerChange accepted here that takes effect by seq but came after
+// the one at instance from, or -1 if a proposer using from's peers missed nothing
+// px.mu must be held
+func (px *Paxos) missedChange(from int, seq int) int {
+	missed := -1
+	for d, _ := range px.changes {
+		if d > from && d+changeDelay <= seq && d > missed {
+			missed = d
+		}
+	}
+	return missed
+}
+
+// Index of addr in peers, or -1
+func indexOf(peers []string, addr string) int {
+	for i, peer := range peers {
+		if peer == addr {
+			return i
+		}
+	}
+	return -1
+}
+
+// Leader of the given sequence, as far as we know
+func (px *Paxos) getLeader(seq int) int {
+	px.leaderMu.Lock()
+	defer px.leaderMu.Unlock()
+	return px.leader[seq]
+}
+
+func (px *Paxos) setLeader(seq int, leader int) {
+	px.leaderMu.Lock()
+	defer px.leaderMu.Unlock()
+	px.leader[seq] = leader
 }
 
 // Get the instance of the given sequence number
 // If haven't heard about it, creats a new instance for that sequence
 // Also updates px.maxInstance
 func (px *Paxos) getInstance(seq int) Proposal {
-	prop := Proposal{-1, -1, nil, false, false}
+	prop := Proposal{noBallot, noBallot, nil, false, false}
 	ok := false
 	// Load instance from memory if available
 	// otherwise look in database
 	if prop, ok = px.instances[seq]; !ok {
 		prop = px.dbGetInstance(seq)
-		if px.writeToMemory {
+		if px.writeToMemory && seq >= px.collected {
 			px.instances[seq] = prop
 		}
 	} else {
@@ -329,134 +850,277 @@ func (px *Paxos) getInstance(seq int) Proposal {
 // Note that Min() actually processes the Done messages
 func (px *Paxos) doneCollector() {
 	oldMin := -1 // Index of highest instance that has been deleted already
-	for !px.dead {
+	for !px.isdead() {
+		px.checkStragglers()
 		// Find out min instance to preserve
 		min := px.Min()
 		// Delete any instances not already deleted
 		px.mu.Lock()
 		for min > oldMin {
-			delete(px.instances, oldMin)
-			px.dbDeleteInstance(oldMin)
+			px.forget(oldMin)
 			oldMin += 1
 		}
+		px.collected = oldMin
 		px.mu.Unlock()
 		time.Sleep(100 * time.Millisecond)
 	}
 }
 
+// Drop everything kept for seq, which is below Min(); px.mu must be held
+func (px *Paxos) forget(seq int) {
+	delete(px.instances, seq)
+	px.dbDeleteInstance(seq)
+	delete(px.proposed, seq)
+	delete(px.assigned, seq)
+	delete(px.damaged, seq)
+	px.leaderMu.Lock()
+	delete(px.leader, seq)
+	px.leaderMu.Unlock()
+	// Nothing more will be learned about seq, so Wait() returns what Status() says
+	px.notifyDecided(seq)
+}
+
 // Respond to a Prepare request
 func (px *Paxos) Prepare(args *PrepareArgs, reply *PrepareReply) error {
-	for dk, dv := range args.Done {
-		px.recordDone(dk, dv)
-	}
+	px.recordDones(args.Done)
 	px.mu.Lock()
-	DPrintf("\n%v (L%v): Received prepare for sequence %v", px.me, px.leader[args.Instance], args.Instance)
+	DPrintf("\n%v (L%v): Received prepare for sequence %v", px.me, px.getLeader(args.Instance), args.Instance)
 	prop := px.getInstance(args.Instance)
 	reply.Err = true
 
-	newDone := make(map[int]int)
+	newDone := make(map[string]int)
 	for dk, dv := range px.getDone() {
 		newDone[dk] = dv
 	}
 
-	// Check if proposal number is high enough
-	if args.PID > prop.Prepare {
+	if args.Instance < px.collected {
+		// Whatever we promised or accepted is gone, and the value was decided anyway
+		reply.Forgotten = true
+	} else if px.cantVote(args.Instance) {
+		// We can't tell what we promised or accepted, so any answer might break it
+		DPrintf("\n%v: Refusing prepare for damaged instance %v", px.me, args.Instance)
+	} else if px.learnsOnly(args.Instance) {
+		DPrintf("\n%v: Learner refusing prepare for instance %v", px.me, args.Instance)
+	} else if missed := px.missedChange(args.Config, args.Instance); missed >= 0 {
+		// Refuse proposers that don't know which peers run the instance
+		reply.Stale = true
+		reply.Change = missed
+	} else if px.multi() && (args.PID.Less(px.promised) || px.leasedToOther(px.peerAddr(args.Instance, args.Server))) {
+		// Only the leader may prepare while the lease we granted lasts
+		DPrintf("\n%v: Refusing prepare from %v during a lease", px.me, args.Server)
+	} else if prop.Prepare.Less(args.PID) {
 		px.putInstance(args.Instance, Proposal{args.PID, prop.Accept, prop.Value, prop.Decided, prop.Accepted})
 		reply.Err = false
 		reply.PID = prop.Accept
 		reply.Value = prop.Value
 		reply.Leader = args.Server
-		reply.Decided = prop.Accepted
-		if args.Decided {
-			reply.Decided = prop.Decided
-		}
-		px.leader[args.Instance] = args.Server
+		reply.Decided = prop.Decided
+		reply.Accepted = prop.Accepted
+		px.setLeader(args.Instance, args.Server)
 	}
 	px.mu.Unlock()
 
-	for dk, dv := range px.getDone() {
+	for dk, dv := range px.copyDone() {
 		newDone[dk] = dv
 	}
 	reply.Done = newDone
 
-	return nil
+	// Whatever we promised or accepted is written before the reply goes out, unless durability is DurabilityNone
+	return px.ack("Prepare")
 }
 
 // Respond to an Accept request
 func (px *Paxos) Accept(args *AcceptArgs, reply *AcceptReply) error {
-	for dk, dv := range args.Done {
-		px.recordDone(dk, dv)
-	}
+	px.recordDones(args.Done)
 	px.mu.Lock()
-	DPrintf("\n%v (L%v): Received accept for sequence %v (%v)", px.me, px.leader[args.Instance], args.Instance, args.Value)
+	DPrintf("\n%v (L%v): Received accept for sequence %v (%v)", px.me, px.getLeader(args.Instance), args.Instance, args.Value)
 	// Create instance if needed (note prepare request may have been lost in network)
 	prop := px.getInstance(args.Instance)
 	reply.Err = true
 
-	newDone := make(map[int]int)
+	newDone := make(map[string]int)
 	for dk, dv := range px.getDone() {
 		newDone[dk] = dv
 	}
 
-	if prop.Decided && !args.Decided && args.Server == px.leader[args.Instance] {
+	_, isChange := args.Value.(PeerChange)
+	if args.Instance < px.collected {
+		reply.Forgotten = true
+	} else if px.cantVote(args.Instance) || px.learnsOnly(args.Instance) {
+		DPrintf("\n%v: Refusing accept for instance %v", px.me, args.Instance)
+	} else if missed := px.missedChange(args.Config, args.Instance); missed >= 0 {
+		// Refuse proposers that don't know which peers run the instance
+		reply.Stale = true
+		reply.Change = missed
+	} else if isChange && px.maxInstance >= args.Instance+changeDelay && !(prop.Accepted && reflect.DeepEqual(prop.Value, args.Value)) {
+		// Instances the change would apply to already ran with the current peers
+		// Refusing it here, forever, keeps it from being chosen
+		reply.TooLate = true
+	} else if px.multi() {
+		// Any ballot but one below the leader's promise will do
+		if !args.PID.Less(prop.Prepare) && !args.PID.Less(px.promised) {
+			px.putInstance(args.Instance, Proposal{args.PID, args.PID, args.Value, prop.Decided, true})
+			reply.Err = false
+			reply.PID = args.PID
+		} else {
+			reply.Promised = px.promised
+		}
+	} else if prop.Decided && !args.Decided && args.Server == px.getLeader(args.Instance) {
 		DPrintf("\nDIDNT HEAR")
-		px.leader[args.Instance] = -1
-	} else if args.PID >= prop.Prepare && (args.Server == px.leader[args.Instance] || enableLeader == 0) {
+		px.setLeader(args.Instance, -1)
+	} else if !args.PID.Less(prop.Prepare) && (args.Server == px.getLeader(args.Instance) || px.enableLeader == 0) {
 		px.putInstance(args.Instance, Proposal{args.PID, args.PID, args.Value, prop.Decided, true})
 		reply.Err = false
 		reply.PID = args.PID
-		px.leader[args.Instance] = args.Server
+		px.setLeader(args.Instance, args.Server)
 	}
 	px.mu.Unlock()
 
-	for dk, dv := range px.getDone() {
+	for dk, dv := range px.copyDone() {
 		newDone[dk] = dv
 	}
 	reply.Done = newDone
-	reply.Leader = px.leader[args.Instance]
+	reply.Leader = px.getLeader(args.Instance)
 
-	return nil
+	return px.ack("Accept")
 }
 
 // Respond to a Decide request
 func (px *Paxos) Decide(args *DecideArgs, reply *DecideReply) error {
 	px.mu.Lock()
-	DPrintf("\n%v (L%v): Received decide for sequence %v (%v)", px.me, px.leader[args.Instance], args.Instance, args.Value)
+	DPrintf("\n%v (L%v): Received decide for sequence %v (%v)", px.me, px.getLeader(args.Instance), args.Instance, args.Value)
 	px.putInstance(args.Instance, Proposal{args.PID, args.PID, args.Value, true, true})
 
-	px.leader[args.Instance] = args.Server
-	if _, ok := px.leader[args.Instance+1]; !ok {
-		px.leader[args.Instance+1] = args.Server
+	if args.Instance >= px.collected {
+		px.leaderMu.Lock()
+		px.leader[args.Instance] = args.Server
+		if _, ok := px.leader[args.Instance+1]; !ok {
+			px.leader[args.Instance+1] = args.Server
+		}
+		px.leaderMu.Unlock()
 	}
 
-	if args.Instance > px.maxInstance {
-		px.maxInstance = args.Instance
-	}
 	px.mu.Unlock()
 	reply.Err = false
 
-	for dk, dv := range args.Done {
-		px.recordDone(dk, dv)
-	}
-	newDone := make(map[int]int)
-	for dk, dv := range px.getDone() {
-		newDone[dk] = dv
-	}
+	px.recordDones(args.Done)
+	reply.Done = px.copyDone()
+	reply.Leader = px.getLeader(args.Instance)
 
-	// If someone is listening for this sequence to finish, let them know
-	// (used for benchmark speed tests to avoid sleeping)
-	if channel, exists := px.doneChannels[args.Instance]; exists {
-		channel <- true
-		delete(px.doneChannels, args.Instance)
-	}
+	return px.ack("Decide")
+}
 
-	for dk, dv := range px.getDone() {
-		newDone[dk] = dv
+// Reply from one peer to a broadcast Prepare or Accept
+type prepareResult struct {
+	index    int
+	answered bool
+	reply    PrepareReply
+}
+
+type acceptResult struct {
+	index    int
+	answered bool
+	reply    AcceptReply
+}
+
+// Send Prepare requests to the given peers in parallel
+// Returns the promises once a phase 1 quorum has promised, or once none can anymore,
+// along with the newest PeerChange a refusing peer said the proposer missed (-1 if none)
+// and whether a refusing peer had forgotten the instance
+// Calls still outstanding keep running and record their piggybacked done responses
+func (px *Paxos) broadcastPrepare(args *PrepareArgs, peers []string) ([]prepareResult, int, bool) {
+	total := len(peers)
+	results := make(chan prepareResult, total)
+	for i := 0; i < total; i++ {
+		go func(index int) {
+			var reply PrepareReply
+			answered := px.callAcceptor(peers[index], "Paxos.Prepare", args, &reply)
+			if answered {
+				px.recordDones(reply.Done)
+			}
+			results <- prepareResult{index, answered, reply}
+		}(i)
+	}
+
+	promises := make([]prepareResult, 0, total)
+	promised := make(map[string]bool)
+	refused := make(map[string]bool)
+	missed := -1
+	forgotten := false
+	for !px.quorums.has(phase1, peers, promised) && px.quorums.possible(phase1, peers, refused) {
+		result := <-results
+		if result.answered && !result.reply.Err {
+			promises = append(promises, result)
+			promised[peers[result.index]] = true
+		} else {
+			refused[peers[result.index]] = true
+			if result.answered && result.reply.Stale && result.reply.Change > missed {
+				missed = result.reply.Change
+			}
+			forgotten = forgotten || (result.answered && result.reply.Forgotten)
+		}
 	}
-	reply.Done = newDone
-	reply.Leader = px.leader[args.Instance]
+	return promises, missed, forgotten
+}
 
-	return nil
+// Outcome of a broadcast Accept
+type acceptOutcome struct {
+	accepted  bool            // A phase 2 quorum accepted
+	forgotten bool            // A peer had forgotten the instance
+	deposed   bool            // A peer rejected because it follows another leader (we stop waiting in that case)
+	missed    int             // Newest PeerChange a peer said the proposer missed, or -1
+	tooLate   map[string]bool // Peers that will never accept the PeerChange being proposed
+	promised  Ballot          // Highest ballot a peer promised a Multi-Paxos leader instead
+}
+
+// Send Accept requests to the given peers in parallel
+// Returns once a phase 2 quorum has accepted, or once none can anymore
+// Calls still outstanding keep running and record their piggybacked done responses
+func (px *Paxos) broadcastAccept(args *AcceptArgs, peers []string) acceptOutcome {
+	total := len(peers)
+	results := make(chan acceptResult, total)
+	for i := 0; i < total; i++ {
+		go func(index int) {
+			var reply AcceptReply
+			answered := px.callAcceptor(peers[index], "Paxos.Accept", args, &reply)
+			if answered {
+				px.recordDones(reply.Done)
+			}
+			results <- acceptResult{index, answered, reply}
+		}(i)
+	}
+
+	out := acceptOutcome{missed: -1, tooLate: make(map[string]bool), promised: noBallot}
+	accepted := make(map[string]bool)
+	rejected := make(map[string]bool)
+	for !px.quorums.has(phase2, peers, accepted) && px.quorums.possible(phase2, peers, rejected) {
+		result := <-results
+		peer := peers[result.index]
+		if result.answered && !result.reply.Err {
+			accepted[peer] = true
+			continue
+		}
+		rejected[peer] = true
+		if !result.answered {
+			continue
+		}
+		if result.reply.Stale && result.reply.Change > out.missed {
+			out.missed = result.reply.Change
+		}
+		out.forgotten = out.forgotten || result.reply.Forgotten
+		if result.reply.TooLate {
+			out.tooLate[peer] = true
+		}
+		if out.promised.Less(result.reply.Promised) {
+			out.promised = result.reply.Promised
+		}
+		if result.reply.Leader != args.Server && px.stickyLeader() && !result.reply.Stale && !result.reply.TooLate {
+			out.deposed = true
+			return out
+		}
+	}
+	out.accepted = px.quorums.has(phase2, peers, accepted)
+	return out
 }
 
 // Propose a value for a sequence (will do prepare, accept, decide)
@@ -464,175 +1128,307 @@ func (px *Paxos) Propose(args *ProposeArgs, reply *ProposeReply) error {
 	seq := args.Sequence
 	v := args.Value
 
-	for dk, dv := range args.Done {
-		px.recordDone(dk, dv)
-	}
-	newDone := make(map[int]int)
-	for dk, dv := range px.getDone() {
-		newDone[dk] = dv
-	}
+	px.recordDones(args.Done)
+	newDone := px.copyDone()
 
 	px.mu.Lock()
-	if px.proposed[seq] && enableLeader > 0 {
-		DPrintf("\n%v (L%v): Ignoring proposal for instance %v (%v)", px.me, px.leader[seq], seq, v)
+	if seq < px.collected || (px.proposed[seq] && px.stickyLeader()) {
+		DPrintf("\n%v (L%v): Ignoring proposal for instance %v (%v)", px.me, px.getLeader(seq), seq, v)
 		reply.Err = false
 		reply.Done = newDone
-		reply.Leader = px.leader[seq]
+		reply.Leader = px.getLeader(seq)
+		reply.Forgotten = seq < px.collected
 		px.mu.Unlock()
 		return nil
 	} else {
-		DPrintf("\n%v (L%v): Starting proposal for instance %v (%v)", px.me, px.leader[seq], seq, v)
+		DPrintf("\n%v (L%v): Starting proposal for instance %v (%v)", px.me, px.getLeader(seq), seq, v)
 		px.proposed[seq] = true
 	}
+	px.mu.Unlock()
+
+	decided := px.propose(seq, v, newDone)
+	if !decided {
+		// Gave up; let a retry propose again
+		px.mu.Lock()
+		delete(px.proposed, seq)
+		px.mu.Unlock()
+	}
+	// Followers retry elsewhere when a Multi-Paxos leader fails
+	reply.Err = px.multi() && !decided
 
-	if px.leader[seq] != px.me {
-		px.leader[seq] = -1
+	// Copy rather than update newDone, since late Prepare/Accept calls may still be sending it
+	reply.Done = make(map[string]int)
+	for dk, dv := range newDone {
+		reply.Done[dk] = dv
+	}
+	for dk, dv := range px.copyDone() {
+		reply.Done[dk] = dv
 	}
+	reply.Leader = px.getLeader(seq)
 
+	return nil
+}
+
+// Run Paxos on seq until it is decided, with v as the value unless another may have been chosen
+// Gives up if this peer doesn't run seq, or doesn't lead in Multi-Paxos
+// Returns whether seq is decided
+func (px *Paxos) propose(seq int, v interface{}, newDone map[string]int) bool {
+	if px.multi() {
+		if decided, handled := px.proposeMulti(seq, v, newDone); handled {
+			return decided
+		}
+	}
+	px.mu.Lock()
+	from, peers := px.configAt(seq)
+	me := indexOf(peers, px.addr)
+	if px.getLeader(seq) != me {
+		px.setLeader(seq, -1)
+	}
 	prop := px.getInstance(seq)
+	nPID := Ballot{0, me}
+	if px.multi() {
+		// A leader running both phases must still outbid its promise
+		nPID = Ballot{px.promised.Round + 1, me}
+	}
 	px.mu.Unlock()
-	nPID := 0
+	// Set once too few peers to accept are left to take a PeerChange at seq
+	noChange := false
 
-	for !prop.Decided && !px.dead {
-		total := len(px.peers)
-		hPID := -1
+	for !prop.Decided && !px.isdead() && me >= 0 {
+		hPID := noBallot
 		hDecided := false
+		chosen := false
 		hValue := v
-		ok := 0
+		promised := make(map[string]bool)
+		missed := -1
+		forgotten := false
 
-		if enableLeader == 2 {
-			px.leader[seq] = -1
+		if px.enableLeader == 2 {
+			px.setLeader(seq, -1)
 		}
 
-		if px.leader[seq] == px.me && enableLeader > 0 {
-			ok = total
+		if px.getLeader(seq) == me && px.stickyLeader() {
+			for _, peer := range peers {
+				promised[peer] = true
+			}
 		} else {
 			// Send Prepare requests to everyone (and record piggybacked done response)
-			DPrintf("\n%v (L%v): Sending prepare for sequence %v", px.me, px.leader[seq], seq)
-			for i := 0; i < len(px.peers); i++ {
-				args := &PrepareArgs{px.me, seq, nPID, hDecided, newDone, px.leader[seq]}
-				var reply PrepareReply
-				if px.callAcceptor(i, "Paxos.Prepare", args, &reply) && !reply.Err {
-					for dk, dv := range reply.Done {
-						px.recordDone(dk, dv)
-					}
-					ok += 1
+			DPrintf("\n%v (L%v): Sending prepare for sequence %v", px.me, px.getLeader(seq), seq)
+			args := &PrepareArgs{me, seq, nPID, hDecided, newDone, px.getLeader(seq), from}
+			var promises []prepareResult
+			promises, missed, forgotten = px.broadcastPrepare(args, peers)
+			for _, promise := range promises {
+				reply := promise.reply
+				promised[peers[promise.index]] = true
+
+				if reply.Accepted {
+					hDecided = true
+				}
 
-					if reply.Decided {
-						DPrintf("\n%v (L%v): Got decided %v for sequence %v from %v", px.me, px.leader[seq], reply.Value, seq, i)
-						hDecided = true
-						v = reply.Value
-						hValue = reply.Value
-					}
+				// A decided value is final, no matter what else was accepted
+				if reply.Decided && !chosen {
+					DPrintf("\n%v (L%v): Got decided %v for sequence %v from %v", px.me, px.getLeader(seq), reply.Value, seq, promise.index)
+					chosen = true
+					hValue = reply.Value
+				}
 
-					// Record highest prepare number / value among responses
-					if reply.PID > hPID {
-						hPID = reply.PID
-						if !hDecided {
-							hValue = reply.Value
-						}
+				// Record highest prepare number / value among responses
+				// (promises arrive in any order, so only the highest accepted ballot decides the value)
+				if hPID.Less(reply.PID) {
+					hPID = reply.PID
+					if !chosen {
+						hValue = reply.Value
 					}
 				}
 			}
+			if hDecided {
+				v = hValue
+			}
 		}
-		DPrintf("\n%v (L%v): Has %v for sequence %v", px.me, px.leader[seq], v, seq)
+		if _, isChange := hValue.(PeerChange); isChange && noChange {
+			// No PeerChange can be chosen at seq anymore, so nothing else was chosen either
+			hValue = nil
+			v = nil
+		}
+		DPrintf("\n%v (L%v): Has %v for sequence %v", px.me, px.getLeader(seq), v, seq)
 
 		// If prepare was rejected, start over with new proposal value
-		if ok <= total/2 {
+		if !px.quorums.has(phase1, peers, promised) {
+			if forgotten {
+				px.giveUp(seq)
+				return false
+			}
+			if missed >= 0 {
+				from, peers, me = px.learnChange(missed, newDone)
+			}
 			px.mu.Lock()
 			prop = px.getInstance(seq)
 			px.mu.Unlock()
-			if hPID > nPID {
-				nPID = hPID + 1
+			if nPID.Less(hPID) {
+				nPID = Ballot{hPID.Round + 1, me}
 			} else {
-				nPID = nPID + 1
+				nPID = Ballot{nPID.Round + 1, me}
 			}
+			// Our own acceptor may have made us leader, but without a quorum we aren't
+			px.setLeader(seq, -1)
 			continue
 		}
 
 		// Send Accept requests to everyone (and record piggybacked done response)
-		DPrintf("\n%v (L%v): Sending accept for sequence %v (%v)", px.me, px.leader[seq], seq, hValue)
-		ok = 0
-		for i := 0; i < len(px.peers); i++ {
-			args := &AcceptArgs{px.me, seq, nPID, hValue, hDecided, newDone, px.leader[seq]}
-			var reply AcceptReply
-			if px.callAcceptor(i, "Paxos.Accept", args, &reply) {
-				if !reply.Err {
-					for dk, dv := range reply.Done {
-						px.recordDone(dk, dv)
-					}
-					ok += 1
-				} else {
-					if reply.Leader != px.me && enableLeader > 0 {
-						DPrintf("\nRESETTING THINGS")
-						px.leader[seq] = -1
-						break
-					}
-				}
-			}
+		DPrintf("\n%v (L%v): Sending accept for sequence %v (%v)", px.me, px.getLeader(seq), seq, hValue)
+		args := &AcceptArgs{me, seq, nPID, hValue, hDecided, newDone, px.getLeader(seq), from}
+		out := px.broadcastAccept(args, peers)
+		if out.deposed {
+			DPrintf("\nRESETTING THINGS")
+			px.setLeader(seq, -1)
 		}
 
 		// If accept was rejected, start over with new proposal value
-		if ok <= total/2 {
+		if !out.accepted {
+			if out.forgotten {
+				px.giveUp(seq)
+				return false
+			}
+			if !px.quorums.possible(phase2, peers, out.tooLate) {
+				noChange = true
+			}
+			if out.missed >= 0 {
+				from, peers, me = px.learnChange(out.missed, newDone)
+			}
 			px.mu.Lock()
 			prop = px.getInstance(seq)
 			px.mu.Unlock()
-			if hPID > nPID {
-				nPID = hPID + 1
+			if nPID.Less(hPID) {
+				nPID = Ballot{hPID.Round + 1, me}
 			} else {
-				nPID = nPID + 1
+				nPID = Ballot{nPID.Round + 1, me}
 			}
-			px.leader[seq] = -1
+			px.setLeader(seq, -1)
 			continue
 		}
 
 		// Send Decided messages to everyone (and record piggybacked done response)
-		DPrintf("\n%v (L%v): Sending decided for sequence %v", px.me, px.leader[seq], seq)
-		waitChan := make(chan int)
-		for i := 0; i < len(px.peers); i++ {
-			args := &DecideArgs{px.me, seq, nPID, hValue, newDone, px.leader[seq]}
-			go func(index int, args DecideArgs) {
-				var reply DecideReply
-				waitChan <- 1
-				if px.callAcceptor(index, "Paxos.Decide", &args, &reply) && !reply.Err {
-					for dk, dv := range reply.Done {
-						px.recordDone(dk, dv)
-					}
-				}
-			}(i, *args)
-			<-waitChan
-		}
-		break
+		// Peers of a newer PeerChange hear too, so new peers don't miss instances
+		DPrintf("\n%v (L%v): Sending decided for sequence %v", px.me, px.getLeader(seq), seq)
+		args2 := &DecideArgs{me, seq, nPID, hValue, newDone, px.getLeader(seq)}
+		px.broadcastDecide(args2, peers)
+		return true
 	}
+	return prop.Decided
+}
 
-	for dk, dv := range px.getDone() {
-		newDone[dk] = dv
+// Stop proposing for an instance the other peers forgot
+// It was decided, but this peer can only learn the outcome from a snapshot,
+// so fetch one that covers it; waiters then find it in FetchedSnapshot
+func (px *Paxos) giveUp(seq int) {
+	DPrintf("\n%v: Instance %v was forgotten by the other peers, giving up", px.me, seq)
+	px.mu.Lock()
+	delete(px.proposed, seq)
+	covered := seq <= px.snapSeq
+	px.mu.Unlock()
+	for !covered && !px.isdead() && px.fetchSnapshot(seq) < 0 {
+		time.Sleep(recoveryRetryDelay)
 	}
-	reply.Done = newDone
-	reply.Leader = px.leader[seq]
+}
 
-	return nil
+// Send Decide to the given peers, the newest known peers and the learners, retrying in the background
+func (px *Paxos) broadcastDecide(args *DecideArgs, peers []string) {
+	px.mu.Lock()
+	targets := append([]string{}, peers...)
+	for _, peer := range append(px.latestPeers(), px.learners...) {
+		if indexOf(targets, peer) < 0 {
+			targets = append(targets, peer)
+		}
+	}
+	px.mu.Unlock()
+	for _, peer := range targets {
+		go func(peer string) {
+			var reply DecideReply
+			if px.callAcceptor(peer, "Paxos.Decide", args, &reply) && !reply.Err {
+				px.recordDones(reply.Done)
+			}
+		}(peer)
+	}
 }
 
-func (px *Paxos) callLeader(seq int, v interface{}) {
-	newDone := make(map[int]int)
-	for dk, dv := range px.getDone() {
-		newDone[dk] = dv
+// An acceptor refused us because of a PeerChange it accepted at seq
+// Find out what was decided there, and tell that instance's peers, so the
+// acceptor isn't left thinking the change might still happen
+// Returns the peers that now run the instance being proposed
+func (px *Paxos) learnChange(seq int, newDone map[string]int) (int, []string, int) {
+	px.propose(seq, nil, newDone)
+	px.mu.Lock()
+	prop := px.getInstance(seq)
+	_, peers := px.configAt(seq)
+	px.mu.Unlock()
+	if prop.Decided {
+		args := &DecideArgs{indexOf(peers, px.addr), seq, prop.Accept, prop.Value, newDone, px.getLeader(seq)}
+		var wg sync.WaitGroup
+		for _, peer := range peers {
+			wg.Add(1)
+			go func(peer string) {
+				defer wg.Done()
+				var reply DecideReply
+				if peer == px.addr {
+					px.Decide(args, &reply)
+				} else {
+					px.callWrap(peer, "Paxos.Decide", args, &reply)
+				}
+			}(peer)
+		}
+		wg.Wait()
 	}
+	return px.proposerConfig(seq)
+}
+
+// The instance of the PeerChange behind seq's peers, the peers, and this peer's index in them
+func (px *Paxos) proposerConfig(seq int) (int, []string, int) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	from, peers := px.configAt(seq)
+	return from, peers, indexOf(peers, px.addr)
+}
+
+func (px *Paxos) callLeader(seq int, v interface{}) {
+	newDone := px.copyDone()
 
 	args := &ProposeArgs{seq, v, newDone}
 	var reply ProposeReply
 
-	if enableLeader == 2 {
-		px.leader[seq] = -1
+	_, peers, me := px.proposerConfig(seq)
+	if me < 0 {
+		// Not one of the peers running seq, so ask one of them to propose
+		// (in Multi-Paxos only the leader accepts)
+		for !px.isdead() {
+			for _, peer := range peers {
+				if px.callWrap(peer, "Paxos.Propose", args, &reply) && !reply.Err {
+					if reply.Forgotten {
+						px.giveUp(seq)
+					}
+					return
+				}
+			}
+			time.Sleep(50 * time.Millisecond)
+		}
+		return
 	}
 
-	if px.leader[seq] == px.me || px.leader[seq] == -1 || enableLeader == 0 {
+	if px.multi() {
+		px.forward(seq, args)
+		return
+	}
+	if px.enableLeader == 2 {
+		px.setLeader(seq, -1)
+	}
+
+	leader := px.getLeader(seq)
+	if leader == me || leader < 0 || leader >= len(peers) || px.enableLeader == 0 {
 		px.Propose(args, &reply)
 	} else {
-		if px.callWrap(px.peers[px.leader[seq]], "Paxos.Propose", args, &reply) && !reply.Err {
-			for pr, vl := range reply.Done {
-				px.recordDone(pr, vl)
+		if px.callWrap(peers[leader], "Paxos.Propose", args, &reply) && !reply.Err {
+			px.recordDones(reply.Done)
+			if reply.Forgotten {
+				px.giveUp(seq)
 			}
 		} else {
 			DPrintf("\nFALLBACK for %v", reply.Err)
@@ -650,14 +1446,47 @@ func (px *Paxos) callLeader(seq int, v interface{}) {
 //
 func (px *Paxos) Start(seq int, v interface{}) {
 	go func() {
-		for px.recovering && !px.dead {
+		for px.isrecovering() && !px.isdead() {
 			time.Sleep(10 * time.Millisecond)
 		}
-		DPrintf("\n%v Starting %v, recovering %v dead %v", px.me, seq, px.recovering, px.dead)
+		DPrintf("\n%v Starting %v, recovering %v dead %v", px.me, seq, px.isrecovering(), px.isdead())
 		px.callLeader(seq, v)
 	}()
 }
 
+//
+// the application wants the given peers to run Paxos from now on.
+// the change is agreed on like any other value, and takes
+// effect changeDelay instances after the one it was decided at;
+// ChangePeers returns that first instance, or -1 if killed.
+// start the new peers (with Recovery on) once it returns;
+// they fetch the instances they missed from the others.
+//
+func (px *Paxos) ChangePeers(peers []string) int {
+	change := PeerChange{peers}
+	for !px.isdead() {
+		seq := px.Max() + 1
+		px.Start(seq, change)
+		decided, v := px.Wait(seq, 0)
+		if decided && reflect.DeepEqual(v, change) {
+			return seq + changeDelay
+		}
+	}
+	return -1
+}
+
+// Make a learner one of the peers, through ChangePeers
+// Returns the first instance it votes in, or -1 if killed
+func (px *Paxos) Promote(learner string) int {
+	px.mu.Lock()
+	peers := append([]string{}, px.latestPeers()...)
+	px.mu.Unlock()
+	if indexOf(peers, learner) < 0 {
+		peers = append(peers, learner)
+	}
+	return px.ChangePeers(peers)
+}
+
 //
 // the application on this machine is done with
 // all instances <= seq.
@@ -665,7 +1494,7 @@ func (px *Paxos) Start(seq int, v interface{}) {
 // see the comments for Min() for more explanation.
 //
 func (px *Paxos) Done(seq int) {
-	px.recordDone(px.me, seq)
+	px.recordDone(px.addr, seq)
 }
 
 //
@@ -674,9 +1503,11 @@ func (px *Paxos) Done(seq int) {
 // this peer.
 //
 func (px *Paxos) Max() int {
-	for px.recovering && !px.dead {
+	for px.isrecovering() && !px.isdead() {
 		time.Sleep(10 * time.Millisecond)
 	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
 	return px.maxInstance
 }
 
@@ -709,17 +1540,28 @@ func (px *Paxos) Max() int {
 // instances.
 //
 func (px *Paxos) Min() int {
-	for px.recovering && !px.dead {
+	for px.isrecovering() && !px.isdead() {
 		time.Sleep(10 * time.Millisecond)
 	}
-	done := px.getDone()
-	minDone := done[px.me]
-	for _, v := range done {
-		if v < minDone {
-			minDone = v
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	return minDone(px.getDone(), px.gcPeers()) + 1
+}
+
+// Lowest Done() argument among the given peers, counting peers never heard from as -1
+// Peers that were removed no longer hold Min() back
+func minDone(done map[string]int, peers []string) int {
+	min := -1
+	for i, peer := range peers {
+		v, ok := done[peer]
+		if !ok {
+			v = -1
+		}
+		if i == 0 || v < min {
+			min = v
 		}
 	}
-	return minDone + 1
+	return min
 }
 
 //
@@ -731,7 +1573,7 @@ func (px *Paxos) Min() int {
 //
 func (px *Paxos) Status(seq int) (bool, interface{}) {
 	start := time.Now()
-	for px.recovering && !px.dead {
+	for px.isrecovering() && !px.isdead() {
 		time.Sleep(10 * time.Millisecond)
 		if time.Since(start).Seconds() > 5 {
 			break
@@ -744,34 +1586,103 @@ func (px *Paxos) Status(seq int) (bool, interface{}) {
 	return prop.Decided, prop.Value
 }
 
-// Record a "done" value from a peer
-func (px *Paxos) recordDone(peer int, val int) {
+// Record a "done" value from this peer's application
+func (px *Paxos) recordDone(peer string, val int) {
+	px.recordDones(map[string]int{peer: val})
+}
+
+// Record the "done" values a peer sent, writing the map once if any grew
+func (px *Paxos) recordDones(values map[string]int) {
+	if len(values) == 0 {
+		return
+	}
 	px.mu.Lock()
 	defer px.mu.Unlock()
-	//DPrintf("\n%v (L%v): recording done %v, %v", px.me, px.leader[args.Instance], peer, val)
 	done := px.getDone()
-	oldVal := done[peer]
-	if val > oldVal {
-		if px.writeToMemory {
-			px.done[peer] = val
+	changed := false
+	for peer, val := range values {
+		if oldVal, ok := done[peer]; !ok || val > oldVal {
+			if px.writeToMemory {
+				px.done[peer] = val
+			}
+			done[peer] = val
+			changed = true
 		}
-		done[peer] = val
+	}
+	if changed {
 		px.dbWriteDone(done)
 	}
 }
 
-// Gets the "done" values from memory or disk
-func (px *Paxos) getDone() map[int]int {
+// A copy of the "done" values, safe to send or range over without px.mu
+func (px *Paxos) copyDone() map[string]int {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	done := make(map[string]int)
+	for dk, dv := range px.getDone() {
+		done[dk] = dv
+	}
+	return done
+}
+
+// Gets the "done" values from memory or disk; px.mu must be held
+func (px *Paxos) getDone() map[string]int {
 	if px.writeToMemory {
 		return px.done
 	}
 	return px.dbReadDone()
 }
 
-// Set a channel which can be used to listen for when a sequence is decided
-// Used by benchmark speed tests to avoid sleep times
-func (px *Paxos) SetDoneChannel(seq int, channel chan bool) {
-	px.doneChannels[seq] = channel
+// Wait until the given instance is decided here, the timeout passes, or the peer is killed
+// Also returns, undecided, once the other peers forgot the instance and a snapshot covering it
+// was fetched for FetchedSnapshot
+// A timeout of 0 waits as long as it takes
+// Returns the same as Status
+func (px *Paxos) Wait(seq int, timeout time.Duration) (bool, interface{}) {
+	// Get the channel before checking, so a decision in between isn't missed
+	channel := px.decidedChannel(seq)
+	if decided, value := px.Status(seq); decided {
+		return decided, value
+	}
+	if timeout > 0 {
+		timer := time.NewTimer(timeout)
+		defer timer.Stop()
+		select {
+		case <-channel:
+		case <-timer.C:
+		}
+	} else {
+		<-channel
+	}
+	return px.Status(seq)
+}
+
+// Channel that is closed once the given instance is decided (or forgotten, or covered by a fetched snapshot, or the peer is killed)
+func (px *Paxos) decidedChannel(seq int) chan bool {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.waitMu.Lock()
+	defer px.waitMu.Unlock()
+	channel, ok := px.waiters[seq]
+	if !ok {
+		channel = make(chan bool)
+		if px.isdead() || seq < px.collected || seq <= px.snapSeq {
+			close(channel)
+			return channel
+		}
+		px.waiters[seq] = channel
+	}
+	return channel
+}
+
+// Wake up everyone waiting for the given instance
+func (px *Paxos) notifyDecided(seq int) {
+	px.waitMu.Lock()
+	defer px.waitMu.Unlock()
+	if channel, ok := px.waiters[seq]; ok {
+		close(channel)
+		delete(px.waiters, seq)
+	}
 }
 
 //
@@ -785,7 +1696,7 @@ func (px *Paxos) Kill() {
 	// Destroy the database
 	if px.persistent && !px.dbDeleted {
 		DPrintfPersist("\n%v (L%v): Destroying database... ", px.me)
-		err := levigo.DestroyDatabase(px.dbName, px.dbOpts)
+		err := storage.Destroy(px.dbName, px.dbOpts)
 		if err != nil {
 			DPrintfPersist("\terror")
 		} else {
@@ -798,21 +1709,161 @@ func (px *Paxos) Kill() {
 func (px *Paxos) KillSaveDisk() {
 	// Kill the server
 	DPrintf("\n%v: Killing the server", px.me)
-	px.dead = true
-	if px.l != nil {
-		px.l.Close()
+	px.dbCommit()
+	atomic.StoreInt32(&px.dead, 1)
+	// Wake up everyone waiting, since nothing will be decided anymore
+	px.waitMu.Lock()
+	for seq, channel := range px.waiters {
+		close(channel)
+		delete(px.waiters, seq)
+	}
+	px.waitMu.Unlock()
+	px.mu.Lock()
+	listener := px.listener
+	px.mu.Unlock()
+	if listener != nil {
+		listener.Close()
 	}
+	px.transport.Close()
 	// Close the database
 	if px.persistent && !px.dbClosed {
 		px.dbLock.Lock()
+		for px.dbCommitting != nil {
+			px.dbCommitted.Wait()
+		}
 		px.db.Close()
-		px.dbReadOptions.Close()
-		px.dbWriteOptions.Close()
+		px.dbCommitted.Broadcast()
 		px.dbLock.Unlock()
 		px.dbClosed = true
 	}
 }
 
+// Stage a write for the next batch; a nil value deletes the key; px.dbLock must be held
+// The write is visible to dbRead right away, and in the database once dbCommit returns
+// Values are stored with a checksum, which dbRead checks
+func (px *Paxos) dbStage(key string, value []byte) error {
+	if value != nil {
+		value = storage.Frame(value)
+	}
+	px.dbPending[key] = value
+	return nil
+}
+
+// Read a key, including staged writes; px.dbLock must be held
+// Returns nil if the key doesn't exist, and storage.ErrCorrupt if it was damaged
+func (px *Paxos) dbRead(key string) ([]byte, error) {
+	record, ok := px.dbPending[key]
+	if !ok {
+		record, ok = px.dbCommitting[key]
+	}
+	if !ok {
+		var err error
+		if record, err = px.db.Get([]byte(key)); err != nil {
+			return nil, err
+		}
+	}
+	if record == nil {
+		return nil, nil
+	}
+	return storage.Unframe(record)
+}
+
+// Write every staged write to the database, synced at DurabilitySync
+// Concurrent callers share batches, so many writes cost one disk write
+// Returns the error if the batch with our writes couldn't be written; its writes
+// go back into the pending batch, so a later commit retries them
+func (px *Paxos) dbCommit() error {
+	if !px.persistent {
+		return nil
+	}
+	px.dbLock.Lock()
+	defer px.dbLock.Unlock()
+	// Our writes are in the pending batch, or in an earlier one if it is empty
+	target := px.dbBatch
+	if len(px.dbPending) == 0 {
+		target--
+	}
+	for px.dbWritten < target {
+		if px.isdead() {
+			return errKilled
+		}
+		if px.dbCommitting != nil {
+			px.dbCommitted.Wait()
+			continue
+		}
+		writes := px.dbPending
+		px.dbCommitting = writes
+		px.dbPending = make(map[string][]byte)
+		px.dbBatch++
+		px.dbLock.Unlock()
+
+		batch := px.db.Batch()
+		for key, value := range writes {
+			if value == nil {
+				batch.Delete([]byte(key))
+			} else {
+				batch.Put([]byte(key), value)
+			}
+		}
+		err := batch.Write()
+		batch.Close()
+
+		px.dbLock.Lock()
+		px.dbCommitting = nil
+		if err != nil {
+			DPrintfPersist("\n%v: Error writing batch of %v: %v", px.me, len(writes), err)
+			// Put the writes back under their old batch number, keeping newer ones
+			for key, value := range writes {
+				if _, ok := px.dbPending[key]; !ok {
+					px.dbPending[key] = value
+				}
+			}
+			px.dbBatch--
+			px.dbCommitted.Broadcast()
+			return err
+		}
+		px.dbWritten++
+		px.dbCommitted.Broadcast()
+	}
+	return nil
+}
+
+var errCrashed = errors.New("paxos: crashed before replying")
+var errKilled = errors.New("paxos: killed before writing")
+
+// Make a request's writes as durable as Options.Durability asks, before its reply goes out
+// Returns an error, so no reply is sent, if they couldn't be written or crashAfter says to crash here
+func (px *Paxos) ack(method string) error {
+	if px.durability != DurabilityNone {
+		if err := px.dbCommit(); err != nil {
+			return err
+		}
+	}
+	if crashAfter := px.getCrashAfter(); crashAfter != nil && crashAfter(method) {
+		px.crash()
+		return errCrashed
+	}
+	return nil
+}
+
+// Stop the peer the way a crash would, losing writes that were only staged
+func (px *Paxos) crash() {
+	DPrintf("\n%v: Crashing", px.me)
+	px.dbLock.Lock()
+	atomic.StoreInt32(&px.dead, 1)
+	px.dbPending = make(map[string][]byte)
+	px.dbLock.Unlock()
+	px.KillSaveDisk()
+}
+
+// Commit writes staged outside of requests, such as by Done
+func (px *Paxos) commitLoop() {
+	for !px.isdead() {
+		time.Sleep(10 * time.Millisecond)
+		px.dbCommit()
+	}
+}
+
 // Writes the given instance to the database
 func (px *Paxos) dbWriteInstance(seq int, toWrite Proposal) {
 	if !px.persistent {
@@ -820,12 +1871,12 @@ func (px *Paxos) dbWriteInstance(seq int, toWrite Proposal) {
 	}
 	px.dbLock.Lock()
 	defer px.dbLock.Unlock()
-	if px.dead {
+	if px.isdead() {
 		return
 	}
 
 	toPrint := ""
-	toPrint += fmt.Sprintf("\n%v (L%v): Writing instance %v to database... ", px.me, px.leader[seq], seq)
+	toPrint += fmt.Sprintf("\n%v (L%v): Writing instance %v to database... ", px.me, px.getLeader(seq), seq)
 	// Encode the instance into a byte array
 	var buffer bytes.Buffer
 	enc := gob.NewEncoder(&buffer)
@@ -835,7 +1886,7 @@ func (px *Paxos) dbWriteInstance(seq int, toWrite Proposal) {
 	} else {
 		// Write the state to the database
 		key := "instance_" + strconv.Itoa(seq)
-		err := px.db.Put(px.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := px.dbStage(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -851,21 +1902,22 @@ func (px *Paxos) dbWriteInstance(seq int, toWrite Proposal) {
 
 // Tries to get the desired instance from the database
 // If it doesn't exist, returns empty Proposal
+// If it is damaged, also marks it damaged; px.mu must be held
 func (px *Paxos) dbGetInstance(toGet int) Proposal {
 	if !px.persistent {
-		return Proposal{-1, -1, nil, false, false}
+		return Proposal{noBallot, noBallot, nil, false, false}
 	}
 	px.dbLock.Lock()
 	defer px.dbLock.Unlock()
-	if px.dead {
-		return Proposal{-1, -1, nil, false, false}
+	if px.isdead() {
+		return Proposal{noBallot, noBallot, nil, false, false}
 	}
 
 	toPrint := ""
-	toPrint += fmt.Sprintf("\n%v (L%v): Reading instance %v from database... ", px.me, px.leader[toGet], toGet)
+	toPrint += fmt.Sprintf("\n%v (L%v): Reading instance %v from database... ", px.me, px.getLeader(toGet), toGet)
 	// Read entry from database if it exists
 	key := "instance_" + strconv.Itoa(toGet)
-	entryBytes, err := px.db.Get(px.dbReadOptions, []byte(key))
+	entryBytes, err := px.dbRead(key)
 
 	// Decode the entry if it exists, otherwise return empty
 	if err == nil && len(entryBytes) > 0 {
@@ -876,19 +1928,24 @@ func (px *Paxos) dbGetInstance(toGet int) Proposal {
 		err = decoder.Decode(&entryDecoded)
 		if err != nil {
 			toPrint += "\terror"
+			px.damaged[toGet] = true
 		} else {
 			toPrint += "\tsuccess"
 			DPrintfPersist(toPrint)
 			return entryDecoded
 		}
+	} else if err != nil {
+		// An empty Proposal would forget what we promised, so the instance isn't voted on
+		toPrint += fmt.Sprintf("\tDamaged %s", fmt.Sprint(err))
+		px.damaged[toGet] = true
 	} else {
 		toPrint += fmt.Sprintf("\tNo entry found in database %s", fmt.Sprint(err))
 		DPrintfPersist(toPrint)
-		return Proposal{-1, -1, nil, false, false}
+		return Proposal{noBallot, noBallot, nil, false, false}
 	}
 
 	DPrintfPersist(toPrint)
-	return Proposal{-1, -1, nil, false, false}
+	return Proposal{noBallot, noBallot, nil, false, false}
 }
 
 // Deletes the given instance from the database
@@ -898,14 +1955,14 @@ func (px *Paxos) dbDeleteInstance(seq int) {
 	}
 	px.dbLock.Lock()
 	defer px.dbLock.Unlock()
-	if px.dead {
+	if px.isdead() {
 		return
 	}
 
-	DPrintfPersist("\n%v (L%v): Deleting instance %v from the database... ", px.me, px.leader[seq], seq)
+	DPrintfPersist("\n%v (L%v): Deleting instance %v from the database... ", px.me, px.getLeader(seq), seq)
 	// Delete entry if it exists
 	key := "instance_" + strconv.Itoa(seq)
-	err := px.db.Delete(px.dbWriteOptions, []byte(key))
+	err := px.dbStage(key, nil)
 	if err != nil {
 		DPrintfPersist("\terror")
 	} else {
@@ -914,27 +1971,27 @@ func (px *Paxos) dbDeleteInstance(seq int) {
 }
 
 // Read Paxos "done" state from database if it exists
-func (px *Paxos) dbReadDone() map[int]int {
-	done := make(map[int]int)
-	for i := 0; i < len(px.peers); i++ {
-		done[i] = -1
+func (px *Paxos) dbReadDone() map[string]int {
+	done := make(map[string]int)
+	for _, peer := range px.peers {
+		done[peer] = -1
 	}
 	if !px.persistent {
 		return done
 	}
 	px.dbLock.Lock()
 	defer px.dbLock.Unlock()
-	if px.dead {
+	if px.isdead() {
 		return done
 	}
 
-	doneBytes, err := px.db.Get(px.dbReadOptions, []byte("done"))
+	doneBytes, err := px.dbRead("done")
 	if err == nil && len(doneBytes) > 0 {
 		// Decode the "done" state
 		DPrintfPersist("\n\t%v: Decoding stored 'done' state... ", px.me)
 		buffer := *bytes.NewBuffer(doneBytes)
 		decoder := gob.NewDecoder(&buffer)
-		var doneDecoded map[int]int
+		var doneDecoded map[string]int
 		err = decoder.Decode(&doneDecoded)
 		if err != nil {
 			DPrintfPersist("\terror decoding: %s", fmt.Sprint(err))
@@ -951,13 +2008,13 @@ func (px *Paxos) dbReadDone() map[int]int {
 }
 
 // Write the "done" state to the database
-func (px *Paxos) dbWriteDone(done map[int]int) {
+func (px *Paxos) dbWriteDone(done map[string]int) {
 	if !px.persistent {
 		return
 	}
 	px.dbLock.Lock()
 	defer px.dbLock.Unlock()
-	if px.dead {
+	if px.isdead() {
 		return
 	}
 
@@ -970,7 +2027,7 @@ func (px *Paxos) dbWriteDone(done map[int]int) {
 		DPrintfPersist("\terror encoding")
 	} else {
 		// Write the state to the database
-		err := px.db.Put(px.dbWriteOptions, []byte("done"), buffer.Bytes())
+		err := px.dbStage("done", buffer.Bytes())
 		if err != nil {
 			DPrintfPersist("\terror writing to database")
 		} else {
@@ -984,12 +2041,12 @@ func (px *Paxos) dbWriteMaxInstance(max int) {
 	if !px.persistent {
 		return
 	}
-	if px.dead {
+	if px.isdead() {
 		return
 	}
 
 	toPrint := ""
-	toPrint += fmt.Sprintf("\n%v (L%v): Writing max instance %v to database... ", px.me, px.leader[max], max)
+	toPrint += fmt.Sprintf("\n%v (L%v): Writing max instance %v to database... ", px.me, px.getLeader(max), max)
 	// Encode the number into a byte array
 	var buffer bytes.Buffer
 	enc := gob.NewEncoder(&buffer)
@@ -999,7 +2056,7 @@ func (px *Paxos) dbWriteMaxInstance(max int) {
 	} else {
 		// Write the state to the database
 		key := "dbMaxInstance"
-		err := px.db.Put(px.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := px.dbStage(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -1010,6 +2067,60 @@ func (px *Paxos) dbWriteMaxInstance(max int) {
 	DPrintfPersist(toPrint)
 }
 
+// Writes the Multi-Paxos promise to the database; px.mu must be held
+func (px *Paxos) dbWritePromised() {
+	if !px.persistent {
+		return
+	}
+	px.dbLock.Lock()
+	defer px.dbLock.Unlock()
+	if px.isdead() {
+		return
+	}
+
+	DPrintfPersist("\n%v: Writing promise %v to database... ", px.me, px.promised)
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	err := enc.Encode(px.promised)
+	if err != nil {
+		DPrintfPersist("\terror encoding: %s", fmt.Sprint(err))
+	} else if err := px.dbStage("promised", buffer.Bytes()); err != nil {
+		DPrintfPersist("\terror writing to database")
+	} else {
+		DPrintfPersist("\tsuccess")
+	}
+}
+
+// Peer sets as stored in the database
+type peerState struct {
+	Initial []string
+	Changes map[int]ChangeState
+}
+
+// Writes the peer sets to the database; px.mu must be held
+func (px *Paxos) dbWritePeers() {
+	if !px.persistent {
+		return
+	}
+	px.dbLock.Lock()
+	defer px.dbLock.Unlock()
+	if px.isdead() {
+		return
+	}
+
+	DPrintfPersist("\n%v: Writing peers to database... ", px.me)
+	var buffer bytes.Buffer
+	enc := gob.NewEncoder(&buffer)
+	err := enc.Encode(peerState{px.initial, px.changes})
+	if err != nil {
+		DPrintfPersist("\terror encoding: %s", fmt.Sprint(err))
+	} else if err := px.dbStage("peers", buffer.Bytes()); err != nil {
+		DPrintfPersist("\terror writing to database")
+	} else {
+		DPrintfPersist("\tsuccess")
+	}
+}
+
 // Initialize database for persistence
 // and load any previously written "done" state
 func (px *Paxos) dbInit(tag string) {
@@ -1020,7 +2131,7 @@ func (px *Paxos) dbInit(tag string) {
 	defer px.dbLock.Unlock()
 	px.mu.Lock()
 	defer px.mu.Unlock()
-	if px.dead {
+	if px.isdead() {
 		return
 	}
 
@@ -1031,48 +2142,31 @@ func (px *Paxos) dbInit(tag string) {
 	gob.Register(Proposal{})
 
 	// Open database (create it if it doesn't exist)
-	px.dbOpts = levigo.NewOptions()
-	if px.dbUseCache {
-		if px.dbCacheSize*1000000 > MaxInt {
-			fmt.Printf("\nDesired cache size %v is too large... using %v instead\n", px.dbCacheSize*1000000, MaxInt)
-			px.dbOpts.SetCache(levigo.NewLRUCache(MaxInt))
-		} else {
-			px.dbOpts.SetCache(levigo.NewLRUCache(px.dbCacheSize * 1000000))
-		}
-	}
-	if px.dbUseCompression {
-		px.dbOpts.SetCompression(levigo.SnappyCompression)
-	} else {
-		px.dbOpts.SetCompression(levigo.NoCompression)
-	}
-	px.dbOpts.SetCache(levigo.NewLRUCache(3 << 30))
-	px.dbOpts.SetCreateIfMissing(true)
-	dbDir := "/home/ubuntu/mexos/src/paxos/persist/"
-	px.dbName = dbDir + "paxosDB_" + tag + "_" + strconv.Itoa(px.me)
-	os.MkdirAll(dbDir, 0777)
+	px.dbName = filepath.Join(px.dbDir, "paxosDB_"+tag+"_"+strconv.Itoa(px.me))
+	os.MkdirAll(px.dbDir, 0777)
 	DPrintfPersist("\n\t%v: DB Name: %s", px.me, px.dbName)
 	var err error
-	px.db, err = levigo.Open(px.dbName, px.dbOpts)
+	px.db, err = storage.Open(px.dbName, px.dbOpts)
 	if err != nil {
 		DPrintfPersist("\n\t%v: Error opening database! \n\t%s", px.me, fmt.Sprint(err))
 		fmt.Printf("\n\t%v: Error opening database! \n\t%s", px.me, fmt.Sprint(err))
-	} else {
-		DPrintfPersist("\n\t%v: Database opened successfully", px.me)
+		return
 	}
-
-	// Create options for reading/writing entries
-	px.dbReadOptions = levigo.NewReadOptions()
-	px.dbWriteOptions = levigo.NewWriteOptions()
-	px.dbReadOptions.SetFillCache(px.dbUseCache)
+	DPrintfPersist("\n\t%v: Database opened successfully", px.me)
+	if err := storage.UpgradeFormat(px.db); err != nil {
+		DPrintfPersist("\n\t%v: Error framing records written before checksums: %v", px.me, err)
+	}
+	scrubbedMax := px.dbScrub()
 
 	// Read Paxos "done" state from database if it exists
-	doneBytes, err := px.db.Get(px.dbReadOptions, []byte("done"))
+	// (a damaged one reads as none, which only keeps instances longer)
+	doneBytes, err := px.dbRead("done")
 	if err == nil && len(doneBytes) > 0 {
 		// Decode the "done" state
 		DPrintfPersist("\n\t%v: Decoding stored 'done' state... ", px.me)
 		buffer := *bytes.NewBuffer(doneBytes)
 		decoder := gob.NewDecoder(&buffer)
-		var doneDecoded map[int]int
+		var doneDecoded map[string]int
 		err = decoder.Decode(&doneDecoded)
 		if err != nil {
 			DPrintfPersist("\terror decoding: %s", fmt.Sprint(err))
@@ -1088,9 +2182,41 @@ func (px *Paxos) dbInit(tag string) {
 		DPrintfPersist("\n\t%v: No stored 'done' state to load", px.me)
 	}
 
+	// Read peer sets from database if they exist
+	peersBytes, err := px.dbRead("peers")
+	if err == nil && len(peersBytes) > 0 {
+		DPrintfPersist("\n\t%v: Decoding peers... ", px.me)
+		var stored peerState
+		err = gob.NewDecoder(bytes.NewBuffer(peersBytes)).Decode(&stored)
+		if err != nil {
+			DPrintfPersist("\terror decoding: %s", fmt.Sprint(err))
+		} else {
+			px.initial = stored.Initial
+			for d, change := range stored.Changes {
+				px.changes[d] = change
+			}
+			DPrintfPersist("\tsuccess")
+		}
+	}
+
+	// Read the Multi-Paxos promise from database if it exists
+	promisedBytes, err := px.dbRead("promised")
+	if err == nil && len(promisedBytes) > 0 {
+		var promised Ballot
+		if err := gob.NewDecoder(bytes.NewBuffer(promisedBytes)).Decode(&promised); err != nil {
+			DPrintfPersist("\n\t%v: Error decoding promise: %s", px.me, fmt.Sprint(err))
+		} else {
+			px.promised = promised
+			// Before the restart we may have granted a lease that hasn't run out,
+			// so help nobody lead or prepare until it would have
+			px.leaseHolder = unknownHolder
+			px.followUntil = time.Now().Add(px.leaseDuration)
+		}
+	}
+
 	// Read max instance from database if it exists
 	px.dbMaxInstance = -1
-	maxInstanceBytes, err := px.db.Get(px.dbReadOptions, []byte("dbMaxInstance"))
+	maxInstanceBytes, err := px.dbRead("dbMaxInstance")
 	if err == nil && len(maxInstanceBytes) > 0 {
 		// Decode the max instance
 		DPrintfPersist("\n\t%v: Decoding max instance... ", px.me)
@@ -1108,18 +2234,116 @@ func (px *Paxos) dbInit(tag string) {
 	} else {
 		DPrintfPersist("\n\t%v: No stored max instance to load", px.me)
 	}
+	if scrubbedMax > px.maxInstance {
+		px.maxInstance = scrubbedMax
+	}
+}
+
+// Check the record of every key in the database, before any is used; px.mu and px.dbLock must be held
+// Damaged instances are marked, and a damaged promise or peer set makes this peer voteless
+// (damage to anything else only loses what can be learned again)
+// Returns the highest instance with a record, damaged or not
+func (px *Paxos) dbScrub() int {
+	maxSeq := -1
+	iterator := px.db.Iterator()
+	defer iterator.Close()
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		key := string(iterator.Key())
+		seq := -1
+		if strings.HasPrefix(key, "instance_") {
+			seq, _ = strconv.Atoi(strings.TrimPrefix(key, "instance_"))
+			if seq > maxSeq {
+				maxSeq = seq
+			}
+		}
+		if _, err := storage.Unframe(iterator.Value()); err == nil {
+			continue
+		}
+		DPrintfPersist("\n\t%v: Record of %v is damaged", px.me, key)
+		if seq >= 0 {
+			px.damaged[seq] = true
+		} else if key == "promised" || key == "peers" {
+			px.voteless = true
+		}
+	}
+	if px.voteless {
+		fmt.Printf("\n\t%v: Promises in the database are damaged, not voting", px.me)
+	}
+	return maxSeq
+}
+
+// Fetch decided copies of damaged instances from the other peers, until none are left
+// An instance no peer has decided stays damaged until a Decide arrives for it
+func (px *Paxos) repair() {
+	for !px.isdead() && len(px.peers) > 1 {
+		px.mu.Lock()
+		seqs := make([]int, 0, len(px.damaged))
+		for seq := range px.damaged {
+			seqs = append(seqs, seq)
+		}
+		px.mu.Unlock()
+		if len(seqs) == 0 {
+			return
+		}
+		for _, seq := range seqs {
+			px.repairInstance(seq)
+		}
+		time.Sleep(recoveryRetryDelay)
+	}
+}
+
+func (px *Paxos) repairInstance(seq int) {
+	// Nobody proposes below Min(), so what we did there no longer matters
+	if seq < px.Min() {
+		px.mu.Lock()
+		delete(px.damaged, seq)
+		px.mu.Unlock()
+		px.dbDeleteInstance(seq)
+		return
+	}
+	for index, server := range px.peers {
+		if index == px.me {
+			continue
+		}
+		var reply RecoverReply
+		ok := px.callWrap(server, "Paxos.FetchRecovery", RecoverArgs{seq}, &reply)
+		if ok && !reply.Err && reply.Instance.Decided {
+			DPrintfPersist("\n\t%v: Repaired instance %v from %v", px.me, seq, index)
+			px.mu.Lock()
+			px.putInstance(seq, reply.Instance)
+			px.mu.Unlock()
+			return
+		}
+	}
 }
 
-func (px *Paxos) startup(tag string) {
+// Take on the peer history of a peer we recover from; px.mu must be held
+// A peer started with the peers of a PeerChange learns the peers before it this way
+func (px *Paxos) adoptPeers(initial []string, changes map[int]ChangeState) {
+	known := false
+	for _, change := range px.changes {
+		if change.Decided {
+			known = true
+		}
+	}
+	if !known && initial != nil {
+		px.initial = initial
+	}
+	for d, change := range changes {
+		if !px.changes[d].Decided {
+			px.changes[d] = change
+		}
+	}
+	px.dbWritePeers()
+}
+
+// local is the highest instance this peer's application had applied, read before requests are served
+func (px *Paxos) startup(local int) {
 	defer func() {
-		px.recovering = false
+		atomic.StoreInt32(&px.recovering, 0)
 		DPrintfPersist("\n%v Marked recovery false", px.me)
 		go px.doneCollector()
 	}()
-	// Initialize database, check if state is stored
-	px.recovering = true
-	DPrintfPersist("\n%v Marked recovery true", px.me)
-	px.dbInit(tag)
 	if !px.recovery {
 		return
 	}
@@ -1127,9 +2351,10 @@ func (px *Paxos) startup(tag string) {
 	if len(px.peers) == 1 {
 		return
 	}
+	peersMin := -1
 	haveState := false
 	args := RecoverArgs{-1}
-	for !px.dead && !haveState {
+	for !px.isdead() && !haveState {
 		for index, server := range px.peers {
 			if index == px.me {
 				continue
@@ -1139,70 +2364,317 @@ func (px *Paxos) startup(tag string) {
 			ok := px.callWrap(server, "Paxos.FetchRecovery", args, &reply)
 			if ok && !reply.Err {
 				DPrintfPersist("\n\t%v: Got %v", px.me, reply)
-				for peer, doneVal := range reply.Done {
-					px.recordDone(peer, doneVal)
-				}
+				px.recordDones(reply.Done)
+				px.mu.Lock()
 				if reply.MaxInstance > px.maxInstance {
 					px.maxInstance = reply.MaxInstance
 				}
+				px.adoptPeers(reply.Initial, reply.Changes)
+				px.mu.Unlock()
+				if reply.Min > peersMin {
+					peersMin = reply.Min
+				}
 				haveState = true
 			}
 		}
 	}
 
-	done := px.getDone()
-	minDone := done[px.me]
-	for _, v := range done {
-		if v < minDone {
-			minDone = v
+	px.mu.Lock()
+	min := minDone(px.getDone(), px.latestPeers()) + 1
+	px.mu.Unlock()
+	// Peers may have forgotten instances this peer never applied, so start from a snapshot
+	if local+1 < peersMin {
+		if seq := px.fetchSnapshot(peersMin - 1); seq+1 > min {
+			min = seq + 1
 		}
 	}
-	min := minDone + 1
 	DPrintfPersist("\n\t%v: Starting to recover sequences", px.me)
 	// Now either state was stored or state was gone but is recovered
 	// Now want to get up to date
-	for seq := min; seq <= px.maxInstance; seq++ {
-		// Ask peer for sequences that I should have but that are not decided,
+	px.mu.Lock()
+	max := px.maxInstance
+	px.mu.Unlock()
+	px.recoverRange(min, max)
+}
+
+// Fetch the decided instances from min to max, in chunks spread over the other peers
+// A chunk a peer fails to send goes back in the queue for the next peer to take
+func (px *Paxos) recoverRange(min int, max int) {
+	if min > max {
+		return
+	}
+	chunks := make(chan [2]int, (max-min)/recoveryChunk+1)
+	var remaining sync.WaitGroup
+	for from := min; from <= max; from += recoveryChunk {
+		to := from + recoveryChunk
+		if to > max+1 {
+			to = max + 1
+		}
+		remaining.Add(1)
+		chunks <- [2]int{from, to}
+	}
+	finished := make(chan bool)
+	go func() {
+		remaining.Wait()
+		close(finished)
+	}()
+	for index, server := range px.peers {
+		if index != px.me {
+			go px.recoverChunks(server, chunks, &remaining, finished)
+		}
+	}
+	for !px.isdead() {
+		select {
+		case <-finished:
+			return
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// Fetch chunks [from, to) of the log from one peer, in batches, until none are left
+func (px *Paxos) recoverChunks(server string, chunks chan [2]int, remaining *sync.WaitGroup, finished chan bool) {
+	for !px.isdead() {
+		var chunk [2]int
+		select {
+		case <-finished:
+			return
+		case chunk = <-chunks:
+		}
+		from, to := chunk[0], chunk[1]
+		for from < to && !px.isdead() {
+			DPrintfPersist("\n\t%v: Asking %v for sequences %v to %v", px.me, server, from, to)
+			args := RecoverRangeArgs{from, to, recoveryBatchBytes}
+			var reply RecoverRangeReply
+			ok := px.callWrap(server, "Paxos.FetchRecoveryRange", args, &reply)
+			if !ok || reply.Err || reply.Next <= from {
+				break
+			}
+			px.mu.Lock()
+			for seq, instance := range reply.Instances {
+				if !px.getInstance(seq).Decided {
+					px.putInstance(seq, instance)
+				}
+			}
+			px.mu.Unlock()
+			from = reply.Next
+		}
+		if from < to {
+			chunks <- [2]int{from, to}
+			time.Sleep(recoveryRetryDelay)
+		} else {
+			remaining.Done()
+		}
+	}
+}
+
+// Send the decided instances in [From, To), stopping early once the reply would pass MaxBytes
+// Next is the first instance not covered, so the caller can ask again from there
+func (px *Paxos) FetchRecoveryRange(args *RecoverRangeArgs, reply *RecoverRangeReply) error {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	reply.Instances = make(map[int]Proposal)
+	size := 0
+	seq := args.From
+	for ; seq < args.To; seq++ {
 		instance := px.getInstance(seq)
-		if instance.Decided {
-			DPrintfPersist("\n\t%v: Sequence %v is already decided", px.me, seq)
+		if !instance.Decided {
 			continue
 		}
-		haveSeq := false
-		args := RecoverArgs{seq}
-		for !px.dead && !haveSeq {
-			for index, server := range px.peers {
-				if index == px.me {
-					continue
+		var buffer bytes.Buffer
+		if err := gob.NewEncoder(&buffer).Encode(instance); err != nil {
+			continue
+		}
+		if size > 0 && size+buffer.Len() > args.MaxBytes {
+			break
+		}
+		size += buffer.Len()
+		reply.Instances[seq] = instance
+	}
+	reply.Next = seq
+	reply.Err = false
+	return nil
+}
+
+// Fetch a snapshot reflecting at least instance atLeast from a peer, and keep it for FetchedSnapshot
+// Waiters on the instances it covers are woken, since they will only be learned from it
+// Gives up if no peer has a Snapshotter or none has caught up after a few tries
+// Returns the instance of the snapshot, or -1
+func (px *Paxos) fetchSnapshot(atLeast int) int {
+	for tries := 0; tries < 3 && !px.isdead(); tries++ {
+		missing := 0
+		for index, server := range px.peers {
+			if index == px.me {
+				continue
+			}
+			DPrintfPersist("\n\t%v: Asking %v for a snapshot", px.me, index)
+			var reply SnapshotReply
+			ok := px.callSnapshot(server, atLeast, &reply)
+			if ok && !reply.Err {
+				px.mu.Lock()
+				if reply.Seq > px.snapSeq {
+					px.snapSeq = reply.Seq
+					px.snapData = reply.Data
 				}
-				DPrintfPersist("\n\t%v: Asking %v for sequence %v", px.me, index, seq)
-				var reply RecoverReply
-				ok := px.callWrap(server, "Paxos.FetchRecovery", args, &reply)
-				if ok && !reply.Err {
-					instance := reply.Instance
-					if instance.Decided {
-						px.putInstance(seq, Proposal{instance.Prepare, instance.Accept, instance.Value, instance.Decided, instance.Accepted})
+				px.waitMu.Lock()
+				for seq, channel := range px.waiters {
+					if seq <= px.snapSeq {
+						close(channel)
+						delete(px.waiters, seq)
 					}
-					DPrintfPersist("\n\t\t%v: Got %v", px.me, px.instances[seq])
-					haveSeq = true
-					break
 				}
+				px.waitMu.Unlock()
+				px.mu.Unlock()
+				return reply.Seq
+			}
+			if ok && reply.Missing {
+				missing++
+			}
+		}
+		if missing == len(px.peers)-1 {
+			break
+		}
+		time.Sleep(recoveryRetryDelay)
+	}
+	DPrintfPersist("\n\t%v: No snapshot to start from", px.me)
+	return -1
+}
+
+// Ask server for a snapshot reflecting at least instance atLeast, a chunk at a time
+// The chunks are joined in reply; returns false if a call failed
+func (px *Paxos) callSnapshot(server string, atLeast int, reply *SnapshotReply) bool {
+	args := SnapshotArgs{AtLeast: atLeast}
+	var data []byte
+	for !px.isdead() {
+		var chunk SnapshotReply
+		if !px.callWrap(server, "Paxos.FetchSnapshot", args, &chunk) {
+			return false
+		}
+		data = append(data, chunk.Data...)
+		if chunk.Err || chunk.Complete {
+			*reply = chunk
+			reply.Data = data
+			return true
+		}
+		args.ID = chunk.ID
+		args.Offset = len(data)
+	}
+	return false
+}
+
+// Send a chunk of the application's snapshot to a peer that fell behind
+// The snapshot is taken for the first chunk and kept for the others, so
+// they all come from the same one; a caller that asks for the rest of a
+// snapshot that was replaced meanwhile gets an error, and starts over
+func (px *Paxos) FetchSnapshot(args *SnapshotArgs, reply *SnapshotReply) error {
+	px.mu.Lock()
+	snapshotter := px.snapshotter
+	px.mu.Unlock()
+	reply.Err = true
+	if snapshotter == nil {
+		reply.Missing = true
+		return nil
+	}
+	px.sendMu.Lock()
+	defer px.sendMu.Unlock()
+	if args.Offset > 0 {
+		if px.sentData == nil || px.sentID != args.ID || args.Offset > len(px.sentData) {
+			return nil
+		}
+	} else if px.sentData == nil || px.sentSeq < args.AtLeast {
+		// Taken outside px.mu, since the application may be waiting on paxos
+		seq, data := snapshotter.Snapshot()
+		if seq < args.AtLeast || data == nil {
+			return nil
+		}
+		px.sentID, px.sentSeq, px.sentData = rand.Int63(), seq, data
+	}
+	end := args.Offset + snapshotChunk
+	reply.Seq = px.sentSeq
+	reply.ID = px.sentID
+	if end >= len(px.sentData) {
+		reply.Data = px.sentData[args.Offset:]
+		reply.Complete = true
+		// Sent in full; the next peer that falls behind gets a newer one
+		px.sentData = nil
+	} else {
+		reply.Data = px.sentData[args.Offset:end]
+	}
+	reply.Err = false
+	return nil
+}
+
+//
+// the application found its own state damaged: fetch a snapshot
+// reflecting at least instance seq from a peer, to install instead.
+// keeps asking until a peer has one; returns -1, nil if killed.
+//
+func (px *Paxos) RequestSnapshot(seq int) (int, []byte) {
+	for !px.isdead() {
+		for index, server := range px.peers {
+			if index == px.me {
+				continue
+			}
+			var reply SnapshotReply
+			if px.callSnapshot(server, seq, &reply) && !reply.Err {
+				return reply.Seq, reply.Data
 			}
 		}
+		time.Sleep(recoveryRetryDelay)
+	}
+	return -1, nil
+}
+
+//
+// the application serves snapshots of its state through s,
+// so peers behind Min() can start from one instead of the forgotten instances.
+//
+func (px *Paxos) SetSnapshotter(s Snapshotter) {
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	px.snapshotter = s
+}
+
+//
+// the snapshot fetched when this peer was behind its peers' Min(), at
+// startup or once they answered that an instance it proposed was
+// forgotten, and the instance it reflects; the application should
+// install it before applying later instances. returns -1, nil if there
+// is none, or it was already taken.
+//
+func (px *Paxos) FetchedSnapshot() (int, []byte) {
+	for px.isrecovering() && !px.isdead() {
+		time.Sleep(10 * time.Millisecond)
 	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	if px.snapData == nil {
+		return -1, nil
+	}
+	seq, data := px.snapSeq, px.snapData
+	px.snapData = nil
+	return seq, data
 }
 
 func (px *Paxos) FetchRecovery(args *RecoverArgs, reply *RecoverReply) error {
 	px.mu.Lock()
 	defer px.mu.Unlock()
 	DPrintfPersist("\n%v: Got Fetch request", px.me)
-	reply.Done = make(map[int]int)
+	reply.Done = make(map[string]int)
 	if args.Seq == -1 {
 		done := px.getDone()
 		for peer, doneVal := range done {
 			reply.Done[peer] = doneVal
 		}
 		reply.MaxInstance = px.maxInstance
+		reply.Min = minDone(done, px.gcPeers()) + 1
+		reply.Initial = px.initial
+		reply.Changes = make(map[int]ChangeState)
+		for d, change := range px.changes {
+			if change.Decided {
+				reply.Changes[d] = change
+			}
+		}
 		DPrintfPersist("\n%v: sending %v", px.me, reply)
 	} else {
 		instance := px.getInstance(args.Seq)
@@ -1218,45 +2690,107 @@ func (px *Paxos) FetchRecovery(args *RecoverArgs, reply *RecoverReply) error {
 // the ports of all the paxos peers (including this one)
 // are in peers[]. this servers port is peers[me].
 //
-func Make(peers []string, me int, rpcs *rpc.Server, network bool, tag string) *Paxos {
+func Make(peers []string, me int, rpcs *rpc.Server, network bool, tag string, opts Options) *Paxos {
 	px := &Paxos{}
 
 	// Read memory options
-	px.persistent = persistent
-	px.recovery = recovery
-	px.dbUseCompression = dbUseCompression
-	px.dbUseCache = dbUseCache
-	px.dbCacheSize = dbCacheSize
-	px.writeToMemory = writeToMemory
+	px.persistent = opts.Persistent
+	px.recovery = opts.Recovery
+	px.dbOpts = opts.StorageOptions()
+	px.durability = opts.Durability
+	px.dbPending = make(map[string][]byte)
+	px.dbBatch = 1
+	px.dbCommitted = sync.NewCond(&px.dbLock)
+	px.dbDir = opts.DBDir("paxos")
+	px.writeToMemory = opts.WriteToMemory
+	px.enableLeader = opts.EnableLeader
+	voters := make([]string, 0, len(peers))
+	for _, peer := range peers {
+		if indexOf(opts.Learners, peer) < 0 {
+			voters = append(voters, peer)
+		}
+	}
+	for _, learner := range opts.Learners {
+		if indexOf(peers, learner) < 0 {
+			panic(fmt.Sprintf("paxos: learner %v is not a peer", learner))
+		}
+	}
+	px.learners = append([]string{}, opts.Learners...)
+	px.excludeAfter = opts.ExcludeAfter
+	quorums, err := newQuorums(voters, opts)
+	if err != nil {
+		panic(err)
+	}
+	px.quorums = quorums
+	px.startport = opts.StartPort
+	// Without a database, memory is the only place to keep state
+	if !px.persistent {
+		px.writeToMemory = true
+	}
 
 	// Network stuff
 	px.peers = peers
 	px.me = me
+	px.addr = peers[me]
+	px.initial = voters
+	px.changes = make(map[int]ChangeState)
+	gob.Register(PeerChange{})
+	px.snapSeq = -1
+	px.relay = opts.Relay
+	px.leaseDuration = opts.LeaseDuration
+	if px.leaseDuration <= 0 {
+		px.leaseDuration = time.Second
+	}
+	px.promised = noBallot
+	px.assigned = make(map[int]interface{})
+	px.maxAssigned = -1
+	px.routes = make(map[string]ReachRow)
+	if px.relay {
+		gob.Register(PrepareArgs{})
+		gob.Register(PrepareReply{})
+		gob.Register(AcceptArgs{})
+		gob.Register(AcceptReply{})
+		gob.Register(DecideArgs{})
+		gob.Register(DecideReply{})
+	}
 	px.network = network
+	tr := opts.Transport
+	if tr == nil {
+		tr = transport.New(transport.Network(network), opts.RPCTimeout)
+	}
+	px.transport = tr.Endpoint(peers[me])
 	px.reachable = make([]bool, len(px.peers))
 	for i := range px.peers {
 		px.reachable[i] = true
 	}
-	px.deaf = false
 
 	// Paxos state
 	px.instances = make(map[int]Proposal)
 	px.leader = make(map[int]int)
 	px.proposed = make(map[int]bool)
 	px.maxInstance = -1
-	px.done = make(map[int]int)
-	for i := 0; i < len(px.peers); i++ {
-		px.done[i] = -1
+	px.done = make(map[string]int)
+	for _, peer := range px.peers {
+		px.done[peer] = -1
 	}
-	px.doneChannels = make(map[int]chan bool)
+	px.waiters = make(map[int]chan bool)
+	px.excluded = make(map[string]bool)
+	px.heard = make(map[string]time.Time)
+	px.pinging = make(map[string]bool)
 
 	// Persistence stuff
-	waitChan := make(chan int)
-	go func() {
-		waitChan <- 1
-		px.startup(tag)
-	}()
-	<-waitChan
+	// The database is loaded before requests are served, so none sees a peer without its promises
+	atomic.StoreInt32(&px.recovering, 1)
+	DPrintfPersist("\n%v Marked recovery true", px.me)
+	px.damaged = make(map[int]bool)
+	px.dbInit(tag)
+	// Peers' messages raise our own Done value too, so read it before any arrive
+	local, ok := px.copyDone()[px.addr]
+	if !ok {
+		local = -1
+	}
+	go px.startup(local)
+	go px.repair()
 
 	if rpcs != nil {
 		// caller will create socket &c
@@ -1278,71 +2812,125 @@ func Make(peers []string, me int, rpcs *rpc.Server, network bool, tag string) *P
 		}
 
 		// prepare to receive connections from clients.
-		// change "unix" to "tcp" to use over a network.
+		// over a network, every peer listens on the start port
+		addr := peers[me]
 		if px.network {
-			l, e := net.Listen("tcp", ":"+strconv.Itoa(startport))
-			if e != nil {
-				log.Fatal("listen error: ", e)
-			}
-			px.l = l
-		} else {
-			os.Remove(peers[me]) // only needed for "unix"
-			l, e := net.Listen("unix", peers[me])
-			if e != nil {
-				log.Fatal("listen error: ", e)
-			}
-			px.l = l
-		}
-
-		// please do not change any of the following code,
-		// or do anything to subvert it.
-
-		// create a thread to accept RPC connections
-		go func() {
-			for px.dead == false {
-				conn, err := px.l.Accept()
-				if err == nil && px.dead == false {
-					if px.deaf || (px.unreliable && (rand.Int63()%1000) < 100) {
-						// discard the request.
-						conn.Close()
-					} else if px.unreliable && (rand.Int63()%1000) < 200 {
-						// process the request but force discard of reply.
-						if !px.network {
-							c1 := conn.(*net.UnixConn)
-							f, _ := c1.File()
-							err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-							if err != nil {
-								fmt.Printf("shutdown: %v\n", err)
-							}
-
-						} else {
-							//respond to imaginary port?
-							c1 := conn.(*net.TCPConn)
-							f, _ := c1.File()
-							err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-							if err != nil {
-								fmt.Printf("shutdown: %v\n", err)
-							}
-						}
-						px.rpcCount++
-						go rpcs.ServeConn(conn)
-					} else {
-						px.rpcCount++
-						go rpcs.ServeConn(conn)
-					}
-				} else if err == nil {
-					conn.Close()
-				}
-				if err != nil && px.dead == false {
-					fmt.Printf("Paxos(%v) accept: %v\n", me, err.Error())
-				}
-			}
-		}()
+			addr = ":" + strconv.Itoa(px.startport)
+		}
+		// unreliable/deaf are applied to each request by px.fault
+		l, e := px.transport.Listen(addr, rpcs, px.fault)
+		if e != nil {
+			log.Fatal("listen error: ", e)
+		}
+		// A request that crashes the peer may have killed it already
+		px.mu.Lock()
+		px.listener = l
+		px.mu.Unlock()
+		if px.isdead() {
+			l.Close()
+		}
 	}
 
+	if px.persistent {
+		go px.commitLoop()
+	}
+	if px.relay {
+		go px.gossip()
+	}
+	if px.multi() {
+		go px.leaderLoop()
+	}
+	if px.excludeAfter > 0 {
+		go px.watchStragglers()
+	}
 	return px
 }
 
+// Decide what happens to an incoming request, to simulate an unreliable network
+func (px *Paxos) fault() transport.Fault {
+	if px.isdeaf() || (px.isunreliable() && (rand.Int63()%1000) < 100) {
+		// discard the request.
+		return transport.DropRequest
+	} else if px.isunreliable() && (rand.Int63()%1000) < 200 {
+		// process the request but force discard of reply.
+		atomic.AddInt32(&px.rpcCount, 1)
+		return transport.DropReply
+	}
+	atomic.AddInt32(&px.rpcCount, 1)
+	return transport.Deliver
+}
+
+func (px *Paxos) isdead() bool {
+	return atomic.LoadInt32(&px.dead) != 0
+}
+
+func (px *Paxos) isrecovering() bool {
+	return atomic.LoadInt32(&px.recovering) != 0
+}
+
+// Drop a share of incoming requests and replies, for testing
+func (px *Paxos) setunreliable(what bool) {
+	if what {
+		atomic.StoreInt32(&px.unreliable, 1)
+	} else {
+		atomic.StoreInt32(&px.unreliable, 0)
+	}
+}
+
+func (px *Paxos) isunreliable() bool {
+	return atomic.LoadInt32(&px.unreliable) != 0
+}
+
+// Drop every incoming request, for testing
+func (px *Paxos) setdeaf(what bool) {
+	if what {
+		atomic.StoreInt32(&px.deaf, 1)
+	} else {
+		atomic.StoreInt32(&px.deaf, 0)
+	}
+}
+
+func (px *Paxos) isdeaf() bool {
+	return atomic.LoadInt32(&px.deaf) != 0
+}
+
+// Crash once a request's writes are made whenever crashAfter says so, for testing
+func (px *Paxos) setCrashAfter(crashAfter func(method string) bool) {
+	px.crashMu.Lock()
+	defer px.crashMu.Unlock()
+	px.crashAfter = crashAfter
+}
+
+func (px *Paxos) getCrashAfter() func(method string) bool {
+	px.crashMu.Lock()
+	defer px.crashMu.Unlock()
+	return px.crashAfter
+}
+
+// Number of requests handled so far
+func (px *Paxos) getRPCCount() int {
+	return int(atomic.LoadInt32(&px.rpcCount))
+}
+
+// Whether calls to srv get through, for partition tests
+func (px *Paxos) canReach(srv string) bool {
+	px.reachMu.Lock()
+	defer px.reachMu.Unlock()
+	for i, p := range px.peers {
+		if p == srv && !px.reachable[i] {
+			return false
+		}
+	}
+	return true
+}
+
+// Let calls to peers[i] through or not, for partition tests
+func (px *Paxos) setReachable(i int, reachable bool) {
+	px.reachMu.Lock()
+	defer px.reachMu.Unlock()
+	px.reachable[i] = reachable
+}
+
 func enableLog() {
 	log.SetOutput(os.Stderr)
 }
@@ -0,0 +1,229 @@
+package paxos
+
+//
+// Quorums for the two phases of Paxos (Flexible Paxos).
+//
+// Phase 1 (Prepare, leader elections) and phase 2 (Accept, lease
+// renewals) need not use majorities: all Paxos needs is that every
+// phase 1 quorum shares a peer with every phase 2 quorum. Make refuses
+// options that don't guarantee it.
+//
+// Quorums are counted by weight: each peer's vote weighs
+// Options.Weights[peer] (1 if missing), and any peers whose weights add
+// up to Q1 (or Q2) are a quorum, so with N the total weight, Q1 + Q2 > N
+// must hold. Or they are listed as explicit sets (Q1Sets, Q2Sets), in
+// which case only a listed set, or a superset of one, is a quorum.
+//
+// The sizes and sets are checked against the peers given to Make, and
+// only apply while the peers are the same; after a PeerChange to other
+// peers, a quorum is more than half the weight of the new peers.
+//
+
+import "fmt"
+import "sort"
+
+type phase int
+
+const (
+	phase1 phase = 1
+	phase2 phase = 2
+)
+
+type quorums struct {
+	peers   []string       // Peers the sizes and sets were checked against, sorted
+	weights map[string]int // Weight of each peer's vote, where it isn't 1
+	size    [3]int         // Weight each phase needs (when it has no sets)
+	sets    [3][][]string  // Explicit quorums of each phase, if any
+}
+
+// Check the quorum options for the given peers, filling in the sizes left at 0
+func newQuorums(peers []string, opts Options) (*quorums, error) {
+	q := &quorums{}
+	q.peers = append([]string{}, peers...)
+	sort.Strings(q.peers)
+	q.weights = make(map[string]int)
+	for peer, w := range opts.Weights {
+		if w < 0 {
+			return nil, fmt.Errorf("paxos: negative weight %v for %v", w, peer)
+		}
+		q.weights[peer] = w
+	}
+	total := q.total(peers)
+	if total <= 0 {
+		return nil, fmt.Errorf("paxos: peers %v have no weight", peers)
+	}
+
+	q.size[phase1] = opts.Q1
+	q.size[phase2] = opts.Q2
+	q.sets[phase1] = opts.Q1Sets
+	q.sets[phase2] = opts.Q2Sets
+	for _, ph := range []phase{phase1, phase2} {
+		if q.size[ph] < 0 || q.size[ph] > total {
+			return nil, fmt.Errorf("paxos: Q%v = %v is out of range for total weight %v", ph, q.size[ph], total)
+		}
+		if len(q.sets[ph]) > 0 && q.size[ph] != 0 {
+			return nil, fmt.Errorf("paxos: both Q%v and Q%vSets are set", ph, ph)
+		}
+		for _, set := range q.sets[ph] {
+			if len(set) == 0 {
+				return nil, fmt.Errorf("paxos: empty set in Q%vSets", ph)
+			}
+			for _, peer := range set {
+				if indexOf(peers, peer) < 0 {
+					return nil, fmt.Errorf("paxos: %v in Q%vSets is not a peer", peer, ph)
+				}
+			}
+		}
+	}
+
+	// A size left at 0 is the smallest one that meets every quorum of the other phase,
+	// or a majority when both are
+	unset := func(ph phase) bool {
+		return q.size[ph] == 0 && len(q.sets[ph]) == 0
+	}
+	majority := unset(phase1) && unset(phase2)
+	for _, ph := range []phase{phase1, phase2} {
+		other := 3 - ph
+		if !unset(ph) {
+			continue
+		}
+		if majority {
+			q.size[ph] = total/2 + 1
+		} else if len(q.sets[other]) > 0 {
+			for _, set := range q.sets[other] {
+				if rest := q.total(q.without(set)); rest+1 > q.size[ph] {
+					q.size[ph] = rest + 1
+				}
+			}
+		} else {
+			q.size[ph] = total - q.size[other] + 1
+		}
+	}
+
+	if err := q.check(total); err != nil {
+		return nil, err
+	}
+	return q, nil
+}
+
+// Whether every phase 1 quorum shares a peer with every phase 2 quorum
+func (q *quorums) check(total int) error {
+	sets1, sets2 := q.sets[phase1], q.sets[phase2]
+	switch {
+	case len(sets1) > 0 && len(sets2) > 0:
+		for _, s1 := range sets1 {
+			for _, s2 := range sets2 {
+				if !intersect(s1, s2) {
+					return fmt.Errorf("paxos: quorums %v and %v share no peer", s1, s2)
+				}
+			}
+		}
+	case len(sets1) > 0 || len(sets2) > 0:
+		// Some phase's quorum by weight fits in the peers outside a set unless they weigh too little
+		sets, ph := sets1, phase2
+		if len(sets) == 0 {
+			sets, ph = sets2, phase1
+		}
+		for _, set := range sets {
+			if rest := q.total(q.without(set)); rest >= q.size[ph] {
+				return fmt.Errorf("paxos: peers outside %v weigh %v, enough for Q%v = %v", set, rest, ph, q.size[ph])
+			}
+		}
+	default:
+		if q.size[phase1]+q.size[phase2] <= total {
+			return fmt.Errorf("paxos: Q1 + Q2 = %v must be more than the total weight %v",
+				q.size[phase1]+q.size[phase2], total)
+		}
+	}
+	return nil
+}
+
+// Whether the given members of peers are a quorum for a phase
+func (q *quorums) has(ph phase, peers []string, members map[string]bool) bool {
+	if !q.covers(peers) {
+		return 2*q.total(inside(peers, members)) > q.total(peers)
+	}
+	if len(q.sets[ph]) > 0 {
+		for _, set := range q.sets[ph] {
+			all := true
+			for _, peer := range set {
+				all = all && members[peer]
+			}
+			if all {
+				return true
+			}
+		}
+		return false
+	}
+	return q.total(inside(peers, members)) >= q.size[ph]
+}
+
+// Whether peers can still form a quorum for a phase without the given ones
+func (q *quorums) possible(ph phase, peers []string, refused map[string]bool) bool {
+	left := make(map[string]bool)
+	for _, peer := range peers {
+		if !refused[peer] {
+			left[peer] = true
+		}
+	}
+	return q.has(ph, peers, left)
+}
+
+// The peers that are members
+func inside(peers []string, members map[string]bool) []string {
+	var in []string
+	for _, peer := range peers {
+		if members[peer] {
+			in = append(in, peer)
+		}
+	}
+	return in
+}
+
+func (q *quorums) weight(peer string) int {
+	if w, ok := q.weights[peer]; ok {
+		return w
+	}
+	return 1
+}
+
+func (q *quorums) total(peers []string) int {
+	total := 0
+	for _, peer := range peers {
+		total += q.weight(peer)
+	}
+	return total
+}
+
+// The checked peers that aren't in set
+func (q *quorums) without(set []string) []string {
+	var rest []string
+	for _, peer := range q.peers {
+		if indexOf(set, peer) < 0 {
+			rest = append(rest, peer)
+		}
+	}
+	return rest
+}
+
+// Whether peers are the ones the sizes and sets were checked against
+func (q *quorums) covers(peers []string) bool {
+	if len(peers) != len(q.peers) {
+		return false
+	}
+	for _, peer := range peers {
+		if i := sort.SearchStrings(q.peers, peer); i == len(q.peers) || q.peers[i] != peer {
+			return false
+		}
+	}
+	return true
+}
+
+func intersect(a []string, b []string) bool {
+	for _, peer := range a {
+		if indexOf(b, peer) >= 0 {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,140 @@
+package paxos
+
+//
+// Letting Min() move past stragglers.
+//
+// Min() waits for every peer's Done(), so one dead peer keeps every
+// other peer from forgetting anything. An excluded peer is passed over
+// instead, until its Done() catches up with what the others forgot:
+//
+// px.Exclude(peer string) -- let Min() pass peer, such as one that is down
+// Options.ExcludeAfter -- exclude peers that haven't answered for this long,
+//                         dead or just cut off, as long as a Snapshotter
+//                         can serve them later
+//
+// Acceptors refuse instances they forgot, so a straggler can't get a
+// different value chosen for one. When it proposes one, it fetches a
+// snapshot instead, and its Wait() returns for the instances the snapshot
+// covers; a restarted straggler fetches one at startup. Either way the
+// application installs it from FetchedSnapshot().
+//
+
+import "time"
+
+type PingArgs struct {
+	Done map[string]int
+}
+
+type PingReply struct {
+	Done map[string]int
+}
+
+// Let Min() pass peer until it catches up
+func (px *Paxos) Exclude(peer string) {
+	if peer == px.addr {
+		return
+	}
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	DPrintf("\n%v: Excluding %v from Min()", px.me, peer)
+	px.excluded[peer] = true
+}
+
+// Peers whose Done() values Min() waits for; px.mu must be held
+// A learner waits for its own application too
+func (px *Paxos) gcPeers() []string {
+	var peers []string
+	for _, peer := range px.latestPeers() {
+		if !px.excluded[peer] {
+			peers = append(peers, peer)
+		}
+	}
+	if indexOf(peers, px.addr) < 0 {
+		peers = append(peers, px.addr)
+	}
+	return peers
+}
+
+// Exclude peers that have been silent too long, and take back excluded peers
+// that caught up, so that Min() never goes back
+func (px *Paxos) checkStragglers() {
+	min := px.Min()
+	now := time.Now()
+	px.mu.Lock()
+	defer px.mu.Unlock()
+	peers := px.latestPeers()
+
+	silent := make(map[string]bool)
+	px.heardMu.Lock()
+	for _, peer := range peers {
+		if at, ok := px.heard[peer]; !ok {
+			// Peers get ExcludeAfter to answer from when we first count them
+			px.heard[peer] = now
+		} else if now.Sub(at) > px.excludeAfter {
+			silent[peer] = true
+		}
+	}
+	px.heardMu.Unlock()
+
+	done := px.getDone()
+	for _, peer := range peers {
+		if peer == px.addr {
+			continue
+		}
+		if px.excluded[peer] {
+			if v, ok := done[peer]; ok && v+1 >= min {
+				DPrintf("\n%v: %v caught up to %v, counting it in Min() again", px.me, peer, min)
+				delete(px.excluded, peer)
+			}
+		} else if px.excludeAfter > 0 && px.snapshotter != nil && silent[peer] {
+			DPrintf("\n%v: Excluding %v from Min(), it has been silent too long", px.me, peer)
+			px.excluded[peer] = true
+		}
+	}
+}
+
+// Note that peer answered a call
+func (px *Paxos) heardFrom(peer string) {
+	px.heardMu.Lock()
+	defer px.heardMu.Unlock()
+	px.heard[peer] = time.Now()
+}
+
+// Ping the peers regularly, so silent ones stand out even when nothing is proposed
+func (px *Paxos) watchStragglers() {
+	for !px.isdead() {
+		time.Sleep(px.excludeAfter / 4)
+		px.mu.Lock()
+		peers := append([]string{}, px.latestPeers()...)
+		px.mu.Unlock()
+		for _, peer := range peers {
+			if peer == px.addr {
+				continue
+			}
+			px.heardMu.Lock()
+			busy := px.pinging[peer]
+			px.pinging[peer] = true
+			px.heardMu.Unlock()
+			if busy {
+				continue
+			}
+			go func(peer string) {
+				args := &PingArgs{px.copyDone()}
+				var reply PingReply
+				if px.callWrap(peer, "Paxos.Ping", args, &reply) {
+					px.recordDones(reply.Done)
+				}
+				px.heardMu.Lock()
+				delete(px.pinging, peer)
+				px.heardMu.Unlock()
+			}(peer)
+		}
+	}
+}
+
+// Answer a ping, trading done values
+func (px *Paxos) Ping(args *PingArgs, reply *PingReply) error {
+	px.recordDones(args.Done)
+	reply.Done = px.copyDone()
+	return nil
+}
@@ -1,13 +1,20 @@
 package paxos
 
 import "testing"
+import "bytes"
 import "runtime"
 import "strconv"
 import "os"
+import "path/filepath"
 import "time"
 import "fmt"
 import "math/rand"
 import "sync"
+import "sync/atomic"
+import "net"
+import "errors"
+import "storage"
+import "transport"
 
 const onlyBenchmarks = false
 const runOldTests = true
@@ -25,6 +32,13 @@ func makePort(tag string, host int) string {
 	return s
 }
 
+// Options for a test's peers, with databases under a fresh temporary directory
+func testOptions(test testing.TB) Options {
+	opts := DefaultOptions()
+	opts.DataDir = test.TempDir()
+	return opts
+}
+
 // Check how many of the given Paxos servers are decided on the given sequence
 // Fatally errors if servers are decided on conflicting values
 func numDecided(test interface{}, paxosServers []*Paxos, seq int) int {
@@ -81,27 +95,11 @@ func waitForDecisionMajority(test interface{}, paxosServers []*Paxos, seq int) {
 }
 
 // Wait for all servers to be decided
-// Uses channels, so will learn of decisions immediately (no sleeping)
+// Uses Wait, so will learn of decisions immediately (no sleeping)
 // Useful for benchmarking since won't add sleep time
 func waitForDecisionChannels(test interface{}, paxosServers []*Paxos, seq int) {
-	// Create buffered channel for responses
-	doneChannel := make(chan bool, len(paxosServers))
-	numFinished := 0
-
-	// Give the channel to Paxos servers
 	for i := 0; i < len(paxosServers); i++ {
-		if finished, _ := paxosServers[i].Status(seq); finished {
-			numFinished++
-		} else {
-			paxosServers[i].SetDoneChannel(seq, doneChannel)
-		}
-	}
-	// Wait for decision
-	tStart := time.Now()
-	for numFinished < len(paxosServers) {
-		<-doneChannel
-		numFinished++
-		if time.Since(tStart).Seconds() > 10 {
+		if decided, _ := paxosServers[i].Wait(seq, 10*time.Second); !decided {
 			switch test.(type) {
 			case *testing.T:
 				test.(*testing.T).Fatalf("\ntimed out waiting for decision")
@@ -110,7 +108,6 @@ func waitForDecisionChannels(test interface{}, paxosServers []*Paxos, seq int) {
 			}
 		}
 	}
-	close(doneChannel)
 }
 
 // Check that there are not too many decided servers
@@ -134,6 +131,7 @@ func cleanup(paxosServers []*Paxos) {
 // Test the Paxos agreement speed
 // Waits for all servers to hear about agreements
 func BenchmarkAgreementSpeed_1Instance_1Value_1Proposer(benchmark *testing.B) {
+	opts := testOptions(benchmark)
 
 	//fmt.Printf("\nBenchmark agreement speed: single instance, single proposer, single proposal ...")
 
@@ -146,7 +144,7 @@ func BenchmarkAgreementSpeed_1Instance_1Value_1Proposer(benchmark *testing.B) {
 		paxosPorts[i] = makePort("time", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	benchmark.ResetTimer()
@@ -159,9 +157,102 @@ func BenchmarkAgreementSpeed_1Instance_1Value_1Proposer(benchmark *testing.B) {
 	//fmt.Printf("\n\tLatency: %v us per instance", int(duration.Nanoseconds()/1000)/benchmark.N)
 }
 
+// Test the Paxos agreement speed at each durability
+// Proposals are started ten at a time, so their writes can share batches
+func BenchmarkAcceptorWrites(benchmark *testing.B) {
+	for _, durability := range []Durability{DurabilityNone, DurabilityBuffered, DurabilitySync} {
+		name := durability.String()
+		benchmark.Run(name, func(benchmark *testing.B) {
+			opts := testOptions(benchmark)
+			opts.Transport = transport.NewMemory(0)
+			opts.Durability = durability
+
+			const numServers = 3
+			var paxosServers []*Paxos = make([]*Paxos, numServers)
+			defer cleanup(paxosServers)
+			paxosPorts := makeMemoryPorts("writes-"+name, numServers)
+			for i := 0; i < numServers; i++ {
+				paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+			}
+
+			benchmark.ResetTimer()
+			for i := 0; i < benchmark.N; i += 10 {
+				for seq := i; seq < i+10 && seq < benchmark.N; seq++ {
+					paxosServers[0].Start(seq, seq)
+				}
+				for seq := i; seq < i+10 && seq < benchmark.N; seq++ {
+					paxosServers[0].Wait(seq, 0)
+				}
+			}
+		})
+	}
+}
+
+// Listen on the given port but never answer, like a peer that has hung
+// Returns a function that closes the listener and any connections it is holding
+func makeUnresponsivePeer(port string) func() {
+	os.Remove(port)
+	l, err := net.Listen("unix", port)
+	if err != nil {
+		panic(fmt.Sprintf("listen error: %v", err))
+	}
+	var mu sync.Mutex
+	var conns []net.Conn
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			mu.Lock()
+			conns = append(conns, conn)
+			mu.Unlock()
+		}
+	}()
+	return func() {
+		l.Close()
+		mu.Lock()
+		for _, conn := range conns {
+			conn.Close()
+		}
+		mu.Unlock()
+	}
+}
+
+// Test the Paxos agreement speed when one peer never responds
+// Waits for the responsive servers to hear about agreements
+func BenchmarkAgreementSpeed_1Instance_1Value_1Proposer_1Unresponsive(benchmark *testing.B) {
+	opts := testOptions(benchmark)
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers-1)
+	var paxosPorts []string = make([]string, numServers)
+	defer cleanup(paxosServers)
+
+	for i := 0; i < numServers; i++ {
+		paxosPorts[i] = makePort("unresponsive", i)
+	}
+	closePeer := makeUnresponsivePeer(paxosPorts[numServers-1])
+	defer closePeer()
+	for i := 0; i < numServers-1; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+	}
+	// Startup recovery waits out an RPC timeout on the hung peer; only agreement is timed
+	for i := 0; i < numServers-1; i++ {
+		paxosServers[i].Max()
+	}
+
+	benchmark.ResetTimer()
+	for i := 0; i < benchmark.N; i++ {
+		paxosServers[0].Start(i, "x")
+		waitForDecisionChannels(benchmark, paxosServers, i)
+	}
+}
+
 // Test the Paxos agreement speed
 // Waits for all servers to hear about agreements
 func BenchmarkAgreementSpeed_1Instance_5Value_1Proposer(benchmark *testing.B) {
+	opts := testOptions(benchmark)
 
 	//fmt.Printf("\nBenchmark agreement speed: single instance, single proposer, multiple proposals ...")
 
@@ -174,7 +265,7 @@ func BenchmarkAgreementSpeed_1Instance_5Value_1Proposer(benchmark *testing.B) {
 		paxosPorts[i] = makePort("time", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	numValues := 5
@@ -193,6 +284,7 @@ func BenchmarkAgreementSpeed_1Instance_5Value_1Proposer(benchmark *testing.B) {
 // Test the Paxos agreement speed
 // Waits for all servers to hear about agreements
 func BenchmarkAgreementSpeed_1Instance_5Value_3Proposer(benchmark *testing.B) {
+	opts := testOptions(benchmark)
 
 	//fmt.Printf("\nBenchmark agreement speed: single instance, multiple proposers, multiple proposals ...")
 
@@ -205,7 +297,7 @@ func BenchmarkAgreementSpeed_1Instance_5Value_3Proposer(benchmark *testing.B) {
 		paxosPorts[i] = makePort("time", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	numValues := 5
@@ -224,6 +316,7 @@ func BenchmarkAgreementSpeed_1Instance_5Value_3Proposer(benchmark *testing.B) {
 // Test the Paxos agreement speed
 // Waits for all servers to hear about agreements
 func BenchmarkAgreementSpeed_5Instance_5Value_3Proposer(benchmark *testing.B) {
+	opts := testOptions(benchmark)
 
 	//fmt.Printf("\nBenchmark agreement speed: multiple instances, multiple proposers, multiple proposals ...")
 
@@ -236,7 +329,7 @@ func BenchmarkAgreementSpeed_5Instance_5Value_3Proposer(benchmark *testing.B) {
 		paxosPorts[i] = makePort("time", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	numInstances := 5
@@ -257,39 +350,45 @@ func BenchmarkAgreementSpeed_5Instance_5Value_3Proposer(benchmark *testing.B) {
 	//fmt.Printf("\n\tLatency: %v us per instance", int(duration.Nanoseconds()/1000)/benchmark.N/numInstances)
 }
 
+// The default directory for the databases stays put when the working directory changes
+func TestDefaultDataDir(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	dir := DefaultOptions().DataDir
+	if !filepath.IsAbs(dir) || filepath.Base(dir) != "persist" {
+		test.Fatalf("Default data directory is %v, expected an absolute path ending in persist", dir)
+	}
+	test.Chdir(test.TempDir())
+	if moved := DefaultOptions().DataDir; moved != dir {
+		test.Fatalf("Default data directory moved from %v to %v with the working directory", dir, moved)
+	}
+}
+
 // Test that instances are not forgotten when servers are killed and restarted
 func TestFilePersistenceBasic(test *testing.T) {
 	if onlyBenchmarks || !runNewTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	tag := "persistence"
 	const numServers = 5
 	var paxosServers []*Paxos = make([]*Paxos, numServers)
 	defer cleanup(paxosServers)
-	defer cleanPrivatePorts(tag, numServers)
 
-	// Create ports for servers
-	var paxosPorts [][]string = make([][]string, numServers)
+	// Put the servers on a simulated network so they can be partitioned
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	paxosPorts := makeMemoryPorts(tag, numServers)
 	for i := 0; i < numServers; i++ {
-		paxosPorts[i] = make([]string, numServers)
-		for j := 0; j < numServers; j++ {
-			if j == i {
-				// Create actual server port for myself
-				paxosPorts[i][i] = makePort(tag, i)
-			} else {
-				// Create port that does nothing until a hard link is established by calling partitionServer()
-				paxosPorts[i][j] = makePrivatePort(tag, i, j)
-			}
-		}
-		paxosServers[i] = Make(paxosPorts[i], i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
-	defer partitionServers(test, tag, numServers, []int{}, []int{}, []int{})
 
 	fmt.Printf("\nTest Persistence, single failure, save disk ...")
 	// Put all servers in the same partition
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 	// Get agreement on an instance
 	paxosServers[0].Start(0, 0)
 	waitForDecision(test, paxosServers, 0, numServers)
@@ -300,8 +399,8 @@ func TestFilePersistenceBasic(test *testing.T) {
 	paxosServers[1].Start(1, 1)
 	waitForDecisionMajority(test, paxosServers, 1)
 	// Bring server back
-	paxosServers[0] = Make(paxosPorts[0], 0, nil, false, "")
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 	// See if restarted server remembers first instance
 	decided, value := paxosServers[0].Status(0)
 	_, trueValue := paxosServers[1].Status(0)
@@ -317,34 +416,25 @@ func TestFilePersistencePartition(test *testing.T) {
 	if onlyBenchmarks || !runNewTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	tag := "persistencePartition"
 	const numServers = 5
 	var paxosServers []*Paxos = make([]*Paxos, numServers)
 	defer cleanup(paxosServers)
-	defer cleanPrivatePorts(tag, numServers)
 
-	// Create ports for servers
-	var paxosPorts [][]string = make([][]string, numServers)
+	// Put the servers on a simulated network so they can be partitioned
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	paxosPorts := makeMemoryPorts(tag, numServers)
 	for i := 0; i < numServers; i++ {
-		paxosPorts[i] = make([]string, numServers)
-		for j := 0; j < numServers; j++ {
-			if j == i {
-				// Create actual server port for myself
-				paxosPorts[i][i] = makePort(tag, i)
-			} else {
-				// Create port that does nothing until a hard link is established by calling partitionServer()
-				paxosPorts[i][j] = makePrivatePort(tag, i, j)
-			}
-		}
-		paxosServers[i] = Make(paxosPorts[i], i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
-	defer partitionServers(test, tag, numServers, []int{}, []int{}, []int{})
 
 	fmt.Printf("\nTest Persistence, partition ...")
 	// Partition servers
-	partitionServers(test, tag, numServers, []int{0, 1, 2}, []int{3, 4}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2}, []int{3, 4}, []int{})
 	// Get agreement in the majority partition
 	paxosServers[0].Start(0, 0)
 	waitForDecisionMajority(test, paxosServers, 0)
@@ -358,11 +448,11 @@ func TestFilePersistencePartition(test *testing.T) {
 	paxosServers[3].Start(0, 1)
 	time.Sleep(100 * time.Millisecond)
 	// Bring majority back
-	paxosServers[0] = Make(paxosPorts[0], 0, nil, false, "")
-	paxosServers[1] = Make(paxosPorts[1], 1, nil, false, "")
-	paxosServers[2] = Make(paxosPorts[2], 2, nil, false, "")
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
+	paxosServers[1] = Make(paxosPorts, 1, nil, false, "", opts)
+	paxosServers[2] = Make(paxosPorts, 2, nil, false, "", opts)
 	// Check that old value is forced when partition heals
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 	waitForDecision(test, paxosServers, 0, numServers)
 	_, newValue := paxosServers[3].Status(0)
 	if decidedValue != newValue {
@@ -376,33 +466,24 @@ func TestFilePersistenceAllRestart(test *testing.T) {
 	if onlyBenchmarks || !runNewTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	tag := "persistenceAll"
 	const numServers = 5
 	var paxosServers []*Paxos = make([]*Paxos, numServers)
 	defer cleanup(paxosServers)
-	defer cleanPrivatePorts(tag, numServers)
 
-	// Create ports for servers
-	var paxosPorts [][]string = make([][]string, numServers)
+	// Put the servers on a simulated network so they can be partitioned
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	paxosPorts := makeMemoryPorts(tag, numServers)
 	for i := 0; i < numServers; i++ {
-		paxosPorts[i] = make([]string, numServers)
-		for j := 0; j < numServers; j++ {
-			if j == i {
-				// Create actual server port for myself
-				paxosPorts[i][i] = makePort(tag, i)
-			} else {
-				// Create port that does nothing until a hard link is established by calling partitionServer()
-				paxosPorts[i][j] = makePrivatePort(tag, i, j)
-			}
-		}
-		paxosServers[i] = Make(paxosPorts[i], i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
-	defer partitionServers(test, tag, numServers, []int{}, []int{}, []int{})
 
 	fmt.Printf("\nTest Persistence, all servers restart ...")
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 
 	// Get agreement on instance
 	paxosServers[0].Start(0, 0)
@@ -430,7 +511,7 @@ func TestFilePersistenceAllRestart(test *testing.T) {
 	waitChan := make(chan int)
 	for i := 0; i < numServers; i++ {
 		go func(index int) {
-			paxosServers[index] = Make(paxosPorts[index], index, nil, false, "")
+			paxosServers[index] = Make(paxosPorts, index, nil, false, "", opts)
 			waitChan <- 1
 			min := paxosServers[index].Min()
 			max := paxosServers[index].Max()
@@ -447,7 +528,7 @@ func TestFilePersistenceAllRestart(test *testing.T) {
 		}(i)
 		<-waitChan
 	}
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 	time.Sleep(1 * time.Second)
 	// Call Done on server that was left out before
 	paxosServers[0].Done(0)
@@ -475,34 +556,25 @@ func TestFilePersistenceRecovery(test *testing.T) {
 	if onlyBenchmarks || !runNewTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	tag := "persistence"
 	const numServers = 5
 	var paxosServers []*Paxos = make([]*Paxos, numServers)
 	defer cleanup(paxosServers)
-	defer cleanPrivatePorts(tag, numServers)
 
-	// Create ports for servers
-	var paxosPorts [][]string = make([][]string, numServers)
+	// Put the servers on a simulated network so they can be partitioned
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	paxosPorts := makeMemoryPorts(tag, numServers)
 	for i := 0; i < numServers; i++ {
-		paxosPorts[i] = make([]string, numServers)
-		for j := 0; j < numServers; j++ {
-			if j == i {
-				// Create actual server port for myself
-				paxosPorts[i][i] = makePort(tag, i)
-			} else {
-				// Create port that does nothing until a hard link is established by calling partitionServer()
-				paxosPorts[i][j] = makePrivatePort(tag, i, j)
-			}
-		}
-		paxosServers[i] = Make(paxosPorts[i], i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
-	defer partitionServers(test, tag, numServers, []int{}, []int{}, []int{})
 
 	fmt.Printf("\nTest Persistence Recovery, single failure, poke restarted server ...")
 	// Put all servers in the same partition
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 	// Get agreement on an instance (only wait for majority)
 	paxosServers[0].Start(0, 0)
 	waitForDecision(test, paxosServers, 0, numServers-1)
@@ -513,8 +585,8 @@ func TestFilePersistenceRecovery(test *testing.T) {
 	paxosServers[1].Start(1, 1)
 	waitForDecision(test, paxosServers, 1, numServers-1)
 	// Bring server back
-	paxosServers[0] = Make(paxosPorts[0], 0, nil, false, "")
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 	// Get agreement on first instance again (poke restarted server)
 	paxosServers[0].Start(0, 1)
 	waitForDecision(test, paxosServers, 0, numServers)
@@ -537,8 +609,8 @@ func TestFilePersistenceRecovery(test *testing.T) {
 	paxosServers[1].Start(2, 2)
 	waitForDecision(test, paxosServers, 2, numServers-1)
 	// Bring server back
-	paxosServers[0] = Make(paxosPorts[0], 0, nil, false, "")
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 	// See if restarted server knows about missed instance
 	decided, value = paxosServers[0].Status(2)
 	_, trueValue = paxosServers[1].Status(2)
@@ -553,6 +625,7 @@ func TestFileBasic(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	const numServers = 3
@@ -565,7 +638,7 @@ func TestFileBasic(test *testing.T) {
 		paxosPorts[i] = makePort("basic", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	fmt.Printf("\nTest: Single proposer ...")
@@ -613,10 +686,61 @@ func TestFileBasic(test *testing.T) {
 	fmt.Printf("\n\tPassed")
 }
 
+// Run a persistent group and an in-memory group side by side
+// Options are per-instance, so both modes can coexist in one process
+func TestFileOptions(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 3
+	var diskServers []*Paxos = make([]*Paxos, numServers)
+	var memServers []*Paxos = make([]*Paxos, numServers)
+	var diskPorts []string = make([]string, numServers)
+	var memPorts []string = make([]string, numServers)
+	defer cleanup(diskServers)
+	defer cleanup(memServers)
+
+	memOpts := opts
+	memOpts.Persistent = false
+	memOpts.Recovery = false
+
+	for i := 0; i < numServers; i++ {
+		diskPorts[i] = makePort("optsdisk", i)
+		memPorts[i] = makePort("optsmem", i)
+	}
+	for i := 0; i < numServers; i++ {
+		diskServers[i] = Make(diskPorts, i, nil, false, "optsdisk", opts)
+		memServers[i] = Make(memPorts, i, nil, false, "optsmem", memOpts)
+	}
+
+	fmt.Printf("\nTest: Persistent and in-memory groups side by side ...")
+
+	for seq := 0; seq < 5; seq++ {
+		diskServers[seq%numServers].Start(seq, seq*10)
+		memServers[seq%numServers].Start(seq, seq*10+1)
+	}
+	for seq := 0; seq < 5; seq++ {
+		waitForDecision(test, diskServers, seq, numServers)
+		waitForDecision(test, memServers, seq, numServers)
+		if _, v := diskServers[0].Status(seq); v != seq*10 {
+			test.Fatalf("wrong value in persistent group; seq=%v v=%v", seq, v)
+		}
+		if _, v := memServers[0].Status(seq); v != seq*10+1 {
+			test.Fatalf("wrong value in in-memory group; seq=%v v=%v", seq, v)
+		}
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
 func TestFileDeaf(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	const numServers = 5
@@ -629,7 +753,7 @@ func TestFileDeaf(test *testing.T) {
 		paxosPorts[i] = makePort("deaf", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	fmt.Printf("\nTest: Deaf proposer ...")
@@ -667,6 +791,7 @@ func TestFileForget(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	const numServers = 6
@@ -679,7 +804,7 @@ func TestFileForget(test *testing.T) {
 		paxosPorts[i] = makePort("forget", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	fmt.Printf("\nTest: Forgetting ...")
@@ -758,6 +883,7 @@ func TestFileForgetManyUnreliable(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	const numServers = 3
@@ -770,14 +896,14 @@ func TestFileForgetManyUnreliable(test *testing.T) {
 		paxosPorts[i] = makePort("forgetMany", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
-		paxosServers[i].unreliable = true
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		paxosServers[i].setunreliable(true)
 	}
 
 	fmt.Printf("\nTest: Lots of forgetting ...")
 
 	const maxSeq = 20
-	done := false
+	var done int32
 
 	// Start a lot of proposals for random sequences
 	go func() {
@@ -793,7 +919,7 @@ func TestFileForgetManyUnreliable(test *testing.T) {
 
 	// Randomly call Done on decided sequences
 	go func() {
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			seq := (rand.Int() % maxSeq)
 			serverToCheck := (rand.Int() % numServers)
 			// If haven't already called Done and it's decided, call Done
@@ -808,9 +934,9 @@ func TestFileForgetManyUnreliable(test *testing.T) {
 	}()
 
 	time.Sleep(5 * time.Second)
-	done = true
+	atomic.StoreInt32(&done, 1)
 	for i := 0; i < numServers; i++ {
-		paxosServers[i].unreliable = false
+		paxosServers[i].setunreliable(false)
 	}
 	time.Sleep(2 * time.Second)
 
@@ -832,6 +958,7 @@ func TestFileForgetMem(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 
 	runtime.GOMAXPROCS(4)
 
@@ -847,7 +974,7 @@ func TestFileForgetMem(test *testing.T) {
 		paxosPorts[i] = makePort("forgetMemory", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	// Run initial sequence
@@ -905,6 +1032,7 @@ func TestFileRPCCountRegular(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	fmt.Printf("\nTest: RPC counts aren't too high ...")
@@ -919,7 +1047,7 @@ func TestFileRPCCountRegular(test *testing.T) {
 		paxosPorts[i] = makePort("count", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 
 	// Wait for servers to finish sending recovery RPCs
@@ -929,7 +1057,7 @@ func TestFileRPCCountRegular(test *testing.T) {
 	rpcCount := 0
 	rpcTotalCount := 0
 	for j := 0; j < numServers; j++ {
-		count := paxosServers[j].rpcCount
+		count := paxosServers[j].getRPCCount()
 		rpcCount += count
 		rpcTotalCount += count
 	}
@@ -944,7 +1072,7 @@ func TestFileRPCCountRegular(test *testing.T) {
 	}
 	rpcCount = -rpcTotalCount // Subtract recovery RPCs
 	for j := 0; j < numServers; j++ {
-		count := paxosServers[j].rpcCount
+		count := paxosServers[j].getRPCCount()
 		rpcCount += count
 		rpcTotalCount += count
 	}
@@ -974,7 +1102,7 @@ func TestFileRPCCountRegular(test *testing.T) {
 
 	rpcCount = -rpcTotalCount // Subtract previous count to only count this round of RPCs
 	for j := 0; j < numServers; j++ {
-		count := paxosServers[j].rpcCount
+		count := paxosServers[j].getRPCCount()
 		rpcCount += count
 		rpcTotalCount += count
 	}
@@ -998,6 +1126,7 @@ func TestFileRPCCountPrePrepare(test *testing.T) {
 	if onlyBenchmarks || !runNewTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	fmt.Printf("\nTest: Pre-prepare messages reduce RPC count ...")
@@ -1012,7 +1141,7 @@ func TestFileRPCCountPrePrepare(test *testing.T) {
 		paxosPorts[i] = makePort("count", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 	// Wait for servers to finish sending recovery RPCs
 	for i := 0; i < numServers; i++ {
@@ -1021,7 +1150,7 @@ func TestFileRPCCountPrePrepare(test *testing.T) {
 	rpcCount := 0
 	rpcTotalCount := 0
 	for j := 0; j < numServers; j++ {
-		count := paxosServers[j].rpcCount
+		count := paxosServers[j].getRPCCount()
 		rpcCount += count
 		rpcTotalCount += count
 	}
@@ -1034,7 +1163,7 @@ func TestFileRPCCountPrePrepare(test *testing.T) {
 	seq++
 	rpcCount = -rpcTotalCount // Subtract recovery RPCs
 	for j := 0; j < numServers; j++ {
-		count := paxosServers[j].rpcCount
+		count := paxosServers[j].getRPCCount()
 		rpcCount += count
 		rpcTotalCount += count
 	}
@@ -1049,7 +1178,7 @@ func TestFileRPCCountPrePrepare(test *testing.T) {
 	}
 	rpcCount = -rpcTotalCount // Subtract initial agreement round
 	for j := 0; j < numServers; j++ {
-		count := paxosServers[j].rpcCount
+		count := paxosServers[j].getRPCCount()
 		rpcCount += count
 		rpcTotalCount += count
 	}
@@ -1079,7 +1208,7 @@ func TestFileRPCCountPrePrepare(test *testing.T) {
 	}
 	rpcCount = -rpcTotalCount // Subtract previous count to only count this round of RPCs
 	for j := 0; j < numServers; j++ {
-		count := paxosServers[j].rpcCount
+		count := paxosServers[j].getRPCCount()
 		rpcCount += count
 		rpcTotalCount += count
 	}
@@ -1098,6 +1227,7 @@ func TestFileMany(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	fmt.Printf("\nTest: Many instances ...")
@@ -1112,7 +1242,7 @@ func TestFileMany(test *testing.T) {
 		paxosPorts[i] = makePort("many", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
 	for i := 0; i < numServers; i++ {
 		paxosServers[i].Start(0, 0)
@@ -1156,6 +1286,7 @@ func TestFileOld(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	fmt.Printf("\nTest: Minority proposal ignored ...")
@@ -1170,20 +1301,20 @@ func TestFileOld(test *testing.T) {
 		paxosPorts[i] = makePort("old", i)
 	}
 
-	paxosServers[1] = Make(paxosPorts, 1, nil, false, "")
-	paxosServers[2] = Make(paxosPorts, 2, nil, false, "")
-	paxosServers[3] = Make(paxosPorts, 3, nil, false, "")
+	paxosServers[1] = Make(paxosPorts, 1, nil, false, "", opts)
+	paxosServers[2] = Make(paxosPorts, 2, nil, false, "", opts)
+	paxosServers[3] = Make(paxosPorts, 3, nil, false, "", opts)
 	paxosServers[1].Start(1, 111)
 
 	waitForDecisionMajority(test, paxosServers, 1)
 
-	paxosServers[0] = Make(paxosPorts, 0, nil, false, "")
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
 	paxosServers[0].Start(1, 222)
 
 	waitForDecision(test, paxosServers, 1, 4)
 
 	if false {
-		paxosServers[4] = Make(paxosPorts, 4, nil, false, "")
+		paxosServers[4] = Make(paxosPorts, 4, nil, false, "", opts)
 		waitForDecision(test, paxosServers, 1, numServers)
 	}
 
@@ -1197,6 +1328,7 @@ func TestFileManyUnreliable(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	fmt.Printf("\nTest: Many instances, unreliable RPC ...")
@@ -1211,8 +1343,8 @@ func TestFileManyUnreliable(test *testing.T) {
 		paxosPorts[i] = makePort("manyUnreliable", i)
 	}
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
-		paxosServers[i].unreliable = true
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		paxosServers[i].setunreliable(true)
 	}
 	for i := 0; i < numServers; i++ {
 		paxosServers[i].Start(0, 0)
@@ -1248,91 +1380,183 @@ func TestFileManyUnreliable(test *testing.T) {
 	fmt.Printf("\n\tPassed")
 }
 
-// Make a port meant for communication between the given src and dst
-func makePrivatePort(tag string, src int, dst int) string {
-	s := "/var/tmp/824-"
-	s += strconv.Itoa(os.Getuid()) + "/"
-	s += "px-" + tag + "-"
-	s += strconv.Itoa(os.Getpid()) + "-"
-	s += strconv.Itoa(src) + "-"
-	s += strconv.Itoa(dst)
-	return s
+// Many proposers competing for the same instances, with unreliable RPC
+// Ballots are unique, so servers must still agree on a value that was proposed
+func TestFileDuelingProposers(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	// Without a leader, every Start runs a full proposal of its own
+	opts.EnableLeader = 0
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("\nTest: Dueling proposers, unreliable RPC ...")
+
+	const numServers = 5
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	var paxosPorts []string = make([]string, numServers)
+	defer cleanup(paxosServers)
+
+	// Make ports for servers
+	for i := 0; i < numServers; i++ {
+		paxosPorts[i] = makePort("dueling", i)
+	}
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		paxosServers[i].setunreliable(true)
+	}
+
+	// Start several proposals for each instance on every server at once
+	const numInstances = 5
+	const numProposals = 4
+	for seq := 0; seq < numInstances; seq++ {
+		for i := 0; i < numServers; i++ {
+			for j := 0; j < numProposals; j++ {
+				paxosServers[i].Start(seq, (seq*100)+(i*10)+j)
+			}
+		}
+	}
+
+	// Wait for everyone to agree, and make sure the value was really proposed
+	for seq := 0; seq < numInstances; seq++ {
+		waitForDecision(test, paxosServers, seq, numServers)
+		_, value := paxosServers[0].Status(seq)
+		proposed := value.(int)
+		if proposed/100 != seq || (proposed%100)/10 >= numServers || proposed%10 >= numProposals {
+			test.Fatalf("decided value was never proposed; seq=%v v=%v", seq, value)
+		}
+	}
+
+	fmt.Printf("\n\tPassed")
 }
 
-// Delete all private ports created for directed communication
-func cleanPrivatePorts(tag string, n int) {
-	for i := 0; i < n; i++ {
-		for j := 0; j < n; j++ {
-			port_ij := makePrivatePort(tag, i, j)
-			os.Remove(port_ij)
+// Test that Wait returns as soon as an instance is decided
+func TestFileWait(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	runtime.GOMAXPROCS(4)
+
+	tag := "wait"
+	const numServers = 3
+	const numWaiters = 5
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	var paxosPorts []string = make([]string, numServers)
+	defer cleanup(paxosServers)
+	for i := 0; i < numServers; i++ {
+		paxosPorts[i] = makePort(tag, i)
+	}
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+	}
+
+	fmt.Printf("\nTest: Wait for decisions ...")
+
+	// Undecided instances time out
+	start := time.Now()
+	if decided, _ := paxosServers[0].Wait(0, 100*time.Millisecond); decided {
+		test.Fatalf("Wait reported an undecided instance as decided")
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		test.Fatalf("Wait returned before its timeout")
+	}
+
+	// Everyone waiting on every server learns the decision
+	var wg sync.WaitGroup
+	values := make(chan interface{}, numServers*numWaiters)
+	for i := 0; i < numServers; i++ {
+		for j := 0; j < numWaiters; j++ {
+			wg.Add(1)
+			go func(px *Paxos) {
+				defer wg.Done()
+				_, value := px.Wait(0, 10*time.Second)
+				values <- value
+			}(paxosServers[i])
+		}
+	}
+	paxosServers[1].Start(0, "hello")
+	wg.Wait()
+	close(values)
+	for value := range values {
+		if value != "hello" {
+			test.Fatalf("waiter saw %v instead of the decided value", value)
+		}
+	}
+
+	// Decided instances return right away
+	if decided, value := paxosServers[2].Wait(0, 0); !decided || value != "hello" {
+		test.Fatalf("Wait on a decided instance returned %v, %v", decided, value)
+	}
+
+	// Killing a peer wakes up everyone waiting on it
+	killed := make(chan bool, 1)
+	go func() {
+		decided, _ := paxosServers[0].Wait(1, 0)
+		killed <- decided
+	}()
+	time.Sleep(50 * time.Millisecond)
+	paxosServers[0].KillSaveDisk()
+	select {
+	case decided := <-killed:
+		if decided {
+			test.Fatalf("killed peer reported an undecided instance as decided")
 		}
+	case <-time.After(time.Second):
+		test.Fatalf("Wait didn't return when the peer was killed")
 	}
+
+	fmt.Printf("\n\tPassed")
 }
 
-// Partition the servers into the specified three partitions
-func partitionServers(test *testing.T, tag string, numServers int, p1 []int, p2 []int, p3 []int) {
-	// Delete any links that may have been made previously
-	cleanPrivatePorts(tag, numServers)
+// Make addresses for peers on a simulated network
+func makeMemoryPorts(tag string, numServers int) []string {
+	ports := make([]string, numServers)
+	for i := 0; i < numServers; i++ {
+		ports[i] = "px-" + tag + "-" + strconv.Itoa(i)
+	}
+	return ports
+}
 
-	// Loop through desired partitions, forging the necessary communication links
-	// Will link files so that servers in the same partition can read/write from each other's files
-	// Servers in different partitions will try to write to files which no one is actually listening on
+// Partition the servers into the specified three partitions
+// Servers left out of every partition can't talk to anyone
+func partitionServers(network *transport.Memory, ports []string, p1 []int, p2 []int, p3 []int) {
 	partitions := [][]int{p1, p2, p3}
-	for partitionIndex := 0; partitionIndex < len(partitions); partitionIndex++ {
-		partition := partitions[partitionIndex]
-		// Loop through all combinations of servers in this partition
-		for i := 0; i < len(partition); i++ {
-			for j := 0; j < len(partition); j++ {
-				port_ij := makePrivatePort(tag, partition[i], partition[j])
-				port_j := makePort(tag, partition[j])
-				// Create hard link between the actual server port (port_j)
-				// And the port which server i thinks it should use to talk to j (port_ij)
-				// Thus, server i will in fact be able to talk to server j
-				err := os.Link(port_j, port_ij)
-				if err != nil {
-					// one reason this link can fail is if the
-					// corresponding Paxos peer has prematurely quit and
-					// deleted its socket file (e.g., called px.Kill()).
-					test.Fatalf("os.Link(%v, %v): %v\n", port_ij, port_j, err)
-				}
-			}
+	groups := make([][]string, len(partitions))
+	for i, partition := range partitions {
+		for _, server := range partition {
+			groups[i] = append(groups[i], ports[server])
 		}
 	}
+	network.Partition(groups...)
 }
 
 func TestFilePartition(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	tag := "partition"
 	const numServers = 5
 	var paxosServers []*Paxos = make([]*Paxos, numServers)
 	defer cleanup(paxosServers)
-	defer cleanPrivatePorts(tag, numServers)
 
-	// Create ports for servers
+	// Put the servers on a simulated network so they can be partitioned
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	paxosPorts := makeMemoryPorts(tag, numServers)
 	for i := 0; i < numServers; i++ {
-		var paxosPorts []string = make([]string, numServers)
-		for j := 0; j < numServers; j++ {
-			if j == i {
-				// Create actual server port for myself
-				paxosPorts[i] = makePort(tag, i)
-			} else {
-				// Create port that does nothing until a hard link is established by calling partitionServer()
-				paxosPorts[j] = makePrivatePort(tag, i, j)
-			}
-		}
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
 	}
-	defer partitionServers(test, tag, numServers, []int{}, []int{}, []int{})
 
 	seq := 0
 
 	fmt.Printf("\nTest: No decision if partitioned ...")
 
-	partitionServers(test, tag, numServers, []int{0, 2}, []int{1, 3}, []int{4})
+	partitionServers(network, paxosPorts, []int{0, 2}, []int{1, 3}, []int{4})
 	paxosServers[1].Start(seq, 111)
 	checkMaxDecided(test, paxosServers, seq, 0)
 
@@ -1340,7 +1564,7 @@ func TestFilePartition(test *testing.T) {
 
 	fmt.Printf("\nTest: Decision in majority partition ...")
 
-	partitionServers(test, tag, numServers, []int{0}, []int{1, 2, 3}, []int{4})
+	partitionServers(network, paxosPorts, []int{0}, []int{1, 2, 3}, []int{4})
 	waitForDecisionMajority(test, paxosServers, seq)
 
 	fmt.Printf("\n\tPassed")
@@ -1349,7 +1573,7 @@ func TestFilePartition(test *testing.T) {
 
 	paxosServers[0].Start(seq, 1000) // poke them
 	paxosServers[4].Start(seq, 1004)
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 
 	waitForDecision(test, paxosServers, seq, numServers)
 
@@ -1359,7 +1583,7 @@ func TestFilePartition(test *testing.T) {
 
 	for numIterations := 0; numIterations < 20; numIterations++ {
 		seq++
-		partitionServers(test, tag, numServers, []int{0, 1, 2}, []int{3, 4}, []int{})
+		partitionServers(network, paxosPorts, []int{0, 1, 2}, []int{3, 4}, []int{})
 		paxosServers[0].Start(seq, seq*10)
 		paxosServers[3].Start(seq, (seq*10)+1)
 		waitForDecisionMajority(test, paxosServers, seq)
@@ -1367,7 +1591,7 @@ func TestFilePartition(test *testing.T) {
 			test.Fatalf("too many decided")
 		}
 
-		partitionServers(test, tag, numServers, []int{0, 1}, []int{2, 3, 4}, []int{})
+		partitionServers(network, paxosPorts, []int{0, 1}, []int{2, 3, 4}, []int{})
 		waitForDecision(test, paxosServers, seq, numServers)
 	}
 
@@ -1379,10 +1603,10 @@ func TestFilePartition(test *testing.T) {
 		seq++
 
 		for i := 0; i < numServers; i++ {
-			paxosServers[i].unreliable = true
+			paxosServers[i].setunreliable(true)
 		}
 
-		partitionServers(test, tag, numServers, []int{0, 1, 2}, []int{3, 4}, []int{})
+		partitionServers(network, paxosPorts, []int{0, 1, 2}, []int{3, 4}, []int{})
 		for i := 0; i < numServers; i++ {
 			paxosServers[i].Start(seq, (seq*10)+i)
 		}
@@ -1391,10 +1615,10 @@ func TestFilePartition(test *testing.T) {
 			test.Fatalf("too many decided")
 		}
 
-		partitionServers(test, tag, numServers, []int{0, 1}, []int{2, 3, 4}, []int{})
+		partitionServers(network, paxosPorts, []int{0, 1}, []int{2, 3, 4}, []int{})
 
 		for i := 0; i < numServers; i++ {
-			paxosServers[i].unreliable = false
+			paxosServers[i].setunreliable(false)
 		}
 
 		waitForDecision(test, paxosServers, seq, 5)
@@ -1403,10 +1627,47 @@ func TestFilePartition(test *testing.T) {
 	fmt.Printf("\n\tPassed")
 }
 
+// Test agreement over links that lose, delay and reorder messages
+func TestFileLossyLinks(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	runtime.GOMAXPROCS(4)
+
+	tag := "lossy"
+	const numServers = 5
+	const numInstances = 20
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+
+	network := transport.NewMemory(0)
+	network.SetDefault(transport.Link{Drop: 0.1, Delay: time.Millisecond, Jitter: 5 * time.Millisecond})
+	opts.Transport = network
+	paxosPorts := makeMemoryPorts(tag, numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+	}
+
+	fmt.Printf("\nTest: Agreement over lossy, reordering links ...")
+
+	for seq := 0; seq < numInstances; seq++ {
+		for i := 0; i < numServers; i++ {
+			paxosServers[i].Start(seq, seq*10+i)
+		}
+	}
+	for seq := 0; seq < numInstances; seq++ {
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
 func TestFileLots(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	fmt.Printf("\nTest: Many requests, changing partitions ...")
@@ -1415,63 +1676,55 @@ func TestFileLots(test *testing.T) {
 	const numServers = 5
 	var paxosServers []*Paxos = make([]*Paxos, numServers)
 	defer cleanup(paxosServers)
-	defer cleanPrivatePorts(tag, numServers)
 
-	// Make ports for servers
+	// Put the servers on a simulated network so they can be partitioned
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	paxosPorts := makeMemoryPorts(tag, numServers)
 	for i := 0; i < numServers; i++ {
-		var paxosPorts []string = make([]string, numServers)
-		for j := 0; j < numServers; j++ {
-			if j == i {
-				// Make actual server port for myself
-				paxosPorts[i] = makePort(tag, i)
-			} else {
-				// Create port that does nothing until a hard link is established by calling partitionServer()
-				paxosPorts[j] = makePrivatePort(tag, i, j)
-			}
-		}
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
-		paxosServers[i].unreliable = true
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		paxosServers[i].setunreliable(true)
 	}
-	defer partitionServers(test, tag, numServers, []int{}, []int{}, []int{})
 
-	done := false
+	var done int32
 
 	// re-partition periodically
 	partitionDoneChannel := make(chan bool)
 	go func() {
 		defer func() { partitionDoneChannel <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			// Randomly assign each server to a partition
 			partitions := make([][]int, 3)
 			for i := 0; i < numServers; i++ {
 				partition := (rand.Int() % 3)
 				partitions[partition] = append(partitions[partition], i)
 			}
-			partitionServers(test, tag, numServers, partitions[0], partitions[1], partitions[2])
+			partitionServers(network, paxosPorts, partitions[0], partitions[1], partitions[2])
 			time.Sleep(time.Duration(rand.Int63()%200) * time.Millisecond)
 		}
 	}()
 
-	seq := 0
+	var seq int32 // Instances started so far
 
 	// periodically start a new instance
 	proposerDoneChannel := make(chan bool)
 	go func() {
 		defer func() { proposerDoneChannel <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			// How many instances are in progress?
+			started := int(atomic.LoadInt32(&seq))
 			decidedCount := 0
-			for i := 0; i < seq; i++ {
+			for i := 0; i < started; i++ {
 				if numDecided(test, paxosServers, i) == numServers {
 					decidedCount++
 				}
 			}
 			// If less than 10 active sequences, start a new one (on every server)
-			if seq-decidedCount < 10 {
+			if started-decidedCount < 10 {
 				for i := 0; i < numServers; i++ {
-					paxosServers[i].Start(seq, rand.Int()%10)
+					paxosServers[i].Start(started, rand.Int()%10)
 				}
-				seq++
+				atomic.AddInt32(&seq, 1)
 			}
 			time.Sleep(time.Duration(rand.Int63()%300) * time.Millisecond)
 		}
@@ -1481,9 +1734,9 @@ func TestFileLots(test *testing.T) {
 	checkerDoneChannel := make(chan bool)
 	go func() {
 		defer func() { checkerDoneChannel <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			// Check that all sequences are consistent
-			for i := 0; i < seq; i++ {
+			for i := 0; i < int(atomic.LoadInt32(&seq)); i++ {
 				numDecided(test, paxosServers, i)
 			}
 			time.Sleep(time.Duration(rand.Int63()%300) * time.Millisecond)
@@ -1492,18 +1745,18 @@ func TestFileLots(test *testing.T) {
 
 	// Run for 20 seconds and then kill the threads
 	time.Sleep(20 * time.Second)
-	done = true
+	atomic.StoreInt32(&done, 1)
 	<-proposerDoneChannel
 	<-partitionDoneChannel
 	<-checkerDoneChannel
 
 	// Repair partitions, then check that all instances decided.
 	for i := 0; i < numServers; i++ {
-		paxosServers[i].unreliable = false
+		paxosServers[i].setunreliable(false)
 	}
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 
-	for i := 0; i < seq; i++ {
+	for i := 0; i < int(atomic.LoadInt32(&seq)); i++ {
 		waitForDecisionMajority(test, paxosServers, i)
 	}
 
@@ -1514,6 +1767,7 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 	if onlyBenchmarks || !runNewTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	fmt.Printf("\nTest: Many requests, changing partitions, random reboots, unreliable ...")
@@ -1522,28 +1776,18 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 	const numServers = 5
 	var paxosServers []*Paxos = make([]*Paxos, numServers)
 	defer cleanup(paxosServers)
-	defer cleanPrivatePorts(tag, numServers)
 
-	// Make ports for servers
-	var paxosPorts [][]string = make([][]string, numServers)
+	// Put the servers on a simulated network so they can be partitioned
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	paxosPorts := makeMemoryPorts(tag, numServers)
 	for i := 0; i < numServers; i++ {
-		paxosPorts[i] = make([]string, numServers)
-		for j := 0; j < numServers; j++ {
-			if j == i {
-				// Make actual server port for myself
-				paxosPorts[i][i] = makePort(tag, i)
-			} else {
-				// Create port that does nothing until a hard link is established by calling partitionServer()
-				paxosPorts[i][j] = makePrivatePort(tag, i, j)
-			}
-		}
-		paxosServers[i] = Make(paxosPorts[i], i, nil, false, "")
-		paxosServers[i].unreliable = true
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		paxosServers[i].setunreliable(true)
 	}
-	defer partitionServers(test, tag, numServers, []int{}, []int{}, []int{})
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 
-	done := false
+	var done int32
 	partitions := make([][]int, 3)
 	partitions[0] = []int{0, 1, 2, 3, 4}
 	var partitionLock sync.Mutex
@@ -1552,7 +1796,7 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 	rebootDoneChannel := make(chan bool)
 	go func() {
 		defer func() { rebootDoneChannel <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			// Randomly reboot a server with its disk contents
 			partitionLock.Lock()
 			toKill := rand.Int() % (numServers - 1)
@@ -1563,9 +1807,9 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 			}
 			time.Sleep(time.Duration(50+rand.Int63()%50) * time.Millisecond)
 
-			paxosServers[toKill] = Make(paxosPorts[toKill], toKill, nil, false, "")
-			paxosServers[toKill].unreliable = true
-			partitionServers(test, tag, numServers, partitions[0], partitions[1], partitions[2])
+			paxosServers[toKill] = Make(paxosPorts, toKill, nil, false, "", opts)
+			paxosServers[toKill].setunreliable(true)
+			partitionServers(network, paxosPorts, partitions[0], partitions[1], partitions[2])
 			time.Sleep(time.Duration(100+rand.Int63()%50) * time.Millisecond)
 			partitionLock.Unlock()
 			time.Sleep(time.Duration(500+rand.Int63()%1000) * time.Millisecond)
@@ -1576,7 +1820,7 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 	partitionDoneChannel := make(chan bool)
 	go func() {
 		defer func() { partitionDoneChannel <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			// Randomly assign each server to a partition
 			partitionLock.Lock()
 			for i := 0; i < 3; i++ {
@@ -1586,32 +1830,37 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 				partition := (rand.Int() % 3)
 				partitions[partition] = append(partitions[partition], i)
 			}
-			partitionServers(test, tag, numServers, partitions[0], partitions[1], partitions[2])
+			partitionServers(network, paxosPorts, partitions[0], partitions[1], partitions[2])
 			partitionLock.Unlock()
 			time.Sleep(time.Duration(rand.Int63()%250) * time.Millisecond)
 		}
 	}()
 
-	seq := 0
+	var seq int32 // Instances started so far
 
 	// periodically start a new instance
 	proposerDoneChannel := make(chan bool)
 	go func() {
 		defer func() { proposerDoneChannel <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
+			// Servers are replaced by reboots under partitionLock
+			partitionLock.Lock()
+			servers := append([]*Paxos{}, paxosServers...)
+			partitionLock.Unlock()
 			// How many instances are in progress?
+			started := int(atomic.LoadInt32(&seq))
 			decidedCount := 0
-			for i := 0; i < seq; i++ {
-				if numDecided(test, paxosServers, i) == numServers {
+			for i := 0; i < started; i++ {
+				if numDecided(test, servers, i) == numServers {
 					decidedCount++
 				}
 			}
 			// If less than 10 active sequences, start a new one (on every server)
-			if seq-decidedCount < 10 {
+			if started-decidedCount < 10 {
 				for i := 0; i < numServers; i++ {
-					paxosServers[i].Start(seq, rand.Int()%10)
+					servers[i].Start(started, rand.Int()%10)
 				}
-				seq++
+				atomic.AddInt32(&seq, 1)
 			}
 			time.Sleep(time.Duration(rand.Int63()%300) * time.Millisecond)
 		}
@@ -1621,10 +1870,13 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 	checkerDoneChannel := make(chan bool)
 	go func() {
 		defer func() { checkerDoneChannel <- true }()
-		for done == false {
+		for atomic.LoadInt32(&done) == 0 {
 			// Check that all sequences are consistent
-			for i := 0; i < seq; i++ {
-				numDecided(test, paxosServers, i)
+			partitionLock.Lock()
+			servers := append([]*Paxos{}, paxosServers...)
+			partitionLock.Unlock()
+			for i := 0; i < int(atomic.LoadInt32(&seq)); i++ {
+				numDecided(test, servers, i)
 			}
 			time.Sleep(time.Duration(rand.Int63()%300) * time.Millisecond)
 		}
@@ -1653,7 +1905,7 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 		duration--
 		time.Sleep(1 * time.Second)
 	}
-	done = true
+	atomic.StoreInt32(&done, 1)
 	<-proposerDoneChannel
 	<-partitionDoneChannel
 	<-rebootDoneChannel
@@ -1661,61 +1913,425 @@ func TestFilePersistenceLotsPartitionsRebootsUnreliable(test *testing.T) {
 
 	// Repair partitions, then check that all instances decided.
 	for i := 0; i < numServers; i++ {
-		paxosServers[i].unreliable = false
+		paxosServers[i].setunreliable(false)
 	}
-	partitionServers(test, tag, numServers, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	partitionServers(network, paxosPorts, []int{0, 1, 2, 3, 4}, []int{}, []int{})
 
-	for i := 0; i < seq; i++ {
+	for i := 0; i < int(atomic.LoadInt32(&seq)); i++ {
 		waitForDecisionMajority(test, paxosServers, i)
 	}
 
 	fmt.Printf("\n\tPassed\n\n")
 }
 
-func TestFileRecovery(test *testing.T) {
+// Wait for the given server to crash
+func waitForCrash(test *testing.T, px *Paxos) {
+	for iters := 0; iters < 100 && !px.isdead(); iters++ {
+		time.Sleep(10 * time.Millisecond)
+	}
+	if !px.isdead() {
+		test.Fatalf("server did not crash")
+	}
+}
+
+// Test that a value accepted just before a crash is still chosen after a reboot
+// and that crashing between writes and replies never breaks agreement
+func TestFileCrashBeforeReply(test *testing.T) {
 	if onlyBenchmarks || !runNewTests {
 		return
 	}
 	runtime.GOMAXPROCS(4)
 
-	fmt.Printf("\nTest: Recovery after reboot with disk ...")
+	for _, durability := range []Durability{DurabilityBuffered, DurabilitySync} {
+		fmt.Printf("\nTest: Crash after accepting, before replying (%v) ...", durability)
+		opts := testOptions(test)
+		opts.Durability = durability
+		opts.EnableLeader = 0
+		network := transport.NewMemory(0)
+		opts.Transport = network
+
+		const numServers = 3
+		var paxosServers []*Paxos = make([]*Paxos, numServers)
+		paxosPorts := makeMemoryPorts("crash-"+durability.String(), numServers)
+		for i := 0; i < numServers; i++ {
+			paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		}
+		paxosServers[2].setCrashAfter(func(method string) bool { return method == "Accept" })
+
+		// Server 0 and server 2 accept "v", so it is chosen, but 0 never hears that 2 did
+		partitionServers(network, paxosPorts, []int{0, 2}, []int{1}, []int{})
+		paxosServers[0].Start(0, "v")
+		waitForCrash(test, paxosServers[2])
+		paxosServers[0].KillSaveDisk()
+
+		// Server 1 proposes "w" with only the rebooted server 2 to talk to
+		paxosServers[2] = Make(paxosPorts, 2, nil, false, "", opts)
+		partitionServers(network, paxosPorts, []int{1, 2}, []int{0}, []int{})
+		paxosServers[1].Start(0, "w")
+		waitForDecision(test, paxosServers[1:], 0, 2)
+		if _, value := paxosServers[1].Status(0); value != "v" {
+			test.Fatalf("decided %v, but \"v\" was chosen before the crash", value)
+		}
 
-	const numServers = 3
+		paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
+		partitionServers(network, paxosPorts, []int{0, 1, 2}, []int{}, []int{})
+		waitForDecision(test, paxosServers, 0, numServers)
+		cleanup(paxosServers)
+		fmt.Printf("\n\tPassed")
+	}
+
+	fmt.Printf("\nTest: Random crashes before replying ...")
+	opts := testOptions(test)
+	opts.EnableLeader = 0
+	opts.Transport = transport.NewMemory(0)
+
+	const numServers = 5
 	var paxosServers []*Paxos = make([]*Paxos, numServers)
-	var paxosPorts []string = make([]string, numServers)
 	defer cleanup(paxosServers)
-
-	// Make ports for the servers
-	for i := 0; i < numServers; i++ {
-		paxosPorts[i] = makePort("recovery", i)
-	}
+	paxosPorts := makeMemoryPorts("crashes", numServers)
+	var crashMu sync.Mutex
+	crashing := true
+	crashAfter := func(method string) bool {
+		crashMu.Lock()
+		defer crashMu.Unlock()
+		return crashing && (method == "Prepare" || method == "Accept") && rand.Intn(100) < 2
+	}
+	var serversMu sync.Mutex
 	for i := 0; i < numServers; i++ {
-		paxosServers[i] = Make(paxosPorts, i, nil, false, "")
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		paxosServers[i].setCrashAfter(crashAfter)
 	}
 
-	// Get agreement on some instances
-	seq := 0
-	for seq = 0; seq < 10; seq++ {
-		paxosServers[rand.Int()%numServers].Start(seq, seq)
-	}
-	for i := 0; i < seq; i++ {
-		waitForDecision(test, paxosServers, i, numServers)
-	}
+	// Reboot crashed servers from their disks
+	var done int32
+	rebootDoneChannel := make(chan bool)
+	go func() {
+		defer func() { rebootDoneChannel <- true }()
+		for atomic.LoadInt32(&done) == 0 {
+			serversMu.Lock()
+			for i := 0; i < numServers; i++ {
+				if paxosServers[i].isdead() {
+					paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+					paxosServers[i].setCrashAfter(crashAfter)
+				}
+			}
+			serversMu.Unlock()
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
 
-	// Kill a server (save disk)
-	paxosServers[0].KillSaveDisk()
-	time.Sleep(500 * time.Millisecond)
+	// Every server proposes its own value for every instance
+	const numInstances = 30
+	for seq := 0; seq < numInstances; seq++ {
+		serversMu.Lock()
+		for i := 0; i < numServers; i++ {
+			paxosServers[i].Start(seq, seq*numServers+i)
+		}
+		serversMu.Unlock()
+		time.Sleep(50 * time.Millisecond)
+		serversMu.Lock()
+		for i := 0; i <= seq; i++ {
+			numDecided(test, paxosServers, i)
+		}
+		serversMu.Unlock()
+	}
 
-	// Get agreement on some more instances
-	for ; seq < 20; seq++ {
-		paxosServers[rand.Int()%(numServers-1)+1].Start(seq, seq)
+	// Stop crashing, and propose again everywhere, since decisions sent by crashed servers may be lost
+	crashMu.Lock()
+	crashing = false
+	crashMu.Unlock()
+	atomic.StoreInt32(&done, 1)
+	<-rebootDoneChannel
+	for i := 0; i < numServers; i++ {
+		if paxosServers[i].isdead() {
+			paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		}
 	}
-	for i := 0; i < seq; i++ {
-		waitForDecision(test, paxosServers, i, numServers-1)
+	for seq := 0; seq < numInstances; seq++ {
+		for i := 0; i < numServers; i++ {
+			paxosServers[i].Start(seq, -1)
+		}
+	}
+	for seq := 0; seq < numInstances; seq++ {
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+// Whether batches written to "failing" databases fail
+var failWrites int32
+
+var errWriteFailed = errors.New("test: write failed")
+
+// In-memory engine whose batch writes fail while failWrites is set
+type failingEngine struct {
+	storage.Engine
+}
+
+type failingBatch struct {
+	storage.Batch
+}
+
+func (db failingEngine) Batch() storage.Batch {
+	return failingBatch{db.Engine.Batch()}
+}
+
+func (batch failingBatch) Write() error {
+	if atomic.LoadInt32(&failWrites) != 0 {
+		return errWriteFailed
+	}
+	return batch.Batch.Write()
+}
+
+func init() {
+	storage.Register("failing", func(name string, opts storage.Options) (storage.Engine, error) {
+		opts.Engine = "memory"
+		db, err := storage.Open(name, opts)
+		if err != nil {
+			return nil, err
+		}
+		return failingEngine{db}, nil
+	}, func(name string, opts storage.Options) error {
+		opts.Engine = "memory"
+		return storage.Destroy(name, opts)
+	})
+}
+
+// Test that a peer whose writes fail doesn't reply, and replies once they land
+func TestFileWriteFailure(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("\nTest: No replies while writes fail ...")
+	opts := testOptions(test)
+	opts.Durability = DurabilityBuffered
+	opts.EnableLeader = 0
+	network := transport.NewMemory(0)
+	opts.Transport = network
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	paxosPorts := makeMemoryPorts("writefail", numServers)
+	for i := 0; i < numServers; i++ {
+		serverOpts := opts
+		if i == 2 {
+			serverOpts.DBEngine = "failing"
+		}
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", serverOpts)
+	}
+
+	// Server 0 can only reach server 2, whose promises and accepts never land
+	atomic.StoreInt32(&failWrites, 1)
+	defer atomic.StoreInt32(&failWrites, 0)
+	partitionServers(network, paxosPorts, []int{0, 2}, []int{1}, []int{})
+	paxosServers[0].Start(0, "v")
+	time.Sleep(1 * time.Second)
+	if decided := numDecided(test, paxosServers, 0); decided != 0 {
+		test.Fatalf("%v servers decided without server 2's writes landing", decided)
+	}
+
+	// Once writes work again, the retried writes land and the value is chosen
+	atomic.StoreInt32(&failWrites, 0)
+	waitForDecision(test, paxosServers[:1], 0, 1)
+	if _, value := paxosServers[0].Status(0); value != "v" {
+		test.Fatalf("decided %v instead of \"v\"", value)
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+// Flip a bit in the record of key in a killed peer's database, or store a damaged record if there is none
+func damageRecord(test *testing.T, px *Paxos, key string) {
+	db, err := storage.Open(px.dbName, px.dbOpts)
+	if err != nil {
+		test.Fatalf("could not open the database of %v: %v", px.me, err)
+	}
+	defer db.Close()
+	record, _ := db.Get([]byte(key))
+	if record == nil {
+		record = storage.Frame([]byte("garbage"))
+	}
+	record[len(record)-1] ^= 1
+	db.Put([]byte(key), record)
+}
+
+// Whether px refuses to promise anything for seq
+func refusesPrepare(px *Paxos, seq int) bool {
+	args := PrepareArgs{Instance: seq, PID: Ballot{100, 0}, Config: -1}
+	var reply PrepareReply
+	px.Prepare(&args, &reply)
+	return reply.Err
+}
+
+// Test that damaged records are found at startup, not voted on, and repaired from peers
+func TestFileDamagedRecords(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	opts.Transport = transport.NewMemory(0)
+	paxosPorts := makeMemoryPorts("damaged", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+	}
+	for seq := 0; seq < 5; seq++ {
+		paxosServers[0].Start(seq, seq*10)
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+
+	fmt.Printf("\nTest: Damaged instances are repaired from peers ...")
+	paxosServers[2].KillSaveDisk()
+	damageRecord(test, paxosServers[2], "instance_1")
+	damageRecord(test, paxosServers[2], "instance_9")
+	paxosServers[2] = Make(paxosPorts, 2, nil, false, "", opts)
+	waitForDecision(test, paxosServers, 1, numServers)
+	if _, value := paxosServers[2].Status(1); value != 10 {
+		test.Fatalf("repaired instance 1 to %v, wanted 10", value)
+	}
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Damaged instances are not voted on until decided ...")
+	// No peer has decided instance 9, so it can't be repaired yet
+	if !refusesPrepare(paxosServers[2], 9) {
+		test.Fatalf("promised in a damaged instance")
+	}
+	paxosServers[1].Start(9, 90)
+	waitForDecision(test, paxosServers, 9, numServers)
+	if refusesPrepare(paxosServers[2], 10) {
+		test.Fatalf("refused an undamaged instance")
+	}
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: A peer with damaged promises stops voting ...")
+	paxosServers[2].KillSaveDisk()
+	damageRecord(test, paxosServers[2], "peers")
+	paxosServers[2] = Make(paxosPorts, 2, nil, false, "", opts)
+	if !refusesPrepare(paxosServers[2], 11) {
+		test.Fatalf("promised with damaged peer sets")
+	}
+	// The others still agree, and the voteless peer learns what they decide
+	paxosServers[0].Start(12, 120)
+	waitForDecision(test, paxosServers, 12, numServers)
+	fmt.Printf("\n\tPassed")
+}
+
+// Rewrite a killed peer's database the way the code before checksums wrote it
+func unframeRecords(test *testing.T, px *Paxos) {
+	db, err := storage.Open(px.dbName, px.dbOpts)
+	if err != nil {
+		test.Fatalf("could not open the database of %v: %v", px.me, err)
+	}
+	defer db.Close()
+	batch := db.Batch()
+	defer batch.Close()
+	iterator := db.Iterator()
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		key := append([]byte(nil), iterator.Key()...)
+		data, err := storage.Unframe(iterator.Value())
+		if err != nil || string(key) == storage.FormatKey {
+			batch.Delete(key)
+		} else {
+			batch.Put(key, append([]byte(nil), data...))
+		}
+	}
+	iterator.Close()
+	if err := batch.Write(); err != nil {
+		test.Fatalf("could not rewrite the database of %v: %v", px.me, err)
+	}
+}
+
+func TestFileLegacyRecords(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	opts.Transport = transport.NewMemory(0)
+	paxosPorts := makeMemoryPorts("legacy", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+	}
+	for seq := 0; seq < 5; seq++ {
+		paxosServers[0].Start(seq, seq*10)
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+
+	fmt.Printf("\nTest: Records written before checksums are read back ...")
+	for i := 0; i < numServers; i++ {
+		paxosServers[i].KillSaveDisk()
+	}
+	unframeRecords(test, paxosServers[2])
+	// Alone, so whatever it knows comes from its own disk
+	paxosServers[2] = Make(paxosPorts, 2, nil, false, "", opts)
+	for seq := 0; seq < 5; seq++ {
+		if decided, value := paxosServers[2].Status(seq); !decided || value != seq*10 {
+			test.Fatalf("read instance %v as %v, %v, wanted %v", seq, decided, value, seq*10)
+		}
+	}
+	if refusesPrepare(paxosServers[2], 5) {
+		test.Fatalf("stopped voting after reading records without checksums")
+	}
+	fmt.Printf("\n\tPassed")
+}
+
+func TestFileRecovery(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("\nTest: Recovery after reboot with disk ...")
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	var paxosPorts []string = make([]string, numServers)
+	defer cleanup(paxosServers)
+
+	// Make ports for the servers
+	for i := 0; i < numServers; i++ {
+		paxosPorts[i] = makePort("recovery", i)
+	}
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+	}
+
+	// Get agreement on some instances
+	seq := 0
+	for seq = 0; seq < 10; seq++ {
+		paxosServers[rand.Int()%numServers].Start(seq, seq)
+	}
+	for i := 0; i < seq; i++ {
+		waitForDecision(test, paxosServers, i, numServers)
+	}
+
+	// Kill a server (save disk)
+	paxosServers[0].KillSaveDisk()
+	time.Sleep(500 * time.Millisecond)
+
+	// Get agreement on some more instances
+	for ; seq < 20; seq++ {
+		paxosServers[rand.Int()%(numServers-1)+1].Start(seq, seq)
+	}
+	for i := 0; i < seq; i++ {
+		waitForDecision(test, paxosServers, i, numServers-1)
 	}
 
 	// Restart server
-	paxosServers[0] = Make(paxosPorts, 0, nil, false, "")
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
 
 	// See if it caught itself up with the others
 	max := paxosServers[0].Max()
@@ -1745,7 +2361,7 @@ func TestFileRecovery(test *testing.T) {
 	time.Sleep(500 * time.Millisecond)
 
 	// Restart server
-	paxosServers[0] = Make(paxosPorts, 0, nil, false, "")
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
 
 	// See if it caught itself up with the others
 	max = paxosServers[0].Max()
@@ -1770,3 +2386,1176 @@ func TestFileRecovery(test *testing.T) {
 
 	fmt.Printf("\n\tPassed\n\n")
 }
+
+// Replace a peer through the log, and check that the new set runs later instances
+func TestFileChangePeers(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	opts.Transport = transport.NewMemory(0)
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("\nTest: Changing peers ...")
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers+1)
+	defer cleanup(paxosServers)
+	paxosPorts := makeMemoryPorts("change", numServers+1)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts[:numServers], i, nil, false, "", opts)
+	}
+
+	seq := 0
+	for ; seq < 5; seq++ {
+		paxosServers[seq%numServers].Start(seq, seq*10)
+	}
+	for i := 0; i < seq; i++ {
+		waitForDecision(test, paxosServers, i, numServers)
+	}
+
+	// Swap peer 0 for peer 3
+	newPorts := []string{paxosPorts[3], paxosPorts[1], paxosPorts[2]}
+	start := paxosServers[1].ChangePeers(newPorts)
+	if start < seq+changeDelay {
+		test.Fatalf("Change takes effect at %v, expected at least %v", start, seq+changeDelay)
+	}
+	paxosServers[3] = Make(newPorts, 0, nil, false, "", opts)
+	if max := paxosServers[3].Max(); max < start-changeDelay {
+		test.Fatalf("New peer has max %v, expected at least %v", max, start-changeDelay)
+	}
+
+	// The old peer can't stop the new peers once it's gone
+	paxosServers[0].Kill()
+	paxosServers[0] = nil
+	for seq = start; seq < start+5; seq++ {
+		paxosServers[3].Start(seq, seq*10)
+	}
+	for i := start; i < seq; i++ {
+		waitForDecision(test, paxosServers, i, numServers)
+	}
+	// Instances between the change and start still get decided
+	for i := start - changeDelay + 1; i < start; i++ {
+		paxosServers[2].Start(i, i*10)
+		waitForDecision(test, paxosServers[1:3], i, 2)
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Min follows the new peers ...")
+
+	for i := 1; i <= numServers; i++ {
+		paxosServers[i].Done(start)
+	}
+	paxosServers[1].Start(seq, seq*10)
+	waitForDecision(test, paxosServers, seq, numServers)
+	for i := 1; i <= numServers; i++ {
+		paxosServers[i].Start(seq+i, (seq+i)*10)
+		waitForDecision(test, paxosServers, seq+i, numServers)
+	}
+	for i := 1; i <= numServers; i++ {
+		if min := paxosServers[i].Min(); min != start+1 {
+			test.Fatalf("Peer %v has min %v, expected %v", i, min, start+1)
+		}
+	}
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+// Stands in for an application, with a snapshot of the instances it has applied
+type testSnapshotter struct {
+	mu    sync.Mutex
+	seq   int
+	data  []byte
+	taken int // Snapshot calls
+}
+
+func (s *testSnapshotter) Snapshot() (int, []byte) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.taken++
+	return s.seq, s.data
+}
+
+func (s *testSnapshotter) applied(seq int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.seq = seq
+	s.data = []byte("state-" + strconv.Itoa(seq))
+}
+
+// A peer that lost its disk starts from a snapshot when the others forgot what it missed
+func TestFileSnapshot(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	opts.Transport = transport.NewMemory(0)
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("\nTest: Catch up from a snapshot ...")
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	paxosPorts := makeMemoryPorts("snapshot", numServers)
+	snapshotters := make([]*testSnapshotter, numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		snapshotters[i] = &testSnapshotter{seq: -1}
+		paxosServers[i].SetSnapshotter(snapshotters[i])
+	}
+
+	seq := 0
+	for ; seq < 20; seq++ {
+		paxosServers[seq%numServers].Start(seq, seq*10)
+	}
+	for i := 0; i < seq; i++ {
+		waitForDecision(test, paxosServers, i, numServers)
+	}
+	for i := 0; i < numServers; i++ {
+		snapshotters[i].applied(seq - 1)
+		paxosServers[i].Done(seq - 1)
+	}
+	// Agree on more, so every peer hears the others' Done
+	for ; seq < 25; seq++ {
+		for i := 0; i < numServers; i++ {
+			paxosServers[i].Start(seq, seq*10)
+		}
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+	for i := 0; i < numServers; i++ {
+		if min := paxosServers[i].Min(); min != 20 {
+			test.Fatalf("Peer %v has min %v, expected 20", i, min)
+		}
+	}
+
+	// Lose peer 0's disk, and let the others go on without it
+	paxosServers[0].Kill()
+	for ; seq < 30; seq++ {
+		paxosServers[1].Start(seq, seq*10)
+		waitForDecision(test, paxosServers[1:], seq, numServers-1)
+	}
+
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
+	snapSeq, data := paxosServers[0].FetchedSnapshot()
+	if snapSeq != 19 || string(data) != "state-19" {
+		test.Fatalf("Fetched snapshot %v at %v, expected state-19 at 19", string(data), snapSeq)
+	}
+	if again, _ := paxosServers[0].FetchedSnapshot(); again != -1 {
+		test.Fatalf("Snapshot fetched twice")
+	}
+	// Only the instances after the snapshot were recovered
+	for i := 20; i < seq; i++ {
+		if decided, v := paxosServers[0].Status(i); !decided || v != i*10 {
+			test.Fatalf("Restarted peer has %v, %v for instance %v, expected %v", decided, v, i, i*10)
+		}
+	}
+	if decided, _ := paxosServers[0].Status(10); decided {
+		test.Fatalf("Restarted peer recovered instance 10, which the snapshot covers")
+	}
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+// A snapshot too big for one reply is sent in chunks, all from one Snapshot call
+func TestFileSnapshotChunks(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	opts.Transport = transport.NewMemory(0)
+
+	fmt.Printf("\nTest: Snapshot sent in chunks ...")
+
+	const numServers = 2
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	paxosPorts := makeMemoryPorts("snapshotchunks", numServers)
+	snapshotters := make([]*testSnapshotter, numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+		snapshotters[i] = &testSnapshotter{seq: -1}
+		paxosServers[i].SetSnapshotter(snapshotters[i])
+	}
+
+	data := make([]byte, 2*snapshotChunk+snapshotChunk/2)
+	for i := range data {
+		data[i] = byte(i % 251)
+	}
+	snapshotters[1].mu.Lock()
+	snapshotters[1].seq = 7
+	snapshotters[1].data = data
+	snapshotters[1].mu.Unlock()
+
+	seq, got := paxosServers[0].RequestSnapshot(7)
+	if seq != 7 || !bytes.Equal(got, data) {
+		test.Fatalf("Fetched %v bytes at %v, expected the %v bytes at 7", len(got), seq, len(data))
+	}
+	// The snapshot was sent in full, so the next peer to ask gets a new one
+	paxosServers[0].RequestSnapshot(7)
+	snapshotters[1].mu.Lock()
+	taken := snapshotters[1].taken
+	snapshotters[1].mu.Unlock()
+	if taken != 2 {
+		test.Fatalf("Took %v snapshots for two fetches, expected 2", taken)
+	}
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+// A peer that missed many instances recovers them in batches, not one RPC each
+func TestFileRecoveryRange(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	opts.Transport = transport.NewMemory(0)
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("\nTest: Recovery of 10k missed instances ...")
+
+	const numServers = 3
+	const numInstances = 10000
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	paxosPorts := makeMemoryPorts("range", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+	}
+
+	// Peer 0 misses everything
+	paxosServers[0].Kill()
+	for seq := 0; seq < numInstances; seq += 100 {
+		for i := seq; i < seq+100; i++ {
+			paxosServers[1+i%2].Start(i, i*10)
+		}
+		for i := seq; i < seq+100; i++ {
+			paxosServers[1].Wait(i, 0)
+		}
+	}
+	rpcsBefore := paxosServers[1].getRPCCount() + paxosServers[2].getRPCCount()
+
+	start := time.Now()
+	paxosServers[0] = Make(paxosPorts, 0, nil, false, "", opts)
+	if max := paxosServers[0].Max(); max != numInstances-1 {
+		test.Fatalf("Restarted peer has max %v, expected %v", max, numInstances-1)
+	}
+	duration := time.Since(start)
+	for i := 0; i < numInstances; i++ {
+		if decided, v := paxosServers[0].Status(i); !decided || v != i*10 {
+			test.Fatalf("Restarted peer has %v, %v for instance %v, expected %v", decided, v, i, i*10)
+		}
+	}
+	rpcs := paxosServers[1].getRPCCount() + paxosServers[2].getRPCCount() - rpcsBefore
+	if rpcs > numInstances/100 {
+		test.Fatalf("Recovery took %v RPCs, expected at most %v", rpcs, numInstances/100)
+	}
+	fmt.Printf("\n\tRecovered %v instances in %v with %v RPCs", numInstances, duration, rpcs)
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+// Peers that can't reach each other directly agree through a peer they both reach
+func TestFileRelay(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	opts.Transport = transport.NewMemory(0)
+	opts.Relay = true
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 5
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	paxosPorts := makeMemoryPorts("relay", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(paxosPorts, i, nil, false, "", opts)
+	}
+
+	fmt.Printf("\nTest: Reachability is gossiped ...")
+
+	// 0 and 4 each reach one other peer directly, and a majority through it
+	part(test, paxosServers, []int{0, 1}, []int{1, 2, 3}, []int{3, 4})
+	for iters := 0; ; iters++ {
+		paxosServers[0].routeMu.Lock()
+		known := paxosServers[0].routes[paxosPorts[3]].Links[paxosPorts[4]]
+		paxosServers[0].routeMu.Unlock()
+		if known {
+			break
+		}
+		if iters > 50 {
+			test.Fatalf("Peer 0 never heard that 3 reaches 4")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Decision through relays ...")
+
+	paxosServers[0].Start(0, 100)
+	waitForDecision(test, paxosServers, 0, 4)
+	paxosServers[4].Start(1, 101)
+	waitForDecision(test, paxosServers, 1, 4)
+	// 4 learns the first instance by proposing
+	paxosServers[4].Start(0, 104)
+	waitForDecision(test, paxosServers, 0, numServers)
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: No decision without a relayed majority ...")
+
+	// 0 only reaches 1, which reaches nobody else
+	part(test, paxosServers, []int{0, 1}, []int{2, 3, 4}, []int{})
+	time.Sleep(500 * time.Millisecond)
+	paxosServers[0].Start(2, 200)
+	checkMaxDecided(test, paxosServers, 2, 0)
+	part(test, paxosServers, []int{0, 1, 2}, []int{2, 3, 4}, []int{})
+	waitForDecision(test, paxosServers, 2, numServers-1)
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+// Indexes of the peers that hold a leader lease
+func leaseHolders(paxosServers []*Paxos) []int {
+	var holders []int
+	for i, px := range paxosServers {
+		if px != nil && px.IsLeader() {
+			holders = append(holders, i)
+		}
+	}
+	return holders
+}
+
+// Wait until one of the given peers holds a lease and the rest follow it, and return it
+// Fails if two peers ever hold a lease at once
+func waitForLeader(test *testing.T, paxosServers []*Paxos, among []int) int {
+	for iters := 0; iters < 100; iters++ {
+		holders := leaseHolders(paxosServers)
+		if len(holders) > 1 {
+			test.Fatalf("Peers %v all hold leases", holders)
+		}
+		if len(holders) == 1 {
+			leader := holders[0]
+			followed := true
+			for _, i := range among {
+				if paxosServers[i].Leader() != paxosServers[leader].addr {
+					followed = false
+				}
+			}
+			if followed && indexOf(paxosPorts(paxosServers, among), paxosServers[leader].addr) >= 0 {
+				return leader
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	test.Fatalf("No leader among %v", among)
+	return -1
+}
+
+func paxosPorts(paxosServers []*Paxos, among []int) []string {
+	var ports []string
+	for _, i := range among {
+		ports = append(ports, paxosServers[i].addr)
+	}
+	return ports
+}
+
+func TestFileMultiPaxos(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	opts.EnableLeader = MultiPaxos
+	opts.LeaseDuration = 200 * time.Millisecond
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	ports := makeMemoryPorts("multi", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+	}
+	all := []int{0, 1, 2}
+
+	fmt.Printf("\nTest: Multi-Paxos elects one leader ...")
+
+	leader := waitForLeader(test, paxosServers, all)
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Followers forward to the leader ...")
+
+	for seq := 0; seq < 10; seq++ {
+		paxosServers[seq%numServers].Start(seq, seq*10)
+	}
+	for seq := 0; seq < 10; seq++ {
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+	// Only the leader's ballot got anything accepted
+	for seq := 0; seq < 10; seq++ {
+		paxosServers[leader].mu.Lock()
+		prop := paxosServers[leader].getInstance(seq)
+		pid := paxosServers[leader].leaderPID
+		paxosServers[leader].mu.Unlock()
+		if prop.Accept != pid {
+			test.Fatalf("Instance %v accepted at %v, expected the leader's %v", seq, prop.Accept, pid)
+		}
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Cut off leader is replaced ...")
+
+	var others []int
+	for _, i := range all {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	partitionServers(network, ports, []int{leader}, others, []int{})
+	paxosServers[leader].Start(10, 100)
+	newLeader := waitForLeader(test, paxosServers, others)
+	paxosServers[others[0]].Start(11, 110)
+	waitForDecision(test, paxosServers, 11, numServers-1)
+	if newLeader == leader {
+		test.Fatalf("Cut off peer %v still leads", leader)
+	}
+	// The old leader can't get anything chosen on its own
+	if numDecided(test, paxosServers, 10) > 0 {
+		test.Fatalf("Instance 10 decided by a lone peer")
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Old leader follows after heal ...")
+
+	partitionServers(network, ports, all, []int{}, []int{})
+	waitForDecision(test, paxosServers, 10, numServers)
+	waitForDecision(test, paxosServers, 11, numServers)
+	waitForLeader(test, paxosServers, all)
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+// Test that followers restarted during a lease don't help anyone else lead until it runs out
+func TestFileLeaseRestart(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	opts.EnableLeader = MultiPaxos
+	opts.LeaseDuration = time.Second
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	ports := makeMemoryPorts("leaserestart", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+	}
+	all := []int{0, 1, 2}
+
+	fmt.Printf("\nTest: Restarted followers keep the lease they granted ...")
+
+	leader := waitForLeader(test, paxosServers, all)
+	var others []int
+	for _, i := range all {
+		if i != leader {
+			others = append(others, i)
+		}
+	}
+	partitionServers(network, ports, []int{leader}, others, []int{})
+	for _, i := range others {
+		paxosServers[i].KillSaveDisk()
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+	}
+	paxosServers[others[0]].Start(0, "follower")
+	for paxosServers[leader].IsLeader() {
+		if holders := leaseHolders(paxosServers); len(holders) > 1 {
+			test.Fatalf("Peers %v all hold leases", holders)
+		}
+		if numDecided(test, paxosServers, 0) > 0 {
+			test.Fatalf("Instance 0 decided while %v still held its lease", leader)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	newLeader := waitForLeader(test, paxosServers, others)
+	paxosServers[newLeader].Start(0, "follower")
+	waitForDecision(test, paxosServers, 0, numServers-1)
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+func TestFileQuorumOptions(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	ports := makeMemoryPorts("quorumopts", 5)
+
+	fmt.Printf("\nTest: Quorums that may not intersect are refused ...")
+
+	bad := []Options{
+		{Q1: 2, Q2: 3},
+		{Q1: 1, Q2: 4},
+		{Q1: 6},
+		{Q2: -1},
+		{Weights: map[string]int{ports[0]: -1}},
+		{Weights: map[string]int{ports[0]: 0, ports[1]: 0, ports[2]: 0, ports[3]: 0, ports[4]: 0}},
+		// Total weight 7, so Q1 + Q2 = 7 isn't enough
+		{Q1: 4, Q2: 3, Weights: map[string]int{ports[0]: 3}},
+		{Q1Sets: [][]string{{ports[0], ports[1]}}, Q2Sets: [][]string{{ports[2], ports[3]}}},
+		{Q1Sets: [][]string{{ports[0], ports[1]}, {ports[2]}}, Q2Sets: [][]string{{ports[0], ports[2]}, {ports[1], ports[3]}}},
+		// Peers 2, 3 and 4 outside the set are enough for Q2
+		{Q1Sets: [][]string{{ports[0], ports[1]}}, Q2: 3},
+		{Q1: 3, Q1Sets: [][]string{{ports[0], ports[1], ports[2]}}},
+		{Q1Sets: [][]string{{ports[0], "px-stranger"}}},
+		{Q2Sets: [][]string{{}}},
+	}
+	for _, opts := range bad {
+		if _, err := newQuorums(ports, opts); err == nil {
+			test.Fatalf("accepted Q1 %v Q2 %v weights %v sets %v %v",
+				opts.Q1, opts.Q2, opts.Weights, opts.Q1Sets, opts.Q2Sets)
+		}
+	}
+	func() {
+		defer func() {
+			if recover() == nil {
+				test.Fatalf("Make accepted Q1 + Q2 = N")
+			}
+		}()
+		opts := testOptions(test)
+		opts.Transport = transport.NewMemory(0)
+		opts.Q1 = 2
+		opts.Q2 = 3
+		Make(ports, 0, nil, false, "", opts)
+	}()
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Quorum sizes left at 0 meet the other phase ...")
+
+	sizes := []struct {
+		opts   Options
+		q1, q2 int
+	}{
+		{Options{}, 3, 3},
+		{Options{Q2: 2}, 4, 2},
+		{Options{Q1: 5}, 5, 1},
+		{Options{Q1: 3, Q2: 4}, 3, 4},
+		{Options{Weights: map[string]int{ports[0]: 3, ports[1]: 0}}, 4, 4},
+		{Options{Q1Sets: [][]string{{ports[0], ports[1]}, {ports[0], ports[2], ports[3]}}}, 0, 4},
+	}
+	for _, s := range sizes {
+		q, err := newQuorums(ports, s.opts)
+		if err != nil {
+			test.Fatalf("refused Q1 %v Q2 %v: %v", s.opts.Q1, s.opts.Q2, err)
+		}
+		if q.size[phase1] != s.q1 || q.size[phase2] != s.q2 {
+			test.Fatalf("sizes %v and %v, wanted %v and %v", q.size[phase1], q.size[phase2], s.q1, s.q2)
+		}
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Quorums are counted by weight, by set, and by majority for other peers ...")
+
+	members := func(indices ...int) map[string]bool {
+		m := make(map[string]bool)
+		for _, i := range indices {
+			m[ports[i]] = true
+		}
+		return m
+	}
+	q, _ := newQuorums(ports, Options{Q2: 2, Weights: map[string]int{ports[0]: 2}})
+	// Total weight 6, so Q1 is 5
+	if !q.has(phase2, ports, members(0)) || q.has(phase2, ports, members(1)) {
+		test.Fatalf("phase 2 quorums not counted by weight")
+	}
+	if q.has(phase1, ports, members(0, 1, 2)) || !q.has(phase1, ports, members(0, 1, 2, 3)) {
+		test.Fatalf("phase 1 quorums not counted by weight")
+	}
+	if q.possible(phase1, ports, members(0)) || !q.possible(phase1, ports, members(4)) {
+		test.Fatalf("phase 1 quorums not possible as they should be")
+	}
+	// Other peers than the checked ones go back to majorities (peer 0 still weighs 2)
+	others := append([]string{}, ports[:3]...)
+	if !q.has(phase1, others, members(0, 1)) || q.has(phase2, others, members(0)) {
+		test.Fatalf("other peers not counted by weighted majority")
+	}
+
+	grid := Options{
+		Q1Sets: [][]string{{ports[0], ports[1]}, {ports[2], ports[3]}},
+		Q2Sets: [][]string{{ports[0], ports[2]}, {ports[1], ports[3]}},
+	}
+	q, err := newQuorums(ports[:4], grid)
+	if err != nil {
+		test.Fatalf("refused grid quorums: %v", err)
+	}
+	if !q.has(phase1, ports[:4], members(2, 3, 0)) || q.has(phase1, ports[:4], members(0, 2)) {
+		test.Fatalf("phase 1 quorums not counted by set")
+	}
+	if !q.has(phase2, ports[:4], members(1, 3)) || q.has(phase2, ports[:4], members(0, 1)) {
+		test.Fatalf("phase 2 quorums not counted by set")
+	}
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+// Start seq on one peer of each group, and check that no group decides it
+func checkUndecided(test *testing.T, paxosServers []*Paxos, seq int, groups ...[]int) {
+	for _, group := range groups {
+		paxosServers[group[0]].Start(seq, seq*10+group[0])
+	}
+	time.Sleep(time.Second)
+	if numDecided(test, paxosServers, seq) > 0 {
+		test.Fatalf("Instance %v decided by one of %v", seq, groups)
+	}
+}
+
+func TestFileFlexibleQuorums(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	opts.EnableLeader = MultiPaxos
+	opts.LeaseDuration = 200 * time.Millisecond
+	opts.Q2 = 2
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 5
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	ports := makeMemoryPorts("flexible", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+	}
+	all := []int{0, 1, 2, 3, 4}
+
+	fmt.Printf("\nTest: A leader decides with a phase 2 quorum of two ...")
+
+	leader := waitForLeader(test, paxosServers, all)
+	paxosServers[leader].Start(0, 0)
+	waitForDecision(test, paxosServers, 0, numServers)
+	partner := (leader + 1) % numServers
+	var rest []int
+	for _, i := range all {
+		if i != leader && i != partner {
+			rest = append(rest, i)
+		}
+	}
+	partitionServers(network, ports, []int{leader, partner}, rest, []int{})
+	for seq := 1; seq < 5; seq++ {
+		paxosServers[leader].Start(seq, seq*10)
+		waitForDecision(test, paxosServers, seq, 2)
+	}
+	if !paxosServers[leader].IsLeader() {
+		test.Fatalf("Leader lost its lease with a phase 2 quorum")
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: A majority can't elect a leader with Q1 = 4 ...")
+
+	paxosServers[rest[0]].Start(5, 51)
+	time.Sleep(time.Second)
+	for _, i := range rest {
+		if paxosServers[i].IsLeader() {
+			test.Fatalf("Peer %v got elected by three of five", i)
+		}
+	}
+	for seq := 1; seq <= 5; seq++ {
+		for _, i := range rest {
+			if decided, value := paxosServers[i].Status(seq); decided && value != seq*10 {
+				test.Fatalf("Peer %v decided %v for instance %v", i, value, seq)
+			}
+		}
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Everyone agrees after heal ...")
+
+	partitionServers(network, ports, all, []int{}, []int{})
+	for seq := 0; seq <= 5; seq++ {
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+	for seq := 1; seq < 5; seq++ {
+		if _, value := paxosServers[rest[0]].Status(seq); value != seq*10 {
+			test.Fatalf("Instance %v decided %v, wanted %v", seq, value, seq*10)
+		}
+	}
+	waitForLeader(test, paxosServers, all)
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+func TestFileWeightedQuorums(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	opts.EnableLeader = 0
+	// Fresh peers have nothing to recover, and can't while partitioned right away
+	opts.Recovery = false
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 4
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	ports := makeMemoryPorts("weighted", numServers)
+
+	fmt.Printf("\nTest: A heavy peer decides on its own ...")
+
+	// Total weight 7, so one peer of weight 4 is a majority and the other three aren't
+	opts.Weights = map[string]int{ports[0]: 4}
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+	}
+	partitionServers(network, ports, []int{0}, []int{1, 2, 3}, []int{})
+	paxosServers[0].Start(0, 0)
+	waitForDecision(test, paxosServers, 0, 1)
+	checkUndecided(test, paxosServers, 1, []int{1, 2, 3})
+	partitionServers(network, ports, []int{0, 1, 2, 3}, []int{}, []int{})
+	waitForDecision(test, paxosServers, 0, numServers)
+	waitForDecision(test, paxosServers, 1, numServers)
+	cleanup(paxosServers)
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Grid quorums need a row to prepare and a column to accept ...")
+
+	// Rows {0, 1} and {2, 3} prepare, columns {0, 2} and {1, 3} accept
+	opts.Weights = nil
+	opts.Q1Sets = [][]string{{ports[0], ports[1]}, {ports[2], ports[3]}}
+	opts.Q2Sets = [][]string{{ports[0], ports[2]}, {ports[1], ports[3]}}
+	opts.DataDir = test.TempDir()
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+	}
+	partitionServers(network, ports, []int{0, 1}, []int{2, 3}, []int{})
+	checkUndecided(test, paxosServers, 0, []int{0, 1}, []int{2, 3})
+	partitionServers(network, ports, []int{0, 2}, []int{1, 3}, []int{})
+	checkUndecided(test, paxosServers, 1, []int{0, 2}, []int{1, 3})
+	// A row plus one peer of the other row holds a column too
+	partitionServers(network, ports, []int{0, 1, 2}, []int{3}, []int{})
+	paxosServers[1].Start(2, 21)
+	waitForDecision(test, paxosServers, 2, 3)
+	partitionServers(network, ports, []int{0, 1, 2, 3}, []int{}, []int{})
+	for seq := 0; seq < 3; seq++ {
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+func TestFileLearners(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	runtime.GOMAXPROCS(4)
+
+	const numVoters = 3
+	const numServers = 5
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	ports := makeMemoryPorts("learners", numServers)
+	opts.Learners = ports[numVoters:]
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+	}
+
+	fmt.Printf("\nTest: Learners learn every decided value ...")
+
+	for seq := 0; seq < 5; seq++ {
+		paxosServers[seq%numVoters].Start(seq, seq*10)
+	}
+	for seq := 0; seq < 5; seq++ {
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+	// A learner asks the voters to propose for it
+	paxosServers[3].Start(5, 50)
+	waitForDecision(test, paxosServers, 5, numServers)
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Learners don't count toward quorums ...")
+
+	partitionServers(network, ports, []int{0, 3, 4}, []int{1, 2}, []int{})
+	paxosServers[0].Start(6, 60)
+	time.Sleep(time.Second)
+	if numDecided(test, paxosServers, 6) > 0 {
+		test.Fatalf("One voter and two learners decided instance 6")
+	}
+	paxosServers[1].Start(7, 70)
+	waitForDecision(test, paxosServers[1:3], 7, 2)
+	partitionServers(network, ports, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	waitForDecision(test, paxosServers, 6, numServers)
+	waitForDecision(test, paxosServers, 7, numServers)
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Learners don't hold back Min ...")
+
+	paxosServers[4].KillSaveDisk()
+	paxosServers[4] = nil
+	for i := 0; i < numVoters; i++ {
+		paxosServers[i].Done(7)
+	}
+	// Dones travel with the next instances
+	for seq := 8; seq < 8+numVoters; seq++ {
+		paxosServers[seq%numVoters].Start(seq, seq*10)
+		waitForDecision(test, paxosServers, seq, numServers-1)
+	}
+	for i := 0; i < numVoters; i++ {
+		if min := paxosServers[i].Min(); min != 8 {
+			test.Fatalf("Voter %v has min %v, expected 8", i, min)
+		}
+	}
+	// A learner keeps the instances its own application hasn't applied
+	if min := paxosServers[3].Min(); min != 0 {
+		test.Fatalf("Learner has min %v, expected 0", min)
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: A restarted learner catches up ...")
+
+	paxosServers[4] = Make(ports, 4, nil, false, "", opts)
+	for seq := 8; seq < 8+numVoters; seq++ {
+		waitForDecision(test, paxosServers, seq, numServers)
+	}
+	if decided, value := paxosServers[4].Status(8); !decided || value != 80 {
+		test.Fatalf("Restarted learner has %v for instance 8, expected 80", value)
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Promoted learners vote ...")
+
+	paxosServers[0].Promote(ports[3])
+	start := paxosServers[0].Promote(ports[4])
+	if start < 0 {
+		test.Fatalf("Promotion failed")
+	}
+	// The promoted peers must hear of the change before the decider is cut off
+	for iters := 0; ; iters++ {
+		heard := 0
+		for _, px := range paxosServers {
+			if decided, _ := px.Status(start - changeDelay); decided {
+				heard++
+			}
+		}
+		if heard == numServers {
+			break
+		}
+		if iters == 100 {
+			test.Fatalf("Only %v peers heard of the promotion", heard)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	// Three of five voters are a majority now
+	partitionServers(network, ports, []int{0, 3, 4}, []int{1, 2}, []int{})
+	paxosServers[3].Start(start, start*10)
+	waitForDecision(test, []*Paxos{paxosServers[0], paxosServers[3], paxosServers[4]}, start, 3)
+	partitionServers(network, ports, []int{0, 1, 2, 3, 4}, []int{}, []int{})
+	waitForDecision(test, paxosServers, start, numServers)
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+func checkMin(test *testing.T, paxosServers []*Paxos, among []int, wanted int) {
+	for iters := 0; ; iters++ {
+		wrong := -1
+		for _, i := range among {
+			if min := paxosServers[i].Min(); min != wanted {
+				wrong = i
+			}
+		}
+		if wrong < 0 {
+			return
+		}
+		if iters == 50 {
+			test.Fatalf("Peer %v has min %v, expected %v", wrong, paxosServers[wrong].Min(), wanted)
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// Wait for the given peers to count peer in Min() again
+func checkIncluded(test *testing.T, paxosServers []*Paxos, among []int, peer string) {
+	for _, i := range among {
+		for iters := 0; ; iters++ {
+			paxosServers[i].mu.Lock()
+			excluded := paxosServers[i].excluded[peer]
+			paxosServers[i].mu.Unlock()
+			if !excluded {
+				break
+			}
+			if iters == 50 {
+				test.Fatalf("Peer %v still excludes %v", i, peer)
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+	}
+}
+
+func TestFileStragglers(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	opts.Transport = transport.NewMemory(0)
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 3
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	ports := makeMemoryPorts("stragglers", numServers)
+	snapshotters := make([]*testSnapshotter, numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+		snapshotters[i] = &testSnapshotter{seq: -1}
+		paxosServers[i].SetSnapshotter(snapshotters[i])
+	}
+	// Agree on instances from..to-1 among the given peers, applying them
+	seq := 0
+	agree := func(to int, among []int) {
+		for ; seq < to; seq++ {
+			paxosServers[among[0]].Start(seq, seq*10)
+			waitForDecision(test, paxosServers, seq, len(among))
+		}
+		for _, i := range among {
+			snapshotters[i].applied(seq - 1)
+			paxosServers[i].Done(seq - 1)
+		}
+	}
+
+	fmt.Printf("\nTest: Excluded peers don't hold back Min ...")
+
+	agree(10, []int{0, 1, 2})
+	// Dones travel with the next instances
+	agree(13, []int{0, 1, 2})
+	checkMin(test, paxosServers, []int{0, 1, 2}, 10)
+
+	paxosServers[0].KillSaveDisk()
+	paxosServers[0] = nil
+	others := []int{1, 2}
+	agree(20, others)
+	agree(23, others)
+	checkMin(test, paxosServers, others, 10)
+	for _, i := range others {
+		paxosServers[i].Exclude(ports[0])
+	}
+	checkMin(test, paxosServers, others, 20)
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Forgotten instances are refused ...")
+
+	// Wait for the collector to forget
+	time.Sleep(500 * time.Millisecond)
+	args := &PrepareArgs{Server: 0, Instance: 15, PID: Ballot{1 << 20, 0}, Done: map[string]int{}}
+	var reply PrepareReply
+	paxosServers[1].Prepare(args, &reply)
+	if !reply.Forgotten || !reply.Err {
+		test.Fatalf("Prepare for a forgotten instance got %+v", reply)
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: A straggler catches up from a snapshot and counts again ...")
+
+	paxosServers[0] = Make(ports, 0, nil, false, "", opts)
+	snapSeq, _ := paxosServers[0].FetchedSnapshot()
+	if snapSeq < 19 {
+		test.Fatalf("Straggler fetched a snapshot at %v, expected at least 19", snapSeq)
+	}
+	snapshotters[0].applied(snapSeq)
+	paxosServers[0].SetSnapshotter(snapshotters[0])
+	paxosServers[0].Done(snapSeq)
+	agree(26, []int{0, 1, 2})
+	agree(29, []int{0, 1, 2})
+	checkMin(test, paxosServers, []int{0, 1, 2}, 26)
+	// The collectors take the straggler back on their next pass
+	checkIncluded(test, paxosServers, others, ports[0])
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Peers silent past ExcludeAfter are excluded ...")
+
+	for i := 0; i < numServers; i++ {
+		paxosServers[i].Kill()
+		paxosServers[i] = nil
+	}
+	opts = testOptions(test)
+	opts.Transport = transport.NewMemory(0)
+	opts.ExcludeAfter = 500 * time.Millisecond
+	ports = makeMemoryPorts("excludeafter", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+		snapshotters[i] = &testSnapshotter{seq: -1}
+		paxosServers[i].SetSnapshotter(snapshotters[i])
+	}
+	seq = 0
+	agree(5, []int{0, 1, 2})
+	// Pings carry the Dones, and keep quiet peers from being excluded
+	time.Sleep(time.Second)
+	checkMin(test, paxosServers, []int{0, 1, 2}, 5)
+
+	paxosServers[2].Kill()
+	paxosServers[2] = nil
+	others = []int{0, 1}
+	agree(10, others)
+	checkMin(test, paxosServers, others, 10)
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: A straggler cut off past ExcludeAfter catches up without restarting ...")
+
+	for i := 0; i < numServers; i++ {
+		if paxosServers[i] != nil {
+			paxosServers[i].Kill()
+			paxosServers[i] = nil
+		}
+	}
+	opts = testOptions(test)
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	opts.ExcludeAfter = 500 * time.Millisecond
+	ports = makeMemoryPorts("cutoff", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+		snapshotters[i] = &testSnapshotter{seq: -1}
+		paxosServers[i].SetSnapshotter(snapshotters[i])
+	}
+	seq = 0
+	agree(5, []int{0, 1, 2})
+
+	partitionServers(network, ports, []int{0, 1}, []int{2}, []int{})
+	agree(10, others)
+	time.Sleep(time.Second)
+	agree(13, others)
+	checkMin(test, paxosServers, others, 10)
+	// Wait for the collectors to forget
+	time.Sleep(500 * time.Millisecond)
+	// Deaf, so the retried Decides can't teach it the instances; its own calls still get answers
+	paxosServers[2].setdeaf(true)
+	partitionServers(network, ports, []int{0, 1, 2}, []int{}, []int{})
+
+	// Proposing an instance the others forgot fetches a snapshot, and the wait ends
+	paxosServers[2].Start(5, "late")
+	waitStart := time.Now()
+	if decided, _ := paxosServers[2].Wait(5, 10*time.Second); decided {
+		test.Fatalf("Straggler learned forgotten instance 5")
+	}
+	if time.Since(waitStart) >= 10*time.Second {
+		test.Fatalf("Straggler is still waiting for forgotten instance 5")
+	}
+	snapSeq, _ = paxosServers[2].FetchedSnapshot()
+	if snapSeq < 9 {
+		test.Fatalf("Straggler fetched a snapshot at %v, expected at least 9", snapSeq)
+	}
+	paxosServers[2].setdeaf(false)
+	snapshotters[2].applied(snapSeq)
+	paxosServers[2].Done(snapSeq)
+	seq = snapSeq + 1
+	// Pings carry the Dones, and the straggler counts again
+	agree(seq+3, []int{0, 1, 2})
+	checkMin(test, paxosServers, []int{0, 1, 2}, seq)
+	checkIncluded(test, paxosServers, others, ports[2])
+
+	fmt.Printf("\n\tPassed\n\n")
+}
+
+// Entries kept for any instance, in every per-instance map
+func keptInstances(px *Paxos) int {
+	px.mu.Lock()
+	kept := len(px.instances) + len(px.proposed) + len(px.assigned) + len(px.damaged)
+	px.mu.Unlock()
+	px.leaderMu.Lock()
+	kept += len(px.leader)
+	px.leaderMu.Unlock()
+	px.waitMu.Lock()
+	kept += len(px.waiters)
+	px.waitMu.Unlock()
+	return kept
+}
+
+func heapInUse() uint64 {
+	var stats runtime.MemStats
+	runtime.GC()
+	runtime.ReadMemStats(&stats)
+	return stats.HeapAlloc
+}
+
+// Memory stays flat when the application keeps calling Done()
+// Takes over a minute, so it is skipped with -short
+func TestFileForgetLong(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	if testing.Short() {
+		test.Skip("100k instances take over a minute")
+	}
+	opts := testOptions(test)
+	opts.Transport = transport.NewMemory(0)
+	opts.Persistent = false
+	opts.WriteToMemory = true
+	runtime.GOMAXPROCS(4)
+
+	fmt.Printf("\nTest: Per-instance state is forgotten over 100k instances ...")
+
+	const numServers = 3
+	const numInstances = 100000
+	var paxosServers []*Paxos = make([]*Paxos, numServers)
+	defer cleanup(paxosServers)
+	ports := makeMemoryPorts("forgetlong", numServers)
+	for i := 0; i < numServers; i++ {
+		paxosServers[i] = Make(ports, i, nil, false, "", opts)
+	}
+
+	var baseline uint64
+	for seq := 0; seq < numInstances; seq++ {
+		paxosServers[seq%numServers].Start(seq, seq)
+		for _, px := range paxosServers {
+			if decided, v := px.Wait(seq, 10*time.Second); !decided || v != seq {
+				test.Fatalf("Instance %v got %v, %v", seq, decided, v)
+			}
+			px.Done(seq)
+		}
+		// The heap after 10k instances is compared with the heap after 100k
+		if seq == numInstances/10 {
+			baseline = heapInUse()
+		}
+	}
+	// Give the collectors a moment to catch up
+	time.Sleep(time.Second)
+
+	for i, px := range paxosServers {
+		if kept := keptInstances(px); kept > 1000 {
+			test.Fatalf("Peer %v keeps %v entries for instances below Min %v", i, kept, px.Min())
+		}
+	}
+	// Keeping even one map entry for each of the last 90k instances would take megabytes
+	if heap := heapInUse(); heap > baseline+(512<<10) {
+		test.Fatalf("Heap grew from %v to %v bytes", baseline, heap)
+	}
+
+	fmt.Printf("\n\tPassed\n\n")
+}
@@ -0,0 +1,511 @@
+package rsm
+
+//
+// Replicated state machine on top of a Paxos peer.
+//
+// The application implements StateMachine and submits its ops:
+//
+// r = rsm.Make(px, sm, applied) -- sm already reflects every instance <= applied
+// r.Submit(op) (result, error) -- agree on op, apply it, and return sm's result
+// r.SubmitPipelined(op, l) (result, error) -- Submit, releasing l while op is agreed on
+// r.SetPipeline(depth) -- let up to depth SubmitPipelined ops be agreed on at once
+// r.Sync() error -- apply every instance this peer has heard of
+// r.SyncLeased() (bool, error) -- if this peer holds the Paxos leader lease, apply every instance that may be chosen
+// r.Applied() int -- highest instance applied
+// r.Snapshot() (seq, data) -- state of sm and of the library as of instance seq
+// r.Restore(data) -- replace the state with a snapshot taken by a peer
+//
+// Ops are applied in log order, once per instance, in the goroutine
+// that called Submit or Sync. Instances that are not decided when
+// the log is replayed get a no-op, so the log never stalls on a
+// proposer that died. Ops that implement Request are applied at most
+// once per request, even when a client sends it to several servers.
+// Values that are not Entries, such as paxos PeerChanges, are no-ops.
+//
+// The RSM serves its snapshots to Paxos peers that fall behind the
+// others' Min(), and installs the one its own peer fetched, at startup
+// or once the others forgot instances it missed, before replaying the
+// rest of the log. A state machine that finds its state damaged
+// returns ErrDamaged from Apply, and the RSM replaces the state with
+// a peer's snapshot and applies the log again from there.
+//
+
+import "bytes"
+import "crypto/rand"
+import "encoding/gob"
+import "errors"
+import "math/big"
+import "paxos"
+import "sync"
+import "time"
+
+var ErrKilled = errors.New("rsm: paxos peer killed")
+var ErrDamaged = errors.New("rsm: state machine damaged")
+
+// How long to wait for an instance before proposing there again
+const retryInterval = time.Second
+
+// Options for a server built on an RSM: its Paxos peer's, and how it submits ops
+type Options struct {
+	paxos.Options
+	BatchSize  int           // Most client ops a shardkv server agrees on in one instance (1 = no batching)
+	BatchDelay time.Duration // How long a shardkv server waits for more client ops before proposing a batch
+	Pipeline   int           // Most client ops a shardkv or shardmaster server agrees on at once (1 = one at a time)
+}
+
+// Returns paxos.DefaultOptions, submitting one op at a time
+func DefaultOptions() Options {
+	opts := Options{Options: paxos.DefaultOptions()}
+	opts.BatchSize = 1
+	opts.BatchDelay = time.Millisecond
+	opts.Pipeline = 1
+	return opts
+}
+
+type StateMachine interface {
+	// Apply a decided op and return its result
+	// Returns ErrDamaged, applying nothing, if the state was found damaged
+	Apply(op interface{}) interface{}
+
+	// Every instance <= seq has been applied; persist it if needed
+	// Paxos may forget those instances once this returns
+	Applied(seq int)
+
+	// Encode the whole state, or return nil if it was found damaged,
+	// and replace it with an encoded state
+	Snapshot() []byte
+	Restore(data []byte)
+}
+
+// Ops from clients that retry implement Request
+// Each client's IDs must increase with every request it sends, since a
+// server's retries can bring back a request older than the last one applied
+// Client 0 means the op is not a request, and is never deduplicated
+// Results of requests are part of snapshots, so their types must be registered with gob
+type Request interface {
+	RequestID() (client int64, id int64)
+}
+
+// The value agreed on for each instance; ID tells Submit whose op won
+// An Entry with a nil Op is a no-op
+type Entry struct {
+	ID int64
+	Op interface{}
+}
+
+// The last request applied for a client, and its result
+// Requests with lower IDs were applied already, or are older than it
+type lastRequest struct {
+	ID     int64
+	Result interface{}
+}
+
+type snapshot struct {
+	Applied int
+	Clients map[int64]lastRequest
+	State   []byte
+}
+
+type RSM struct {
+	mu        sync.Mutex
+	px        *paxos.Paxos
+	sm        StateMachine
+	applied   int
+	clients   map[int64]lastRequest
+	repairing bool // Whether the damaged state is being replaced; nothing is applied meanwhile
+
+	// Pipelining
+	depth    int                   // Most SubmitPipelined ops agreed on at once
+	slots    chan bool             // One per op being agreed on
+	waiting  map[int64]bool        // Entries of SubmitPipelined ops not applied yet
+	results  map[int64]interface{} // Results of those entries, once applied
+	seqMu    sync.Mutex
+	next     int          // Lowest instance not yet claimed by SubmitPipelined
+	inflight map[int]bool // Instances claimed by SubmitPipelined and not decided yet
+}
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	return bigx.Int64()
+}
+
+func Make(px *paxos.Paxos, sm StateMachine, applied int) *RSM {
+	gob.Register(Entry{})
+	r := &RSM{}
+	r.px = px
+	r.sm = sm
+	r.applied = applied
+	r.clients = make(map[int64]lastRequest)
+	r.depth = 1
+	r.slots = make(chan bool, 1)
+	r.waiting = make(map[int64]bool)
+	r.results = make(map[int64]interface{})
+	r.inflight = make(map[int]bool)
+	px.SetSnapshotter(r)
+	return r
+}
+
+// Let up to depth SubmitPipelined ops be agreed on at once; call before submitting
+func (r *RSM) SetPipeline(depth int) {
+	if depth < 1 {
+		depth = 1
+	}
+	r.depth = depth
+	r.slots = make(chan bool, depth)
+}
+
+// Agree on op and apply it, along with every op decided before it
+// Returns what sm.Apply returned, or the saved result of a duplicate request
+func (r *RSM) Submit(op interface{}) (interface{}, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	entry := Entry{nrand(), op}
+	r.waiting[entry.ID] = true
+	defer func() {
+		delete(r.waiting, entry.ID)
+		delete(r.results, entry.ID)
+	}()
+	for {
+		if err := r.installFetched(); err != nil {
+			return nil, err
+		}
+		// Propose at the first instance nobody has used yet
+		seq := r.px.Max() + 1
+		if seq <= r.applied {
+			seq = r.applied + 1
+		}
+		if err := r.catchUp(seq); err != nil {
+			return nil, err
+		}
+		r.px.Start(seq, entry)
+		r.mu.Unlock()
+		decided, v := r.wait(seq, func() { r.px.Start(seq, entry) })
+		r.mu.Lock()
+		if !decided {
+			if err := r.skipForgotten(seq); err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Apply everything up to our instance, which another caller may have done meanwhile
+		if err := r.catchUp(seq + 1); err != nil {
+			return nil, err
+		}
+		// Another peer's op may have taken the instance; try the next one
+		if won, _ := v.(Entry); won.Op != nil && won.ID == entry.ID {
+			return r.results[entry.ID], nil
+		}
+	}
+}
+
+// Same as Submit, but l, which the caller holds, is released while op
+// is agreed on, so other ops can be proposed at later instances in the
+// meantime. Ops are still applied in log order, with l and r.mu held
+// With a pipeline depth of 1 this is Submit, and l stays held
+func (r *RSM) SubmitPipelined(op interface{}, l sync.Locker) (interface{}, error) {
+	if r.depth <= 1 {
+		return r.Submit(op)
+	}
+
+	entry := Entry{nrand(), op}
+	r.mu.Lock()
+	r.waiting[entry.ID] = true
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.waiting, entry.ID)
+		delete(r.results, entry.ID)
+		r.mu.Unlock()
+	}()
+
+	for {
+		r.slots <- true
+		seq := r.claim()
+		l.Unlock()
+		r.px.Start(seq, entry)
+		decided, v := r.wait(seq, func() { r.px.Start(seq, entry) })
+		r.seqMu.Lock()
+		delete(r.inflight, seq)
+		r.seqMu.Unlock()
+		<-r.slots
+		l.Lock()
+		if !decided {
+			r.mu.Lock()
+			err := r.skipForgotten(seq)
+			r.mu.Unlock()
+			if err != nil {
+				return nil, err
+			}
+			continue
+		}
+
+		// Apply everything up to our instance, which may have been done by another op already
+		r.mu.Lock()
+		err := r.catchUp(seq + 1)
+		result := r.results[entry.ID]
+		r.mu.Unlock()
+		if err != nil {
+			return nil, err
+		}
+		// Another peer's op may have taken the instance; try the next one
+		if won, _ := v.(Entry); won.Op != nil && won.ID == entry.ID {
+			return result, nil
+		}
+	}
+}
+
+// Wait for seq to be decided, calling propose again every retryInterval
+// in case the proposal was lost, e.g. with the leader it was sent to
+// Returns undecided only if the peer was killed or seq was forgotten
+func (r *RSM) wait(seq int, propose func()) (bool, interface{}) {
+	for {
+		start := time.Now()
+		decided, v := r.px.Wait(seq, retryInterval)
+		if decided || time.Since(start) < retryInterval {
+			return decided, v
+		}
+		propose()
+	}
+}
+
+// Pick the first instance nobody has used or claimed yet, and claim it
+func (r *RSM) claim() int {
+	r.mu.Lock()
+	applied := r.applied
+	r.mu.Unlock()
+	r.seqMu.Lock()
+	defer r.seqMu.Unlock()
+	seq := r.px.Max() + 1
+	if seq <= applied {
+		seq = applied + 1
+	}
+	if seq < r.next {
+		seq = r.next
+	}
+	r.next = seq + 1
+	r.inflight[seq] = true
+	return seq
+}
+
+// Whether SubmitPipelined has claimed seq and not seen it decided yet
+func (r *RSM) claimed(seq int) bool {
+	r.seqMu.Lock()
+	defer r.seqMu.Unlock()
+	return r.inflight[seq]
+}
+
+// Apply everything decided so far, filling holes with no-ops
+func (r *RSM) Sync() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.catchUp(r.px.Max() + 1)
+}
+
+// Apply every instance that may have been chosen, if the Paxos peer holds
+// the leader lease. sm then reflects every op that completed before the
+// call, so reads can be answered from it without going through the log.
+// Returns false without a lease; the caller should Submit instead
+func (r *RSM) SyncLeased() (bool, error) {
+	seq, leased := r.px.ReadIndex()
+	if !leased {
+		return false, nil
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return true, r.catchUp(seq + 1)
+}
+
+func (r *RSM) Applied() int {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.applied
+}
+
+// Returns the state as of Applied(), for a peer that can't replay the log
+func (r *RSM) Snapshot() (int, []byte) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	state := r.sm.Snapshot()
+	if state == nil {
+		return -1, nil
+	}
+	var buffer bytes.Buffer
+	s := snapshot{r.applied, r.clients, state}
+	if err := gob.NewEncoder(&buffer).Encode(s); err != nil {
+		return -1, nil
+	}
+	return r.applied, buffer.Bytes()
+}
+
+// Install a snapshot made by Snapshot, unless this peer is already past it
+func (r *RSM) Restore(data []byte) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.restore(data)
+}
+
+// Install the snapshot Paxos fetched when it started, if any; r.mu must be held
+func (r *RSM) installFetched() error {
+	if _, data := r.px.FetchedSnapshot(); data != nil {
+		return r.restore(data)
+	}
+	return nil
+}
+
+// r.mu must be held
+func (r *RSM) restore(data []byte) error {
+	var s snapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return err
+	}
+	if s.Applied <= r.applied {
+		return nil
+	}
+	r.install(s)
+	return nil
+}
+
+// Replace the state with a decoded snapshot; r.mu must be held
+func (r *RSM) install(s snapshot) {
+	r.sm.Restore(s.State)
+	r.clients = s.Clients
+	if r.clients == nil {
+		r.clients = make(map[int64]lastRequest)
+	}
+	r.setApplied(s.Applied)
+}
+
+// Apply every instance below maxSeq; r.mu must be held
+// r.mu is released while waiting for an instance, since peers fetch
+// snapshots under it, so other callers may apply some instances meanwhile
+func (r *RSM) catchUp(maxSeq int) error {
+	if r.repairing {
+		return ErrDamaged
+	}
+	if err := r.installFetched(); err != nil {
+		return err
+	}
+	from := r.applied
+	for seq := r.applied + 1; seq < maxSeq; seq++ {
+		decided, v := r.px.Status(seq)
+		if !decided {
+			propose := func() {
+				// An op being agreed on there will get it decided
+				if !r.claimed(seq) {
+					r.px.Start(seq, Entry{})
+				}
+			}
+			propose()
+			r.mu.Unlock()
+			decided, v = r.wait(seq, propose)
+			r.mu.Lock()
+			if r.applied >= seq {
+				seq = r.applied
+				continue
+			}
+		}
+		if !decided {
+			if err := r.skipForgotten(seq); err != nil {
+				return err
+			}
+			// Go on after the snapshot
+			seq = r.applied
+			continue
+		}
+		entry, _ := v.(Entry)
+		if r.applyEntry(entry) == ErrDamaged {
+			if err := r.repair(); err != nil {
+				return err
+			}
+			// Apply again from the snapshot, which may be older than seq
+			seq = r.applied
+			continue
+		}
+		r.applied = seq
+	}
+	if r.applied > from {
+		r.setApplied(r.applied)
+	}
+	return nil
+}
+
+// Wait returned without seq decided: the peer was killed, or the other
+// peers forgot seq and Paxos fetched a snapshot that covers it instead
+// Installs the snapshot, or returns ErrKilled; r.mu must be held
+func (r *RSM) skipForgotten(seq int) error {
+	if err := r.installFetched(); err != nil {
+		return err
+	}
+	if r.applied < seq {
+		return ErrKilled
+	}
+	return nil
+}
+
+// Replace the state, which sm found damaged, with a peer's snapshot
+// The snapshot may be older than what was applied here, but not than
+// Min(), so the log still holds every instance after it to apply again
+// r.mu is released while the snapshot is fetched, and catchUp fails
+// with ErrDamaged until it is installed; r.mu must be held
+func (r *RSM) repair() error {
+	r.repairing = true
+	defer func() { r.repairing = false }()
+	r.mu.Unlock()
+	_, data := r.px.RequestSnapshot(r.px.Min() - 1)
+	r.mu.Lock()
+	if data == nil {
+		return ErrKilled
+	}
+	var s snapshot
+	if err := gob.NewDecoder(bytes.NewReader(data)).Decode(&s); err != nil {
+		return err
+	}
+	r.install(s)
+	return nil
+}
+
+// Apply one decided entry, keeping its result if a SubmitPipelined op is waiting for it
+// The result of an entry sm found damaged state for is lost; its op is in the snapshot that repairs it
+func (r *RSM) applyEntry(entry Entry) interface{} {
+	result := r.apply(entry)
+	if r.waiting[entry.ID] && result != ErrDamaged {
+		r.results[entry.ID] = result
+	}
+	return result
+}
+
+// Apply one decided entry, skipping no-ops and duplicate requests
+func (r *RSM) apply(entry Entry) interface{} {
+	if entry.Op == nil {
+		return nil
+	}
+	req, ok := entry.Op.(Request)
+	if !ok {
+		return r.sm.Apply(entry.Op)
+	}
+	client, id := req.RequestID()
+	if client == 0 {
+		return r.sm.Apply(entry.Op)
+	}
+	if last, ok := r.clients[client]; ok && id <= last.ID {
+		// Only the client of the last request can still be waiting for a result
+		if id == last.ID {
+			return last.Result
+		}
+		return nil
+	}
+	result := r.sm.Apply(entry.Op)
+	if result != ErrDamaged {
+		r.clients[client] = lastRequest{id, result}
+	}
+	return result
+}
+
+func (r *RSM) setApplied(seq int) {
+	r.applied = seq
+	r.sm.Applied(seq)
+	r.px.Done(seq)
+}
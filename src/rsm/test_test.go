@@ -0,0 +1,468 @@
+package rsm
+
+import "testing"
+import "paxos"
+import "transport"
+import "strconv"
+import "sync"
+import "encoding/gob"
+import "bytes"
+import "fmt"
+import "time"
+
+// Adds N to the counter, or makes a client's request to do so
+type AddOp struct {
+	N      int
+	Client int64
+	ID     int64
+}
+
+func (op AddOp) RequestID() (int64, int64) {
+	return op.Client, op.ID
+}
+
+// Replicated counter; each Apply returns the new total
+type counter struct {
+	mu      sync.Mutex
+	total   int
+	ops     int
+	applied int
+	damaged bool // set by tests; Restore clears it
+}
+
+func (c *counter) Apply(op interface{}) interface{} {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.damaged {
+		return ErrDamaged
+	}
+	c.total += op.(AddOp).N
+	c.ops++
+	return c.total
+}
+
+func (c *counter) Applied(seq int) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.applied = seq
+}
+
+func (c *counter) Snapshot() []byte {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.damaged {
+		return nil
+	}
+	var buffer bytes.Buffer
+	gob.NewEncoder(&buffer).Encode(c.total)
+	return buffer.Bytes()
+}
+
+func (c *counter) Restore(data []byte) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	gob.NewDecoder(bytes.NewReader(data)).Decode(&c.total)
+	c.damaged = false
+}
+
+func (c *counter) get() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.total
+}
+
+// Options for peers on a fresh simulated network, keeping nothing on disk
+func testOptions(test *testing.T) paxos.Options {
+	gob.Register(AddOp{})
+	opts := paxos.DefaultOptions()
+	opts.Persistent = false
+	opts.DataDir = test.TempDir()
+	opts.Transport = transport.NewMemory(0)
+	return opts
+}
+
+// Start numServers Paxos peers on a simulated network, each with a counter
+func makeServers(test *testing.T, tag string, numServers int) ([]*paxos.Paxos, []*RSM, []*counter) {
+	pxa, rsms, counters, _, _ := makeServersOpts(test, tag, numServers)
+	return pxa, rsms, counters
+}
+
+// Same as makeServers, also returning the ports and options so servers can be restarted
+func makeServersOpts(test *testing.T, tag string, numServers int) ([]*paxos.Paxos, []*RSM, []*counter, []string, paxos.Options) {
+	opts := testOptions(test)
+	ports := make([]string, numServers)
+	for i := 0; i < numServers; i++ {
+		ports[i] = "rsm-" + tag + "-" + strconv.Itoa(i)
+	}
+	pxa := make([]*paxos.Paxos, numServers)
+	rsms := make([]*RSM, numServers)
+	counters := make([]*counter, numServers)
+	for i := 0; i < numServers; i++ {
+		pxa[i] = paxos.Make(ports, i, nil, false, "", opts)
+		counters[i] = &counter{applied: -1}
+		rsms[i] = Make(pxa[i], counters[i], -1)
+	}
+	return pxa, rsms, counters, ports, opts
+}
+
+func cleanup(pxa []*paxos.Paxos) {
+	for i := 0; i < len(pxa); i++ {
+		if pxa[i] != nil {
+			pxa[i].Kill()
+		}
+	}
+}
+
+// Concurrent submits at every server are each applied once, in the same order everywhere
+func TestSubmit(test *testing.T) {
+	const numServers = 3
+	const perServer = 10
+	pxa, rsms, counters := makeServers(test, "submit", numServers)
+	defer cleanup(pxa)
+
+	fmt.Printf("Test: Concurrent Submit ...\n")
+	results := make(chan int, numServers*perServer)
+	var wg sync.WaitGroup
+	for i := 0; i < numServers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < perServer; j++ {
+				result, err := rsms[i].Submit(AddOp{N: 1})
+				if err != nil {
+					test.Errorf("Submit failed: %v", err)
+					return
+				}
+				results <- result.(int)
+			}
+		}(i)
+	}
+	wg.Wait()
+	close(results)
+
+	// Each op saw a different total
+	seen := make(map[int]bool)
+	for result := range results {
+		if seen[result] {
+			test.Fatalf("Two ops got the same result %v", result)
+		}
+		seen[result] = true
+	}
+	for i := 0; i < numServers; i++ {
+		// Adding nothing makes the server catch up with the others
+		if _, err := rsms[i].Submit(AddOp{N: 0}); err != nil {
+			test.Fatalf("Submit failed: %v", err)
+		}
+		if total := counters[i].get(); total != numServers*perServer {
+			test.Fatalf("Server %v has total %v, wanted %v", i, total, numServers*perServer)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// A request sent to two servers is applied once, and both get its result
+func TestDuplicate(test *testing.T) {
+	pxa, rsms, counters := makeServers(test, "duplicate", 3)
+	defer cleanup(pxa)
+
+	fmt.Printf("Test: Duplicate requests ...\n")
+	op := AddOp{5, 1, 1}
+	first, err := rsms[0].Submit(op)
+	if err != nil {
+		test.Fatalf("Submit failed: %v", err)
+	}
+	again, err := rsms[1].Submit(op)
+	if err != nil {
+		test.Fatalf("Submit failed: %v", err)
+	}
+	if first != 5 || again != 5 {
+		test.Fatalf("Results %v and %v, wanted 5", first, again)
+	}
+	// The client's next request goes through
+	if next, _ := rsms[2].Submit(AddOp{5, 1, 2}); next != 10 {
+		test.Fatalf("Next request got %v, wanted 10", next)
+	}
+	// Ops that are not requests are never deduplicated
+	rsms[0].Submit(AddOp{N: 1})
+	rsms[0].Submit(AddOp{N: 1})
+	for i := 0; i < 3; i++ {
+		rsms[i].Submit(AddOp{N: 0})
+		if total := counters[i].get(); total != 12 {
+			test.Fatalf("Server %v has total %v, wanted 12", i, total)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// A request that comes back after a newer one from its client was applied is not applied again
+func TestStaleDuplicate(test *testing.T) {
+	pxa, rsms, counters := makeServers(test, "staleduplicate", 3)
+	defer cleanup(pxa)
+
+	fmt.Printf("Test: Requests retried after a newer one ...\n")
+	if _, err := rsms[0].Submit(AddOp{5, 1, 1}); err != nil {
+		test.Fatalf("Submit failed: %v", err)
+	}
+	if _, err := rsms[1].Submit(AddOp{5, 1, 2}); err != nil {
+		test.Fatalf("Submit failed: %v", err)
+	}
+	// A server's retry proposes the first request again
+	if _, err := rsms[2].Submit(AddOp{5, 1, 1}); err != nil {
+		test.Fatalf("Submit failed: %v", err)
+	}
+	for i := 0; i < 3; i++ {
+		rsms[i].Submit(AddOp{N: 0})
+		if total := counters[i].get(); total != 10 {
+			test.Fatalf("Server %v has total %v, wanted 10", i, total)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// Holes in the log are filled with no-ops, and Applied and Done follow
+func TestNoOps(test *testing.T) {
+	pxa, rsms, counters := makeServers(test, "noops", 3)
+	defer cleanup(pxa)
+
+	fmt.Printf("Test: Holes filled with no-ops ...\n")
+	pxa[0].Start(5, Entry{1, AddOp{N: 7}})
+	pxa[0].Wait(5, 0)
+	if err := rsms[0].Sync(); err != nil {
+		test.Fatalf("Sync failed: %v", err)
+	}
+	if total := counters[0].get(); total != 7 {
+		test.Fatalf("Total %v, wanted 7", total)
+	}
+	if counters[0].ops != 1 {
+		test.Fatalf("%v ops applied, wanted 1", counters[0].ops)
+	}
+	if rsms[0].Applied() != 5 || counters[0].applied != 5 {
+		test.Fatalf("Applied %v, wanted 5", rsms[0].Applied())
+	}
+	for seq := 0; seq < 5; seq++ {
+		decided, v := pxa[2].Wait(seq, 0)
+		if !decided || v.(Entry).Op != nil {
+			test.Fatalf("Instance %v is %v, wanted a no-op", seq, v)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// A snapshot carries the state and the duplicate table to another server
+func TestSnapshot(test *testing.T) {
+	pxa, rsms, counters := makeServers(test, "snapshot", 3)
+	defer cleanup(pxa)
+
+	fmt.Printf("Test: Snapshot and Restore ...\n")
+	for i := 1; i <= 5; i++ {
+		rsms[0].Submit(AddOp{1, 1, int64(i)})
+	}
+	seq, data := rsms[0].Snapshot()
+	if seq != 4 {
+		test.Fatalf("Snapshot at %v, wanted 4", seq)
+	}
+
+	fresh := &counter{applied: -1}
+	r := Make(pxa[2], fresh, -1)
+	if err := r.Restore(data); err != nil {
+		test.Fatalf("Restore failed: %v", err)
+	}
+	if fresh.get() != 5 || r.Applied() != 4 {
+		test.Fatalf("Restored total %v at %v, wanted 5 at 4", fresh.get(), r.Applied())
+	}
+	// The restored server still knows the client's last request
+	if result, _ := r.Submit(AddOp{1, 1, 5}); result != 5 {
+		test.Fatalf("Duplicate after Restore got %v, wanted 5", result)
+	}
+	rsms[1].Submit(AddOp{N: 0})
+	if counters[1].get() != 5 {
+		test.Fatalf("Server 1 has total %v, wanted 5", counters[1].get())
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// A server whose state is damaged replaces it with a peer's snapshot,
+// and applies the op that found the damage again
+func TestRepair(test *testing.T) {
+	pxa, rsms, counters := makeServers(test, "repair", 3)
+	defer cleanup(pxa)
+
+	fmt.Printf("Test: Repair damaged state from a peer ...\n")
+	for i := 0; i < 5; i++ {
+		rsms[i%3].Submit(AddOp{N: 1})
+	}
+	counters[1].mu.Lock()
+	counters[1].total = 1000
+	counters[1].damaged = true
+	counters[1].mu.Unlock()
+
+	result, err := rsms[1].Submit(AddOp{N: 1})
+	if err != nil {
+		test.Fatalf("Submit failed: %v", err)
+	}
+	if result != 6 || counters[1].get() != 6 {
+		test.Fatalf("Repaired server got %v with total %v, wanted 6", result, counters[1].get())
+	}
+	rsms[0].Submit(AddOp{N: 0})
+	if counters[0].get() != 6 {
+		test.Fatalf("Server 0 has total %v, wanted 6", counters[0].get())
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// A server restarted without its state installs a snapshot from the others,
+// once they have forgotten the instances it would need
+func TestCatchUpFromSnapshot(test *testing.T) {
+	pxa, rsms, counters, ports, opts := makeServersOpts(test, "catchup", 3)
+	defer cleanup(pxa)
+
+	fmt.Printf("Test: Catch up from a snapshot ...\n")
+	for i := 0; i < 10; i++ {
+		rsms[i%3].Submit(AddOp{N: 1})
+	}
+	// Every server applies everything, then the Done calls spread with more instances
+	for round := 0; round < 2; round++ {
+		for i := 0; i < 3; i++ {
+			rsms[i].Submit(AddOp{N: 0})
+		}
+	}
+	if min := pxa[1].Min(); min < 10 {
+		test.Fatalf("Min is %v, expected at least 10", min)
+	}
+
+	pxa[0].Kill()
+	for i := 0; i < 5; i++ {
+		rsms[1].Submit(AddOp{N: 1})
+	}
+
+	pxa[0] = paxos.Make(ports, 0, nil, false, "", opts)
+	counters[0] = &counter{applied: -1}
+	rsms[0] = Make(pxa[0], counters[0], -1)
+	if _, err := rsms[0].Submit(AddOp{N: 0}); err != nil {
+		test.Fatalf("Submit failed: %v", err)
+	}
+	if total := counters[0].get(); total != 15 {
+		test.Fatalf("Restarted server has total %v, wanted 15", total)
+	}
+	if counters[0].ops > 10 {
+		test.Fatalf("Restarted server replayed %v ops, wanted only the tail", counters[0].ops)
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// A server cut off past ExcludeAfter keeps running, and catches up from a snapshot once it can reach the others
+func TestStragglerCatchUp(test *testing.T) {
+	opts := testOptions(test)
+	opts.ExcludeAfter = 500 * time.Millisecond
+	network := opts.Transport.(*transport.Memory)
+	ports := make([]string, 3)
+	for i := 0; i < 3; i++ {
+		ports[i] = "rsm-straggler-" + strconv.Itoa(i)
+	}
+	pxa := make([]*paxos.Paxos, 3)
+	rsms := make([]*RSM, 3)
+	counters := make([]*counter, 3)
+	for i := 0; i < 3; i++ {
+		pxa[i] = paxos.Make(ports, i, nil, false, "", opts)
+		counters[i] = &counter{applied: -1}
+		rsms[i] = Make(pxa[i], counters[i], -1)
+	}
+	defer cleanup(pxa)
+
+	fmt.Printf("Test: Straggler catches up without restarting ...\n")
+	for i := 0; i < 9; i++ {
+		rsms[i%3].Submit(AddOp{N: 1})
+	}
+	network.Partition([]string{ports[0], ports[1]}, []string{ports[2]})
+	for i := 0; i < 6; i++ {
+		rsms[i%2].Submit(AddOp{N: 1})
+	}
+	// The others exclude the straggler, then forget what it missed
+	for iters := 0; pxa[0].Min() <= 9 || pxa[1].Min() <= 9; iters++ {
+		if iters == 50 {
+			test.Fatalf("Min is %v and %v, expected past 9", pxa[0].Min(), pxa[1].Min())
+		}
+		for i := 0; i < 2; i++ {
+			rsms[i].Submit(AddOp{N: 0})
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	network.Heal()
+
+	submitted := make(chan error)
+	go func() {
+		_, err := rsms[2].Submit(AddOp{N: 0})
+		submitted <- err
+	}()
+	select {
+	case err := <-submitted:
+		if err != nil {
+			test.Fatalf("Submit failed: %v", err)
+		}
+	case <-time.After(10 * time.Second):
+		test.Fatalf("Straggler's Submit is stuck")
+	}
+	if total := counters[2].get(); total != 15 {
+		test.Fatalf("Straggler has total %v, wanted 15", total)
+	}
+	fmt.Printf("  ... Passed\n")
+}
+
+// Pipelined submits are agreed on at once, and each is still applied once in log order
+func TestPipeline(test *testing.T) {
+	const numOps = 16
+	pxa, rsms, counters, _, opts := makeServersOpts(test, "pipeline", 3)
+	defer cleanup(pxa)
+	opts.Transport.(*transport.Memory).SetDefault(transport.Link{Delay: 5 * time.Millisecond})
+	rsms[0].SetPipeline(8)
+
+	fmt.Printf("Test: Pipelined Submit ...\n")
+	start := time.Now()
+	for i := 0; i < numOps; i++ {
+		rsms[1].Submit(AddOp{N: 1})
+	}
+	serial := time.Since(start)
+
+	start = time.Now()
+	var mu sync.Mutex
+	results := make(chan int, numOps)
+	var wg sync.WaitGroup
+	for i := 0; i < numOps; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			mu.Lock()
+			defer mu.Unlock()
+			result, err := rsms[0].SubmitPipelined(AddOp{N: 1}, &mu)
+			if err != nil {
+				test.Errorf("Submit failed: %v", err)
+				return
+			}
+			results <- result.(int)
+		}()
+	}
+	wg.Wait()
+	pipelined := time.Since(start)
+	close(results)
+
+	seen := make(map[int]bool)
+	for result := range results {
+		if seen[result] || result <= numOps || result > 2*numOps {
+			test.Fatalf("Unexpected result %v", result)
+		}
+		seen[result] = true
+	}
+	if len(seen) != numOps {
+		test.Fatalf("%v results, wanted %v", len(seen), numOps)
+	}
+	if pipelined > serial/2 {
+		test.Fatalf("Pipelined ops took %v, and %v one at a time", pipelined, serial)
+	}
+	for i := 0; i < 3; i++ {
+		rsms[i].Submit(AddOp{N: 0})
+		if total := counters[i].get(); total != 2*numOps {
+			test.Fatalf("Server %v has total %v, wanted %v", i, total, 2*numOps)
+		}
+	}
+	fmt.Printf("  ... Passed\n")
+}
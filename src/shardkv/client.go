@@ -1,25 +1,30 @@
 package shardkv
 
 import "shardmaster"
-import "net/rpc"
+import "transport"
 import "time"
 import "sync"
 import "fmt"
 
 type Clerk struct {
-	mu       sync.Mutex // one RPC at a time
-	sm       *shardmaster.Clerk
-	config   shardmaster.Config
-	me       int64
-	network  bool
-	clientID int64
+	mu        sync.Mutex // one RPC at a time
+	sm        *shardmaster.Clerk
+	config    shardmaster.Config
+	me        int64
+	transport transport.Transport
+	clientID  int64
 }
 
 func MakeClerk(shardmasters []string, network bool) *Clerk {
+	return MakeClerkTransport(shardmasters, transport.Shared(transport.Network(network)))
+}
+
+// Clerk that reaches the shardmasters and groups through the given transport
+func MakeClerkTransport(shardmasters []string, tr transport.Transport) *Clerk {
 	ck := new(Clerk)
-	ck.sm = shardmaster.MakeClerk(shardmasters, network)
+	ck.sm = shardmaster.MakeClerkTransport(shardmasters, tr)
 	ck.me = nrand()
-	ck.network = network
+	ck.transport = tr
 	ck.clientID = nrand()
 	return ck
 }
@@ -38,44 +43,19 @@ func MakeClerk(shardmasters []string, network bool) *Clerk {
 // error after a while if it doesn't get a reply from the server.
 //
 // please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
+// tr is the transport of the clerk or server making the call.
 //
 func call(srv string, rpcname string, args interface{},
-	reply interface{}, network bool) bool {
-	if network {
-		c, errx := rpc.Dial("tcp", srv)
-		if errx != nil {
-			return false
-		}
-		defer c.Close()
-
-		err := c.Call(rpcname, args, reply)
-		if err == nil {
-			return true
-		}
-
-		if printRPCerrors {
-			fmt.Println(err)
-		}
-		return false
-
-	} else {
-		c, errx := rpc.Dial("unix", srv)
-		if errx != nil {
-			return false
-		}
-		defer c.Close()
-
-		err := c.Call(rpcname, args, reply)
-		if err == nil {
-			return true
-		}
+	reply interface{}, tr transport.Transport) bool {
+	err := tr.Call(srv, rpcname, args, reply)
+	if err == nil {
+		return true
+	}
 
-		if printRPCerrors {
-			fmt.Println(err)
-		}
-		return false
+	if printRPCerrors {
+		fmt.Println(err)
 	}
+	return false
 }
 
 //
@@ -113,7 +93,7 @@ func (ck *Clerk) Get(key string) string {
 			// try each server in the shard's replication group.
 			for _, srv := range servers {
 				var reply KVReply
-				ok := call(srv, "ShardKV.Get", args, &reply, ck.network)
+				ok := call(srv, "ShardKV.Get", args, &reply, ck.transport)
 				if ok && (reply.Err == OK || reply.Err == ErrNoKey) {
 					return reply.Value
 				}
@@ -149,7 +129,7 @@ func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
 			for _, srv := range servers {
 				var reply KVReply
 				DPrintf("About to send Put rpc to %s.", srv)
-				ok := call(srv, "ShardKV.Put", args, &reply, ck.network)
+				ok := call(srv, "ShardKV.Put", args, &reply, ck.transport)
 				if ok && reply.Err == OK {
 					return reply.Value
 				}
@@ -166,7 +146,7 @@ func (ck *Clerk) PutExt(key string, value string, dohash bool) string {
 		prior := ck.config.Num
 		ck.config = ck.sm.Query(-1)
 		DPrintf("Prior config %d new is %d: %v", prior, ck.config.Num,
-			ck.config.Shards,)
+			ck.config.Shards)
 	}
 	return ""
 }
@@ -1,22 +1,25 @@
 package shardkv
 
-import "net"
+import "io"
 import "fmt"
 import "net/rpc"
 import "log"
 import "time"
 import "paxos"
+import "rsm"
 import "sync"
+import "sync/atomic"
 import "os"
 
 //import "io"
-import "syscall"
 import "encoding/gob"
 import "math/rand"
 import "shardmaster"
 import "strconv"
+import "path/filepath"
 
-import "github.com/jmhodges/levigo"
+import "storage"
+import "transport"
 import "bytes"
 import "strings"
 
@@ -30,24 +33,12 @@ const Log = 0
 
 var logfile *os.File
 
-// DATABASE / MEMORY CONFIGURATION
-// Remember to set the corresponding variables in shardmaster and paxos
-// for accurate testing!
-const persistent = true
-const recovery = true
-const writeToMemory = false                    // Whether responses/store should be written to memory (as well as disk / disk cache)
-const dbUseCompression = true                  // Whether database should compress entries
-const dbUseCache = true                        // Whether database should use a built-in cache
-const dbCacheSize = 20                         // Size of database cache in MB (ignored if dbUseCache is false)
+// MEMORY CONFIGURATION
+// (database options are passed to StartServer and shared with shardmaster and paxos)
 const memoryLimit = 100                        // Memory limit in MB
 const memoryThreshold = memoryLimit * 75 / 100 // When to stop filling memory (when to abort a Fetch RPC and use multiple messages)
 const recoveryRetryDelay = 500                 // Time in ms to wait before resending acknowledgments
 
-// Will use these to check that dbCacheSize doesn't overflow an int
-// (int size is either 32 or 64 bits depending on implementation)
-const MaxUint = ^uint(0)
-const MaxInt = int(^uint(0) >> 1)
-
 func DPrintf(format string, a ...interface{}) (n int, err error) {
 	if Debug > 0 {
 		log.Printf(format, a...)
@@ -63,58 +54,84 @@ func DPrintfPersist(format string, a ...interface{}) (n int, err error) {
 }
 
 type Op struct {
-	Op       int //1 = Get, 2 = Put, 3 = PutHash, 4 = Reconfigure
+	Op       int //0 = Check, 1 = Get, 2 = Put, 3 = PutHash, 4 = Reconfigure, 5 = Batch
 	OpID     int64
 	ClientID int64
 	Key      string
 	Value    string
 
 	ConfigNum int
+	Shard     int               // shard that Store and Response belong to
 	Store     map[string]string // key/value store
-	Response  map[int64]string  // client responses, indexed by client ID
+	Response  map[int64]string  // client responses for the shard, indexed by client ID
 	Seen      map[int64]bool    // which ops have been seen, indexed by op ID
+	Final     bool              // the last Reconfigure for ConfigNum, which switches to it
+
+	Batch []Op // client ops agreed on together, in order
+}
+
+// A client op waiting to be proposed in a batch
+type pendingOp struct {
+	op    Op
+	reply *KVReply
+	done  chan bool
 }
 
 type ShardKV struct {
 	mu        sync.Mutex
-	l         net.Listener
-	dead      bool // for testing
+	listener  io.Closer
+	dead      int32 // for testing; read with isdead()
 	dbClosed  bool
 	dbDeleted bool
 
 	// Network stuff
 	me         int
-	unreliable bool // for testing
-	network    bool
+	unreliable int32 // for testing; set with setunreliable()
+	transport  transport.Transport
 
 	// ShardKV state
 	sm       *shardmaster.Clerk
 	px       *paxos.Paxos
-	gid      int64 // my replica group ID
-	config   shardmaster.Config
-	store    map[string]string // key/value store
-	response map[int64]string  // client responses, indexed by client ID
-	seen     map[int64]bool    // which ops have been seen, indexed by op ID
+	rsm      *rsm.RSM                              // applies the log to the store; nil until recovery is done
+	gid      int64                                 // my replica group ID
+	config   shardmaster.Config                    // written with kv.mu and kv.stateMu held, once requests are served
+	store    map[string]string                     // key/value store
+	response [shardmaster.NShards]map[int64]string // client responses per shard, indexed by client ID
+	seen     map[int64]bool                        // which ops have been seen, indexed by op ID
+	stateMu  sync.Mutex                            // guards store, response and seen, and the sending fields; Fetch reads config under it
 	minSeq   int
+	pending  []*pendingOp // client ops waiting for the batcher
+	batching bool         // whether the batcher is running
 
 	// Persistence stuff
-	dbReadOptions  *levigo.ReadOptions
-	dbWriteOptions *levigo.WriteOptions
-	dbOpts         *levigo.Options
-	dbName         string
-	db             *levigo.DB
-	dbLock         sync.Mutex
-	recovering     bool
-	sending        bool
-	sendingTo      string
-	shardIterator  *levigo.Iterator
+	dbOpts        storage.Options
+	dbDir         string
+	dbName        string
+	db            storage.Engine
+	dbLock        sync.Mutex
+	recovering    int32 // read with isrecovering()
+	damaged       bool  // Whether the database was damaged, and wiped, at startup
+	corrupt       int32 // set when a record is found damaged while running, until a peer's snapshot replaces the state; read with iscorrupt()
+	sending       bool  // Whether a shard is being sent, so client ops must wait
+	sendingTo     string
+	shardIterator storage.Iterator
+
+	// Behavioral Options (shared with the Paxos peer)
+	persistent    bool
+	recovery      bool
+	writeToMemory bool
+	batchSize     int
+	batchDelay    time.Duration
+	pipeline      int
 }
 
 // Write the desired key/value to memory and/or disk
 func (kv *ShardKV) putValue(key string, value string) {
 	// Write to memory if using memory
-	if writeToMemory {
+	if kv.writeToMemory {
+		kv.stateMu.Lock()
 		kv.store[key] = value
+		kv.stateMu.Unlock()
 	}
 	// Write to disk if persistent is enabled
 	kv.dbPut(key, value)
@@ -122,7 +139,9 @@ func (kv *ShardKV) putValue(key string, value string) {
 
 // Get the desired value, either from memory or disk
 func (kv *ShardKV) getValue(key string) (string, bool) {
+	kv.stateMu.Lock()
 	value, exists := kv.store[key]
+	kv.stateMu.Unlock()
 	if !exists {
 		value, exists = kv.dbGet(key)
 	}
@@ -132,8 +151,10 @@ func (kv *ShardKV) getValue(key string) (string, bool) {
 // Write the seen opID to memory and/or disk
 func (kv *ShardKV) putSeen(opID int64, seen bool) {
 	// Write to memory if using memory
-	if writeToMemory {
+	if kv.writeToMemory {
+		kv.stateMu.Lock()
 		kv.seen[opID] = seen
+		kv.stateMu.Unlock()
 	}
 	// Write to disk if persistent is enabled
 	kv.dbWriteSeen(opID, seen)
@@ -141,7 +162,9 @@ func (kv *ShardKV) putSeen(opID int64, seen bool) {
 
 // Get whether the op is seen, either from memory or disk
 func (kv *ShardKV) getSeen(opID int64) bool {
+	kv.stateMu.Lock()
 	seen := kv.seen[opID]
+	kv.stateMu.Unlock()
 	if !seen {
 		seen = kv.dbGetSeen(opID)
 	}
@@ -149,210 +172,376 @@ func (kv *ShardKV) getSeen(opID int64) bool {
 }
 
 // Write the desired response to memory and/or disk
-func (kv *ShardKV) putResponse(opID int64, clientID int64, value string) {
+// Responses are kept per shard, so those that move with a shard never
+// replace the response to a later op of the same client on another shard
+func (kv *ShardKV) putResponse(opID int64, clientID int64, shard int, value string) {
 	// Write to memory if using memory
-	if writeToMemory {
-		kv.response[clientID] = value
+	if kv.writeToMemory {
+		kv.stateMu.Lock()
+		kv.response[shard][clientID] = value
 		kv.seen[opID] = true
+		kv.stateMu.Unlock()
 	}
 	// Write to disk if persistent is enabled
-	kv.dbWriteResponse(opID, clientID, value)
+	kv.dbWriteResponse(opID, clientID, shard, value)
 }
 
 // Get the desired response, either from memory or disk
-func (kv *ShardKV) getResponse(opID int64, clientID int64) (string, bool) {
+func (kv *ShardKV) getResponse(opID int64, clientID int64, shard int) (string, bool) {
 	response := ""
 	exists := false
+	kv.stateMu.Lock()
 	if kv.seen[opID] {
-		response, exists = kv.response[clientID]
+		response, exists = kv.response[shard][clientID]
 	}
+	kv.stateMu.Unlock()
 	if !exists {
-		response, exists = kv.dbGetResponse(opID, clientID)
+		response, exists = kv.dbGetResponse(opID, clientID, shard)
 	}
 	return response, exists
 }
 
-// Process log entries up until the given sequence
-func (kv *ShardKV) processLog(maxSeq int) {
-	if maxSeq <= kv.minSeq+1 {
-		return
+// Apply a decided op; rsm calls this in log order
+// Get, Put and PutHash return a KVReply with the value the key had before the op,
+// or ErrWrongGroup, changing nothing, if this group doesn't own the key's shard
+func (kv *ShardKV) Apply(opp interface{}) interface{} {
+	op := opp.(Op)
+	// A damaged record can't be trusted, nor anything derived from it
+	if kv.iscorrupt() {
+		return rsm.ErrDamaged
 	}
-	DPrintf("%d.%d.%d) Process Log Until %d\n", kv.gid, kv.me, kv.config.Num, maxSeq)
-
-	for i := kv.minSeq + 1; i < maxSeq; i++ {
-		to := 10 * time.Millisecond
-		start := false
-		// Get decided value or propose a no-op
-		for !kv.dead {
-			decided, opp := kv.px.Status(i)
-			if decided {
-				op := opp.(Op)
-				if op.Op == 1 {
-					DPrintf("%d.%d.%d) Log %d: Op #%d - GET(%s)\n", kv.gid, kv.me, kv.config.Num, i, op.OpID, op.Key)
-					// Write the response to memory and disk
-					val, _ := kv.getValue(op.Key)
-					kv.putResponse(op.OpID, op.ClientID, val)
-				} else if op.Op == 2 {
-					DPrintf("%d.%d.%d) Log %d: Op #%d - PUT(%s, %s)\n", kv.gid, kv.me, kv.config.Num, i, op.OpID, op.Key, op.Value)
-					// Write the response to memory and disk
-					val, _ := kv.getValue(op.Key)
-					kv.putResponse(op.OpID, op.ClientID, val)
-					// Write the value to memory and/or disk
-					kv.putValue(op.Key, op.Value)
-				} else if op.Op == 3 {
-					DPrintf("%d.%d.%d) Log %d: Op #%d - PUTHASH(%s, %s)\n", kv.gid, kv.me, kv.config.Num, i, op.OpID, op.Key, op.Value)
-					// Write the response to memory and disk
-					val, _ := kv.getValue(op.Key)
-					kv.putResponse(op.OpID, op.ClientID, val)
-					// Write the value to memory and disk
-					val = strconv.Itoa(int(hash(val + op.Value)))
-					kv.putValue(op.Key, val)
-				} else if op.Op == 4 {
-					DPrintf("%d.%d.%d) Log %d: Op #%d - RECONFIGURE(%d)\n", kv.gid, kv.me, kv.config.Num, i, op.OpID, op.ConfigNum)
-					// Write the new shard data to memory and disk
-					for nk, nv := range op.Store {
-						kv.putValue(nk, nv)
-					}
-					// Write the new responses to memory and disk
-					for clientID, value := range op.Response {
-						kv.putResponse(-1, clientID, value)
-					}
-					// Write seen op IDs to memory and disk
-					for opID, _ := range op.Seen {
-						kv.putSeen(opID, true)
-					}
-					// Record the new config in memory and disk
-					kv.config = kv.sm.Query(op.ConfigNum)
-					kv.dbWriteConfigNum(kv.config.Num)
-				}
-				break
-			} else if !start {
-				kv.px.Start(i, Op{})
-				start = true
-			}
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
-			}
+	if op.Op == 0 {
+		return nil
+	}
+	if op.Op == 4 {
+		// Replicas agree on reconfigurations like on client ops, so all of them
+		// stop and start serving a shard at the same point in the log
+		// A replica that fell behind may propose one for a config already switched to
+		if op.ConfigNum != kv.config.Num+1 {
+			return nil
+		}
+		DPrintf("%d.%d.%d) Apply: Op #%d - RECONFIGURE(%d)\n", kv.gid, kv.me, kv.config.Num, op.OpID, op.ConfigNum)
+		// Write the new shard data to memory and disk
+		for nk, nv := range op.Store {
+			kv.putValue(nk, nv)
 		}
+		// Write the new responses to memory and disk
+		for clientID, value := range op.Response {
+			kv.putResponse(-1, clientID, op.Shard, value)
+		}
+		// Write seen op IDs to memory and disk
+		for opID, _ := range op.Seen {
+			kv.putSeen(opID, true)
+		}
+		// Record the new config in memory and disk
+		if op.Final {
+			kv.setConfig(kv.sm.Query(op.ConfigNum))
+		}
+		return nil
 	}
-	// Update the new minSeq in memory and disk
-	kv.minSeq = maxSeq - 1
+	if op.Op == 5 {
+		DPrintf("%d.%d.%d) Apply: Batch of %d ops\n", kv.gid, kv.me, kv.config.Num, len(op.Batch))
+		results := make([]KVReply, len(op.Batch))
+		for i, each := range op.Batch {
+			result, ok := kv.Apply(each).(KVReply)
+			if !ok {
+				return rsm.ErrDamaged
+			}
+			results[i] = result
+		}
+		return results
+	}
+
+	// The shard may have moved since the op was proposed; the client
+	// retries at the new owner, which must not find it seen here
+	if kv.config.Shards[key2shard(op.Key)] != kv.gid {
+		DPrintf("%d.%d.%d) Apply: Op %d for a shard of another group\n", kv.gid, kv.me, kv.config.Num, op.OpID)
+		return KVReply{Err: ErrWrongGroup}
+	}
+	var result KVReply
+	// Retries are caught here rather than by rsm, because the responses
+	// move with the shards and are kept on disk across restarts
+	v, seen := kv.getResponse(op.OpID, op.ClientID, key2shard(op.Key))
+	val, _ := kv.getValue(op.Key)
+	// Reads that hit a damaged record found nothing, so change nothing
+	if kv.iscorrupt() {
+		return rsm.ErrDamaged
+	}
+	if seen {
+		DPrintf("%d.%d.%d) Apply: Already Seen Op %d\n", kv.gid, kv.me, kv.config.Num, op.OpID)
+		setReply(&result, v)
+		return result
+	}
+	// Write the response to memory and disk
+	kv.putResponse(op.OpID, op.ClientID, key2shard(op.Key), val)
+	if op.Op == 1 {
+		DPrintf("%d.%d.%d) Apply: Op #%d - GET(%s)\n", kv.gid, kv.me, kv.config.Num, op.OpID, op.Key)
+	} else if op.Op == 2 {
+		DPrintf("%d.%d.%d) Apply: Op #%d - PUT(%s, %s)\n", kv.gid, kv.me, kv.config.Num, op.OpID, op.Key, op.Value)
+		// Write the value to memory and/or disk
+		kv.putValue(op.Key, op.Value)
+	} else if op.Op == 3 {
+		DPrintf("%d.%d.%d) Apply: Op #%d - PUTHASH(%s, %s)\n", kv.gid, kv.me, kv.config.Num, op.OpID, op.Key, op.Value)
+		// Write the value to memory and disk
+		kv.putValue(op.Key, strconv.Itoa(int(hash(val+op.Value))))
+	}
+	setReply(&result, val)
+	return result
+}
+
+// Record how far the log has been applied
+func (kv *ShardKV) Applied(seq int) {
+	kv.minSeq = seq
 	kv.dbWriteMinSeq(kv.minSeq)
-	kv.px.Done(kv.minSeq)
 }
 
-// Log the given op and execute it
-func (kv *ShardKV) processKV(op Op, reply *KVReply) {
-	for !kv.dead {
-		// Process any missed log entries
-		seq := kv.px.Max() + 1
-		kv.processLog(seq)
-		// If wrong group for shard, return
-		if kv.config.Shards[key2shard(op.Key)] != kv.gid {
-			return
+// Everything a replica holds, for rsm snapshots
+type kvSnapshot struct {
+	Config   shardmaster.Config
+	Store    map[string]string
+	Response [shardmaster.NShards]map[int64]string
+	Seen     map[int64]bool
+}
+
+// Encode the store, responses and seen ops from memory and disk
+// The whole store has to fit in memory, but Paxos sends it to peers in chunks
+// Returns nil if the state is damaged, so peers fetch a snapshot elsewhere
+func (kv *ShardKV) Snapshot() []byte {
+	// Peers fetch snapshots without kv.mu
+	kv.stateMu.Lock()
+	defer kv.stateMu.Unlock()
+	if kv.iscorrupt() {
+		return nil
+	}
+	state := kvSnapshot{}
+	state.Config = kv.config
+	var err error
+	if state.Store, err = kv.dbGetStore(); err != nil {
+		return nil
+	}
+	for k, v := range kv.store {
+		state.Store[k] = v
+	}
+	for shard := range state.Response {
+		if state.Response[shard], err = kv.dbGetResponses(shard, map[int64]bool{}); err != nil {
+			return nil
 		}
-		// If duplicate request, use previous response
-		if v, seen := kv.getResponse(op.OpID, op.ClientID); seen {
-			DPrintf("%d.%d.%d) Already Seen Op %d\n", kv.gid, kv.me, kv.config.Num, op.OpID)
-			if v == "" {
-				reply.Err = ErrNoKey
-			} else {
-				reply.Err = OK
-			}
-			reply.Value = v
-			return
+		for id, value := range kv.response[shard] {
+			state.Response[shard][id] = value
 		}
+	}
+	if state.Seen, err = kv.dbGetSeenIDs(map[int64]bool{}); err != nil {
+		return nil
+	}
+	for id, _ := range kv.seen {
+		state.Seen[id] = true
+	}
 
-		// Propose desired op to Paxos log
-		kv.px.Start(seq, op)
-		to := 10 * time.Millisecond
-		for !kv.dead {
-			// Check if sequence has been decided
-			if decided, _ := kv.px.Status(seq); decided {
-				// Process any missed log entries
-				seq := kv.px.Max() + 1
-				kv.processLog(seq)
-				// If wrong group for shard, return
-				if kv.config.Shards[key2shard(op.Key)] != kv.gid {
-					return
-				}
-				// If have seen op (duplicate or just decided), return response
-				if v, seen := kv.getResponse(op.OpID, op.ClientID); seen {
-					if v == "" {
-						reply.Err = ErrNoKey
-					} else {
-						reply.Err = OK
-					}
-					reply.Value = v
-					return
-				} else {
-					break
-				}
-			}
+	var buffer bytes.Buffer
+	gob.NewEncoder(&buffer).Encode(state)
+	return buffer.Bytes()
+}
 
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
-			}
+// Install a snapshot over the current state
+// Keys are never deleted, so a newer snapshot covers every key held here,
+// but damaged state is wiped first, since the rest of it can't be trusted either
+func (kv *ShardKV) Restore(data []byte) {
+	var state kvSnapshot
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&state)
+	if err != nil {
+		DPrintf("%d.%d.%d) Restore: bad snapshot %v\n", kv.gid, kv.me, kv.config.Num, err)
+		return
+	}
+	if kv.iscorrupt() {
+		kv.wipe()
+	}
+	for k, v := range state.Store {
+		kv.putValue(k, v)
+	}
+	for shard, responses := range state.Response {
+		for clientID, value := range responses {
+			kv.putResponse(-1, clientID, shard, value)
 		}
 	}
+	for opID, _ := range state.Seen {
+		kv.putSeen(opID, true)
+	}
+	kv.setConfig(state.Config)
 }
 
-// Log and execute a reconfiguration
-func (kv *ShardKV) addReconfigure(num int, store map[string]string, response map[int64]string, seen map[int64]bool) {
-	defer func() {
-		DPrintf("%d.%d.%d) Reconfigure Returns\n", kv.gid, kv.me, kv.config.Num)
-	}()
+// Forget the whole state, in memory and on disk, and clear the damage
+func (kv *ShardKV) wipe() {
+	kv.stateMu.Lock()
+	kv.store = make(map[string]string)
+	for shard := range kv.response {
+		kv.response[shard] = make(map[int64]string)
+	}
+	kv.seen = make(map[int64]bool)
+	kv.stateMu.Unlock()
+	if kv.persistent {
+		kv.dbLock.Lock()
+		kv.dbWipe()
+		kv.dbLock.Unlock()
+	}
+	atomic.StoreInt32(&kv.corrupt, 0)
+}
 
-	newOp := Op{}
-	newOp.Op = 4
-	newOp.OpID = int64(num)
-	newOp.ClientID = -1
-	newOp.ConfigNum = num
-	newOp.Store = store
-	newOp.Response = response
-	newOp.Seen = seen
-	DPrintf("%d.%d.%d) Reconfigure: %d\n", kv.gid, kv.me, kv.config.Num, num)
-
-	for !kv.dead {
-		// Process any missed log entries
-		seq := kv.px.Max() + 1
-		kv.processLog(seq)
-		// If desired config is now out of date, return
-		if kv.config.Num >= num {
-			return
-		}
+// Switch to config, in memory and on disk; kv.mu must be held
+func (kv *ShardKV) setConfig(config shardmaster.Config) {
+	kv.stateMu.Lock()
+	kv.config = config
+	kv.stateMu.Unlock()
+	kv.dbWriteConfigNum(config.Num)
+}
 
-		// Propose reconfiguration to Paxos
-		kv.px.Start(seq, newOp)
-
-		to := 10 * time.Millisecond
-		for !kv.dead {
-			// Check if sequence has been decided
-			if decided, _ := kv.px.Status(seq); decided {
-				// Process any missed log entries
-				seq := kv.px.Max() + 1
-				kv.processLog(seq)
-				// If config is updated, return
-				if kv.config.Num >= num {
-					return
-				} else {
-					break
-				}
-			}
+// Fill in the reply to a Get or Put from its response
+func setReply(reply *KVReply, value string) {
+	if value == "" {
+		reply.Err = ErrNoKey
+	} else {
+		reply.Err = OK
+	}
+	reply.Value = value
+}
+
+// Log the given op and execute it
+func (kv *ShardKV) processKV(op Op, reply *KVReply) {
+	// Killed before recovery finished, so there may be no rsm
+	if kv.isdead() {
+		return
+	}
+	// Process any missed log entries
+	if kv.rsm.Sync() != nil {
+		return
+	}
+	// If wrong group for shard, return
+	if kv.config.Shards[key2shard(op.Key)] != kv.gid {
+		return
+	}
+	// If duplicate request, use previous response
+	response, seen := kv.getResponse(op.OpID, op.ClientID, key2shard(op.Key))
+	if kv.iscorrupt() {
+		return
+	}
+	if seen {
+		DPrintf("%d.%d.%d) Already Seen Op %d\n", kv.gid, kv.me, kv.config.Num, op.OpID)
+		setReply(reply, response)
+		return
+	}
 
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
+	if kv.batchSize > 1 {
+		kv.submitBatched(op, reply)
+		return
+	}
+	// Other client ops can be proposed while this one is agreed on
+	v, err := kv.rsm.SubmitPipelined(op, &kv.mu)
+	if err != nil {
+		return
+	}
+	// The result is lost if the op found the state damaged
+	if result, ok := v.(KVReply); ok {
+		*reply = result
+	}
+}
+
+// Queue op for the batcher and wait for its reply; kv.mu must be held
+// kv.mu is released while waiting, so other client ops can join the batch
+func (kv *ShardKV) submitBatched(op Op, reply *KVReply) {
+	p := &pendingOp{op, reply, make(chan bool, 1)}
+	kv.pending = append(kv.pending, p)
+	if !kv.batching {
+		kv.batching = true
+		go kv.proposeBatches()
+	}
+	kv.mu.Unlock()
+	<-p.done
+	kv.mu.Lock()
+}
+
+// Propose the queued client ops, up to kv.batchSize per instance, until none are left
+// Ops that arrive while a batch is being agreed on go in the next one
+func (kv *ShardKV) proposeBatches() {
+	time.Sleep(kv.batchDelay)
+	for {
+		kv.mu.Lock()
+		if len(kv.pending) == 0 || kv.isdead() {
+			// Killed: the waiting ops get ErrWrongGroup
+			for _, p := range kv.pending {
+				p.done <- true
 			}
+			kv.pending = nil
+			kv.batching = false
+			kv.mu.Unlock()
+			return
+		}
+		n := len(kv.pending)
+		if n > kv.batchSize {
+			n = kv.batchSize
+		}
+		batch := kv.pending[:n]
+		kv.pending = kv.pending[n:]
+		kv.processBatch(batch)
+		kv.mu.Unlock()
+		for _, p := range batch {
+			p.done <- true
 		}
 	}
 }
 
+// Log the given client ops in one instance and execute them; kv.mu must be held
+func (kv *ShardKV) processBatch(batch []*pendingOp) {
+	// Process any missed log entries
+	if kv.rsm.Sync() != nil {
+		return
+	}
+	ops := make([]Op, len(batch))
+	for i, p := range batch {
+		ops[i] = p.op
+	}
+	DPrintf("%d.%d.%d) Proposing batch of %d ops\n", kv.gid, kv.me, kv.config.Num, len(ops))
+	v, err := kv.rsm.SubmitPipelined(Op{Op: 5, Batch: ops}, &kv.mu)
+	if err != nil {
+		return
+	}
+	// The results are lost if the batch found the state damaged
+	results, ok := v.([]KVReply)
+	if !ok {
+		return
+	}
+	for i, p := range batch {
+		*p.reply = results[i]
+	}
+}
+
+// Answer a Get from the local store if this replica holds the Paxos leader lease
+// Returns false if it doesn't, and the Get has to go through the log
+func (kv *ShardKV) getLeased(key string, reply *KVReply) bool {
+	// Killed before recovery finished, so there may be no rsm
+	if kv.isdead() {
+		return true
+	}
+	leased, err := kv.rsm.SyncLeased()
+	if !leased {
+		return false
+	}
+	// Shards move through the log, so the config now reflects every move
+	// the new owner could have served a write after
+	if err != nil || kv.config.Shards[key2shard(key)] != kv.gid {
+		return true
+	}
+	value, _ := kv.getValue(key)
+	// A damaged record reads as missing; the Get fails and is retried after repair
+	if kv.iscorrupt() {
+		return true
+	}
+	setReply(reply, value)
+	DPrintf("%d.%d.%d) Get: %s served under lease\n", kv.gid, kv.me, kv.config.Num, key)
+	return true
+}
+
 // Accept a Get request
 func (kv *ShardKV) Get(args *GetArgs, reply *KVReply) error {
-	for (kv.recovering || kv.sending) && !kv.dead {
+	for (kv.isrecovering() || kv.isSending()) && !kv.isdead() {
 		time.Sleep(10 * time.Millisecond)
 	}
 	kv.mu.Lock()
@@ -370,18 +559,16 @@ func (kv *ShardKV) Get(args *GetArgs, reply *KVReply) error {
 	newOp.Key = args.Key
 	DPrintf("%d.%d.%d) Get: %s\n", kv.gid, kv.me, kv.config.Num, args.Key)
 
+	if kv.getLeased(args.Key, reply) {
+		return nil
+	}
 	kv.processKV(newOp, reply)
 	return nil
 }
 
 // Accept a Put request
 func (kv *ShardKV) Put(args *PutArgs, reply *KVReply) error {
-	if args.DoHash {
-		DPrintf("%d.%d.%d) PutHash: %s -> %s\n", kv.gid, kv.me, kv.config.Num, args.Key, args.Value)
-	} else {
-		DPrintf("%d.%d.%d) Put: %s -> %s\n", kv.gid, kv.me, kv.config.Num, args.Key, args.Value)
-	}
-	for (kv.recovering || kv.sending) && !kv.dead {
+	for (kv.isrecovering() || kv.isSending()) && !kv.isdead() {
 		time.Sleep(10 * time.Millisecond)
 	}
 	kv.mu.Lock()
@@ -397,8 +584,10 @@ func (kv *ShardKV) Put(args *PutArgs, reply *KVReply) error {
 
 	newOp := Op{}
 	if args.DoHash {
+		DPrintf("%d.%d.%d) PutHash: %s -> %s\n", kv.gid, kv.me, kv.config.Num, args.Key, args.Value)
 		newOp.Op = 3
 	} else {
+		DPrintf("%d.%d.%d) Put: %s -> %s\n", kv.gid, kv.me, kv.config.Num, args.Key, args.Value)
 		newOp.Op = 2
 	}
 	newOp.OpID = args.ID
@@ -412,20 +601,36 @@ func (kv *ShardKV) Put(args *PutArgs, reply *KVReply) error {
 
 // Respond to a Fetch request
 func (kv *ShardKV) Fetch(args *FetchArgs, reply *FetchReply) error {
-	for kv.recovering && !kv.dead {
+	for kv.isrecovering() && !kv.isdead() {
 		time.Sleep(10 * time.Millisecond)
 	}
-	for kv.sending && args.Sender != kv.sendingTo {
+	for kv.sendingToOther(args.Sender) {
 		time.Sleep(10 * time.Millisecond)
 	}
 	return kv.fetchHandler(args, reply)
 }
 
+// Whether a shard is being sent, so client ops and ticks must wait
+func (kv *ShardKV) isSending() bool {
+	kv.stateMu.Lock()
+	defer kv.stateMu.Unlock()
+	return kv.sending
+}
+
+// Whether a shard is being sent to another server than sender
+func (kv *ShardKV) sendingToOther(sender string) bool {
+	kv.stateMu.Lock()
+	defer kv.stateMu.Unlock()
+	return kv.sending && sender != kv.sendingTo
+}
+
 // Respond to acknowledgement that Fetch is complete
 func (kv *ShardKV) FetchComplete(args *FetchArgs, reply *FetchReply) error {
 	//if args.Sender == kv.sendingTo {
+	kv.stateMu.Lock()
 	kv.sending = false
 	kv.sendingTo = ""
+	kv.stateMu.Unlock()
 	DPrintf("\n%v.%v: Marking sending complete", kv.gid, kv.me)
 	reply.Complete = true
 	//}
@@ -435,16 +640,17 @@ func (kv *ShardKV) FetchComplete(args *FetchArgs, reply *FetchReply) error {
 // This helper "fetch" method now exists because both Fetch
 // and FetchRecovery use it, and Fetch must wait for recovery
 // to complete but FetchRecovery must complete even during recovery
+// Fetch runs without kv.mu, which tick holds while it fetches shards
+// from other groups, so the state is read under kv.stateMu instead
 func (kv *ShardKV) fetchHandler(args *FetchArgs, reply *FetchReply) error {
-	//kv.mu.Lock()
-	defer func() {
-		//kv.mu.Unlock()
-	}()
+	kv.stateMu.Lock()
+	defer kv.stateMu.Unlock()
 
 	DPrintf("%d.%d.%d) Fetch: Shard %d from Config %d\n", kv.gid, kv.me, kv.config.Num, args.Shard, args.Config)
 
-	// If current config is older than requested config, return error
-	if kv.config.Num < args.Config {
+	// If current config is older than requested config, or the state is
+	// damaged until a peer's snapshot repairs it, return error
+	if kv.config.Num < args.Config || kv.iscorrupt() {
 		reply.Err = ErrNoKey
 		return nil
 	}
@@ -465,12 +671,18 @@ func (kv *ShardKV) fetchHandler(args *FetchArgs, reply *FetchReply) error {
 		// Assume all responses can fit in memory (only one per client)
 		idsInMemory := make(map[int64]bool)
 		// Copy responses from memory
-		for id, value := range kv.response {
+		for id, value := range kv.response[args.Shard] {
 			responses[id] = value
 			idsInMemory[id] = true
 		}
 		// Copy responses from disk if not in memory
-		for id, value := range kv.dbGetResponses(idsInMemory) {
+		dbResponses, err := kv.dbGetResponses(args.Shard, idsInMemory)
+		if err != nil {
+			reply.Err = ErrNoKey
+			kv.sending = false
+			return nil
+		}
+		for id, value := range dbResponses {
 			DPrintfPersist("\n\t%v-%v: got response data (%v, %v)", kv.gid, kv.me, id, value)
 			responses[id] = value
 		}
@@ -483,7 +695,13 @@ func (kv *ShardKV) fetchHandler(args *FetchArgs, reply *FetchReply) error {
 			idsInMemory[id] = true
 		}
 		// Copy seen IDs from disk if not in memory
-		for id, _ := range kv.dbGetSeenIDs(idsInMemory) {
+		dbSeenIDs, err := kv.dbGetSeenIDs(idsInMemory)
+		if err != nil {
+			reply.Err = ErrNoKey
+			kv.sending = false
+			return nil
+		}
+		for id, _ := range dbSeenIDs {
 			DPrintfPersist("\n\t%v-%v: got seen data %v", kv.gid, kv.me, id)
 			seenIDs[id] = true
 		}
@@ -516,8 +734,18 @@ func (kv *ShardKV) fetchHandler(args *FetchArgs, reply *FetchReply) error {
 	}
 	// Copy key/value pairs for desired shard from disk if not in memory
 	// Exclude any already seen
-	finished, iterator := kv.dbGetShard(args.Shard, keysCopied, shardStore, kv.shardIterator)
+	finished, iterator, err := kv.dbGetShard(args.Shard, keysCopied, shardStore, kv.shardIterator)
 	kv.shardIterator = iterator
+	if err != nil {
+		// The next Fetch starts over, excluding the keys already sent
+		if !finished {
+			iterator.Close()
+		}
+		kv.shardIterator = nil
+		reply.Err = ErrNoKey
+		kv.sending = false
+		return nil
+	}
 	DPrintfPersist("\n\tCopied from disk, memory usage = %v MB", getMemoryUsage()/1000)
 
 	totalTime := time.Since(startTime)
@@ -542,15 +770,25 @@ func (kv *ShardKV) fetchHandler(args *FetchArgs, reply *FetchReply) error {
 // if so, re-configure.
 //
 func (kv *ShardKV) tick() {
-	for (kv.recovering || kv.sending) && !kv.dead {
+	for (kv.isrecovering() || kv.isSending()) && !kv.isdead() {
 		time.Sleep(10 * time.Millisecond)
 	}
 	kv.mu.Lock()
 	defer kv.mu.Unlock()
 
+	// Killed before recovery finished, so there may be no rsm
+	if kv.isdead() {
+		return
+	}
 	// Process any missed log entries
-	seq := kv.px.Max() + 1
-	kv.processLog(seq)
+	if kv.rsm.Sync() != nil {
+		return
+	}
+	// A damaged record found outside Apply; an op in the log makes rsm repair the state
+	if kv.iscorrupt() {
+		kv.rsm.Submit(Op{})
+		return
+	}
 
 	// Check if current config is latest config
 	newConfig := kv.sm.Query(kv.config.Num + 1)
@@ -577,20 +815,24 @@ func (kv *ShardKV) tick() {
 	}
 
 	// Get store data and response data for new shards
-	if len(remoteGained) != 0 && !kv.dead {
+	if len(remoteGained) != 0 && !kv.isdead() {
 		DPrintf("%d.%d.%d) New Config needs %d\n", kv.gid, kv.me, kv.config.Num, remoteGained)
 		for _, shard := range remoteGained {
 			otherGID := kv.config.Shards[shard]
 			servers := kv.config.Groups[otherGID]
 			haveShard := false
+			// Index of the server being asked, -1 once done
+			// The loop variables are per iteration, so goroutines can't watch them
+			asking := int32(-1)
 			// Keep trying to get new data until success
-			for !kv.dead && !haveShard {
+			for !kv.isdead() && !haveShard {
 				for sid, srv := range servers {
+					atomic.StoreInt32(&asking, int32(sid))
 					keysReceived := make(map[string]bool)
 					numTries := 0
 					badResponse := false
 					// Keep getting data until entire shard is transferred
-					for !kv.dead && !haveShard && !badResponse {
+					for !kv.isdead() && !haveShard && !badResponse {
 						if len(keysReceived) > 0 {
 							//fmt.Printf("\nAsking for more!")
 						}
@@ -598,19 +840,16 @@ func (kv *ShardKV) tick() {
 						fmt.Printf("\n%d.%d.%d) Attempting to get Shard %d from %d.%d\n", kv.gid, kv.me, kv.config.Num, shard, otherGID, sid)
 						args := &FetchArgs{newConfig.Num, shard, keysReceived, fmt.Sprintf("%v-%v", kv.gid, kv.me)}
 						var reply FetchReply
-						ok := call(srv, "ShardKV.Fetch", args, &reply, kv.network)
+						ok := call(srv, "ShardKV.Fetch", args, &reply, kv.transport)
 						if ok && (reply.Err == OK) {
 							DPrintf("%d.%d.%d) Got Shard %d from %d.%d\n", kv.gid, kv.me, kv.config.Num, shard, otherGID, sid)
 							//fmt.Printf("\n%d.%d.%d) Got Shard %d from %d.%d\n", kv.gid, kv.me, kv.config.Num, shard, otherGID, sid)
-							for k, v := range reply.Store {
-								kv.putValue(k, v)
-								keysReceived[k] = true
-							}
-							for clientID, value := range reply.Response {
-								kv.putResponse(-1, clientID, value)
+							op := Op{Op: 4, ConfigNum: newConfig.Num, Shard: shard, Store: reply.Store, Response: reply.Response, Seen: reply.Seen}
+							if _, err := kv.rsm.Submit(op); err != nil {
+								return
 							}
-							for opID, _ := range reply.Seen {
-								kv.putSeen(opID, true)
+							for k, _ := range reply.Store {
+								keysReceived[k] = true
 							}
 							if reply.Complete {
 								DPrintf("%d.%d.%d) Got Complete Shard %d from %d.%d\n", kv.gid, kv.me, kv.config.Num, shard, otherGID, sid)
@@ -624,9 +863,9 @@ func (kv *ShardKV) tick() {
 									ackArgs.Sender = fmt.Sprintf("%v-%v", kv.gid, kv.me)
 									var ackReply FetchReply
 									waitChan <- 1
-									for !kv.dead && !ackSuccess {
+									for !kv.isdead() && !ackSuccess {
 										DPrintf("\n%v.%v: Sending fetch complete to %s", kv.gid, kv.me, server)
-										ackOK := call(server, "ShardKV.FetchComplete", ackArgs, &ackReply, kv.network)
+										ackOK := call(server, "ShardKV.FetchComplete", ackArgs, &ackReply, kv.transport)
 										ackSuccess = ackOK && ackReply.Complete
 										if !ackSuccess {
 											time.Sleep(recoveryRetryDelay * time.Millisecond)
@@ -649,7 +888,7 @@ func (kv *ShardKV) tick() {
 							// Send it an ack of Fetch until success
 							// In case it wakes up
 							waitChan := make(chan int)
-							go func(server string) {
+							go func(server string, index int32) {
 								ackSuccess := false
 								ackArgs := &FetchArgs{}
 								ackArgs.Sender = fmt.Sprintf("%v-%v", kv.gid, kv.me)
@@ -657,21 +896,21 @@ func (kv *ShardKV) tick() {
 								waitChan <- 1
 								// Wait until outer loop moves on from this server
 								// (should be very quick)
-								for srv == server {
+								for atomic.LoadInt32(&asking) == index {
 									time.Sleep(10 * time.Millisecond)
 								}
 								// Keep sending ack until success or until outer loop
 								// decides to try this peer again
-								for !kv.dead && !ackSuccess && (srv != server) {
+								for !kv.isdead() && !ackSuccess && atomic.LoadInt32(&asking) != index {
 									DPrintf("\n%v.%v: Sending fetch complete to %s", kv.gid, kv.me, server)
-									ackOK := call(server, "ShardKV.FetchComplete", ackArgs, &ackReply, kv.network)
+									ackOK := call(server, "ShardKV.FetchComplete", ackArgs, &ackReply, kv.transport)
 									ackSuccess = ackOK && ackReply.Complete
 									if !ackSuccess {
 										time.Sleep(recoveryRetryDelay * time.Millisecond)
 									}
 								}
 								DPrintf("\n%v.%v: Done sending fetch complete to %s", kv.gid, kv.me, server)
-							}(srv)
+							}(srv, int32(sid))
 							<-waitChan
 						}
 						if !ok {
@@ -682,12 +921,14 @@ func (kv *ShardKV) tick() {
 				}
 				time.Sleep(250 * time.Millisecond)
 			}
+			atomic.StoreInt32(&asking, -1)
 		}
 	}
 
-	// Record the new config in memory and disk
-	kv.config = newConfig
-	kv.dbWriteConfigNum(kv.config.Num)
+	// Switch to the new config once the other replicas have all its shards too
+	if _, err := kv.rsm.Submit(Op{Op: 4, ConfigNum: newConfig.Num, Final: true}); err != nil {
+		return
+	}
 	DPrintf("%d.%d.%d) New Config adding config %v\n", kv.gid, kv.me, kv.config.Num, newConfig.Num)
 }
 
@@ -695,26 +936,25 @@ func (kv *ShardKV) tick() {
 func (kv *ShardKV) Kill() {
 	// Kill the server
 	DPrintfPersist("\n%v-%v: Killing the server", kv.gid, kv.me)
-	kv.dead = true
-	if kv.l != nil {
-		kv.l.Close()
+	atomic.StoreInt32(&kv.dead, 1)
+	if kv.listener != nil {
+		kv.listener.Close()
 	}
+	kv.transport.Close()
 	kv.px.Kill()
 
 	// Close the database
-	if persistent && !kv.dbClosed {
+	if kv.persistent && !kv.dbClosed {
 		kv.dbLock.Lock()
 		kv.db.Close()
-		kv.dbReadOptions.Close()
-		kv.dbWriteOptions.Close()
 		kv.dbLock.Unlock()
 		kv.dbClosed = true
 	}
 
 	// Destroy the database
-	if persistent && !kv.dbDeleted {
+	if kv.persistent && !kv.dbDeleted {
 		DPrintfPersist("\n%v-%v: Destroying database... ", kv.gid, kv.me)
-		err := levigo.DestroyDatabase(kv.dbName, kv.dbOpts)
+		err := storage.Destroy(kv.dbName, kv.dbOpts)
 		if err != nil {
 			DPrintfPersist("\terror")
 		} else {
@@ -727,29 +967,35 @@ func (kv *ShardKV) Kill() {
 func (kv *ShardKV) KillSaveDisk() {
 	// Kill the server
 	DPrintfPersist("\n%v-%v: Killing the server", kv.gid, kv.me)
-	kv.dead = true
-	if kv.l != nil {
-		kv.l.Close()
+	atomic.StoreInt32(&kv.dead, 1)
+	if kv.listener != nil {
+		kv.listener.Close()
 	}
+	kv.transport.Close()
 	kv.px.KillSaveDisk()
 
 	// Close the database
-	if persistent && !kv.dbClosed {
+	if kv.persistent && !kv.dbClosed {
 		kv.dbLock.Lock()
 		kv.db.Close()
-		kv.dbReadOptions.Close()
-		kv.dbWriteOptions.Close()
 		kv.dbLock.Unlock()
 		kv.dbClosed = true
 	}
 }
 
+// Deletes every shardkv database stored under opts.DataDir
+// (the Paxos peers' databases are removed by paxos.Destroy)
+// Servers using them should be killed first
+func Destroy(opts paxos.Options) error {
+	return storage.Destroy(opts.DBDir("shardkv"), opts.StorageOptions())
+}
+
 // Get seen IDs from database
-// Excludes any of the given ids
-func (kv *ShardKV) dbGetSeenIDs(exclude map[int64]bool) map[int64]bool {
+// Excludes any of the given ids, and skips damaged records, returning the error
+func (kv *ShardKV) dbGetSeenIDs(exclude map[int64]bool) (map[int64]bool, error) {
 	responses := make(map[int64]bool)
-	if !persistent {
-		return responses
+	if !kv.persistent {
+		return responses, nil
 	}
 	DPrintfPersist("\n%v-%v: dbGetSeenIDs Waiting for dbLock", kv.gid, kv.me)
 	kv.dbLock.Lock()
@@ -758,17 +1004,15 @@ func (kv *ShardKV) dbGetSeenIDs(exclude map[int64]bool) map[int64]bool {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbGetSeenIDs Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
-		return responses
+	if kv.isdead() {
+		return responses, nil
 	}
 
+	var damaged error
 	toPrint := ""
 	toPrint += fmt.Sprintf("\n%v-%v: Reading seen IDs from database... ", kv.gid, kv.me)
-	// Turn off cache-filling while doing bulk read
-	kv.dbReadOptions.SetFillCache(false)
-	defer kv.dbReadOptions.SetFillCache(dbUseCache)
-	// Get database iterator
-	iterator := kv.db.NewIterator(kv.dbReadOptions)
+	// Get database iterator (bulk reads don't fill the cache)
+	iterator := kv.db.Iterator()
 	defer iterator.Close()
 	iterator.Seek([]byte("seen_"))
 	DPrintfPersist("\n%v-%v: dbGetSeenIDs starting iteration", kv.gid, kv.me)
@@ -788,7 +1032,12 @@ func (kv *ShardKV) dbGetSeenIDs(exclude map[int64]bool) map[int64]bool {
 			continue
 		}
 
-		valueBytes := iterator.Value()
+		valueBytes, err := kv.unframe(string(keyBytes), iterator.Value())
+		if err != nil {
+			damaged = err
+			iterator.Next()
+			continue
+		}
 		bufferVal := *bytes.NewBuffer(valueBytes)
 		decoderVal := gob.NewDecoder(&bufferVal)
 		var value int
@@ -808,15 +1057,15 @@ func (kv *ShardKV) dbGetSeenIDs(exclude map[int64]bool) map[int64]bool {
 	}
 
 	DPrintfPersist(toPrint)
-	return responses
+	return responses, damaged
 }
 
-// Get responses from database
-// Excludes any of the given ids
-func (kv *ShardKV) dbGetResponses(exclude map[int64]bool) map[int64]string {
+// Get the responses for a shard from database
+// Excludes any of the given ids, and skips damaged records, returning the error
+func (kv *ShardKV) dbGetResponses(shard int, exclude map[int64]bool) (map[int64]string, error) {
 	responses := make(map[int64]string)
-	if !persistent {
-		return responses
+	if !kv.persistent {
+		return responses, nil
 	}
 	DPrintfPersist("\n%v-%v: dbGetResponses Waiting for dbLock", kv.gid, kv.me)
 	kv.dbLock.Lock()
@@ -825,29 +1074,26 @@ func (kv *ShardKV) dbGetResponses(exclude map[int64]bool) map[int64]string {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbGetResponses Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
-		return responses
+	if kv.isdead() {
+		return responses, nil
 	}
 
+	var damaged error
 	toPrint := ""
 	toPrint += fmt.Sprintf("\n%v-%v: Reading responses from database... ", kv.gid, kv.me)
-	// Turn off cache-filling while doing bulk read
-	kv.dbReadOptions.SetFillCache(false)
-	defer kv.dbReadOptions.SetFillCache(dbUseCache)
-	// Get database iterator
-	iterator := kv.db.NewIterator(kv.dbReadOptions)
+	// Get database iterator (bulk reads don't fill the cache)
+	iterator := kv.db.Iterator()
 	defer iterator.Close()
-	iterator.Seek([]byte("response_"))
+	prefix := fmt.Sprintf("response_%v_", shard)
+	iterator.Seek([]byte(prefix))
 	DPrintfPersist("\n%v-%v: dbGetResponses starting iteration", kv.gid, kv.me)
 	for iterator.Valid() {
 		keyBytes := iterator.Key()
 		keyString := string(keyBytes)
-		if strings.Index(keyString, "response_") < 0 {
-			iterator.Next()
-			toPrint += "\n\tSkipping key " + keyString
-			continue
+		if !strings.HasPrefix(keyString, prefix) {
+			break
 		}
-		keyString = keyString[len("response_"):]
+		keyString = keyString[len(prefix):]
 		key, err := strconv.ParseInt(keyString, 10, 64)
 		if exclude[key] || err != nil {
 			iterator.Next()
@@ -855,7 +1101,12 @@ func (kv *ShardKV) dbGetResponses(exclude map[int64]bool) map[int64]string {
 			continue
 		}
 
-		valueBytes := iterator.Value()
+		valueBytes, err := kv.unframe(string(keyBytes), iterator.Value())
+		if err != nil {
+			damaged = err
+			iterator.Next()
+			continue
+		}
 		bufferVal := *bytes.NewBuffer(valueBytes)
 		decoderVal := gob.NewDecoder(&bufferVal)
 		var value string
@@ -871,14 +1122,70 @@ func (kv *ShardKV) dbGetResponses(exclude map[int64]bool) map[int64]string {
 	}
 
 	DPrintfPersist(toPrint)
-	return responses
+	return responses, damaged
+}
+
+// Get every key/value pair from the database
+// Skips damaged records, returning the error
+func (kv *ShardKV) dbGetStore() (map[string]string, error) {
+	store := make(map[string]string)
+	if !kv.persistent {
+		return store, nil
+	}
+	DPrintfPersist("\n%v-%v: dbGetStore Waiting for dbLock", kv.gid, kv.me)
+	kv.dbLock.Lock()
+	DPrintfPersist("\n%v-%v: dbGetStore Got dbLock", kv.gid, kv.me)
+	defer func() {
+		kv.dbLock.Unlock()
+		DPrintfPersist("\n%v-%v: dbGetStore Released dbLock", kv.gid, kv.me)
+	}()
+	if kv.isdead() {
+		return store, nil
+	}
+
+	var damaged error
+	toPrint := ""
+	toPrint += fmt.Sprintf("\n%v-%v: Reading store from database... ", kv.gid, kv.me)
+	// Get database iterator (bulk reads don't fill the cache)
+	iterator := kv.db.Iterator()
+	defer iterator.Close()
+	iterator.Seek([]byte("KVkey_"))
+	for iterator.Valid() {
+		key := string(iterator.Key())
+		if !strings.HasPrefix(key, "KVkey_") {
+			// Keys are sorted, so the store is done
+			break
+		}
+		key = key[len("KVkey_"):]
+
+		valueBytes, err := kv.unframe("KVkey_"+key, iterator.Value())
+		if err != nil {
+			damaged = err
+			iterator.Next()
+			continue
+		}
+		bufferVal := *bytes.NewBuffer(valueBytes)
+		decoderVal := gob.NewDecoder(&bufferVal)
+		var value string
+		err = decoderVal.Decode(&value)
+		if err != nil {
+			toPrint += fmt.Sprintf("\n\terror decoding value for %v", key)
+			iterator.Next()
+			continue
+		}
+		store[key] = value
+		iterator.Next()
+	}
+
+	DPrintfPersist(toPrint)
+	return store, damaged
 }
 
 // Get key/values pairs for given shard from database
-// Excludes any of the given keys
-func (kv *ShardKV) dbGetShard(shard int, exclude map[string]bool, shardStore map[string]string, iterator *levigo.Iterator) (bool, *levigo.Iterator) {
-	if !persistent {
-		return true, iterator
+// Excludes any of the given keys, and skips damaged records, returning the error
+func (kv *ShardKV) dbGetShard(shard int, exclude map[string]bool, shardStore map[string]string, iterator storage.Iterator) (bool, storage.Iterator, error) {
+	if !kv.persistent {
+		return true, iterator, nil
 	}
 	DPrintfPersist("\n%v-%v: dbGetShard Waiting for dbLock", kv.gid, kv.me)
 	kv.dbLock.Lock()
@@ -887,18 +1194,16 @@ func (kv *ShardKV) dbGetShard(shard int, exclude map[string]bool, shardStore map
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbGetShard Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
-		return true, iterator
+	if kv.isdead() {
+		return true, iterator, nil
 	}
 
+	var damaged error
 	toPrint := ""
 	toPrint += fmt.Sprintf("\n%v-%v: Reading shard %v from database... ", kv.gid, kv.me, shard)
-	// Turn off cache-filling while doing bulk read
-	kv.dbReadOptions.SetFillCache(false)
-	defer kv.dbReadOptions.SetFillCache(dbUseCache)
-	// Get database iterator
-	if len(exclude) == 0 || !iterator.Valid() {
-		iterator = kv.db.NewIterator(kv.dbReadOptions)
+	// Get database iterator (bulk reads don't fill the cache)
+	if len(exclude) == 0 || iterator == nil || !iterator.Valid() {
+		iterator = kv.db.Iterator()
 		iterator.Seek([]byte("KVkey_"))
 	}
 	DPrintfPersist("\n%v-%v: dbGetShard starting iteration", kv.gid, kv.me)
@@ -927,11 +1232,16 @@ func (kv *ShardKV) dbGetShard(shard int, exclude map[string]bool, shardStore map
 			continue
 		}
 
-		valueBytes := iterator.Value()
+		valueBytes, err := kv.unframe(string(keyBytes), iterator.Value())
+		if err != nil {
+			damaged = err
+			iterator.Next()
+			continue
+		}
 		bufferVal := *bytes.NewBuffer(valueBytes)
 		decoderVal := gob.NewDecoder(&bufferVal)
 		var value string
-		err := decoderVal.Decode(&value)
+		err = decoderVal.Decode(&value)
 		if err != nil {
 			toPrint += fmt.Sprintf("\n\terror decoding value for %v", key)
 			iterator.Next()
@@ -946,13 +1256,70 @@ func (kv *ShardKV) dbGetShard(shard int, exclude map[string]bool, shardStore map
 		iterator.Close()
 	}
 	DPrintfPersist(toPrint)
-	return finished, iterator
+	return finished, iterator, damaged
+}
+
+// Store a value with a checksum; kv.dbLock must be held
+func (kv *ShardKV) dbPutRecord(key string, value []byte) error {
+	return kv.db.Put([]byte(key), storage.Frame(value))
+}
+
+// Read a value stored by dbPutRecord, or nil if the key doesn't exist; kv.dbLock must be held
+func (kv *ShardKV) dbGetRecord(key string) ([]byte, error) {
+	record, err := kv.db.Get([]byte(key))
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return kv.unframe(key, record)
+}
+
+// Check the record of key and return its value
+// A record damaged while running marks the server damaged, so it stops
+// applying ops and serving until rsm replaces its state with a peer's snapshot
+func (kv *ShardKV) unframe(key string, record []byte) ([]byte, error) {
+	value, err := storage.Unframe(record)
+	if err != nil {
+		log.Printf("shardkv %v-%v: record %v is damaged (%v); recovering from peers", kv.gid, kv.me, key, err)
+		atomic.StoreInt32(&kv.corrupt, 1)
+		return nil, err
+	}
+	return value, nil
+}
+
+// Check the record of every key in the database; kv.dbLock must be held
+// Returns whether any was damaged
+func (kv *ShardKV) dbScrub() bool {
+	iterator := kv.db.Iterator()
+	defer iterator.Close()
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		if _, err := storage.Unframe(iterator.Value()); err != nil {
+			DPrintfPersist("\n\t%v-%v: Record of %s is damaged", kv.gid, kv.me, iterator.Key())
+			return true
+		}
+	}
+	return false
+}
+
+// Delete every record but the format one; kv.dbLock must be held
+func (kv *ShardKV) dbWipe() {
+	batch := kv.db.Batch()
+	defer batch.Close()
+	iterator := kv.db.Iterator()
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		if string(iterator.Key()) != storage.FormatKey {
+			batch.Delete(append([]byte(nil), iterator.Key()...))
+		}
+	}
+	iterator.Close()
+	if err := batch.Write(); err != nil {
+		DPrintfPersist("\n\t%v-%v: Error wiping database: %v", kv.gid, kv.me, err)
+	}
 }
 
 // Tries to get the value from the database
 // If it doesn't exist, returns empty string
 func (kv *ShardKV) dbGet(key string) (string, bool) {
-	if !persistent {
+	if !kv.persistent {
 		return "", false
 	}
 	DPrintfPersist("\n%v-%v: dbGet Waiting for dbLock", kv.gid, kv.me)
@@ -962,7 +1329,7 @@ func (kv *ShardKV) dbGet(key string) (string, bool) {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbGet Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
+	if kv.isdead() {
 		return "", false
 	}
 
@@ -970,7 +1337,7 @@ func (kv *ShardKV) dbGet(key string) (string, bool) {
 	toPrint += fmt.Sprintf("\n%v-%v: Reading value for %v from database... ", kv.gid, kv.me, key)
 	// Read entry from database if it exists
 	key = fmt.Sprintf("KVkey_%v", key)
-	entryBytes, err := kv.db.Get(kv.dbReadOptions, []byte(key))
+	entryBytes, err := kv.dbGetRecord(key)
 
 	// Decode the entry if it exists, otherwise return empty
 	if err == nil && len(entryBytes) > 0 {
@@ -998,7 +1365,7 @@ func (kv *ShardKV) dbGet(key string) (string, bool) {
 
 // Writes the given key/value to the database
 func (kv *ShardKV) dbPut(key string, value string) {
-	if !persistent {
+	if !kv.persistent {
 		return
 	}
 	DPrintfPersist("\n%v-%v: dbPut Waiting for dbLock", kv.gid, kv.me)
@@ -1008,7 +1375,7 @@ func (kv *ShardKV) dbPut(key string, value string) {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbPut Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
+	if kv.isdead() {
 		return
 	}
 
@@ -1023,7 +1390,7 @@ func (kv *ShardKV) dbPut(key string, value string) {
 	} else {
 		// Write the state to the database
 		key := fmt.Sprintf("KVkey_%v", key)
-		err := kv.db.Put(kv.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := kv.dbPutRecord(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -1035,7 +1402,7 @@ func (kv *ShardKV) dbPut(key string, value string) {
 
 // Tries to get whether the given ID has been seen
 func (kv *ShardKV) dbGetSeen(opID int64) bool {
-	if !persistent {
+	if !kv.persistent {
 		return false
 	}
 	DPrintfPersist("\n%v-%v: dbGetSeen Waiting for dbLock", kv.gid, kv.me)
@@ -1045,7 +1412,7 @@ func (kv *ShardKV) dbGetSeen(opID int64) bool {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbGetSeen Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
+	if kv.isdead() {
 		return false
 	}
 
@@ -1053,7 +1420,7 @@ func (kv *ShardKV) dbGetSeen(opID int64) bool {
 	toPrint += fmt.Sprintf("\n%v-%v: Reading seen %v from database... ", kv.gid, kv.me, opID)
 	// Read entry from database if it exists
 	key := fmt.Sprintf("seen_%v", opID)
-	entryBytes, err := kv.db.Get(kv.dbReadOptions, []byte(key))
+	entryBytes, err := kv.dbGetRecord(key)
 
 	// Decode the entry if it exists, otherwise return empty
 	if err == nil && len(entryBytes) > 0 {
@@ -1081,7 +1448,7 @@ func (kv *ShardKV) dbGetSeen(opID int64) bool {
 
 // Writes the given client response to the database
 func (kv *ShardKV) dbWriteSeen(opID int64, seen bool) {
-	if !persistent {
+	if !kv.persistent {
 		return
 	}
 	DPrintfPersist("\n%v-%v: dbWriteSeen Waiting for dbLock", kv.gid, kv.me)
@@ -1091,7 +1458,7 @@ func (kv *ShardKV) dbWriteSeen(opID int64, seen bool) {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbWriteSeen Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
+	if kv.isdead() {
 		return
 	}
 
@@ -1110,7 +1477,7 @@ func (kv *ShardKV) dbWriteSeen(opID int64, seen bool) {
 	} else {
 		// Write the state to the database
 		key := fmt.Sprintf("seen_%v", opID)
-		err := kv.db.Put(kv.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := kv.dbPutRecord(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -1122,8 +1489,8 @@ func (kv *ShardKV) dbWriteSeen(opID int64, seen bool) {
 
 // Tries to get the desired response from the database
 // If it doesn't exist, returns empty string
-func (kv *ShardKV) dbGetResponse(opID int64, clientID int64) (string, bool) {
-	if !persistent {
+func (kv *ShardKV) dbGetResponse(opID int64, clientID int64, shard int) (string, bool) {
+	if !kv.persistent {
 		return "", false
 	}
 	DPrintfPersist("\n%v-%v: dbGetResponse Waiting for dbLock", kv.gid, kv.me)
@@ -1133,7 +1500,7 @@ func (kv *ShardKV) dbGetResponse(opID int64, clientID int64) (string, bool) {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbGetResponse Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
+	if kv.isdead() {
 		return "", false
 	}
 
@@ -1141,7 +1508,7 @@ func (kv *ShardKV) dbGetResponse(opID int64, clientID int64) (string, bool) {
 	toPrint += fmt.Sprintf("\n%v-%v: Reading response %v (client %v) from database... ", kv.gid, kv.me, opID, clientID)
 	// Return false if opID has not been seen
 	seenKey := fmt.Sprintf("seen_%v", opID)
-	seenBytes, seenErr := kv.db.Get(kv.dbReadOptions, []byte(seenKey))
+	seenBytes, seenErr := kv.dbGetRecord(seenKey)
 	if seenErr != nil || len(seenBytes) == 0 {
 		toPrint += fmt.Sprintf("\topID has not been seen")
 		DPrintfPersist(toPrint)
@@ -1149,8 +1516,8 @@ func (kv *ShardKV) dbGetResponse(opID int64, clientID int64) (string, bool) {
 	}
 
 	// Read entry from database if it exists
-	key := fmt.Sprintf("response_%v", clientID)
-	entryBytes, err := kv.db.Get(kv.dbReadOptions, []byte(key))
+	key := fmt.Sprintf("response_%v_%v", shard, clientID)
+	entryBytes, err := kv.dbGetRecord(key)
 
 	// Decode the entry if it exists, otherwise return empty
 	if err == nil && len(entryBytes) > 0 {
@@ -1177,8 +1544,8 @@ func (kv *ShardKV) dbGetResponse(opID int64, clientID int64) (string, bool) {
 }
 
 // Writes the given client response to the database
-func (kv *ShardKV) dbWriteResponse(opID int64, clientID int64, response string) {
-	if !persistent {
+func (kv *ShardKV) dbWriteResponse(opID int64, clientID int64, shard int, response string) {
+	if !kv.persistent {
 		return
 	}
 	DPrintfPersist("\n%v-%v: dbWriteResponse Waiting for dbLock", kv.gid, kv.me)
@@ -1188,7 +1555,7 @@ func (kv *ShardKV) dbWriteResponse(opID int64, clientID int64, response string)
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbWriteResponse Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
+	if kv.isdead() {
 		return
 	}
 
@@ -1202,8 +1569,8 @@ func (kv *ShardKV) dbWriteResponse(opID int64, clientID int64, response string)
 		DPrintfPersist("\terror encoding: %s", fmt.Sprint(err))
 	} else {
 		// Write the state to the database
-		key := fmt.Sprintf("response_%v", clientID)
-		err := kv.db.Put(kv.dbWriteOptions, []byte(key), buffer.Bytes())
+		key := fmt.Sprintf("response_%v_%v", shard, clientID)
+		err := kv.dbPutRecord(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -1221,7 +1588,7 @@ func (kv *ShardKV) dbWriteResponse(opID int64, clientID int64, response string)
 	} else {
 		// Write the state to the database
 		key := fmt.Sprintf("seen_%v", opID)
-		seenErr := kv.db.Put(kv.dbWriteOptions, []byte(key), seenBuffer.Bytes())
+		seenErr := kv.dbPutRecord(key, seenBuffer.Bytes())
 		if seenErr != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -1233,7 +1600,7 @@ func (kv *ShardKV) dbWriteResponse(opID int64, clientID int64, response string)
 
 // Writes the min sequence number to the database
 func (kv *ShardKV) dbWriteMinSeq(seq int) {
-	if !persistent {
+	if !kv.persistent {
 		return
 	}
 	DPrintfPersist("\n%v-%v: dbWriteMinSeq Waiting for dbLock", kv.gid, kv.me)
@@ -1243,7 +1610,7 @@ func (kv *ShardKV) dbWriteMinSeq(seq int) {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbWriteMinSeq Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
+	if kv.isdead() {
 		return
 	}
 
@@ -1258,7 +1625,7 @@ func (kv *ShardKV) dbWriteMinSeq(seq int) {
 	} else {
 		// Write the state to the database
 		key := "minSeq"
-		err := kv.db.Put(kv.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := kv.dbPutRecord(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -1270,7 +1637,7 @@ func (kv *ShardKV) dbWriteMinSeq(seq int) {
 
 // Writes the config number to the database
 func (kv *ShardKV) dbWriteConfigNum(configNum int) {
-	if !persistent {
+	if !kv.persistent {
 		return
 	}
 	DPrintfPersist("\n%v-%v: dbWriteConfigNum Waiting for dbLock", kv.gid, kv.me)
@@ -1280,7 +1647,7 @@ func (kv *ShardKV) dbWriteConfigNum(configNum int) {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbWriteConfigNum Released dbLock", kv.gid, kv.me)
 	}()
-	if kv.dead {
+	if kv.isdead() {
 		return
 	}
 
@@ -1295,7 +1662,7 @@ func (kv *ShardKV) dbWriteConfigNum(configNum int) {
 	} else {
 		// Write the state to the database
 		key := "configNum"
-		err := kv.db.Put(kv.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := kv.dbPutRecord(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -1308,9 +1675,12 @@ func (kv *ShardKV) dbWriteConfigNum(configNum int) {
 // Initialize database for persistence
 // and load any previously written 'minSeq' and 'configNum' state
 func (kv *ShardKV) dbInit() {
-	if !persistent {
+	if !kv.persistent {
 		return
 	}
+	// Take kv.mu first, like tick does before it writes to the database
+	kv.mu.Lock()
+	defer kv.mu.Unlock()
 	DPrintfPersist("\n%v-%v: dbInit Waiting for dbLock", kv.gid, kv.me)
 	kv.dbLock.Lock()
 	DPrintfPersist("\n%v-%v: dbInit Got dbLock", kv.gid, kv.me)
@@ -1318,52 +1688,39 @@ func (kv *ShardKV) dbInit() {
 		kv.dbLock.Unlock()
 		DPrintfPersist("\n%v-%v: dbInit Released dbLock", kv.gid, kv.me)
 	}()
-	kv.mu.Lock()
-	defer kv.mu.Unlock()
-	if kv.dead {
+	if kv.isdead() {
 		return
 	}
 
 	DPrintfPersist("\n%v-%v: Initializing database", kv.gid, kv.me)
 
 	// Set up database options
-	kv.dbOpts = levigo.NewOptions()
-	if dbUseCache {
-		if dbCacheSize*1000000 > MaxInt {
-			fmt.Printf("\nDesired cache size %v is too large... using %v instead\n", dbCacheSize*1000000, MaxInt)
-			kv.dbOpts.SetCache(levigo.NewLRUCache(MaxInt))
-		} else {
-			kv.dbOpts.SetCache(levigo.NewLRUCache(dbCacheSize * 1000000))
-		}
-	}
-	if dbUseCompression {
-		kv.dbOpts.SetCompression(levigo.SnappyCompression)
-	} else {
-		kv.dbOpts.SetCompression(levigo.NoCompression)
-	}
-	kv.dbOpts.SetCreateIfMissing(true)
-	dbDir := "/home/ubuntu/mexos/src/shardkv/persist/"
-	kv.dbName = dbDir + "shardkvDB_" + fmt.Sprint(kv.gid) + "_" + strconv.Itoa(kv.me)
-	os.MkdirAll(dbDir, 0777)
+	kv.dbName = filepath.Join(kv.dbDir, "shardkvDB_"+fmt.Sprint(kv.gid)+"_"+strconv.Itoa(kv.me))
+	os.MkdirAll(kv.dbDir, 0777)
 	DPrintfPersist("\n\t%v-%v: DB Name: %s", kv.gid, kv.me, kv.dbName)
 	// Open database (create it if it doesn't exist)
 	var err error
-	kv.db, err = levigo.Open(kv.dbName, kv.dbOpts)
+	kv.db, err = storage.Open(kv.dbName, kv.dbOpts)
 	enableLog() //need this here to fix logging issues
 	if err != nil {
 		DPrintfPersist("\n\t%v-%v: Error opening database! \n\t%s", kv.gid, kv.me, fmt.Sprint(err))
 		fmt.Printf("\n\t%v-%v: Error opening database! \n\t%s", kv.gid, kv.me, fmt.Sprint(err))
 	} else {
 		DPrintfPersist("\n\t%v-%v: Database opened successfully", kv.gid, kv.me)
+		if err := storage.UpgradeFormat(kv.db); err != nil {
+			DPrintfPersist("\n\t%v-%v: Error framing records written before checksums: %v", kv.gid, kv.me, err)
+		}
 	}
 
-	// Create options for reading/writing entries
-	kv.dbReadOptions = levigo.NewReadOptions()
-	kv.dbWriteOptions = levigo.NewWriteOptions()
-	kv.dbReadOptions.SetFillCache(dbUseCache)
+	// A damaged record can't be trusted, and the others may depend on it,
+	// so start over from peers like a server that lost its disk
+	if kv.dbScrub() {
+		kv.damaged = true
+		kv.dbWipe()
+	}
 
 	// Read minSeq from database if it exists
-	minSeqBytes, err := kv.db.Get(kv.dbReadOptions, []byte("minSeq"))
+	minSeqBytes, err := kv.dbGetRecord("minSeq")
 	if err == nil && len(minSeqBytes) > 0 {
 		// Decode the max instance
 		DPrintfPersist("\n\t%v-%v: Decoding min seqeunce... ", kv.gid, kv.me)
@@ -1382,7 +1739,7 @@ func (kv *ShardKV) dbInit() {
 	}
 
 	// Read config number from database if it exists
-	configNumBytes, err := kv.db.Get(kv.dbReadOptions, []byte("configNum"))
+	configNumBytes, err := kv.dbGetRecord("configNum")
 	if err == nil && len(configNumBytes) > 0 {
 		// Decode the max instance
 		DPrintfPersist("\n\t%v-%v: Decoding config num... ", kv.gid, kv.me)
@@ -1407,26 +1764,33 @@ func (kv *ShardKV) dbInit() {
 }
 
 func trace(s string) (string, time.Time) {
-    fmt.Println("START:", s)
-    return s, time.Now()
+	fmt.Println("START:", s)
+	return s, time.Now()
 }
 
 func un(s string, startTime time.Time) {
-    endTime := time.Now()
-    fmt.Println("  END:", s, "ElapsedTime in seconds:", endTime.Sub(startTime))
+	endTime := time.Now()
+	fmt.Println("  END:", s, "ElapsedTime in seconds:", endTime.Sub(startTime))
 }
 
+// Recover stored or missed state, then start applying the log after it
+// kv.recovering is set by StartServer and cleared here
 func (kv *ShardKV) startup(servers []string) {
 	defer un(trace("recovery time "))
 	defer func() {
-		kv.recovering = false
+		kv.mu.Lock()
+		kv.rsm = rsm.Make(kv.px, kv, kv.minSeq)
+		kv.rsm.SetPipeline(kv.pipeline)
+		kv.mu.Unlock()
+		atomic.StoreInt32(&kv.recovering, 0)
 		log.Printf("\n%v-%v Marked recovery false", kv.gid, kv.me)
 	}()
 	// Initialize database, check if state is stored
-	kv.recovering = true
-	log.Printf("\n%v-%v Marked recovery true", kv.gid, kv.me)
 	kv.dbInit()
-	if !recovery {
+	if kv.damaged && (!kv.recovery || len(servers) == 1) {
+		log.Fatalf("shardkv %v-%v: database is damaged, and there are no peers to recover it from", kv.gid, kv.me)
+	}
+	if !kv.recovery {
 		return
 	}
 	// Get minSeq and configNum from the most updated peer that responds
@@ -1435,22 +1799,24 @@ func (kv *ShardKV) startup(servers []string) {
 	}
 	haveState := false
 	args := RecoverArgs{-1, -1, make(map[string]bool), ""}
-	for !kv.dead && !haveState {
+	for !kv.isdead() && !haveState {
 		for index, server := range servers {
 			if index == kv.me {
 				continue
 			}
 			DPrintfPersist("\n\t%v-%v: Asking %v for kv recovery state", kv.gid, kv.me, index)
 			var reply RecoverReply
-			ok := call(server, "ShardKV.FetchRecovery", args, &reply, kv.network)
+			ok := call(server, "ShardKV.FetchRecovery", args, &reply, kv.transport)
 			if ok && !reply.Err {
 				DPrintfPersist("\n\t%v%v: Got %v", kv.gid, kv.me, reply)
+				// Peers may ask for our state meanwhile
+				kv.mu.Lock()
 				if reply.MinSeq > kv.minSeq {
-					kv.config = reply.CurrentConfig
+					kv.setConfig(reply.CurrentConfig)
 					kv.minSeq = reply.MinSeq
 					kv.dbWriteMinSeq(kv.minSeq)
-					kv.dbWriteConfigNum(kv.config.Num)
 				}
+				kv.mu.Unlock()
 				haveState = true
 			}
 		}
@@ -1466,24 +1832,28 @@ func (kv *ShardKV) startup(servers []string) {
 	}
 	for _, shard := range myShards {
 		haveShard := false
-		for !kv.dead && !haveShard {
+		// Index of the server being asked, -1 once done
+		// The loop variables are per iteration, so goroutines can't watch them
+		asking := int32(-1)
+		for !kv.isdead() && !haveShard {
 			for index, server := range servers {
 				if index == kv.me {
 					continue
 				}
+				atomic.StoreInt32(&asking, int32(index))
 				// Keep getting shard data until entire store is transfered
 				// or until server doesn't respond
 				keysReceived := make(map[string]bool)
 				numTries := 0
 				badResponse := false
-				for !kv.dead && !haveShard && !badResponse {
+				for !kv.isdead() && !haveShard && !badResponse {
 					if len(keysReceived) > 0 {
 						fmt.Printf("\nAsking for more!")
 					}
 					DPrintfPersist("\n\t%v-%v: Asking %v for shard %v", kv.gid, kv.me, index, shard)
 					args := RecoverArgs{kv.config.Num, shard, keysReceived, fmt.Sprintf("%v-%v", kv.gid, kv.me)}
 					var reply RecoverReply
-					ok := call(server, "ShardKV.FetchRecovery", args, &reply, kv.network)
+					ok := call(server, "ShardKV.FetchRecovery", args, &reply, kv.transport)
 					if ok && !reply.Err {
 						DPrintf("\n\t: %v-%v Got shard %v from %v\n", kv.gid, kv.me, shard, index)
 						for k, v := range reply.Store {
@@ -1491,7 +1861,7 @@ func (kv *ShardKV) startup(servers []string) {
 							keysReceived[k] = true
 						}
 						for clientID, value := range reply.Response {
-							kv.putResponse(-1, clientID, value)
+							kv.putResponse(-1, clientID, shard, value)
 						}
 						for opID, seen := range reply.Seen {
 							kv.putSeen(opID, seen)
@@ -1508,8 +1878,8 @@ func (kv *ShardKV) startup(servers []string) {
 								ackArgs.Sender = fmt.Sprintf("%v-%v", kv.gid, kv.me)
 								var ackReply FetchReply
 								waitChan <- 1
-								for !kv.dead && !ackSuccess {
-									ackOK := call(srv, "ShardKV.FetchComplete", ackArgs, &ackReply, kv.network)
+								for !kv.isdead() && !ackSuccess {
+									ackOK := call(srv, "ShardKV.FetchComplete", ackArgs, &ackReply, kv.transport)
 									ackSuccess = ackOK && ackReply.Complete
 									if !ackSuccess {
 										time.Sleep(recoveryRetryDelay * time.Millisecond)
@@ -1531,25 +1901,25 @@ func (kv *ShardKV) startup(servers []string) {
 						// Send it an ack of Fetch until success
 						// In case it wakes up
 						waitChan := make(chan int)
-						go func(srv string) {
+						go func(srv string, index int32) {
 							ackSuccess := false
 							ackArgs := &FetchArgs{}
 							ackArgs.Sender = fmt.Sprintf("%v-%v", kv.gid, kv.me)
 							var ackReply FetchReply
 							waitChan <- 1
-							for srv == server {
+							for atomic.LoadInt32(&asking) == index {
 								time.Sleep(10 * time.Millisecond)
 							}
-							for !kv.dead && !ackSuccess && (srv != server) {
+							for !kv.isdead() && !ackSuccess && atomic.LoadInt32(&asking) != index {
 								DPrintf("\n%v.%v: Sending fetch complete to %s", kv.gid, kv.me, server)
-								ackOK := call(srv, "ShardKV.FetchComplete", ackArgs, &ackReply, kv.network)
+								ackOK := call(srv, "ShardKV.FetchComplete", ackArgs, &ackReply, kv.transport)
 								ackSuccess = ackOK && ackReply.Complete
 								if !ackSuccess {
 									time.Sleep(recoveryRetryDelay * time.Millisecond)
 								}
 							}
 							DPrintf("\n%v.%v: Done sending fetch complete to %s", kv.gid, kv.me, server)
-						}(server)
+						}(server, int32(index))
 						<-waitChan
 					}
 					if !ok {
@@ -1560,6 +1930,7 @@ func (kv *ShardKV) startup(servers []string) {
 			}
 			time.Sleep(250 * time.Millisecond)
 		}
+		atomic.StoreInt32(&asking, -1)
 	}
 }
 
@@ -1609,7 +1980,7 @@ func (kv *ShardKV) FetchRecovery(args *RecoverArgs, reply *RecoverReply) error {
 // Me is the index of this server in servers[].
 //
 func StartServer(gid int64, shardmasters []string,
-	servers []string, me int, network bool) *ShardKV {
+	servers []string, me int, network bool, opts rsm.Options) *ShardKV {
 	gob.Register(Op{})
 
 	var err error
@@ -1629,30 +2000,38 @@ func StartServer(gid int64, shardmasters []string,
 	//fmt.Println("running shardkv.StartServer(), network = ",network)
 
 	kv := new(ShardKV)
+	// Read memory options
+	kv.persistent = opts.Persistent
+	kv.recovery = opts.Recovery
+	kv.dbOpts = opts.StorageOptions()
+	kv.dbDir = opts.DBDir("shardkv")
+	kv.writeToMemory = opts.WriteToMemory || !opts.Persistent
+	kv.batchSize = opts.BatchSize
+	kv.batchDelay = opts.BatchDelay
+	kv.pipeline = opts.Pipeline
+
 	// Network stuff
 	kv.me = me
-	kv.network = network
+	tr := opts.Transport
+	if tr == nil {
+		tr = transport.New(transport.Network(network), opts.RPCTimeout)
+	}
+	kv.transport = tr.Endpoint(servers[me])
 
 	DPrintf("about to query for new config\n")
 
 	// ShardKV state
 	kv.gid = gid
-	kv.sm = shardmaster.MakeClerk(shardmasters, kv.network)
+	kv.sm = shardmaster.MakeClerkTransport(shardmasters, kv.transport)
 	kv.config = kv.sm.Query(0) //hangs here, since shardmaster doesn't work
 	DPrintf("got new config\n")
 	kv.store = make(map[string]string)
-	kv.response = make(map[int64]string)
+	for shard := range kv.response {
+		kv.response[shard] = make(map[int64]string)
+	}
 	kv.seen = make(map[int64]bool)
 	kv.minSeq = -1
 
-	// Peristence stuff
-	waitChan := make(chan int)
-	go func() {
-		waitChan <- 1
-		kv.startup(servers)
-	}()
-	<-waitChan
-
 	rpcs := rpc.NewServer()
 	if !printRPCerrors {
 		disableLog()
@@ -1663,62 +2042,23 @@ func StartServer(gid int64, shardmasters []string,
 	}
 
 	// Give paxos a tag which is different for each group
-	kv.px = paxos.Make(servers, me, rpcs, kv.network, "shardkv_"+fmt.Sprint(kv.gid))
+	kv.px = paxos.Make(servers, me, rpcs, network, "shardkv_"+fmt.Sprint(kv.gid), opts.Options)
 
-	if kv.network {
-		port := servers[me][len(servers[me])-5 : len(servers[me])]
-		log.Printf("I am peers[%d] = %s, about to listen on port %s\n", me,
-			servers[me], port)
-		l, e := net.Listen("tcp", port)
-		if e != nil {
-			log.Fatal("listen error: ", e)
-		}
-		kv.l = l
-	} else {
-		os.Remove(servers[me])
-		l, e := net.Listen("unix", servers[me])
-		if e != nil {
-			log.Fatal("listen error: ", e)
-		}
-		kv.l = l
+	// unreliable is applied to each request by kv.fault
+	l, e := kv.transport.Listen(servers[me], rpcs, kv.fault)
+	if e != nil {
+		log.Fatal("listen error: ", e)
 	}
+	kv.listener = l
 
-	// please do not change any of the following code,
-	// or do anything to subvert it.
-
-	go func() {
-		for kv.dead == false {
-			conn, err := kv.l.Accept()
-			if err == nil && kv.dead == false {
-				if kv.unreliable && (rand.Int63()%1000) < 100 {
-					// discard the request.
-					conn.Close()
-				} else if kv.unreliable && (rand.Int63()%1000) < 200 {
-					// process the request but force discard of reply.
-					if !kv.network {
-						c1 := conn.(*net.UnixConn)
-						f, _ := c1.File()
-						err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-						if err != nil {
-							fmt.Printf("shutdown: %v\n", err)
-						}
-					}
-					go rpcs.ServeConn(conn)
-				} else {
-					go rpcs.ServeConn(conn)
-				}
-			} else if err == nil {
-				conn.Close()
-			}
-			if err != nil && kv.dead == false {
-				fmt.Printf("ShardKV(%v) accept: %v\n", me, err.Error())
-				kv.Kill()
-			}
-		}
-	}()
+	// Peristence stuff
+	// Requests and tick wait until startup has recovered the state
+	atomic.StoreInt32(&kv.recovering, 1)
+	log.Printf("\n%v-%v Marked recovery true", kv.gid, kv.me)
+	go kv.startup(servers)
 
 	go func() {
-		for kv.dead == false {
+		for !kv.isdead() {
 			kv.tick()
 			time.Sleep(250 * time.Millisecond)
 		}
@@ -1739,26 +2079,26 @@ func (kv *ShardKV) getMyDiskUsage() int {
 	return getSingleDiskUsage(kv.dbName)
 }
 
-// Gets disk space used by all shardKV databases
-func getShardKVDiskUsage() int {
-	return getSingleDiskUsage("/home/ubuntu/mexos/src/shardkv/persist/")
+// Gets disk space used by all shardKV databases under dataDir
+func getShardKVDiskUsage(dataDir string) int {
+	return getSingleDiskUsage(filepath.Join(dataDir, "shardkv"))
 }
 
-// Gets disk space used by all shardmaster databases
-func getShardMasterDiskUsage() int {
-	return getSingleDiskUsage("/home/ubuntu/mexos/src/shardmaster/persist/")
+// Gets disk space used by all shardmaster databases under dataDir
+func getShardMasterDiskUsage(dataDir string) int {
+	return getSingleDiskUsage(filepath.Join(dataDir, "shardmaster"))
 }
 
-// Gets disk space used by all paxos databases
-func getPaxosDiskUsage() int {
-	return getSingleDiskUsage("/home/ubuntu/mexos/src/paxos/persist/")
+// Gets disk space used by all paxos databases under dataDir
+func getPaxosDiskUsage(dataDir string) int {
+	return getSingleDiskUsage(filepath.Join(dataDir, "paxos"))
 }
 
-// Gets disk space used by all paxos, shardmaster, and shardKV databases
-func getDiskUsage() int {
-	paxosUsage := getPaxosDiskUsage()
-	shardmasterUsage := getShardMasterDiskUsage()
-	shardKVUsage := getShardKVDiskUsage()
+// Gets disk space used by all paxos, shardmaster, and shardKV databases under dataDir
+func getDiskUsage(dataDir string) int {
+	paxosUsage := getPaxosDiskUsage(dataDir)
+	shardmasterUsage := getShardMasterDiskUsage(dataDir)
+	shardKVUsage := getShardKVDiskUsage(dataDir)
 	return paxosUsage + shardmasterUsage + shardKVUsage
 }
 
@@ -1817,6 +2157,43 @@ func getSingleDiskUsage(dir string) int {
 	return -1
 }
 
+func (kv *ShardKV) isdead() bool {
+	return atomic.LoadInt32(&kv.dead) != 0
+}
+
+func (kv *ShardKV) iscorrupt() bool {
+	return atomic.LoadInt32(&kv.corrupt) != 0
+}
+
+func (kv *ShardKV) isrecovering() bool {
+	return atomic.LoadInt32(&kv.recovering) != 0
+}
+
+// Drop a share of incoming requests and replies, for testing
+func (kv *ShardKV) setunreliable(what bool) {
+	if what {
+		atomic.StoreInt32(&kv.unreliable, 1)
+	} else {
+		atomic.StoreInt32(&kv.unreliable, 0)
+	}
+}
+
+func (kv *ShardKV) isunreliable() bool {
+	return atomic.LoadInt32(&kv.unreliable) != 0
+}
+
+// Decide what happens to an incoming request, to simulate an unreliable network
+func (kv *ShardKV) fault() transport.Fault {
+	if kv.isunreliable() && (rand.Int63()%1000) < 100 {
+		// discard the request.
+		return transport.DropRequest
+	} else if kv.isunreliable() && (rand.Int63()%1000) < 200 {
+		// process the request but force discard of reply.
+		return transport.DropReply
+	}
+	return transport.Deliver
+}
+
 type NullWriter int
 
 func (NullWriter) Write([]byte) (int, error) { return 0, nil }
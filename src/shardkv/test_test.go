@@ -2,12 +2,17 @@ package shardkv
 
 import "testing"
 import "shardmaster"
+import "paxos"
+import "rsm"
+import "storage"
+import "transport"
 import "runtime"
 import "strconv"
 import "os"
 import "time"
 import "fmt"
 import "sync"
+import "sync/atomic"
 import "math/rand"
 
 // Note: If a persistence test fails, the next one may fail by panic since kill wasn't called
@@ -31,6 +36,20 @@ func makePort(tag string, host int) string {
 	return s
 }
 
+// Options for a test's servers, with databases under a fresh temporary directory
+func testOptions(t testing.TB) rsm.Options {
+	opts := rsm.DefaultOptions()
+	opts.DataDir = t.TempDir()
+	return opts
+}
+
+// Skip a test that measures on-disk behaviour when only the in-memory engine is built in
+func needDisk(t *testing.T) {
+	if storage.DefaultEngine == "memory" {
+		t.Skip("keeps its database in memory without LevelDB")
+	}
+}
+
 // Use for checking PutHash
 func NextValue(hprev string, val string) string {
 	h := hash(hprev + val)
@@ -64,7 +83,7 @@ func shardkvCleanup(kvServers [][]*ShardKV, saveDisk bool) {
 }
 
 // Set up and start servers for shardkv groups and shardmaster
-func setup(tag string, unreliable bool, numGroups int, numReplicas int) ([]string, []int64, [][]string, [][]*ShardKV, func(), func()) {
+func setup(tag string, unreliable bool, numGroups int, numReplicas int, opts rsm.Options) ([]string, []int64, [][]string, [][]*ShardKV, func(), func()) {
 	runtime.GOMAXPROCS(4)
 
 	const numMasters = 3
@@ -75,7 +94,7 @@ func setup(tag string, unreliable bool, numGroups int, numReplicas int) ([]strin
 		smPorts[i] = makePort(tag+"m", i)
 	}
 	for i := 0; i < numMasters; i++ {
-		smServers[i] = shardmaster.StartServer(smPorts, i, false)
+		smServers[i] = shardmaster.StartServer(smPorts, i, false, opts)
 	}
 
 	gids := make([]int64, numGroups)           // each group ID
@@ -90,8 +109,8 @@ func setup(tag string, unreliable bool, numGroups int, numReplicas int) ([]strin
 			kvPorts[i][j] = makePort(tag+"s", (i*numReplicas)+j)
 		}
 		for j := 0; j < numReplicas; j++ {
-			kvServers[i][j] = StartServer(gids[i], smPorts, kvPorts[i], j, false)
-			kvServers[i][j].unreliable = unreliable
+			kvServers[i][j] = StartServer(gids[i], smPorts, kvPorts[i], j, false, opts)
+			kvServers[i][j].setunreliable(unreliable)
 		}
 	}
 
@@ -106,7 +125,8 @@ func TestFileBasic(t *testing.T) {
 	}
 	numGroups := 3
 	numReplicas := 2
-	smPorts, gids, kvPorts, kvServers, clean, _ := setup("basic", false, numGroups, numReplicas)
+	opts := testOptions(t)
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("basic", false, numGroups, numReplicas, opts)
 	defer clean()
 
 	fmt.Printf("\nTest: Basic Join/Leave...\n")
@@ -117,8 +137,8 @@ func TestFileBasic(t *testing.T) {
 	kvClerk := MakeClerk(smPorts, false)
 
 	// Start listening on reboot channel in case we're testing persistence
-	rebootDone := 0
-	go rebootListener(&rebootDone, false, smPorts, gids, kvPorts, kvServers, numGroups, numReplicas)
+	var rebootDone int32
+	go rebootListener(&rebootDone, false, smPorts, gids, kvPorts, kvServers, numGroups, numReplicas, opts)
 
 	kvClerk.Put("a", "x")
 	v := kvClerk.PutHash("a", "b")
@@ -173,12 +193,12 @@ func TestFileBasic(t *testing.T) {
 		}
 	}
 
-	rebootDone = 1
+	atomic.StoreInt32(&rebootDone, 1)
 	fmt.Printf("\n\tMemory usage          : %v", getMemoryUsage())
-	fmt.Printf("\n\tPaxos Disk usage      : %v", getPaxosDiskUsage())
-	fmt.Printf("\n\tShardmaster Disk usage: %v", getShardMasterDiskUsage())
-	fmt.Printf("\n\tShardKV Disk usage    : %v", getShardKVDiskUsage())
-	fmt.Printf("\n\tTotal Disk usage      : %v", getDiskUsage())
+	fmt.Printf("\n\tPaxos Disk usage      : %v", getPaxosDiskUsage(opts.DataDir))
+	fmt.Printf("\n\tShardmaster Disk usage: %v", getShardMasterDiskUsage(opts.DataDir))
+	fmt.Printf("\n\tShardKV Disk usage    : %v", getShardKVDiskUsage(opts.DataDir))
+	fmt.Printf("\n\tTotal Disk usage      : %v", getDiskUsage(opts.DataDir))
 	fmt.Printf("\n\tPassed\n")
 	time.Sleep(2 * time.Second)
 }
@@ -189,7 +209,8 @@ func TestFileMove(t *testing.T) {
 	}
 	numGroups := 3
 	numReplicas := 3
-	smPorts, gids, kvPorts, kvServers, clean, _ := setup("move", false, numGroups, numReplicas)
+	opts := testOptions(t)
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("move", false, numGroups, numReplicas, opts)
 	defer clean()
 
 	fmt.Printf("\nTest: Shards really move...")
@@ -200,8 +221,8 @@ func TestFileMove(t *testing.T) {
 	kvClerk := MakeClerk(smPorts, false)
 
 	// Start listening on reboot channel in case we're testing persistence
-	rebootDone := 0
-	go rebootListener(&rebootDone, false, smPorts, gids, kvPorts, kvServers, numGroups, numReplicas)
+	var rebootDone int32
+	go rebootListener(&rebootDone, false, smPorts, gids, kvPorts, kvServers, numGroups, numReplicas, opts)
 
 	// insert one key per shard
 	for i := 0; i < shardmaster.NShards; i++ {
@@ -242,7 +263,7 @@ func TestFileMove(t *testing.T) {
 
 	time.Sleep(10 * time.Second)
 
-	rebootDone = 1
+	atomic.StoreInt32(&rebootDone, 1)
 	time.Sleep(2 * time.Second)
 	if count > shardmaster.NShards/3 && count < 2*(shardmaster.NShards/3) {
 		fmt.Printf("\n\tPassed\n")
@@ -258,7 +279,8 @@ func TestFileLimp(t *testing.T) {
 	}
 	numGroups := 3
 	numReplicas := 3
-	smPorts, gids, kvPorts, kvServers, clean, _ := setup("limp", false, numGroups, numReplicas)
+	opts := testOptions(t)
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("limp", false, numGroups, numReplicas, opts)
 	defer clean()
 
 	fmt.Printf("\nTest: Reconfiguration with some dead replicas...")
@@ -269,8 +291,8 @@ func TestFileLimp(t *testing.T) {
 	kvClerk := MakeClerk(smPorts, false)
 
 	// Start listening on reboot channel in case we're testing persistence
-	rebootDone := 0
-	go rebootListener(&rebootDone, false, smPorts, gids, kvPorts, kvServers, numGroups, numReplicas)
+	var rebootDone int32
+	go rebootListener(&rebootDone, false, smPorts, gids, kvPorts, kvServers, numGroups, numReplicas, opts)
 
 	kvClerk.Put("a", "b")
 	if kvClerk.Get("a") != "b" {
@@ -324,20 +346,20 @@ func TestFileLimp(t *testing.T) {
 		}
 	}
 
-	rebootDone = 1
+	atomic.StoreInt32(&rebootDone, 1)
 	time.Sleep(2 * time.Second)
 	fmt.Printf("\n\tPassed\n")
 }
 
-func doConcurrent(t *testing.T, unreliable bool) {
+func doConcurrent(t *testing.T, unreliable bool, opts rsm.Options) {
 	numGroups := 3
 	numReplicas := 3
-	smPorts, gids, kvPorts, kvServers, clean, _ := setup("conc"+strconv.FormatBool(unreliable), unreliable, numGroups, numReplicas)
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("conc"+strconv.FormatBool(unreliable), unreliable, numGroups, numReplicas, opts)
 	defer clean()
 
 	// Start listening on reboot channel in case we're testing persistence
-	rebootDone := 0
-	go rebootListener(&rebootDone, unreliable, smPorts, gids, kvPorts, kvServers, numGroups, numReplicas)
+	var rebootDone int32
+	go rebootListener(&rebootDone, unreliable, smPorts, gids, kvPorts, kvServers, numGroups, numReplicas, opts)
 
 	smClerk := shardmaster.MakeClerk(smPorts, false)
 	for i := 0; i < len(gids); i++ {
@@ -384,7 +406,7 @@ func doConcurrent(t *testing.T, unreliable bool) {
 		}
 	}
 
-	rebootDone = 1
+	atomic.StoreInt32(&rebootDone, 1)
 	time.Sleep(2 * time.Second)
 }
 
@@ -393,7 +415,18 @@ func TestFileConcurrent(t *testing.T) {
 		return
 	}
 	fmt.Printf("\nTest: Concurrent Put/Get/Move...")
-	doConcurrent(t, false)
+	doConcurrent(t, false, testOptions(t))
+	fmt.Printf("\n\tPassed\n")
+}
+
+func TestFileConcurrentPipelined(t *testing.T) {
+	if !runNewTests {
+		return
+	}
+	fmt.Printf("\nTest: Concurrent Put/Get/Move (pipelined)...")
+	opts := testOptions(t)
+	opts.Pipeline = 4
+	doConcurrent(t, false, opts)
 	fmt.Printf("\n\tPassed\n")
 }
 
@@ -402,7 +435,60 @@ func TestFileConcurrentUnreliable(t *testing.T) {
 		return
 	}
 	fmt.Printf("\nTest: Concurrent Put/Get/Move (unreliable)...")
-	doConcurrent(t, true)
+	doConcurrent(t, true, testOptions(t))
+	fmt.Printf("\n\tPassed\n")
+}
+
+// Ops agreed on before their shard moved away must not be applied, or
+// be seen as duplicates by the group the clerk retries them at
+func TestFileMoveDuringPuts(t *testing.T) {
+	if !runNewTests {
+		return
+	}
+	fmt.Printf("\nTest: Shards move while PutHashes are in flight...")
+	opts := testOptions(t)
+	opts.Pipeline = 4
+	smPorts, gids, kvPorts, _, clean, _ := setup("movePuts", true, 3, 3, opts)
+	defer clean()
+
+	smClerk := shardmaster.MakeClerk(smPorts, false)
+	for i := 0; i < len(gids); i++ {
+		smClerk.Join(gids[i], kvPorts[i])
+	}
+
+	var done int32
+	go func() {
+		mover := shardmaster.MakeClerk(smPorts, false)
+		for atomic.LoadInt32(&done) == 0 {
+			mover.Move(rand.Int()%shardmaster.NShards, gids[rand.Int()%len(gids)])
+			time.Sleep(50 * time.Millisecond)
+		}
+	}()
+	defer atomic.StoreInt32(&done, 1)
+
+	const npara = 8
+	var wg sync.WaitGroup
+	for i := 0; i < npara; i++ {
+		wg.Add(1)
+		go func(me int) {
+			defer wg.Done()
+			kvClerk := MakeClerk(smPorts, false)
+			key := strconv.Itoa(me)
+			last := ""
+			for iters := 0; iters < 10; iters++ {
+				nv := strconv.Itoa(rand.Int())
+				if v := kvClerk.PutHash(key, nv); v != last {
+					t.Errorf("PutHash(%v) expected %v got %v\n", key, last, v)
+					return
+				}
+				last = NextValue(last, nv)
+			}
+			if v := kvClerk.Get(key); v != last {
+				t.Errorf("Get(%v) expected %v got %v\n", key, last, v)
+			}
+		}(i)
+	}
+	wg.Wait()
 	fmt.Printf("\n\tPassed\n")
 }
 
@@ -413,7 +499,8 @@ func TestFilePersistenceBasic(t *testing.T) {
 
 	fmt.Printf("\nTest: One replica per group, all reboot ...")
 	// Only use one replicas per group
-	smPorts, gids, kvPorts, kvServers, clean, _ := setup("persistBasic", false, 3, 1)
+	opts := testOptions(t)
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("persistBasic", false, 3, 1, opts)
 
 	smClerk := shardmaster.MakeClerk(smPorts, false)
 	kvClerk := MakeClerk(smPorts, false)
@@ -433,8 +520,8 @@ func TestFilePersistenceBasic(t *testing.T) {
 		kvServers[g][0].KillSaveDisk()
 	}
 	for g := 0; g < len(kvServers); g++ {
-		kvServers[g][0] = StartServer(gids[g], smPorts, kvPorts[g], 0, false)
-		kvServers[g][0].unreliable = false
+		kvServers[g][0] = StartServer(gids[g], smPorts, kvPorts[g], 0, false, opts)
+		kvServers[g][0].setunreliable(false)
 	}
 
 	// Check that the keys are still there.
@@ -448,7 +535,7 @@ func TestFilePersistenceBasic(t *testing.T) {
 
 	fmt.Printf("\nTest: Multiple replicas per group, all reboot ...")
 	// Only use one replicas per group
-	smPorts, gids, kvPorts, kvServers, clean, _ = setup("persistBasic", false, 3, 3)
+	smPorts, gids, kvPorts, kvServers, clean, _ = setup("persistBasic", false, 3, 3, opts)
 	defer clean()
 
 	smClerk = shardmaster.MakeClerk(smPorts, false)
@@ -472,8 +559,8 @@ func TestFilePersistenceBasic(t *testing.T) {
 	}
 	for g := 0; g < len(kvServers); g++ {
 		for s := 0; s < len(kvServers[g]); s++ {
-			kvServers[g][s] = StartServer(gids[g], smPorts, kvPorts[g], s, false)
-			kvServers[g][s].unreliable = false
+			kvServers[g][s] = StartServer(gids[g], smPorts, kvPorts[g], s, false, opts)
+			kvServers[g][s].setunreliable(false)
 		}
 	}
 
@@ -486,22 +573,160 @@ func TestFilePersistenceBasic(t *testing.T) {
 	fmt.Printf("\n\tPassed\n")
 }
 
-func rebootListener(done *int, unreliable bool, smPorts []string, gids []int64, kvPorts [][]string, kvServers [][]*ShardKV, numGroups int, numReplicas int) {
-	for *done == 0 {
+// Flip a bit in the record of key in a killed server's database
+func damageRecord(t *testing.T, kv *ShardKV, key string) {
+	db, err := storage.Open(kv.dbName, kv.dbOpts)
+	if err != nil {
+		t.Fatalf("could not open the database of %v-%v: %v", kv.gid, kv.me, err)
+	}
+	defer db.Close()
+	record, _ := db.Get([]byte(key))
+	if record == nil {
+		t.Fatalf("%v-%v has no record of %v", kv.gid, kv.me, key)
+	}
+	record[len(record)-1] ^= 1
+	db.Put([]byte(key), record)
+}
+
+// A replica restarted with a damaged record throws its database away
+// and recovers the group's state from the other replicas
+func TestFileDamagedRecords(t *testing.T) {
+	if !runNewTests {
+		return
+	}
+
+	fmt.Printf("\nTest: Replica with a damaged record recovers from its group ...")
+	opts := testOptions(t)
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("damaged", false, 1, 3, opts)
+	defer clean()
+
+	smClerk := shardmaster.MakeClerk(smPorts, false)
+	smClerk.Join(gids[0], kvPorts[0])
+	kvClerk := MakeClerk(smPorts, false)
+	kvClerk.Put("a", "x")
+	kvClerk.Put("b", "y")
+
+	// Wait for replica 0 to apply the Puts, which writes them
+	for iters := 0; ; iters++ {
+		if _, ok := kvServers[0][0].dbGet("b"); ok {
+			break
+		}
+		if iters == 100 {
+			t.Fatalf("replica 0 never wrote the Puts")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	kvServers[0][0].KillSaveDisk()
+	damageRecord(t, kvServers[0][0], "KVkey_a")
+	kvServers[0][0] = StartServer(gids[0], smPorts, kvPorts[0], 0, false, opts)
+
+	kv := kvServers[0][0]
+	for iters := 0; kv.isrecovering(); iters++ {
+		if iters == 200 {
+			t.Fatalf("replica 0 never recovered")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	if !kv.damaged {
+		t.Fatalf("damaged record was not found")
+	}
+	kv.mu.Lock()
+	a, _ := kv.getValue("a")
+	b, _ := kv.getValue("b")
+	kv.mu.Unlock()
+	if a != "x" || b != "y" {
+		t.Fatalf("recovered a=%q b=%q, wanted x and y", a, b)
+	}
+	if v := kvClerk.Get("a"); v != "x" {
+		t.Fatalf("Get(a) = %q after recovery, wanted x", v)
+	}
+	fmt.Printf("\n\tPassed\n")
+}
+
+// Flip a bit in the record of key in a running server's database
+func damageLiveRecord(t *testing.T, kv *ShardKV, key string) {
+	kv.dbLock.Lock()
+	defer kv.dbLock.Unlock()
+	record, _ := kv.db.Get([]byte(key))
+	if record == nil {
+		t.Fatalf("%v-%v has no record of %v", kv.gid, kv.me, key)
+	}
+	record[len(record)-1] ^= 1
+	kv.db.Put([]byte(key), record)
+}
+
+// A replica that finds a damaged record while running stops serving,
+// and replaces its state with a snapshot from its group
+func TestFileDamagedRecordsWhileRunning(t *testing.T) {
+	if !runNewTests {
+		return
+	}
+
+	fmt.Printf("\nTest: Replica that finds a damaged record while running recovers from its group ...")
+	opts := testOptions(t)
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("damagedlive", false, 1, 3, opts)
+	defer clean()
+
+	smClerk := shardmaster.MakeClerk(smPorts, false)
+	smClerk.Join(gids[0], kvPorts[0])
+	kvClerk := MakeClerk(smPorts, false)
+	kvClerk.Put("a", "x")
+	kvClerk.Put("b", "y")
+
+	// Wait for replica 0 to apply the Puts, which writes them
+	kv := kvServers[0][0]
+	for iters := 0; ; iters++ {
+		if _, ok := kv.dbGet("b"); ok {
+			break
+		}
+		if iters == 100 {
+			t.Fatalf("replica 0 never wrote the Puts")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	damageLiveRecord(t, kv, "KVkey_a")
+	if _, ok := kv.dbGet("a"); ok || !kv.iscorrupt() {
+		t.Fatalf("damaged record was not found")
+	}
+
+	// The group keeps serving, and replica 0 catches up on the Put
+	kvClerk.Put("b", "z")
+	for iters := 0; kv.iscorrupt(); iters++ {
+		if iters == 200 {
+			t.Fatalf("replica 0 never recovered")
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	kv.mu.Lock()
+	kv.rsm.Sync()
+	a, _ := kv.getValue("a")
+	b, _ := kv.getValue("b")
+	kv.mu.Unlock()
+	if a != "x" || b != "z" {
+		t.Fatalf("recovered a=%q b=%q, wanted x and z", a, b)
+	}
+	if v := kvClerk.Get("a"); v != "x" {
+		t.Fatalf("Get(a) = %q after recovery, wanted x", v)
+	}
+	fmt.Printf("\n\tPassed\n")
+}
+
+func rebootListener(done *int32, unreliable bool, smPorts []string, gids []int64, kvPorts [][]string, kvServers [][]*ShardKV, numGroups int, numReplicas int, opts rsm.Options) {
+	for atomic.LoadInt32(done) == 0 {
 		val := <-rebootChannel
 		if val == 0 {
 			// Reboot a random server
 			group := rand.Int() % numGroups
 			server := rand.Int() % numReplicas
-			if kvServers[group][server].dead {
+			if kvServers[group][server].isdead() {
 				continue
 			}
 			fmt.Printf("\n\tKilling server %v-%v", group, server)
 			kvServers[group][server].KillSaveDisk()
 			time.Sleep(50 * time.Millisecond)
 			//fmt.Printf("\n\tStarting server %v-%v", group, server)
-			kvServers[group][server] = StartServer(gids[group], smPorts, kvPorts[group], server, false)
-			kvServers[group][server].unreliable = unreliable
+			kvServers[group][server] = StartServer(gids[group], smPorts, kvPorts[group], server, false, opts)
+			kvServers[group][server].setunreliable(unreliable)
 			//fmt.Printf("\n\tStarted server %v-%v", group, server)
 		} else if val == 1 {
 			// Reboot a random group
@@ -512,7 +737,7 @@ func rebootListener(done *int, unreliable bool, smPorts []string, gids []int64,
 				killed[g] = make(map[int]bool)
 			}
 			for server := 0; server < numReplicas; server++ {
-				if kvServers[group][server].dead {
+				if kvServers[group][server].isdead() {
 					continue
 				}
 				kvServers[group][server].KillSaveDisk()
@@ -525,8 +750,8 @@ func rebootListener(done *int, unreliable bool, smPorts []string, gids []int64,
 				if !killed[group][server] {
 					continue
 				}
-				kvServers[group][server] = StartServer(gids[group], smPorts, kvPorts[group], server, false)
-				kvServers[group][server].unreliable = false
+				kvServers[group][server] = StartServer(gids[group], smPorts, kvPorts[group], server, false, opts)
+				kvServers[group][server].setunreliable(false)
 			}
 		} else if val == -1 {
 			break
@@ -543,9 +768,9 @@ func TestFilePersistenceOriginals(t *testing.T) {
 	fmt.Printf("\nTest the original tests but with random reboots of servers or entire groups... ")
 	rebootChannel = make(chan int)
 	// Start randomly signaling for servers to reboot
-	done := false
+	var done int32
 	go func() {
-		for !done {
+		for atomic.LoadInt32(&done) == 0 {
 			// Randomly choose to kill a server or a whole group
 			// kill whole groups more often since that's harder to deal with
 			if (rand.Int() % 100) < 75 {
@@ -567,12 +792,14 @@ func TestFilePersistenceOriginals(t *testing.T) {
 
 	TestFileConcurrentUnreliable(t)
 
-	done = true
+	atomic.StoreInt32(&done, 1)
 	fmt.Printf("\n\n\tPassed!!\n")
 }
 
 func TestFileMemory(t *testing.T) {
-	smPorts, gids, kvPorts, kvServers, clean, _ := setup("persistBasic", false, 3, 3)
+	needDisk(t)
+	opts := testOptions(t)
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("persistBasic", false, 3, 3, opts)
 	defer clean()
 	smClerk := shardmaster.MakeClerk(smPorts, false)
 	kvClerk := MakeClerk(smPorts, false)
@@ -581,9 +808,9 @@ func TestFileMemory(t *testing.T) {
 	valueSize := 2000 // Size of each value in KB
 
 	// Periodically check that too much memory isn't being used
-	done := false
+	var done int32
 	go func() {
-		for !done {
+		for atomic.LoadInt32(&done) == 0 {
 			runtime.GC()
 			time.Sleep(50 * time.Millisecond) // Not sure if this is needed
 			usage := getMemoryUsage() / 1000
@@ -636,16 +863,16 @@ func TestFileMemory(t *testing.T) {
 	time.Sleep(3 * time.Second)
 
 	// Reboot server to cause recovery
-	kvServers[0][0] = StartServer(gids[0], smPorts, kvPorts[0], 0, false)
+	kvServers[0][0] = StartServer(gids[0], smPorts, kvPorts[0], 0, false, opts)
 	time.Sleep(10 * time.Second)
 
 	fmt.Printf("\n\tMemory usage           (MB): %v", getMemoryUsage()/1000)
-	fmt.Printf("\n\tPaxos Disk usage       (MB): %v", getPaxosDiskUsage()/1000)
-	fmt.Printf("\n\tShardmaster Disk usage (KB): %v", getShardMasterDiskUsage())
-	fmt.Printf("\n\tShardKV Disk usage     (MB): %v", getShardKVDiskUsage()/1000)
-	fmt.Printf("\n\tTotal Disk usage       (MB): %v", getDiskUsage()/1000)
+	fmt.Printf("\n\tPaxos Disk usage       (MB): %v", getPaxosDiskUsage(opts.DataDir)/1000)
+	fmt.Printf("\n\tShardmaster Disk usage (KB): %v", getShardMasterDiskUsage(opts.DataDir))
+	fmt.Printf("\n\tShardKV Disk usage     (MB): %v", getShardKVDiskUsage(opts.DataDir)/1000)
+	fmt.Printf("\n\tTotal Disk usage       (MB): %v", getDiskUsage(opts.DataDir)/1000)
 	fmt.Printf("\n\tPassed\n")
-	done = true
+	atomic.StoreInt32(&done, 1)
 	time.Sleep(5 * time.Second)
 }
 
@@ -704,20 +931,22 @@ func paddedRandIntString(size int) string {
 //		}
 //		runtime.Gosched()
 //	}
-//	fmt.Printf("\n\tComplete, disk usage = %v MB", getDiskUsage()/1024)
+//	fmt.Printf("\n\tComplete, disk usage = %v MB", getDiskUsage(opts.DataDir)/1024)
 
 //	// Make sure goroutines for putting data have ended
 //	time.Sleep(10 * time.Second)
 //}
 
 func TestDiskTransfer(t *testing.T) {
+	needDisk(t)
 	nclients := 3
 	keySize := 32         // Size in bytes
 	valSize := 500 * 1024 // Size in bytes
 	dbTargetSize := 100   // Desired size in MB
 	nItems := int64(dbTargetSize) * int64(1024) * int64(1024) / int64(keySize+valSize)
 	dbSize := float64(nItems) * float64(keySize+valSize) / float64(1024) / float64(1024) // Size accounting for rounding errors
-	smPorts, gids, kvPorts, _, clean, _ := setup("recovery", false, 2, 1)
+	opts := testOptions(t)
+	smPorts, gids, kvPorts, _, clean, _ := setup("recovery", false, 2, 1, opts)
 	defer clean()
 	smClerk := shardmaster.MakeClerk(smPorts, false)
 	kvClerk := MakeClerk(smPorts, false)
@@ -738,26 +967,26 @@ func TestDiskTransfer(t *testing.T) {
 		go func() {
 			ck := MakeClerk(smPorts, false)
 			waitChan <- 1
-			for numPut < nItems {
+			for atomic.LoadInt64(&numPut) < nItems {
 				key := "d" + paddedRandIntString(keySize-1)
 				value := paddedRandIntString(valSize)
 				ck.Put(key, value)
-				numPut++
+				atomic.AddInt64(&numPut, 1)
 			}
 		}()
 		<-waitChan
 	}
 	// Wait for database to be completed
-	for numPut < nItems {
-		if numPut%100 == 0 {
-			fmt.Printf("\n\tPut %v/%v values", numPut, nItems)
-			for numPut%100 == 0 {
+	for atomic.LoadInt64(&numPut) < nItems {
+		if put := atomic.LoadInt64(&numPut); put%100 == 0 {
+			fmt.Printf("\n\tPut %v/%v values", put, nItems)
+			for atomic.LoadInt64(&numPut)%100 == 0 {
 				runtime.Gosched()
 			}
 		}
 		runtime.Gosched()
 	}
-	fmt.Printf("\n\tComplete, disk usage = %v MB", getDiskUsage()/1024)
+	fmt.Printf("\n\tComplete, disk usage = %v MB", getDiskUsage(opts.DataDir)/1024)
 
 	// Make sure goroutines for putting data have ended
 	time.Sleep(10 * time.Second)
@@ -791,3 +1020,234 @@ func TestDiskTransfer(t *testing.T) {
 
 //	fmt.Printf("\n\tTransfer took %v seconds", duration.Seconds())
 //}
+
+// Index of the replica in group that holds the Paxos leader lease
+func waitForLeaseHolder(t *testing.T, group []*ShardKV) int {
+	for iters := 0; iters < 100; iters++ {
+		for i, kv := range group {
+			if kv.px.IsLeader() {
+				return i
+			}
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	t.Fatalf("No replica holds a lease")
+	return -1
+}
+
+// Gets at the leaseholder skip the log, and a replica cut off from
+// the others never answers a Get with a value that has been overwritten
+func TestFileLeaseReads(t *testing.T) {
+	if !runNewTests {
+		return
+	}
+	const numReplicas = 3
+	opts := testOptions(t)
+	network := transport.NewMemory(0)
+	opts.Transport = network
+	opts.EnableLeader = paxos.MultiPaxos
+	opts.LeaseDuration = 300 * time.Millisecond
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("lease", false, 2, numReplicas, opts)
+	defer clean()
+	group := kvServers[0]
+
+	fmt.Printf("\nTest: Gets at the leaseholder skip the log...")
+
+	smClerk := shardmaster.MakeClerkTransport(smPorts, network.Endpoint("lease-smclerk"))
+	smClerk.Join(gids[0], kvPorts[0])
+	kvClerk := MakeClerkTransport(smPorts, network.Endpoint("lease-client"))
+	kvClerk.Put("a", "1")
+
+	leader := waitForLeaseHolder(t, group)
+	before := group[leader].px.Max()
+	for i := 0; i < 10; i++ {
+		var reply KVReply
+		group[leader].Get(&GetArgs{"a", nrand(), nrand()}, &reply)
+		if reply.Err != OK || reply.Value != "1" {
+			t.Fatalf("Get at leaseholder got %v (%v), wanted 1", reply.Value, reply.Err)
+		}
+	}
+	if after := group[leader].px.Max(); after != before {
+		t.Fatalf("Gets at the leaseholder used instances %v to %v", before+1, after)
+	}
+	// Gets elsewhere still go through the log, once the follower has seen the Join
+	other := (leader + 1) % numReplicas
+	var reply KVReply
+	for iters := 0; iters < 50 && reply.Err != OK; iters++ {
+		group[other].Get(&GetArgs{"a", nrand(), nrand()}, &reply)
+		time.Sleep(100 * time.Millisecond)
+	}
+	if reply.Err != OK || reply.Value != "1" {
+		t.Fatalf("Get at follower got %v (%v), wanted 1", reply.Value, reply.Err)
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Cut off leaseholder doesn't serve stale Gets...")
+
+	var majority []string
+	for i, port := range kvPorts[0] {
+		if i != leader {
+			majority = append(majority, port)
+		}
+	}
+	majority = append(majority, smPorts...)
+	majority = append(majority, "lease-smclerk", "lease-client")
+	network.Partition([]string{kvPorts[0][leader]}, majority)
+
+	// The majority takes over, and the write completes there
+	kvClerk.Put("a", "2")
+	stale := make(chan KVReply, 1)
+	go func() {
+		var reply KVReply
+		group[leader].Get(&GetArgs{"a", nrand(), nrand()}, &reply)
+		stale <- reply
+	}()
+	var healed KVReply
+	answered := false
+	select {
+	case healed = <-stale:
+		answered = true
+		if healed.Err == OK && healed.Value != "2" {
+			t.Fatalf("Cut off replica answered %v after the write of 2", healed.Value)
+		}
+	case <-time.After(2 * time.Second):
+		// Waiting for the log, which is fine
+	}
+	newLeader := waitForLeaseHolder(t, group)
+	if newLeader == leader {
+		t.Fatalf("Cut off replica %v still holds a lease", leader)
+	}
+	if v := kvClerk.Get("a"); v != "2" {
+		t.Fatalf("Get got %v, wanted 2", v)
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Reads after the partition heals...")
+
+	network.Heal()
+	if !answered {
+		select {
+		case healed = <-stale:
+		case <-time.After(10 * time.Second):
+			t.Fatalf("Get at the old leaseholder never returned")
+		}
+	}
+	if healed.Err == OK && healed.Value != "2" {
+		t.Fatalf("Old leaseholder answered %v, wanted 2", healed.Value)
+	}
+	kvClerk.Put("a", "3")
+	for i := 0; i < numReplicas; i++ {
+		var reply KVReply
+		group[i].Get(&GetArgs{"a", nrand(), nrand()}, &reply)
+		if reply.Err != OK || reply.Value != "3" {
+			t.Fatalf("Replica %v got %v (%v), wanted 3", i, reply.Value, reply.Err)
+		}
+	}
+
+	fmt.Printf("\n\tPassed")
+
+	fmt.Printf("\nTest: Leaseholders don't serve shards that moved...")
+
+	// Once the new owner took a write, the old one must not answer
+	shard := key2shard("a")
+	smClerk.Join(gids[1], kvPorts[1])
+	smClerk.Move(shard, gids[1])
+	reply = KVReply{}
+	for iters := 0; iters < 50 && reply.Err != OK; iters++ {
+		kvServers[1][0].Put(&PutArgs{"a", "4", false, nrand(), nrand()}, &reply)
+		time.Sleep(100 * time.Millisecond)
+	}
+	if reply.Err != OK {
+		t.Fatalf("New owner never took the write: %v", reply.Err)
+	}
+	leader = waitForLeaseHolder(t, group)
+	reply = KVReply{}
+	group[leader].Get(&GetArgs{"a", nrand(), nrand()}, &reply)
+	if reply.Err != ErrWrongGroup {
+		t.Fatalf("Old owner's leaseholder got %v (%v) after the shard moved", reply.Value, reply.Err)
+	}
+
+	// Whichever group a leaseholder is in, it answers with the last write or not at all
+	moved := make(chan bool)
+	go func() {
+		for i := 0; i < 10; i++ {
+			smClerk.Move(shard, gids[i%2])
+			time.Sleep(100 * time.Millisecond)
+		}
+		moved <- true
+	}()
+	for i, done := 5, false; !done; i++ {
+		value := strconv.Itoa(i)
+		kvClerk.Put("a", value)
+		for g := range gids {
+			holder := waitForLeaseHolder(t, kvServers[g])
+			var reply KVReply
+			kvServers[g][holder].Get(&GetArgs{"a", nrand(), nrand()}, &reply)
+			if reply.Err == OK && reply.Value != value {
+				t.Fatalf("Leaseholder of %v got %v, wanted %v", gids[g], reply.Value, value)
+			}
+		}
+		select {
+		case done = <-moved:
+		default:
+		}
+	}
+
+	fmt.Printf("\n\tPassed\n")
+}
+
+// Concurrent client ops share instances, and each is still applied once
+func TestFileBatch(t *testing.T) {
+	if !runNewTests {
+		return
+	}
+	const numClerks = 20
+	const perClerk = 5
+	opts := testOptions(t)
+	opts.BatchSize = 10
+	opts.BatchDelay = 5 * time.Millisecond
+	smPorts, gids, kvPorts, kvServers, clean, _ := setup("batch", false, 1, 3, opts)
+	defer clean()
+
+	fmt.Printf("\nTest: Concurrent ops are batched...")
+
+	smClerk := shardmaster.MakeClerk(smPorts, false)
+	smClerk.Join(gids[0], kvPorts[0])
+	start := kvServers[0][0].px.Max()
+
+	var wg sync.WaitGroup
+	for i := 0; i < numClerks; i++ {
+		wg.Add(1)
+		go func(me int) {
+			defer wg.Done()
+			kvClerk := MakeClerk(smPorts, false)
+			// Every key starts with "a", so all are in one shard
+			key := "a" + strconv.Itoa(me)
+			last := ""
+			for iters := 0; iters < perClerk; iters++ {
+				nv := strconv.Itoa(rand.Int())
+				if v := kvClerk.PutHash(key, nv); v != last {
+					t.Errorf("PutHash(%v) expected %v got %v", key, last, v)
+					return
+				}
+				last = NextValue(last, nv)
+				if v := kvClerk.Get(key); v != last {
+					t.Errorf("Get(%v) expected %v got %v", key, last, v)
+					return
+				}
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	numOps := numClerks * perClerk * 2
+	used := kvServers[0][0].px.Max() - start
+	if used >= numOps/2 {
+		t.Fatalf("%v ops took %v instances, expected batches", numOps, used)
+	}
+
+	fmt.Printf("\n\t%v ops in %v instances", numOps, used)
+	fmt.Printf("\n\tPassed\n")
+}
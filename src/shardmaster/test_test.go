@@ -1,6 +1,7 @@
 package shardmaster
 
 import "testing"
+import "rsm"
 import "runtime"
 import "strconv"
 import "os"
@@ -8,6 +9,8 @@ import "os"
 import "time"
 import "fmt"
 import "math/rand"
+import "reflect"
+import "storage"
 
 const onlyBenchmarks = false
 const runOldTests = true
@@ -25,6 +28,13 @@ func makePort(tag string, host int) string {
 	return s
 }
 
+// Options for a test's servers, with databases under a fresh temporary directory
+func testOptions(test testing.TB) rsm.Options {
+	opts := rsm.DefaultOptions()
+	opts.DataDir = test.TempDir()
+	return opts
+}
+
 // Kill the given servers
 func cleanup(shardMasterServers []*ShardMaster) {
 	for i := 0; i < len(shardMasterServers); i++ {
@@ -86,6 +96,7 @@ func TestFileBasic(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	const numServers = 3
@@ -98,7 +109,7 @@ func TestFileBasic(test *testing.T) {
 		shardMasterPorts[i] = makePort("basic", i)
 	}
 	for i := 0; i < numServers; i++ {
-		shardMasterServers[i] = StartServer(shardMasterPorts, i, false)
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
 	}
 
 	// Make clerks to communicate with shardmaster
@@ -322,6 +333,7 @@ func TestFileUnreliable(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	const numServers = 3
@@ -334,11 +346,11 @@ func TestFileUnreliable(test *testing.T) {
 		shardMasterPorts[i] = makePort("unrel", i)
 	}
 	for i := 0; i < numServers; i++ {
-		shardMasterServers[i] = StartServer(shardMasterPorts, i, false)
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
 		// don't turn on unreliable because the assignment
 		// doesn't require the shardmaster to detect duplicate
 		// client requests.
-		// shardMasterServers[i].unreliable = true
+		// shardMasterServers[i].setunreliable(true)
 	}
 
 	masterClerk := MakeClerk(shardMasterPorts, false)
@@ -377,6 +389,7 @@ func TestFileFreshQuery(test *testing.T) {
 	if onlyBenchmarks || !runOldTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	const numServers = 3
@@ -389,7 +402,7 @@ func TestFileFreshQuery(test *testing.T) {
 		shardMasterPorts[i] = makePort("fresh", i)
 	}
 	for i := 0; i < numServers; i++ {
-		shardMasterServers[i] = StartServer(shardMasterPorts, i, false)
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
 	}
 
 	clerk1 := MakeClerk([]string{shardMasterPorts[1]}, false)
@@ -418,6 +431,7 @@ func TestFilePersistence(test *testing.T) {
 	if onlyBenchmarks || !runNewTests {
 		return
 	}
+	opts := testOptions(test)
 	runtime.GOMAXPROCS(4)
 
 	const numServers = 3
@@ -430,7 +444,7 @@ func TestFilePersistence(test *testing.T) {
 		shardMasterPorts[i] = makePort("fresh", i)
 	}
 	for i := 0; i < numServers; i++ {
-		shardMasterServers[i] = StartServer(shardMasterPorts, i, false)
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
 	}
 
 	// Make clerks to communicate with servers
@@ -457,7 +471,7 @@ func TestFilePersistence(test *testing.T) {
 	checkConfig(test, gids, masterClerk)
 
 	// Bring server back and query configs
-	shardMasterServers[0] = StartServer(shardMasterPorts, 0, false)
+	shardMasterServers[0] = StartServer(shardMasterPorts, 0, false, opts)
 	if clerks[0].Query(3).Num != 3 {
 		test.Fatalf("Restarted server (with disk) does not remember past configs it had seen")
 	}
@@ -481,7 +495,7 @@ func TestFilePersistence(test *testing.T) {
 	checkConfig(test, gids, masterClerk)
 
 	// Bring server back and query configs
-	shardMasterServers[0] = StartServer(shardMasterPorts, 0, false)
+	shardMasterServers[0] = StartServer(shardMasterPorts, 0, false, opts)
 	if clerks[0].Query(4).Num != 4 {
 		test.Fatalf("Restarted server (no disk) does not remember past configs it had seen")
 	}
@@ -504,7 +518,7 @@ func TestFilePersistence(test *testing.T) {
 
 	// Bring servers back
 	for i := 0; i < numServers; i++ {
-		shardMasterServers[i] = StartServer(shardMasterPorts, i, false)
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
 	}
 	// Check configs
 	for i := 0; i < numServers; i++ {
@@ -518,7 +532,123 @@ func TestFilePersistence(test *testing.T) {
 	fmt.Printf("\n\tPassed\n\n")
 }
 
+// Flip a bit in the record of key in a killed server's database
+func damageRecord(test *testing.T, sm *ShardMaster, key string) {
+	db, err := storage.Open(sm.dbName, sm.dbOpts)
+	if err != nil {
+		test.Fatalf("could not open the database of %v: %v", sm.me, err)
+	}
+	defer db.Close()
+	record, _ := db.Get([]byte(key))
+	if record == nil {
+		test.Fatalf("server %v has no record of %v", sm.me, key)
+	}
+	record[len(record)-1] ^= 1
+	db.Put([]byte(key), record)
+}
+
+func TestFileDamagedRecords(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 3
+	var shardMasterServers []*ShardMaster = make([]*ShardMaster, numServers)
+	var shardMasterPorts []string = make([]string, numServers)
+	defer cleanup(shardMasterServers)
+	for i := 0; i < numServers; i++ {
+		shardMasterPorts[i] = makePort("damaged", i)
+	}
+	for i := 0; i < numServers; i++ {
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
+	}
+	var clerks [numServers]*Clerk
+	for i := 0; i < numServers; i++ {
+		clerks[i] = MakeClerk([]string{shardMasterPorts[i]}, false)
+	}
+
+	fmt.Printf("\nTest: Restarted server with a damaged config recovers it from peers ...")
+	for gid := int64(1); gid <= 3; gid++ {
+		clerks[1].Join(gid, []string{"a", "b", "c"})
+	}
+	clerks[1].Leave(2)
+	latest := clerks[1].Query(-1)
+	// Server 0 writes the configs as it catches up
+	clerks[0].Query(-1)
+
+	shardMasterServers[0].KillSaveDisk()
+	damageRecord(test, shardMasterServers[0], "config_2")
+	shardMasterServers[0] = StartServer(shardMasterPorts, 0, false, opts)
+	for num := 0; num <= latest.Num; num++ {
+		if config, want := clerks[0].Query(num), clerks[1].Query(num); !reflect.DeepEqual(config, want) {
+			test.Fatalf("restarted server has config %v as %v, wanted %v", num, config, want)
+		}
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+// Flip a bit in the record of key in a running server's database
+func damageLiveRecord(test *testing.T, sm *ShardMaster, key string) {
+	sm.dbLock.Lock()
+	defer sm.dbLock.Unlock()
+	record, _ := sm.db.Get([]byte(key))
+	if record == nil {
+		test.Fatalf("server %v has no record of %v", sm.me, key)
+	}
+	record[len(record)-1] ^= 1
+	sm.db.Put([]byte(key), record)
+}
+
+func TestFileDamagedRecordsWhileRunning(test *testing.T) {
+	if onlyBenchmarks || !runNewTests {
+		return
+	}
+	opts := testOptions(test)
+	runtime.GOMAXPROCS(4)
+
+	const numServers = 3
+	var shardMasterServers []*ShardMaster = make([]*ShardMaster, numServers)
+	var shardMasterPorts []string = make([]string, numServers)
+	defer cleanup(shardMasterServers)
+	for i := 0; i < numServers; i++ {
+		shardMasterPorts[i] = makePort("damagedlive", i)
+	}
+	for i := 0; i < numServers; i++ {
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
+	}
+	var clerks [numServers]*Clerk
+	for i := 0; i < numServers; i++ {
+		clerks[i] = MakeClerk([]string{shardMasterPorts[i]}, false)
+	}
+
+	fmt.Printf("\nTest: Server that finds a damaged config while running recovers it from peers ...")
+	for gid := int64(1); gid <= 3; gid++ {
+		clerks[1].Join(gid, []string{"a", "b", "c"})
+	}
+	clerks[1].Leave(2)
+	// Server 0 writes the configs as it catches up
+	clerks[0].Query(-1)
+
+	damageLiveRecord(test, shardMasterServers[0], "config_2")
+	clerks[1].Move(0, 3)
+	latest := clerks[1].Query(-1)
+	for num := 0; num <= latest.Num; num++ {
+		if config, want := clerks[0].Query(num), clerks[1].Query(num); !reflect.DeepEqual(config, want) {
+			test.Fatalf("server has config %v as %v, wanted %v", num, config, want)
+		}
+	}
+	if shardMasterServers[0].iscorrupt() {
+		test.Fatalf("server still marked damaged")
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
 func BenchmarkJoinSpeed_____(benchmark *testing.B) {
+	opts := testOptions(benchmark)
 	const numServers = 3
 	var shardMasterServers []*ShardMaster = make([]*ShardMaster, numServers)
 	var shardMasterPorts []string = make([]string, numServers)
@@ -529,7 +659,7 @@ func BenchmarkJoinSpeed_____(benchmark *testing.B) {
 		shardMasterPorts[i] = makePort("fresh", i)
 	}
 	for i := 0; i < numServers; i++ {
-		shardMasterServers[i] = StartServer(shardMasterPorts, i, false)
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
 	}
 
 	// Make clerks to communicate with servers
@@ -552,6 +682,7 @@ func BenchmarkJoinSpeed_____(benchmark *testing.B) {
 }
 
 func BenchmarkLeaveSpeed____(benchmark *testing.B) {
+	opts := testOptions(benchmark)
 	const numServers = 3
 	var shardMasterServers []*ShardMaster = make([]*ShardMaster, numServers)
 	var shardMasterPorts []string = make([]string, numServers)
@@ -562,7 +693,7 @@ func BenchmarkLeaveSpeed____(benchmark *testing.B) {
 		shardMasterPorts[i] = makePort("fresh", i)
 	}
 	for i := 0; i < numServers; i++ {
-		shardMasterServers[i] = StartServer(shardMasterPorts, i, false)
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
 	}
 
 	// Make clerks to communicate with servers
@@ -586,6 +717,7 @@ func BenchmarkLeaveSpeed____(benchmark *testing.B) {
 }
 
 func BenchmarkJoinLeaveSpeed(benchmark *testing.B) {
+	opts := testOptions(benchmark)
 	const numServers = 3
 	var shardMasterServers []*ShardMaster = make([]*ShardMaster, numServers)
 	var shardMasterPorts []string = make([]string, numServers)
@@ -596,7 +728,7 @@ func BenchmarkJoinLeaveSpeed(benchmark *testing.B) {
 		shardMasterPorts[i] = makePort("fresh", i)
 	}
 	for i := 0; i < numServers; i++ {
-		shardMasterServers[i] = StartServer(shardMasterPorts, i, false)
+		shardMasterServers[i] = StartServer(shardMasterPorts, i, false, opts)
 	}
 
 	// Make clerks to communicate with servers
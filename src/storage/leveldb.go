@@ -0,0 +1,167 @@
+//go:build cgo && !noleveldb
+// +build cgo,!noleveldb
+
+package storage
+
+//
+// LevelDB engine (via levigo).
+// Requires cgo and a system LevelDB; build with -tags noleveldb to leave it out.
+//
+
+import "github.com/jmhodges/levigo"
+import "os"
+
+// Engine used when Options.Engine is empty
+const DefaultEngine = "leveldb"
+
+// Will use this to check that the cache size doesn't overflow an int
+// (int size is either 32 or 64 bits depending on implementation)
+const maxInt = int(^uint(0) >> 1)
+
+type levelDB struct {
+	db           *levigo.DB
+	opts         *levigo.Options
+	cache        *levigo.Cache
+	readOptions  *levigo.ReadOptions
+	writeOptions *levigo.WriteOptions
+	// Bulk reads (iterators) don't fill the cache
+	bulkReadOptions *levigo.ReadOptions
+}
+
+func init() {
+	Register("leveldb", openLevelDB, destroyLevelDB)
+}
+
+func levigoOptions(opts Options) (*levigo.Options, *levigo.Cache) {
+	dbOpts := levigo.NewOptions()
+	var cache *levigo.Cache
+	if opts.Cache {
+		if opts.CacheSize > maxInt/1000000 {
+			cache = levigo.NewLRUCache(maxInt)
+		} else {
+			cache = levigo.NewLRUCache(opts.CacheSize * 1000000)
+		}
+		dbOpts.SetCache(cache)
+	}
+	if opts.Compression {
+		dbOpts.SetCompression(levigo.SnappyCompression)
+	} else {
+		dbOpts.SetCompression(levigo.NoCompression)
+	}
+	dbOpts.SetCreateIfMissing(true)
+	return dbOpts, cache
+}
+
+func openLevelDB(name string, opts Options) (Engine, error) {
+	dbOpts, cache := levigoOptions(opts)
+	db, err := levigo.Open(name, dbOpts)
+	if err != nil {
+		dbOpts.Close()
+		if cache != nil {
+			cache.Close()
+		}
+		return nil, err
+	}
+	ldb := &levelDB{db: db, opts: dbOpts, cache: cache}
+	ldb.readOptions = levigo.NewReadOptions()
+	ldb.readOptions.SetFillCache(opts.Cache)
+	ldb.bulkReadOptions = levigo.NewReadOptions()
+	ldb.bulkReadOptions.SetFillCache(false)
+	ldb.writeOptions = levigo.NewWriteOptions()
+	ldb.writeOptions.SetSync(opts.Sync)
+	return ldb, nil
+}
+
+func destroyLevelDB(name string, opts Options) error {
+	dbOpts, cache := levigoOptions(opts)
+	defer dbOpts.Close()
+	if cache != nil {
+		defer cache.Close()
+	}
+	err := levigo.DestroyDatabase(name, dbOpts)
+	if err != nil {
+		return err
+	}
+	// Clears out directories holding several databases as well
+	return os.RemoveAll(name)
+}
+
+func (ldb *levelDB) Get(key []byte) ([]byte, error) {
+	return ldb.db.Get(ldb.readOptions, key)
+}
+
+func (ldb *levelDB) Put(key, value []byte) error {
+	return ldb.db.Put(ldb.writeOptions, key, value)
+}
+
+func (ldb *levelDB) Delete(key []byte) error {
+	return ldb.db.Delete(ldb.writeOptions, key)
+}
+
+func (ldb *levelDB) Batch() Batch {
+	return &levelBatch{ldb, levigo.NewWriteBatch()}
+}
+
+func (ldb *levelDB) Iterator() Iterator {
+	return ldb.db.NewIterator(ldb.bulkReadOptions)
+}
+
+func (ldb *levelDB) Snapshot() Snapshot {
+	snap := ldb.db.NewSnapshot()
+	readOptions := levigo.NewReadOptions()
+	readOptions.SetFillCache(false)
+	readOptions.SetSnapshot(snap)
+	return &levelSnapshot{ldb, snap, readOptions}
+}
+
+func (ldb *levelDB) Close() error {
+	ldb.db.Close()
+	ldb.readOptions.Close()
+	ldb.bulkReadOptions.Close()
+	ldb.writeOptions.Close()
+	ldb.opts.Close()
+	if ldb.cache != nil {
+		ldb.cache.Close()
+	}
+	return nil
+}
+
+type levelBatch struct {
+	ldb   *levelDB
+	batch *levigo.WriteBatch
+}
+
+func (b *levelBatch) Put(key, value []byte) {
+	b.batch.Put(key, value)
+}
+
+func (b *levelBatch) Delete(key []byte) {
+	b.batch.Delete(key)
+}
+
+func (b *levelBatch) Write() error {
+	return b.ldb.db.Write(b.ldb.writeOptions, b.batch)
+}
+
+func (b *levelBatch) Close() {
+	b.batch.Close()
+}
+
+type levelSnapshot struct {
+	ldb         *levelDB
+	snap        *levigo.Snapshot
+	readOptions *levigo.ReadOptions
+}
+
+func (s *levelSnapshot) Get(key []byte) ([]byte, error) {
+	return s.ldb.db.Get(s.readOptions, key)
+}
+
+func (s *levelSnapshot) Iterator() Iterator {
+	return s.ldb.db.NewIterator(s.readOptions)
+}
+
+func (s *levelSnapshot) Release() {
+	s.readOptions.Close()
+	s.ldb.db.ReleaseSnapshot(s.snap)
+}
@@ -0,0 +1,235 @@
+package storage
+
+//
+// Pure-Go in-memory engine.
+// Contents outlive Close (but not the process) so that a restarted
+// server reopening the same name sees what it wrote before,
+// just like it would with an on-disk engine.
+//
+
+import "errors"
+import "sort"
+import "strings"
+import "sync"
+import "path/filepath"
+
+var ErrClosed = errors.New("storage: database is closed")
+
+type memStore struct {
+	mu   sync.RWMutex
+	data map[string][]byte
+}
+
+var memStoresMu sync.Mutex
+var memStores = make(map[string]*memStore)
+
+type memDB struct {
+	store  *memStore
+	mu     sync.Mutex
+	closed bool
+}
+
+func init() {
+	Register("memory", openMemory, destroyMemory)
+}
+
+func openMemory(name string, opts Options) (Engine, error) {
+	memStoresMu.Lock()
+	defer memStoresMu.Unlock()
+	store, ok := memStores[name]
+	if !ok {
+		store = &memStore{data: make(map[string][]byte)}
+		memStores[name] = store
+	}
+	return &memDB{store: store}, nil
+}
+
+func destroyMemory(name string, opts Options) error {
+	memStoresMu.Lock()
+	defer memStoresMu.Unlock()
+	// Names are paths, so destroying a directory destroys everything under it
+	prefix := strings.TrimSuffix(name, string(filepath.Separator)) + string(filepath.Separator)
+	for storeName := range memStores {
+		if storeName == name || strings.HasPrefix(storeName, prefix) {
+			delete(memStores, storeName)
+		}
+	}
+	return nil
+}
+
+func (db *memDB) isClosed() bool {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	return db.closed
+}
+
+func (db *memDB) Get(key []byte) ([]byte, error) {
+	if db.isClosed() {
+		return nil, ErrClosed
+	}
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+	value, ok := db.store.data[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (db *memDB) Put(key, value []byte) error {
+	if db.isClosed() {
+		return ErrClosed
+	}
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	db.store.data[string(key)] = append([]byte(nil), value...)
+	return nil
+}
+
+func (db *memDB) Delete(key []byte) error {
+	if db.isClosed() {
+		return ErrClosed
+	}
+	db.store.mu.Lock()
+	defer db.store.mu.Unlock()
+	delete(db.store.data, string(key))
+	return nil
+}
+
+func (db *memDB) Batch() Batch {
+	return &memBatch{db: db}
+}
+
+func (db *memDB) Iterator() Iterator {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+	return newMemIterator(db.store.data)
+}
+
+func (db *memDB) Snapshot() Snapshot {
+	db.store.mu.RLock()
+	defer db.store.mu.RUnlock()
+	// Values are never modified in place, so a shallow copy is enough
+	data := make(map[string][]byte, len(db.store.data))
+	for key, value := range db.store.data {
+		data[key] = value
+	}
+	return &memSnapshot{data}
+}
+
+func (db *memDB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	db.closed = true
+	return nil
+}
+
+type memOp struct {
+	key    string
+	value  []byte
+	delete bool
+}
+
+type memBatch struct {
+	db  *memDB
+	ops []memOp
+}
+
+func (b *memBatch) Put(key, value []byte) {
+	b.ops = append(b.ops, memOp{string(key), append([]byte(nil), value...), false})
+}
+
+func (b *memBatch) Delete(key []byte) {
+	b.ops = append(b.ops, memOp{string(key), nil, true})
+}
+
+func (b *memBatch) Write() error {
+	if b.db.isClosed() {
+		return ErrClosed
+	}
+	b.db.store.mu.Lock()
+	defer b.db.store.mu.Unlock()
+	for _, op := range b.ops {
+		if op.delete {
+			delete(b.db.store.data, op.key)
+		} else {
+			b.db.store.data[op.key] = op.value
+		}
+	}
+	return nil
+}
+
+func (b *memBatch) Close() {
+	b.ops = nil
+}
+
+// Iterates over a sorted copy of the keys taken at creation
+type memIterator struct {
+	keys   []string
+	values [][]byte
+	pos    int
+}
+
+func newMemIterator(data map[string][]byte) *memIterator {
+	it := &memIterator{}
+	it.keys = make([]string, 0, len(data))
+	for key := range data {
+		it.keys = append(it.keys, key)
+	}
+	sort.Strings(it.keys)
+	it.values = make([][]byte, len(it.keys))
+	for i, key := range it.keys {
+		it.values[i] = data[key]
+	}
+	it.pos = len(it.keys)
+	return it
+}
+
+func (it *memIterator) Seek(key []byte) {
+	it.pos = sort.SearchStrings(it.keys, string(key))
+}
+
+func (it *memIterator) SeekToFirst() {
+	it.pos = 0
+}
+
+func (it *memIterator) Valid() bool {
+	return it.pos < len(it.keys)
+}
+
+func (it *memIterator) Next() {
+	it.pos++
+}
+
+func (it *memIterator) Key() []byte {
+	return []byte(it.keys[it.pos])
+}
+
+func (it *memIterator) Value() []byte {
+	return it.values[it.pos]
+}
+
+func (it *memIterator) Close() {
+	it.keys = nil
+	it.values = nil
+}
+
+type memSnapshot struct {
+	data map[string][]byte
+}
+
+func (s *memSnapshot) Get(key []byte) ([]byte, error) {
+	value, ok := s.data[string(key)]
+	if !ok {
+		return nil, nil
+	}
+	return append([]byte(nil), value...), nil
+}
+
+func (s *memSnapshot) Iterator() Iterator {
+	return newMemIterator(s.data)
+}
+
+func (s *memSnapshot) Release() {
+	s.data = nil
+}
@@ -0,0 +1,7 @@
+//go:build !cgo || noleveldb
+// +build !cgo noleveldb
+
+package storage
+
+// LevelDB isn't compiled in, so fall back to the in-memory engine
+const DefaultEngine = "memory"
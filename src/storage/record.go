@@ -0,0 +1,67 @@
+package storage
+
+//
+// Checksummed records.
+// Paxos, ShardMaster and ShardKV frame every value they store, so a
+// value damaged on disk is detected when it is read back, instead of
+// being decoded into something else (or into nothing at all).
+//
+// storage.Frame(data) -- data with a checksum in front, ready to store
+// storage.Unframe(record) -- the data again, or ErrCorrupt if it was damaged
+// storage.UpgradeFormat(db) -- frame the records of a database written before framing, once
+//
+
+import "encoding/binary"
+import "errors"
+import "hash/crc32"
+
+var ErrCorrupt = errors.New("storage: record failed its checksum")
+
+// Bytes of checksum in front of the data
+const frameHeader = 4
+
+var crcTable = crc32.MakeTable(crc32.Castagnoli)
+
+func Frame(data []byte) []byte {
+	record := make([]byte, frameHeader+len(data))
+	binary.BigEndian.PutUint32(record, crc32.Checksum(data, crcTable))
+	copy(record[frameHeader:], data)
+	return record
+}
+
+// The returned data shares memory with record
+func Unframe(record []byte) ([]byte, error) {
+	if len(record) < frameHeader {
+		return nil, ErrCorrupt
+	}
+	data := record[frameHeader:]
+	if binary.BigEndian.Uint32(record) != crc32.Checksum(data, crcTable) {
+		return nil, ErrCorrupt
+	}
+	return data, nil
+}
+
+// Key of the record saying a database's records are framed
+// Wiping a database should keep it, or records written afterwards are framed twice
+const FormatKey = "storage_format"
+
+// Version stored in the FormatKey record
+const frameFormat = 1
+
+// Frame every record of a database written before records were framed
+// Stores FormatKey, so it only does so the first time
+func UpgradeFormat(db Engine) error {
+	record, err := db.Get([]byte(FormatKey))
+	if err != nil || record != nil {
+		return err
+	}
+	batch := db.Batch()
+	defer batch.Close()
+	iterator := db.Iterator()
+	for iterator.SeekToFirst(); iterator.Valid(); iterator.Next() {
+		batch.Put(append([]byte(nil), iterator.Key()...), Frame(iterator.Value()))
+	}
+	iterator.Close()
+	batch.Put([]byte(FormatKey), Frame([]byte{frameFormat}))
+	return batch.Write()
+}
@@ -0,0 +1,121 @@
+package storage
+
+//
+// Pluggable key/value storage used for persistence by
+// Paxos, ShardMaster and ShardKV.
+//
+// db, err := storage.Open(name, opts) -- open (or create) a database
+// db.Get(key) -- value for key, or nil if it doesn't exist
+// db.Put(key, value) / db.Delete(key)
+// db.Batch() -- group several writes into one atomic write
+// db.Iterator() -- walk keys in sorted order
+// db.Snapshot() -- consistent read-only view of the database
+// db.Close()
+// storage.Destroy(name, opts) -- delete a database, or every database in a directory
+//
+// Engines register themselves by name; "memory" is always available
+// and "leveldb" is available when built with cgo (and without the
+// noleveldb build tag).
+//
+
+import "fmt"
+import "sync"
+
+// Read/write access to an ordered key/value database
+// Get returns a nil value (and no error) if the key doesn't exist
+type Engine interface {
+	Get(key []byte) ([]byte, error)
+	Put(key, value []byte) error
+	Delete(key []byte) error
+	Batch() Batch
+	Iterator() Iterator
+	Snapshot() Snapshot
+	Close() error
+}
+
+// Group of writes that will be applied atomically by Write
+type Batch interface {
+	Put(key, value []byte)
+	Delete(key []byte)
+	Write() error
+	Close()
+}
+
+// Iterates over keys in sorted order
+// Should be positioned with Seek or SeekToFirst before use
+type Iterator interface {
+	Seek(key []byte)
+	SeekToFirst()
+	Valid() bool
+	Next()
+	Key() []byte
+	Value() []byte
+	Close()
+}
+
+// Consistent read-only view of a database at a point in time
+type Snapshot interface {
+	Get(key []byte) ([]byte, error)
+	Iterator() Iterator
+	Release()
+}
+
+type Options struct {
+	Engine      string // Name of the engine to use ("" = DefaultEngine)
+	Compression bool   // Whether the database should compress entries
+	Cache       bool   // Whether the database should use a built-in cache
+	CacheSize   int    // Size of database cache in MB (ignored if Cache is false)
+	Sync        bool   // Whether writes return only once they are on disk
+}
+
+// Functions an engine provides to open and destroy databases
+type OpenFunc func(name string, opts Options) (Engine, error)
+type DestroyFunc func(name string, opts Options) error
+
+type driver struct {
+	open    OpenFunc
+	destroy DestroyFunc
+}
+
+var driversMu sync.Mutex
+var drivers = make(map[string]driver)
+
+// Make an engine available to Open and Destroy under the given name
+func Register(engine string, open OpenFunc, destroy DestroyFunc) {
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	drivers[engine] = driver{open, destroy}
+}
+
+func getDriver(engine string) (driver, error) {
+	if engine == "" {
+		engine = DefaultEngine
+	}
+	driversMu.Lock()
+	defer driversMu.Unlock()
+	d, ok := drivers[engine]
+	if !ok {
+		return driver{}, fmt.Errorf("storage: unknown engine %q", engine)
+	}
+	return d, nil
+}
+
+// Open the named database, creating it if it doesn't exist
+func Open(name string, opts Options) (Engine, error) {
+	d, err := getDriver(opts.Engine)
+	if err != nil {
+		return nil, err
+	}
+	return d.open(name, opts)
+}
+
+// Delete the named database and everything stored in it
+// If name is a directory, deletes every database under it
+// The databases should be closed first
+func Destroy(name string, opts Options) error {
+	d, err := getDriver(opts.Engine)
+	if err != nil {
+		return err
+	}
+	return d.destroy(name, opts)
+}
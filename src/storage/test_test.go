@@ -0,0 +1,225 @@
+package storage
+
+import "testing"
+import "strconv"
+import "os"
+import "fmt"
+
+// Make a database name that won't collide with other test runs
+func makeName(tag string) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.MkdirAll(s, 0777)
+	s += "storage-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag
+	return s
+}
+
+// Run the given test against every registered engine
+func forEachEngine(test *testing.T, tag string, f func(name string, opts Options)) {
+	engines := []string{"memory"}
+	if DefaultEngine != "memory" {
+		engines = append(engines, DefaultEngine)
+	}
+	for _, engine := range engines {
+		opts := Options{Engine: engine, Cache: true, CacheSize: 1}
+		name := makeName(tag + "-" + engine)
+		Destroy(name, opts)
+		f(name, opts)
+		if err := Destroy(name, opts); err != nil {
+			test.Fatalf("%v: Destroy failed: %v", engine, err)
+		}
+	}
+}
+
+func TestBasic(test *testing.T) {
+	fmt.Printf("\nTest: Get/Put/Delete ...")
+
+	forEachEngine(test, "basic", func(name string, opts Options) {
+		db, err := Open(name, opts)
+		if err != nil {
+			test.Fatalf("%v: Open failed: %v", opts.Engine, err)
+		}
+		defer db.Close()
+
+		if v, err := db.Get([]byte("a")); err != nil || v != nil {
+			test.Fatalf("%v: missing key returned %v, %v", opts.Engine, v, err)
+		}
+		db.Put([]byte("a"), []byte("1"))
+		db.Put([]byte("b"), []byte("2"))
+		if v, _ := db.Get([]byte("a")); string(v) != "1" {
+			test.Fatalf("%v: wrong value %q for a", opts.Engine, v)
+		}
+		db.Delete([]byte("a"))
+		if v, _ := db.Get([]byte("a")); v != nil {
+			test.Fatalf("%v: deleted key returned %q", opts.Engine, v)
+		}
+		if v, _ := db.Get([]byte("b")); string(v) != "2" {
+			test.Fatalf("%v: wrong value %q for b", opts.Engine, v)
+		}
+	})
+
+	fmt.Printf("\n\tPassed")
+}
+
+func TestBatchIterator(test *testing.T) {
+	fmt.Printf("\nTest: Batches and iteration ...")
+
+	forEachEngine(test, "batch", func(name string, opts Options) {
+		db, err := Open(name, opts)
+		if err != nil {
+			test.Fatalf("%v: Open failed: %v", opts.Engine, err)
+		}
+		defer db.Close()
+
+		db.Put([]byte("gone"), []byte("x"))
+		batch := db.Batch()
+		for i := 0; i < 10; i++ {
+			batch.Put([]byte(fmt.Sprintf("key_%02d", i)), []byte(strconv.Itoa(i)))
+		}
+		batch.Delete([]byte("gone"))
+		// Nothing is visible until the batch is written
+		if v, _ := db.Get([]byte("key_00")); v != nil {
+			test.Fatalf("%v: batch applied before Write", opts.Engine)
+		}
+		if err := batch.Write(); err != nil {
+			test.Fatalf("%v: batch Write failed: %v", opts.Engine, err)
+		}
+		batch.Close()
+		if v, _ := db.Get([]byte("gone")); v != nil {
+			test.Fatalf("%v: batched delete not applied", opts.Engine)
+		}
+
+		iterator := db.Iterator()
+		defer iterator.Close()
+		count := 0
+		for iterator.Seek([]byte("key_05")); iterator.Valid(); iterator.Next() {
+			expected := fmt.Sprintf("key_%02d", count+5)
+			if string(iterator.Key()) != expected || string(iterator.Value()) != strconv.Itoa(count+5) {
+				test.Fatalf("%v: iterator at %q=%q, expected %q", opts.Engine, iterator.Key(), iterator.Value(), expected)
+			}
+			count++
+		}
+		if count != 5 {
+			test.Fatalf("%v: iterated over %v keys, expected 5", opts.Engine, count)
+		}
+	})
+
+	fmt.Printf("\n\tPassed")
+}
+
+func TestSnapshotReopen(test *testing.T) {
+	fmt.Printf("\nTest: Snapshots and reopening ...")
+
+	forEachEngine(test, "snapshot", func(name string, opts Options) {
+		db, err := Open(name, opts)
+		if err != nil {
+			test.Fatalf("%v: Open failed: %v", opts.Engine, err)
+		}
+		db.Put([]byte("a"), []byte("old"))
+		snap := db.Snapshot()
+		db.Put([]byte("a"), []byte("new"))
+		db.Put([]byte("b"), []byte("new"))
+		if v, _ := snap.Get([]byte("a")); string(v) != "old" {
+			test.Fatalf("%v: snapshot saw later write %q", opts.Engine, v)
+		}
+		iterator := snap.Iterator()
+		iterator.SeekToFirst()
+		keys := 0
+		for ; iterator.Valid(); iterator.Next() {
+			keys++
+		}
+		iterator.Close()
+		if keys != 1 {
+			test.Fatalf("%v: snapshot iterator saw %v keys, expected 1", opts.Engine, keys)
+		}
+		snap.Release()
+		db.Close()
+
+		// Contents should survive closing and reopening
+		db, err = Open(name, opts)
+		if err != nil {
+			test.Fatalf("%v: reopen failed: %v", opts.Engine, err)
+		}
+		if v, _ := db.Get([]byte("b")); string(v) != "new" {
+			test.Fatalf("%v: value lost across reopen: %q", opts.Engine, v)
+		}
+		db.Close()
+	})
+
+	fmt.Printf("\n\tPassed")
+}
+
+func TestUnknownEngine(test *testing.T) {
+	if _, err := Open(makeName("unknown"), Options{Engine: "nosuchengine"}); err == nil {
+		test.Fatalf("Open with unknown engine should fail")
+	}
+}
+
+func TestFrame(test *testing.T) {
+	fmt.Printf("\nTest: Checksummed records ...")
+
+	for _, data := range []string{"", "a", "some longer value"} {
+		record := Frame([]byte(data))
+		if got, err := Unframe(record); err != nil || string(got) != data {
+			test.Fatalf("Unframe(Frame(%q)) = %q, %v", data, got, err)
+		}
+		// Any flipped bit, in the checksum or the data, is caught
+		for i := 0; i < len(record)*8; i++ {
+			record[i/8] ^= 1 << uint(i%8)
+			if _, err := Unframe(record); err != ErrCorrupt {
+				test.Fatalf("%q with bit %v flipped was not caught", data, i)
+			}
+			record[i/8] ^= 1 << uint(i%8)
+		}
+		if _, err := Unframe(record[:len(record)-1]); len(data) > 0 && err != ErrCorrupt {
+			test.Fatalf("truncated %q was not caught", data)
+		}
+	}
+	if _, err := Unframe([]byte{1, 2}); err != ErrCorrupt {
+		test.Fatalf("record shorter than a checksum was not caught")
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+func TestUpgradeFormat(test *testing.T) {
+	fmt.Printf("\nTest: Records written before framing are framed once ...")
+
+	forEachEngine(test, "upgrade", func(name string, opts Options) {
+		db, err := Open(name, opts)
+		if err != nil {
+			test.Fatalf("%v: Open failed: %v", opts.Engine, err)
+		}
+		defer db.Close()
+
+		// As the code before framing wrote them
+		legacy := map[string]string{"a": "1", "b": "", "c": "some longer value"}
+		for key, value := range legacy {
+			db.Put([]byte(key), []byte(value))
+		}
+		for i := 0; i < 2; i++ {
+			if err := UpgradeFormat(db); err != nil {
+				test.Fatalf("%v: UpgradeFormat failed: %v", opts.Engine, err)
+			}
+			for key, value := range legacy {
+				record, _ := db.Get([]byte(key))
+				if got, err := Unframe(record); err != nil || string(got) != value {
+					test.Fatalf("%v: upgraded %v to %q, %v, wanted %q", opts.Engine, key, got, err, value)
+				}
+			}
+		}
+		// A new database is marked too, so its framed records are left alone
+		db.Delete([]byte(FormatKey))
+		for key := range legacy {
+			db.Delete([]byte(key))
+		}
+		UpgradeFormat(db)
+		if record, _ := db.Get([]byte(FormatKey)); record == nil {
+			test.Fatalf("%v: empty database not marked", opts.Engine)
+		}
+	})
+
+	fmt.Printf("\n\tPassed")
+}
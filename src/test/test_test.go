@@ -11,6 +11,7 @@ import "fmt"
 import "sync"
 import "math/rand"
 import "log"
+import "sort"
 
 const numGroups = 1
 const numReplicas = 3
@@ -331,15 +332,61 @@ func BenchmarkClientLatencyManyShard(benchmark *testing.B) {
 	for i := 0; i < len(gids); i++ {
 		smClerk.Join(gids[i], kvPorts[i])
 	}
-	kvClerk := shardkv.MakeClerk(smPorts, true)
 
+	// Each parallel goroutine is a clerk; start the servers with -pipeline
+	// above 1 to let their requests be agreed on at once
+	var mu sync.Mutex
+	var latencies []time.Duration
 	benchmark.ResetTimer()
-	//tStart := time.Now()
-	for i := 0; i < benchmark.N; i++ {
-		kvClerk.Put(strconv.Itoa(rand.Int()), strconv.Itoa(rand.Int()))
+	benchmark.RunParallel(func(pb *testing.PB) {
+		kvClerk := shardkv.MakeClerk(smPorts, true)
+		for pb.Next() {
+			tStart := time.Now()
+			kvClerk.Put(strconv.Itoa(rand.Int()), strconv.Itoa(rand.Int()))
+			latency := time.Since(tStart)
+			mu.Lock()
+			latencies = append(latencies, latency)
+			mu.Unlock()
+		}
+	})
+	benchmark.StopTimer()
+
+	sort.Slice(latencies, func(i, j int) bool { return latencies[i] < latencies[j] })
+	if len(latencies) > 0 {
+		benchmark.ReportMetric(float64(latencies[len(latencies)/2].Microseconds()), "p50-us")
+		benchmark.ReportMetric(float64(latencies[len(latencies)*99/100].Microseconds()), "p99-us")
 	}
 }
 
+// Start the servers with -batchsize above 1 to batch the clerks' ops
+func BenchmarkManyClerksOneShard(benchmark *testing.B) {
+	const nclerks = 35
+	smPorts, gids, kvPorts := setup("basic", false, numGroups, numReplicas)
+	//defer clean()
+
+	fmt.Printf("\nBenchmark: many clerks, one shard...\n")
+
+	smClerk := shardmaster.MakeClerk(smPorts, true)
+	smClerk.Join(gids[0], kvPorts[0])
+	clerks := make([]*shardkv.Clerk, nclerks)
+	for i := 0; i < nclerks; i++ {
+		clerks[i] = shardkv.MakeClerk(smPorts, true)
+	}
+
+	benchmark.ResetTimer()
+	var wg sync.WaitGroup
+	for i := 0; i < nclerks; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			// Every key starts with "a", so all are in one shard
+			for j := i; j < benchmark.N; j += nclerks {
+				clerks[i].Put("a"+strconv.Itoa(j), strconv.Itoa(rand.Int()))
+			}
+		}(i)
+	}
+	wg.Wait()
+}
 
 func TestManyClientOneShard(t *testing.T) {
 	nclients := 35
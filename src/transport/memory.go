@@ -0,0 +1,318 @@
+package transport
+
+//
+// Simulated network inside one process, for tests.
+//
+// net := transport.NewMemory(seed)
+// net.Endpoint(addr) -- transport for the node at addr
+// net.SetDefault(link) -- behavior of links without a setting of their own
+// net.SetLink(from, to, link) -- behavior of messages sent from one address to another
+// net.Partition(group1, group2, ...) -- only addresses in the same group can talk
+// net.Heal() -- undo Partition
+//
+// Every request and every reply is a message that can be lost or delayed
+// by its link. Lost messages fail the call right away instead of at the
+// deadline, so tests stay fast. Arguments and replies are gob encoded on
+// the way, just like on a socket, so servers never share memory.
+//
+
+import "bytes"
+import "encoding/gob"
+import "errors"
+import "io"
+import "math/rand"
+import "net/rpc"
+import "sync"
+import "time"
+
+var ErrUnreachable = errors.New("transport: address unreachable")
+var ErrLost = errors.New("transport: message lost")
+var ErrAddrInUse = errors.New("transport: address already in use")
+
+// How messages travel in one direction between two addresses
+type Link struct {
+	Drop   float64       // Fraction of messages lost
+	Delay  time.Duration // Time for a message to arrive
+	Jitter time.Duration // Random extra delay up to this much, which reorders messages sent close together
+}
+
+type memLink struct {
+	from string
+	to   string
+}
+
+type Memory struct {
+	timeout time.Duration
+
+	mu          sync.Mutex
+	rand        *rand.Rand
+	listeners   map[string]*memListener
+	defaults    Link
+	links       map[memLink]Link
+	partitioned bool
+	groups      map[string]int // Group of each address while partitioned
+}
+
+// Drops and delays are drawn from a source seeded with seed
+func NewMemory(seed int64) *Memory {
+	m := &Memory{}
+	m.timeout = DefaultTimeout
+	m.rand = rand.New(rand.NewSource(seed))
+	m.listeners = make(map[string]*memListener)
+	m.links = make(map[memLink]Link)
+	m.groups = make(map[string]int)
+	return m
+}
+
+func (m *Memory) SetDefault(link Link) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.defaults = link
+}
+
+func (m *Memory) SetLink(from string, to string, link Link) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.links[memLink{from, to}] = link
+}
+
+// Cut every link between addresses in different groups
+// Addresses left out of every group can't talk to anyone
+// Messages in flight over a cut link are lost
+func (m *Memory) Partition(groups ...[]string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.partitioned = true
+	m.groups = make(map[string]int)
+	for i, group := range groups {
+		for _, addr := range group {
+			m.groups[addr] = i
+		}
+	}
+}
+
+func (m *Memory) Heal() {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.partitioned = false
+	m.groups = make(map[string]int)
+}
+
+func (m *Memory) Listen(addr string, rpcs *rpc.Server, fault func() Fault) (io.Closer, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if _, ok := m.listeners[addr]; ok {
+		return nil, ErrAddrInUse
+	}
+	ml := &memListener{m, addr, rpcs, fault}
+	m.listeners[addr] = ml
+	return ml, nil
+}
+
+// Calls made on the network itself come from the empty address
+func (m *Memory) Call(addr string, name string, args interface{}, reply interface{}) error {
+	return m.call("", addr, name, args, reply)
+}
+
+func (m *Memory) Endpoint(addr string) Transport {
+	return &memEndpoint{m: m, addr: addr}
+}
+
+// The network has no connections of its own
+func (m *Memory) Close() {
+}
+
+type memResult struct {
+	reply []byte
+	err   error
+}
+
+func (m *Memory) call(from string, to string, name string, args interface{}, reply interface{}) error {
+	var req bytes.Buffer
+	if err := gob.NewEncoder(&req).Encode(args); err != nil {
+		return err
+	}
+
+	done := make(chan memResult, 1)
+	go func() {
+		done <- m.deliver(from, to, name, req.Bytes())
+	}()
+	timer := time.NewTimer(m.timeout)
+	defer timer.Stop()
+
+	select {
+	case res := <-done:
+		if res.err != nil {
+			return res.err
+		}
+		return gob.NewDecoder(bytes.NewReader(res.reply)).Decode(reply)
+	case <-timer.C:
+		return ErrTimeout
+	}
+}
+
+// Carry a request to the server at to, and its reply back
+func (m *Memory) deliver(from string, to string, name string, req []byte) memResult {
+	if err := m.transmit(from, to); err != nil {
+		return memResult{nil, err}
+	}
+	m.mu.Lock()
+	ml := m.listeners[to]
+	m.mu.Unlock()
+	if ml == nil {
+		return memResult{nil, ErrUnreachable}
+	}
+
+	fault := Deliver
+	if ml.fault != nil {
+		fault = ml.fault()
+	}
+	if fault == DropRequest {
+		return memResult{nil, errRequestDiscarded}
+	}
+	codec := &memCodec{}
+	codec.name = name
+	codec.req = req
+	ml.rpcs.ServeRequest(codec)
+	if fault == DropReply {
+		return memResult{nil, errReplyDiscarded}
+	}
+
+	if err := m.transmit(to, from); err != nil {
+		return memResult{nil, err}
+	}
+	if codec.err != "" {
+		return memResult{nil, rpc.ServerError(codec.err)}
+	}
+	return memResult{codec.reply, nil}
+}
+
+// Send one message over the link from one address to another, and wait for it to arrive
+func (m *Memory) transmit(from string, to string) error {
+	m.mu.Lock()
+	if !m.connected(from, to) {
+		m.mu.Unlock()
+		return ErrUnreachable
+	}
+	link, ok := m.links[memLink{from, to}]
+	if !ok {
+		link = m.defaults
+	}
+	lost := link.Drop > 0 && m.rand.Float64() < link.Drop
+	delay := link.Delay
+	if link.Jitter > 0 {
+		delay += time.Duration(m.rand.Int63n(int64(link.Jitter)))
+	}
+	m.mu.Unlock()
+
+	if lost {
+		return ErrLost
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+		// The link may have been cut while the message was on its way
+		m.mu.Lock()
+		defer m.mu.Unlock()
+		if !m.connected(from, to) {
+			return ErrUnreachable
+		}
+	}
+	return nil
+}
+
+// Whether messages can get from one address to another; m.mu must be held
+func (m *Memory) connected(from string, to string) bool {
+	if !m.partitioned || from == to {
+		return true
+	}
+	fromGroup, fromOK := m.groups[from]
+	toGroup, toOK := m.groups[to]
+	return fromOK && toOK && fromGroup == toGroup
+}
+
+type memListener struct {
+	m     *Memory
+	addr  string
+	rpcs  *rpc.Server
+	fault func() Fault
+}
+
+func (ml *memListener) Close() error {
+	ml.m.mu.Lock()
+	defer ml.m.mu.Unlock()
+	if ml.m.listeners[ml.addr] == ml {
+		delete(ml.m.listeners, ml.addr)
+	}
+	return nil
+}
+
+type memEndpoint struct {
+	m    *Memory
+	addr string
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (e *memEndpoint) Listen(addr string, rpcs *rpc.Server, fault func() Fault) (io.Closer, error) {
+	return e.m.Listen(addr, rpcs, fault)
+}
+
+func (e *memEndpoint) Call(addr string, name string, args interface{}, reply interface{}) error {
+	e.mu.Lock()
+	closed := e.closed
+	e.mu.Unlock()
+	if closed {
+		return ErrClosed
+	}
+	return e.m.call(e.addr, addr, name, args, reply)
+}
+
+func (e *memEndpoint) Endpoint(addr string) Transport {
+	return e.m.Endpoint(addr)
+}
+
+func (e *memEndpoint) Close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.closed = true
+}
+
+// Feeds one request to an rpc.Server and keeps its response
+type memCodec struct {
+	name  string
+	req   []byte
+	reply []byte
+	err   string
+}
+
+func (c *memCodec) ReadRequestHeader(r *rpc.Request) error {
+	r.ServiceMethod = c.name
+	r.Seq = 0
+	return nil
+}
+
+func (c *memCodec) ReadRequestBody(body interface{}) error {
+	if body == nil {
+		return nil
+	}
+	return gob.NewDecoder(bytes.NewReader(c.req)).Decode(body)
+}
+
+func (c *memCodec) WriteResponse(r *rpc.Response, body interface{}) error {
+	if r.Error != "" {
+		c.err = r.Error
+		return nil
+	}
+	var buf bytes.Buffer
+	if err := gob.NewEncoder(&buf).Encode(body); err != nil {
+		c.err = err.Error()
+		return err
+	}
+	c.reply = buf.Bytes()
+	return nil
+}
+
+func (c *memCodec) Close() error {
+	return nil
+}
@@ -0,0 +1,165 @@
+package transport
+
+//
+// Persistent RPC connections used by the socket transports.
+//
+// pool := transport.NewPool(network, timeout) -- network is "unix" or "tcp"
+// pool.Call(srv, name, args, reply) -- send an RPC, reusing the connection to srv
+// pool.Close() -- close every connection
+//
+// A connection is dialed the first time a server is called and kept
+// for later calls. If a call fails because of the connection, the
+// connection is dropped and the next call dials again.
+// Every call has a deadline; when it passes, the connection is closed.
+//
+
+import "errors"
+import "net"
+import "net/rpc"
+import "os"
+import "sync"
+import "time"
+
+// Deadline for a call when none is given
+const DefaultTimeout = 10 * time.Second
+
+var ErrTimeout = errors.New("transport: call timed out")
+var ErrClosed = errors.New("transport: pool is closed")
+
+// Returns the network to dial for the packages' network flag
+func Network(network bool) string {
+	if network {
+		return "tcp"
+	}
+	return "unix"
+}
+
+type conn struct {
+	client *rpc.Client
+	info   os.FileInfo // Socket file that was dialed (unix only)
+}
+
+// Connections to a set of servers, one per server address
+type Pool struct {
+	network string
+	timeout time.Duration
+
+	mu     sync.Mutex
+	conns  map[string]*conn
+	closed bool
+}
+
+func NewPool(network string, timeout time.Duration) *Pool {
+	p := &Pool{}
+	p.network = network
+	p.timeout = timeout
+	if p.timeout <= 0 {
+		p.timeout = DefaultTimeout
+	}
+	p.conns = make(map[string]*conn)
+	return p
+}
+
+// Send an RPC to the name handler on srv and wait for the reply
+// Returns nil if the server responded; reply is only valid in that case
+func (p *Pool) Call(srv string, name string, args interface{}, reply interface{}) error {
+	c, err := p.get(srv)
+	if err != nil {
+		return err
+	}
+
+	done := make(chan *rpc.Call, 1)
+	timer := time.NewTimer(p.timeout)
+	defer timer.Stop()
+	// Go blocks while sending, which can take forever if srv stops reading
+	go c.client.Go(name, args, reply, done)
+
+	select {
+	case call := <-done:
+		if call.Error == nil {
+			return nil
+		}
+		if _, ok := call.Error.(rpc.ServerError); !ok {
+			// The connection is broken, not just this call
+			p.drop(srv, c)
+		}
+		return call.Error
+	case <-timer.C:
+		// Closing the connection fails the call, so reply is no longer written to once we return
+		p.drop(srv, c)
+		<-done
+		return ErrTimeout
+	}
+}
+
+// Close every connection; later calls fail with ErrClosed
+func (p *Pool) Close() {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.closed = true
+	for srv, c := range p.conns {
+		c.client.Close()
+		delete(p.conns, srv)
+	}
+}
+
+// Returns a connection to srv, dialing one if needed
+func (p *Pool) get(srv string) (*conn, error) {
+	p.mu.Lock()
+	c, ok := p.conns[srv]
+	closed := p.closed
+	p.mu.Unlock()
+	if closed {
+		return nil, ErrClosed
+	}
+	if ok && p.network == "unix" {
+		// Socket files are removed and relinked by restarts (and partition tests),
+		// so only reuse a connection while its path still names the same socket
+		info, err := os.Stat(srv)
+		if err != nil || !os.SameFile(info, c.info) {
+			p.drop(srv, c)
+			ok = false
+		}
+	}
+	if ok {
+		return c, nil
+	}
+
+	c = &conn{}
+	if p.network == "unix" {
+		info, err := os.Stat(srv)
+		if err != nil {
+			return nil, err
+		}
+		c.info = info
+	}
+	nc, err := net.DialTimeout(p.network, srv, p.timeout)
+	if err != nil {
+		return nil, err
+	}
+	c.client = rpc.NewClient(nc)
+
+	// Someone else may have dialed srv at the same time
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	if p.closed {
+		c.client.Close()
+		return nil, ErrClosed
+	}
+	if other, ok := p.conns[srv]; ok {
+		c.client.Close()
+		return other, nil
+	}
+	p.conns[srv] = c
+	return c, nil
+}
+
+// Forget and close the given connection to srv
+func (p *Pool) drop(srv string, c *conn) {
+	p.mu.Lock()
+	if p.conns[srv] == c {
+		delete(p.conns, srv)
+	}
+	p.mu.Unlock()
+	c.client.Close()
+}
@@ -0,0 +1,172 @@
+package transport
+
+//
+// Serving side of the persistent connections, with fault injection.
+//
+// Since a connection now carries many requests, the unreliable/deaf
+// behavior the servers used to apply to each new connection is applied
+// to each request instead:
+//   Deliver -- process the request and send the reply
+//   DropRequest -- don't process the request; the caller sees an error
+//   DropReply -- process the request, but the caller sees an error instead of the reply
+//
+
+import "bufio"
+import "encoding/gob"
+import "io"
+import "net"
+import "net/rpc"
+import "sync"
+
+// Errors seen by callers whose requests or replies were discarded
+var errRequestDiscarded = rpc.ServerError("transport: request discarded")
+var errReplyDiscarded = rpc.ServerError("transport: reply discarded")
+
+// What should happen to an incoming request
+type Fault int
+
+const (
+	Deliver Fault = iota
+	DropRequest
+	DropReply
+)
+
+// Serves an rpc.Server on accepted connections
+// Asks fault (which may be nil) what to do with each request
+type Server struct {
+	rpcs  *rpc.Server
+	fault func() Fault
+
+	mu     sync.Mutex
+	conns  map[net.Conn]bool
+	closed bool
+}
+
+func NewServer(rpcs *rpc.Server, fault func() Fault) *Server {
+	s := &Server{}
+	s.rpcs = rpcs
+	s.fault = fault
+	s.conns = make(map[net.Conn]bool)
+	return s
+}
+
+// Serve requests on conn until it is closed
+func (s *Server) ServeConn(conn net.Conn) {
+	s.mu.Lock()
+	if s.closed {
+		s.mu.Unlock()
+		conn.Close()
+		return
+	}
+	s.conns[conn] = true
+	s.mu.Unlock()
+
+	buf := bufio.NewWriter(conn)
+	codec := &serverCodec{}
+	codec.rwc = conn
+	codec.dec = gob.NewDecoder(conn)
+	codec.enc = gob.NewEncoder(buf)
+	codec.encBuf = buf
+	codec.fault = s.fault
+	codec.dropped = make(map[uint64]bool)
+	s.rpcs.ServeCodec(codec)
+
+	s.mu.Lock()
+	delete(s.conns, conn)
+	s.mu.Unlock()
+}
+
+// Close every connection being served, and any served later
+// Callers see their connections fail, just as if the server had died
+func (s *Server) Close() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.closed = true
+	for conn := range s.conns {
+		conn.Close()
+	}
+}
+
+// Same as the gob codec net/rpc uses, but applies faults to requests
+type serverCodec struct {
+	rwc    io.ReadWriteCloser
+	dec    *gob.Decoder
+	enc    *gob.Encoder
+	encBuf *bufio.Writer
+	fault  func() Fault
+
+	discard bool // The request being read is not to be processed
+
+	mu      sync.Mutex
+	dropped map[uint64]bool // Requests whose replies should be discarded
+	closed  bool
+}
+
+func (c *serverCodec) ReadRequestHeader(r *rpc.Request) error {
+	if err := c.dec.Decode(r); err != nil {
+		return err
+	}
+	if c.fault == nil {
+		return nil
+	}
+	switch c.fault() {
+	case DropRequest:
+		// Failed once its body is read; gob can't always skip a body it isn't
+		// given the type of, and would then misread the rest of the connection
+		c.discard = true
+	case DropReply:
+		c.mu.Lock()
+		c.dropped[r.Seq] = true
+		c.mu.Unlock()
+	}
+	return nil
+}
+
+// net/rpc replies to a request whose body fails with the error, without processing it
+func (c *serverCodec) ReadRequestBody(body interface{}) error {
+	discard := c.discard
+	c.discard = false
+	if err := c.dec.Decode(body); err != nil {
+		return err
+	}
+	if discard {
+		return errRequestDiscarded
+	}
+	return nil
+}
+
+func (c *serverCodec) WriteResponse(r *rpc.Response, body interface{}) (err error) {
+	c.mu.Lock()
+	if c.dropped[r.Seq] {
+		delete(c.dropped, r.Seq)
+		r.Error = string(errReplyDiscarded)
+		body = struct{}{}
+	}
+	c.mu.Unlock()
+
+	if err = c.enc.Encode(r); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Couldn't encode the header, shut down
+			c.Close()
+		}
+		return
+	}
+	if err = c.enc.Encode(body); err != nil {
+		if c.encBuf.Flush() == nil {
+			// Couldn't encode the reply, shut down
+			c.Close()
+		}
+		return
+	}
+	return c.encBuf.Flush()
+}
+
+func (c *serverCodec) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.closed {
+		return nil
+	}
+	c.closed = true
+	return c.rwc.Close()
+}
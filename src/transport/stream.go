@@ -0,0 +1,91 @@
+package transport
+
+//
+// Transport over TCP or unix sockets.
+// Calls go through a Pool and servers accept connections into a Server.
+//
+
+import "fmt"
+import "io"
+import "net"
+import "net/rpc"
+import "os"
+import "sync"
+
+type streamTransport struct {
+	network string
+	pool    *Pool
+}
+
+// TCP servers listen on every interface at addr's port
+func (t *streamTransport) Listen(addr string, rpcs *rpc.Server, fault func() Fault) (io.Closer, error) {
+	if t.network == "unix" {
+		// Left behind by an earlier server at the same address
+		os.Remove(addr)
+	} else {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		addr = ":" + port
+	}
+	l, err := net.Listen(t.network, addr)
+	if err != nil {
+		return nil, err
+	}
+
+	sl := &streamListener{}
+	sl.l = l
+	sl.server = NewServer(rpcs, fault)
+	go sl.accept()
+	return sl, nil
+}
+
+func (t *streamTransport) Call(addr string, name string, args interface{}, reply interface{}) error {
+	return t.pool.Call(addr, name, args, reply)
+}
+
+func (t *streamTransport) Endpoint(addr string) Transport {
+	return New(t.network, t.pool.timeout)
+}
+
+func (t *streamTransport) Close() {
+	t.pool.Close()
+}
+
+type streamListener struct {
+	l      net.Listener
+	server *Server
+
+	mu     sync.Mutex
+	closed bool
+}
+
+func (sl *streamListener) accept() {
+	for {
+		conn, err := sl.l.Accept()
+		if err != nil {
+			if !sl.isClosed() {
+				fmt.Printf("transport: accept: %v\n", err)
+			}
+			return
+		}
+		go sl.server.ServeConn(conn)
+	}
+}
+
+func (sl *streamListener) isClosed() bool {
+	sl.mu.Lock()
+	defer sl.mu.Unlock()
+	return sl.closed
+}
+
+// Stop accepting connections and close the ones being served
+func (sl *streamListener) Close() error {
+	sl.mu.Lock()
+	sl.closed = true
+	sl.mu.Unlock()
+	err := sl.l.Close()
+	sl.server.Close()
+	return err
+}
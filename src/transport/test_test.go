@@ -0,0 +1,487 @@
+package transport
+
+import "testing"
+import "encoding/gob"
+import "strconv"
+import "os"
+import "fmt"
+import "net"
+import "net/rpc"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Make a socket name that won't collide with other test runs
+func makePort(tag string) string {
+	s := "/var/tmp/824-"
+	s += strconv.Itoa(os.Getuid()) + "/"
+	os.MkdirAll(s, 0777)
+	s += "tr-"
+	s += strconv.Itoa(os.Getpid()) + "-"
+	s += tag
+	return s
+}
+
+type EchoArgs struct {
+	Value int
+}
+
+type EchoReply struct {
+	Value int
+}
+
+// RPC handler that counts its calls
+type Echo struct {
+	mu    sync.Mutex
+	calls int
+}
+
+func (e *Echo) Echo(args *EchoArgs, reply *EchoReply) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls++
+	reply.Value = args.Value
+	return nil
+}
+
+func (e *Echo) numCalls() int {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return e.calls
+}
+
+type testServer struct {
+	echo   *Echo
+	server *Server
+	l      net.Listener
+	mu     sync.Mutex
+	conns  int
+}
+
+// Serve an Echo on the given port until killed
+func startServer(test *testing.T, port string, fault func() Fault) *testServer {
+	ts := &testServer{}
+	ts.echo = &Echo{}
+	rpcs := rpc.NewServer()
+	rpcs.Register(ts.echo)
+	ts.server = NewServer(rpcs, fault)
+
+	os.Remove(port)
+	l, err := net.Listen("unix", port)
+	if err != nil {
+		test.Fatalf("listen error: %v", err)
+	}
+	ts.l = l
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			ts.mu.Lock()
+			ts.conns++
+			ts.mu.Unlock()
+			go ts.server.ServeConn(conn)
+		}
+	}()
+	return ts
+}
+
+func (ts *testServer) numConns() int {
+	ts.mu.Lock()
+	defer ts.mu.Unlock()
+	return ts.conns
+}
+
+func (ts *testServer) kill() {
+	ts.l.Close()
+	ts.server.Close()
+}
+
+func TestReuse(test *testing.T) {
+	fmt.Printf("\nTest: Calls share one connection ...")
+
+	port := makePort("reuse")
+	ts := startServer(test, port, nil)
+	defer ts.kill()
+	pool := NewPool("unix", time.Second)
+	defer pool.Close()
+
+	for i := 0; i < 20; i++ {
+		var reply EchoReply
+		if err := pool.Call(port, "Echo.Echo", &EchoArgs{i}, &reply); err != nil {
+			test.Fatalf("call %v failed: %v", i, err)
+		}
+		if reply.Value != i {
+			test.Fatalf("wrong reply %v for %v", reply.Value, i)
+		}
+	}
+	if ts.numConns() != 1 {
+		test.Fatalf("made %v connections for 20 calls", ts.numConns())
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+func TestReconnect(test *testing.T) {
+	fmt.Printf("\nTest: Reconnect after a restart ...")
+
+	port := makePort("reconnect")
+	ts := startServer(test, port, nil)
+	pool := NewPool("unix", time.Second)
+	defer pool.Close()
+
+	var reply EchoReply
+	if err := pool.Call(port, "Echo.Echo", &EchoArgs{1}, &reply); err != nil {
+		test.Fatalf("call failed: %v", err)
+	}
+
+	// A dead server's connections fail
+	ts.kill()
+	os.Remove(port)
+	if err := pool.Call(port, "Echo.Echo", &EchoArgs{2}, &reply); err == nil {
+		test.Fatalf("call to a dead server succeeded")
+	}
+
+	// And the restarted server is reached right away
+	ts = startServer(test, port, nil)
+	defer ts.kill()
+	if err := pool.Call(port, "Echo.Echo", &EchoArgs{3}, &reply); err != nil || reply.Value != 3 {
+		test.Fatalf("call after restart failed: %v", err)
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+func TestTimeout(test *testing.T) {
+	fmt.Printf("\nTest: Calls to a hung server time out ...")
+
+	// Accept connections but never read from them
+	port := makePort("timeout")
+	os.Remove(port)
+	l, err := net.Listen("unix", port)
+	if err != nil {
+		test.Fatalf("listen error: %v", err)
+	}
+	defer l.Close()
+	held := make(chan net.Conn, 1)
+	defer func() {
+		conn := <-held
+		conn.Close()
+	}()
+	go func() {
+		conn, err := l.Accept()
+		if err == nil {
+			held <- conn
+		}
+	}()
+
+	pool := NewPool("unix", 100*time.Millisecond)
+	defer pool.Close()
+	start := time.Now()
+	var reply EchoReply
+	if err := pool.Call(port, "Echo.Echo", &EchoArgs{1}, &reply); err != ErrTimeout {
+		test.Fatalf("expected ErrTimeout, got %v", err)
+	}
+	if time.Since(start) > time.Second {
+		test.Fatalf("call took %v to time out", time.Since(start))
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+func TestFaults(test *testing.T) {
+	fmt.Printf("\nTest: Dropped requests and replies ...")
+
+	var mu sync.Mutex
+	next := Deliver
+	fault := func() Fault {
+		mu.Lock()
+		defer mu.Unlock()
+		return next
+	}
+	setFault := func(f Fault) {
+		mu.Lock()
+		defer mu.Unlock()
+		next = f
+	}
+
+	port := makePort("faults")
+	ts := startServer(test, port, fault)
+	defer ts.kill()
+	pool := NewPool("unix", time.Second)
+	defer pool.Close()
+	var reply EchoReply
+
+	setFault(DropRequest)
+	if err := pool.Call(port, "Echo.Echo", &EchoArgs{1}, &reply); err == nil {
+		test.Fatalf("dropped request succeeded")
+	}
+	if ts.echo.numCalls() != 0 {
+		test.Fatalf("dropped request was processed")
+	}
+
+	setFault(DropReply)
+	if err := pool.Call(port, "Echo.Echo", &EchoArgs{2}, &reply); err == nil {
+		test.Fatalf("dropped reply succeeded")
+	}
+	if ts.echo.numCalls() != 1 {
+		test.Fatalf("request with dropped reply wasn't processed")
+	}
+
+	// Faults don't break the connection for later calls
+	setFault(Deliver)
+	if err := pool.Call(port, "Echo.Echo", &EchoArgs{3}, &reply); err != nil || reply.Value != 3 {
+		test.Fatalf("call after faults failed: %v", err)
+	}
+	if ts.numConns() != 1 {
+		test.Fatalf("made %v connections", ts.numConns())
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+// An interface value inside another, like a Paxos value holding an op
+type Box struct {
+	Inner interface{}
+}
+
+type BoxArgs struct {
+	Value interface{}
+}
+
+func (e *Echo) Unbox(args *BoxArgs, reply *EchoReply) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	e.calls++
+	reply.Value = args.Value.(Box).Inner.(EchoArgs).Value
+	return nil
+}
+
+func TestDropNested(test *testing.T) {
+	fmt.Printf("\nTest: Dropped requests with nested interface values ...")
+
+	gob.Register(Box{})
+	gob.Register(EchoArgs{})
+	drop := int32(1)
+	fault := func() Fault {
+		if atomic.LoadInt32(&drop) != 0 {
+			return DropRequest
+		}
+		return Deliver
+	}
+
+	port := makePort("nested")
+	ts := startServer(test, port, fault)
+	defer ts.kill()
+	pool := NewPool("unix", time.Second)
+	defer pool.Close()
+	var reply EchoReply
+
+	// The types are only described in the first request on the connection,
+	// so the server has to read them even though it drops that request
+	if err := pool.Call(port, "Echo.Unbox", &BoxArgs{Box{EchoArgs{1}}}, &reply); err == nil {
+		test.Fatalf("dropped request succeeded")
+	}
+	atomic.StoreInt32(&drop, 0)
+	if err := pool.Call(port, "Echo.Unbox", &BoxArgs{Box{EchoArgs{2}}}, &reply); err != nil || reply.Value != 2 {
+		test.Fatalf("call after a dropped request failed: %v", err)
+	}
+	if ts.echo.numCalls() != 1 || ts.numConns() != 1 {
+		test.Fatalf("%v calls over %v connections", ts.echo.numCalls(), ts.numConns())
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+// Serve an Echo at addr on the simulated network
+func startMemoryServer(test *testing.T, network *Memory, addr string) *Echo {
+	echo := &Echo{}
+	rpcs := rpc.NewServer()
+	rpcs.Register(echo)
+	if _, err := network.Listen(addr, rpcs, nil); err != nil {
+		test.Fatalf("listen error: %v", err)
+	}
+	return echo
+}
+
+func TestMemoryPartition(test *testing.T) {
+	fmt.Printf("\nTest: Simulated partitions ...")
+
+	network := NewMemory(0)
+	addrs := []string{"a", "b", "c"}
+	for _, addr := range addrs {
+		startMemoryServer(test, network, addr)
+	}
+	a := network.Endpoint("a")
+	c := network.Endpoint("c")
+	var reply EchoReply
+
+	network.Partition([]string{"a", "b"}, []string{"c"})
+	if err := a.Call("b", "Echo.Echo", &EchoArgs{1}, &reply); err != nil {
+		test.Fatalf("call within a partition failed: %v", err)
+	}
+	if err := a.Call("c", "Echo.Echo", &EchoArgs{2}, &reply); err != ErrUnreachable {
+		test.Fatalf("expected ErrUnreachable across partitions, got %v", err)
+	}
+	if err := c.Call("a", "Echo.Echo", &EchoArgs{3}, &reply); err != ErrUnreachable {
+		test.Fatalf("expected ErrUnreachable across partitions, got %v", err)
+	}
+
+	network.Heal()
+	if err := c.Call("a", "Echo.Echo", &EchoArgs{4}, &reply); err != nil || reply.Value != 4 {
+		test.Fatalf("call after heal failed: %v", err)
+	}
+
+	// A closed endpoint can't call, but its server is still there
+	c.Close()
+	if err := c.Call("a", "Echo.Echo", &EchoArgs{5}, &reply); err != ErrClosed {
+		test.Fatalf("expected ErrClosed, got %v", err)
+	}
+	if err := a.Call("c", "Echo.Echo", &EchoArgs{6}, &reply); err != nil {
+		test.Fatalf("call to server of closed endpoint failed: %v", err)
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+func TestMemoryLinks(test *testing.T) {
+	fmt.Printf("\nTest: Simulated lossy and slow links ...")
+
+	network := NewMemory(0)
+	echo := startMemoryServer(test, network, "b")
+	a := network.Endpoint("a")
+	var reply EchoReply
+
+	// Lost requests never reach the server; lost replies do
+	// (x has links of its own, so the defaults set below don't apply to it)
+	x := network.Endpoint("x")
+	network.SetLink("x", "b", Link{Drop: 1})
+	if err := x.Call("b", "Echo.Echo", &EchoArgs{1}, &reply); err != ErrLost {
+		test.Fatalf("expected ErrLost, got %v", err)
+	}
+	if echo.numCalls() != 0 {
+		test.Fatalf("lost request was processed")
+	}
+	network.SetLink("x", "b", Link{})
+	network.SetLink("b", "x", Link{Drop: 1})
+	if err := x.Call("b", "Echo.Echo", &EchoArgs{2}, &reply); err != ErrLost {
+		test.Fatalf("expected ErrLost, got %v", err)
+	}
+	if echo.numCalls() != 1 {
+		test.Fatalf("request with lost reply wasn't processed")
+	}
+
+	// About half of the messages get through a half-lossy link
+	network.SetDefault(Link{Drop: 0.5})
+	lost := 0
+	for i := 0; i < 100; i++ {
+		if err := a.Call("b", "Echo.Echo", &EchoArgs{i}, &reply); err == ErrLost {
+			lost++
+		}
+	}
+	if lost < 50 || lost > 95 {
+		test.Fatalf("lost %v of 100 calls over two half-lossy links", lost)
+	}
+	network.SetDefault(Link{})
+
+	// Delay applies to the request and to the reply
+	network.SetDefault(Link{Delay: 50 * time.Millisecond})
+	start := time.Now()
+	if err := a.Call("b", "Echo.Echo", &EchoArgs{3}, &reply); err != nil {
+		test.Fatalf("delayed call failed: %v", err)
+	}
+	if time.Since(start) < 100*time.Millisecond {
+		test.Fatalf("call took %v over two 50ms links", time.Since(start))
+	}
+
+	// A message on its way is lost if the link is cut
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		network.Partition([]string{"a"}, []string{"b"})
+	}()
+	if err := a.Call("b", "Echo.Echo", &EchoArgs{4}, &reply); err != ErrUnreachable {
+		test.Fatalf("expected ErrUnreachable, got %v", err)
+	}
+	network.Heal()
+
+	// Jitter lets later messages overtake earlier ones
+	network.SetDefault(Link{Jitter: 20 * time.Millisecond})
+	var mu sync.Mutex
+	order := []int{}
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			var reply EchoReply
+			a.Call("b", "Echo.Echo", &EchoArgs{i}, &reply)
+			mu.Lock()
+			order = append(order, reply.Value)
+			mu.Unlock()
+		}(i)
+		time.Sleep(time.Millisecond)
+	}
+	wg.Wait()
+	reordered := false
+	for i := 1; i < len(order); i++ {
+		if order[i] < order[i-1] {
+			reordered = true
+		}
+	}
+	if !reordered {
+		test.Fatalf("no replies were reordered: %v", order)
+	}
+
+	fmt.Printf("\n\tPassed")
+}
+
+// Servers get their own copy of the arguments
+type Mutate struct{}
+
+type MutateArgs struct {
+	Values map[string]int
+}
+
+func (m *Mutate) Mutate(args *MutateArgs, reply *EchoReply) error {
+	args.Values["x"] = 2
+	reply.Value = len(args.Values)
+	return nil
+}
+
+func TestMemoryCopies(test *testing.T) {
+	fmt.Printf("\nTest: Simulated calls don't share memory ...")
+
+	network := NewMemory(0)
+	rpcs := rpc.NewServer()
+	rpcs.Register(&Mutate{})
+	l, err := network.Listen("b", rpcs, nil)
+	if err != nil {
+		test.Fatalf("listen error: %v", err)
+	}
+	if _, err := network.Listen("b", rpcs, nil); err != ErrAddrInUse {
+		test.Fatalf("expected ErrAddrInUse, got %v", err)
+	}
+
+	args := &MutateArgs{map[string]int{"x": 1}}
+	var reply EchoReply
+	if err := network.Call("b", "Mutate.Mutate", args, &reply); err != nil || reply.Value != 1 {
+		test.Fatalf("call failed: %v", err)
+	}
+	if args.Values["x"] != 1 {
+		test.Fatalf("server changed the caller's arguments")
+	}
+
+	// Unknown methods are reported like on a socket
+	if err := network.Call("b", "Mutate.Missing", args, &reply); err == nil {
+		test.Fatalf("call to a missing method succeeded")
+	}
+
+	// Closed servers can't be reached
+	l.Close()
+	if err := network.Call("b", "Mutate.Mutate", args, &reply); err != ErrUnreachable {
+		test.Fatalf("expected ErrUnreachable, got %v", err)
+	}
+
+	fmt.Printf("\n\tPassed")
+}
@@ -0,0 +1,54 @@
+package transport
+
+//
+// How Paxos, ShardMaster and ShardKV reach each other.
+//
+// tr := transport.New(network, timeout) -- TCP or unix sockets
+// tr := transport.NewMemory(seed) -- simulated in-process network
+// tr.Listen(addr, rpcs, fault) -- serve rpcs at addr until the returned Closer is closed
+// tr.Call(addr, name, args, reply) -- send an RPC to addr and wait for the reply
+// tr.Endpoint(addr) -- transport for the node at addr, with connections of its own
+// tr.Close() -- close the connections made by Call
+//
+
+import "io"
+import "net/rpc"
+import "sync"
+import "time"
+
+type Transport interface {
+	// Serve rpcs at addr, asking fault (which may be nil) what to do with each request
+	Listen(addr string, rpcs *rpc.Server, fault func() Fault) (io.Closer, error)
+
+	// Send an RPC to the name handler at addr and wait for the reply
+	// Returns nil if the server responded; reply is only valid in that case
+	Call(addr string, name string, args interface{}, reply interface{}) error
+
+	// Returns a transport for the node listening at addr
+	// Calls made through it come from addr, and Close only affects it
+	Endpoint(addr string) Transport
+
+	// Close the connections made by Call; later calls fail with ErrClosed
+	Close()
+}
+
+// Returns a socket transport for "tcp" or "unix"
+func New(network string, timeout time.Duration) Transport {
+	return &streamTransport{network, NewPool(network, timeout)}
+}
+
+var sharedMu sync.Mutex
+var shared = make(map[string]Transport)
+
+// Process-wide socket transport for the given network, with the default deadline
+// Used by clerks, which don't listen and are never closed
+func Shared(network string) Transport {
+	sharedMu.Lock()
+	defer sharedMu.Unlock()
+	tr, ok := shared[network]
+	if !ok {
+		tr = New(network, DefaultTimeout)
+		shared[network] = tr
+	}
+	return tr
+}